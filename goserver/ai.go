@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// llmRetryAfter is the back-off suggested when every provider failed
+const llmRetryAfter = 30
+
+// sendLLMError maps a pool error to a client response. Provider response
+// bodies can echo request details, so the client only gets the provider name
+// and status; the full error goes to the log.
+func sendLLMError(res *fiber.Ctx, err error) error {
+	slog.ErrorContext(res.UserContext(), "llm request failed", "error", err)
+
+	status, message, retry := describeLLMError(err)
+	if retry {
+		res.Set("Retry-After", strconv.Itoa(llmRetryAfterFor(err)))
+	}
+	return sendError(res, status, message)
+}
+
+// describeLLMError returns the status and client-safe message for a pool
+// error, and whether the client should retry later
+func describeLLMError(err error) (status int, message string, retry bool) {
+	var perr *llmpool.ProviderError
+	hasProvider := errors.As(err, &perr)
+	var failed *llmpool.FailoverError
+	failedOver := errors.As(err, &failed)
+
+	switch {
+	case errors.Is(err, llmpool.ErrNoVisionProvider):
+		return 422, "No configured LLM provider accepts images; retry without an image", false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return 504, "LLM request timed out", false
+	case errors.Is(err, llmpool.ErrBudgetExceeded):
+		return 503, "The LLM budget for this period is spent", false
+	case errors.Is(err, llmpool.ErrAllProvidersRateLimited):
+		return 503, "All LLM providers are rate limited", true
+	case errors.Is(err, llmpool.ErrContentFiltered):
+		return 422, "The LLM provider's content filter refused the prompt", false
+	case failedOver && allAttempts(failed, llmpool.ErrRateLimited):
+		return 503, "All LLM providers are rate limited", true
+	case failedOver && allAttempts(failed, llmpool.ErrAuth):
+		return 502, "All LLM providers rejected their credentials", false
+	case errors.Is(err, llmpool.ErrNoProviders), errors.Is(err, llmpool.ErrAllProvidersFailed):
+		message := "No LLM provider is available"
+		if hasProvider {
+			message = fmt.Sprintf("All LLM providers failed; last was %s (%s)", perr.Provider, providerFailure(perr))
+		}
+		return 503, message, true
+	case !hasProvider:
+		return 502, "LLM request failed", false
+	case errors.Is(err, llmpool.ErrRateLimited):
+		return 503, fmt.Sprintf("LLM provider %s is rate limited", perr.Provider), true
+	case errors.Is(err, llmpool.ErrProviderUnavailable) && perr.StatusCode == 0:
+		return 503, fmt.Sprintf("LLM provider %s is rate limited or cooling off", perr.Provider), true
+	case errors.Is(err, llmpool.ErrAuth):
+		return 502, fmt.Sprintf("LLM provider %s rejected its credentials", perr.Provider), false
+	case errors.Is(err, llmpool.ErrBadRequest):
+		return 502, fmt.Sprintf("LLM provider %s rejected the request (%s)", perr.Provider, providerFailure(perr)), false
+	default:
+		return 502, fmt.Sprintf("LLM provider %s failed (%s)", perr.Provider, providerFailure(perr)), false
+	}
+}
+
+// allAttempts reports whether every attempt of a failover failed with class
+func allAttempts(failed *llmpool.FailoverError, class error) bool {
+	for _, err := range failed.Attempts {
+		if !errors.Is(err, class) {
+			return false
+		}
+	}
+	return true
+}
+
+// llmRetryAfterFor is the Retry-After for err in seconds: when the pool
+// knows a provider frees up, or a rate limited provider said when to come
+// back, that, otherwise llmRetryAfter
+func llmRetryAfterFor(err error) int {
+	var rl *llmpool.RateLimitError
+	if errors.As(err, &rl) && !rl.Until.IsZero() {
+		return max(1, int(math.Ceil(time.Until(rl.Until).Seconds())))
+	}
+	var perr *llmpool.ProviderError
+	if errors.Is(err, llmpool.ErrRateLimited) && errors.As(err, &perr) && perr.RetryAfter > 0 {
+		return max(1, int(math.Ceil(perr.RetryAfter.Seconds())))
+	}
+	return llmRetryAfter
+}
+
+// providerFailure describes a provider error without its response body
+func providerFailure(perr *llmpool.ProviderError) string {
+	switch {
+	case perr.StatusCode != 0:
+		return "status " + strconv.Itoa(perr.StatusCode)
+	case errors.Is(perr, llmpool.ErrProviderTimeout):
+		return "timed out"
+	}
+	return "no response"
+}
+
+var (
+	// aiImageMaxBytes caps the decoded size of a /create/ai reference image
+	aiImageMaxBytes = 2 << 20
+
+	errImageTooLarge = errors.New("image is too large")
+	errNotImage      = errors.New("image must be PNG, JPEG, GIF or WebP")
+)
+
+// aiImageTypes are the formats vision models accept
+var aiImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// requestImage returns the reference image of a /create/ai request as a
+// data: URL, or "" if there is none. A multipart "image" file wins over the
+// base64 fields, which accept either a data: URL or bare base64.
+func requestImage(res *fiber.Ctx, encoded ...string) (string, error) {
+	if file, err := res.FormFile("image"); err == nil {
+		if file.Size > int64(aiImageMaxBytes) {
+			return "", errImageTooLarge
+		}
+		f, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, int64(aiImageMaxBytes)+1))
+		if err != nil {
+			return "", err
+		}
+		return imageDataURL(data)
+	}
+
+	for _, e := range encoded {
+		if e == "" {
+			continue
+		}
+		if header, payload, ok := strings.Cut(e, ","); ok && strings.HasPrefix(header, "data:") {
+			if !strings.HasSuffix(header, ";base64") {
+				return "", fmt.Errorf("image data URL must be base64-encoded")
+			}
+			e = payload
+		}
+		if base64.StdEncoding.DecodedLen(len(e)) > aiImageMaxBytes+3 {
+			return "", errImageTooLarge
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(e))
+		if err != nil {
+			return "", fmt.Errorf("image is not valid base64")
+		}
+		return imageDataURL(data)
+	}
+	return "", nil
+}
+
+// imageDataURL checks size and sniffed type, and encodes data as a data: URL.
+// The declared type is ignored so a mislabelled upload can't get through.
+func imageDataURL(data []byte) (string, error) {
+	if len(data) > aiImageMaxBytes {
+		return "", errImageTooLarge
+	}
+	mediaType := http.DetectContentType(data)
+	if !aiImageTypes[mediaType] {
+		return "", errNotImage
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// imageErrorStatus maps a requestImage error to an HTTP status
+func imageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		return 413
+	case errors.Is(err, errNotImage):
+		return 415
+	case errors.Is(err, errPDFReferenceTooLarge):
+		return 413
+	case errors.Is(err, errInvalidPDF):
+		return 422
+	case errors.Is(err, errPDFRasterUnavailable):
+		return 501
+	case errors.Is(err, context.DeadlineExceeded):
+		return 504
+	default:
+		return 400
+	}
+}
+
+// userMessage builds a user turn, multimodal when an image data URL is given
+func userMessage(text, image string) llmpool.ChatMessage {
+	if image == "" {
+		return llmpool.ChatMessage{Role: "user", Content: text}
+	}
+	return llmpool.ChatMessage{
+		Role: "user",
+		Content: []llmpool.MessagePart{
+			{Type: "text", Text: text},
+			{Type: "image_url", ImageURL: &llmpool.ImageURLObject{URL: image}},
+		},
+	}
+}
+
+// handleCreateAI generates a template from a prompt and an optional
+// reference image or PDF page. Images only go to providers with Vision.
+func handleCreateAI(pool *llmpool.Pool, cfg *Config) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		// JSON, or multipart with the image as an "image" file part
+		var body struct {
+			Message     string `json:"prompt" form:"prompt"`
+			ImageBase64 string `json:"image_base64,omitempty" form:"image_base64"`
+			Base64Image string `json:"image,omitempty" form:"-"`
+			// Provider pins the request to one pool provider; Model overrides its model
+			Provider string `json:"provider,omitempty" form:"provider"`
+			Model    string `json:"model,omitempty" form:"model"`
+			// DocumentType picks a prompt preset (default invoice); the
+			// override replaces the prompt when AI_ALLOW_PROMPT_OVERRIDE is set
+			DocumentType   string `json:"document_type,omitempty" form:"document_type"`
+			PromptOverride string `json:"system_prompt_override,omitempty" form:"system_prompt_override"`
+			// PDFBase64 is a reference PDF used instead of an image; Page
+			// picks the page (default 1)
+			PDFBase64 string `json:"pdf_base64,omitempty" form:"pdf_base64"`
+			Page      int    `json:"page,omitempty" form:"page"`
+		}
+
+		if err := res.BodyParser(&body); err != nil {
+			return sendError(res, 400, "Invalid JSON body")
+		}
+
+		preset, err := presetFor(body.DocumentType)
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		prompt := preset.prompt()
+		if body.PromptOverride != "" {
+			if !cfg.AIAllowPromptOverride {
+				return sendError(res, 403, "system_prompt_override is disabled on this server")
+			}
+			prompt = body.PromptOverride
+		}
+
+		image, err := requestImage(res, body.ImageBase64, body.Base64Image)
+		if err != nil {
+			return sendError(res, imageErrorStatus(err), err.Error())
+		}
+		if body.PDFBase64 != "" {
+			if image != "" {
+				return sendError(res, 400, "send either an image or pdf_base64, not both")
+			}
+			if body.Page < 0 {
+				return sendError(res, 400, "page must be 1 or more")
+			}
+			if image, err = pdfReferenceImage(res.UserContext(), body.PDFBase64, body.Page); err != nil {
+				return sendError(res, imageErrorStatus(err), err.Error())
+			}
+		}
+
+		target, err := providerTarget(pool, body.Provider)
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+
+		req := &llmpool.ChatRequest{
+			Messages: []llmpool.ChatMessage{
+				{Role: "system", Content: prompt},
+				userMessage(body.Message, image),
+			},
+			Model:       body.Model,
+			Temperature: llmpool.Ptr(0.7),
+			MaxTokens:   8000,
+		}
+
+		// Accept: text/event-stream streams the reply as it is generated
+		if strings.Contains(res.Get(fiber.HeaderAccept), "text/event-stream") {
+			return streamTemplate(res, target, req, preset.check)
+		}
+
+		result, err := generateTemplate(res.UserContext(), target.chat, req, cfg.AIValidationRetries, preset.check)
+		if err != nil {
+			return sendLLMError(res, err)
+		}
+		return sendTemplateResult(res, result, nil)
+	}
+}
+
+// aiTemplate is the outcome of a template generation
+type aiTemplate struct {
+	HTML     string
+	Warnings []string
+	// Removed is what sanitizeHTML took out of the final attempt
+	Removed []string
+	Report  templateReport
+	// Last is the final model response; Usage adds up every attempt
+	Last     *llmpool.ChatResponse
+	Usage    tokenUsage
+	Attempts int
+}
+
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// chatFunc sends one chat request; see llmTarget.chat
+type chatFunc func(ctx context.Context, req *llmpool.ChatRequest) (*llmpool.ChatResponse, error)
+
+// llmTarget is where a request goes: the whole pool, or one named provider
+type llmTarget struct {
+	pool     *llmpool.Pool
+	provider string
+}
+
+// providerTarget resolves a request's optional provider field. An unknown
+// name is an error listing the configured providers.
+func providerTarget(pool *llmpool.Pool, name string) (llmTarget, error) {
+	if name == "" {
+		return llmTarget{pool: pool}, nil
+	}
+
+	var names []string
+	providers := pool.GetProviders()
+	for i := range providers {
+		if providers[i].Name == name {
+			return llmTarget{pool: pool, provider: name}, nil
+		}
+		names = append(names, providers[i].Name)
+	}
+	return llmTarget{}, fmt.Errorf("unknown provider %q; available providers: %s", name, strings.Join(names, ", "))
+}
+
+func (t llmTarget) chat(ctx context.Context, req *llmpool.ChatRequest) (*llmpool.ChatResponse, error) {
+	if t.provider != "" {
+		return t.pool.ChatWithProvider(ctx, t.provider, req)
+	}
+	return t.pool.Chat(ctx, req)
+}
+
+func (t llmTarget) stream(ctx context.Context, req *llmpool.ChatRequest, fn func(llmpool.StreamChunk) error) (*llmpool.ChatResponse, error) {
+	if t.provider != "" {
+		return t.pool.ChatStreamWithProvider(ctx, t.provider, req, fn)
+	}
+	return t.pool.ChatStream(ctx, req, fn)
+}
+
+// generateTemplate asks the pool for a template and runs check on it. A
+// template with errors is sent back to the model with the errors as
+// feedback, up to retries more times. The best attempt is returned; the
+// error is only set when no attempt produced a response at all.
+func generateTemplate(ctx context.Context, chat chatFunc, req *llmpool.ChatRequest, retries int, check func(string) templateReport) (*aiTemplate, error) {
+	var best *aiTemplate
+	var usage tokenUsage
+	messages := req.Messages
+
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		if attempt > 1 && ctx.Err() != nil {
+			break
+		}
+
+		attemptReq := *req
+		attemptReq.Messages = messages
+		resp, err := chat(ctx, &attemptReq)
+		if err != nil {
+			if best == nil {
+				return nil, err
+			}
+			// Rate limits and deadlines end the retries; keep what we have
+			slog.WarnContext(ctx, "template retry failed", "attempt", attempt, "error", err)
+			break
+		}
+
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.TotalTokens += resp.Usage.TotalTokens
+
+		html, warnings, removed := cleanAIHTML(resp.Content)
+		current := &aiTemplate{HTML: html, Warnings: warnings, Removed: removed, Report: check(html), Last: resp, Attempts: attempt}
+		if best == nil || len(current.Report.Errors) <= len(best.Report.Errors) {
+			best = current
+		}
+		if current.Report.Valid {
+			break
+		}
+
+		slog.InfoContext(ctx, "generated template failed checks", "attempt", attempt, "errors", current.Report.Errors)
+		messages = append(messages[:len(messages):len(messages)],
+			llmpool.ChatMessage{Role: "assistant", Content: resp.Content},
+			llmpool.ChatMessage{Role: "user", Content: templateFeedback(current.Report)},
+		)
+	}
+
+	best.Usage = usage
+	return best, nil
+}
+
+// templateFeedback is the re-prompt sent after a template fails its checks
+func templateFeedback(report templateReport) string {
+	return "The template you returned has these problems:\n- " + strings.Join(report.Errors, "\n- ") +
+		"\nFix them and return the complete corrected HTML only, with no explanation."
+}
+
+// sendTemplateResult replies with a generated template. A template that
+// still fails its checks gets 502 in sendError's shape, with the best
+// attempt attached for the client to inspect.
+func sendTemplateResult(res *fiber.Ctx, result *aiTemplate, extra fiber.Map) error {
+	usage.get(keyName(res)).AICalls.Add(int64(result.Attempts))
+
+	reply := fiber.Map{
+		"response":   result.HTML,
+		"provider":   result.Last.Provider,
+		"model":      result.Last.Model,
+		"usage":      result.Usage,
+		"attempts":   result.Attempts,
+		"variables":  discoverVariables(result.HTML),
+		"schema":     templateSchema(result.HTML),
+		"warnings":   result.Warnings,
+		"removed":    result.Removed,
+		"validation": result.Report,
+	}
+	for k, v := range extra {
+		reply[k] = v
+	}
+	if !result.Report.Valid {
+		reply["error"] = "Generated template failed validation"
+		reply["request_id"], _ = res.Locals("request_id").(string)
+		return res.Status(502).JSON(reply)
+	}
+	return res.Status(200).JSON(reply)
+}
+
+// variableChanges compares the placeholders of two versions of a template
+type variableChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Retained is the fraction of the original placeholders still present
+	Retained float64 `json:"retained"`
+}
+
+func compareVariables(before, after string) variableChanges {
+	old, updated := discoverVariables(before).names(), discoverVariables(after).names()
+	inOld, inUpdated := make(map[string]bool), make(map[string]bool)
+	for _, n := range old {
+		inOld[n] = true
+	}
+	for _, n := range updated {
+		inUpdated[n] = true
+	}
+
+	c := variableChanges{Added: []string{}, Removed: []string{}, Retained: 1}
+	for _, n := range updated {
+		if !inOld[n] {
+			c.Added = append(c.Added, n)
+		}
+	}
+	for _, n := range old {
+		if !inUpdated[n] {
+			c.Removed = append(c.Removed, n)
+		}
+	}
+	if len(old) > 0 {
+		c.Retained = float64(len(old)-len(c.Removed)) / float64(len(old))
+	}
+	return c
+}
+
+// refineCheck is check plus a guard against the model replacing the
+// template with an unrelated one: at least minRetained of the original
+// placeholders must survive
+func refineCheck(check func(string) templateReport, original string, minRetained float64) func(string) templateReport {
+	return func(tpl string) templateReport {
+		report := check(tpl)
+		if c := compareVariables(original, tpl); c.Retained < minRetained {
+			report.Errors = append(report.Errors, fmt.Sprintf(
+				"only %.0f%% of the original placeholders were kept; keep the existing placeholders (removed: %s) and change only what was asked",
+				c.Retained*100, strings.Join(c.Removed, ", ")))
+			report.Valid = false
+		}
+		return report
+	}
+}
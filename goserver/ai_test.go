@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// generatedInvoice passes the invoice preset's checks
+const generatedInvoice = `<!DOCTYPE html><html><body><h1>{{company_name}}</h1>` +
+	`<p>{{invoice_number}} {{invoice_date}} {{customer_name}}</p>` +
+	`<table><tr><td>{{list.item_name}}</td></tr></table><p>{{total_amount}}</p></body></html>`
+
+// stubProvider is an OpenAI-compatible chat completions server that
+// answers every request with reply and keeps the request bodies
+type stubProvider struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies []map[string]any
+}
+
+func newStubProvider(t *testing.T, reply string) *stubProvider {
+	t.Helper()
+	s := &stubProvider{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("provider request is not JSON: %v", err)
+		}
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"model":   body["model"],
+			"choices": []any{map[string]any{"message": map[string]any{"role": "assistant", "content": reply}}},
+			"usage":   map[string]any{"prompt_tokens": 10, "completion_tokens": 20, "total_tokens": 30},
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubProvider) requests() []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies
+}
+
+// createAIApp serves /create/ai from a pool holding one Groq provider
+// backed by stub
+func createAIApp(t *testing.T, stub *stubProvider, vision bool) *fiber.App {
+	t.Helper()
+	pool := llmpool.NewPool()
+	err := pool.AddProvider(&llmpool.Provider{
+		Name:    "stub",
+		Type:    llmpool.ProviderGroq,
+		APIKey:  "test",
+		BaseURL: stub.URL,
+		Model:   "stub-vision",
+		Vision:  vision,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := usage
+	usage = newUsageTracker(0, nil)
+	t.Cleanup(func() { usage = previous })
+
+	app := fiber.New()
+	app.Post("/create/ai", handleCreateAI(pool, &Config{}))
+	return app
+}
+
+// testPNG is a 2x2 PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func doRequest(t *testing.T, app *fiber.App, req *http.Request) (int, map[string]any) {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("response %d is not JSON: %s", resp.StatusCode, data)
+	}
+	return resp.StatusCode, body
+}
+
+// imagePart returns the image_url part of the user message sent to the
+// provider
+func imagePart(t *testing.T, sent map[string]any) map[string]any {
+	t.Helper()
+	messages, _ := sent["messages"].([]any)
+	if len(messages) != 2 {
+		t.Fatalf("provider got %d messages, want 2", len(messages))
+	}
+	user, _ := messages[1].(map[string]any)
+	parts, ok := user["content"].([]any)
+	if !ok {
+		t.Fatalf("user content is %T, want a list of parts", user["content"])
+	}
+	for _, part := range parts {
+		if p, _ := part.(map[string]any); p["type"] == "image_url" {
+			return p
+		}
+	}
+	t.Fatalf("no image_url part in %v", parts)
+	return nil
+}
+
+func TestCreateAIImageMultipart(t *testing.T) {
+	stub := newStubProvider(t, "```html\n"+generatedInvoice+"\n```")
+	app := createAIApp(t, stub, true)
+	img := testPNG(t)
+
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	w.WriteField("prompt", "Make it look like this")
+	file, _ := w.CreateFormFile("image", "reference.png")
+	file.Write(img)
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/create/ai", &form)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	status, body := doRequest(t, app, req)
+	if status != 200 {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if body["response"] != generatedInvoice || body["provider"] != "stub" {
+		t.Errorf("response %v from %v", body["response"], body["provider"])
+	}
+
+	sent := stub.requests()
+	if len(sent) != 1 {
+		t.Fatalf("provider got %d requests, want 1", len(sent))
+	}
+	want := map[string]any{
+		"type":      "image_url",
+		"image_url": map[string]any{"url": "data:image/png;base64," + base64.StdEncoding.EncodeToString(img)},
+	}
+	if got := imagePart(t, sent[0]); !jsonEqual(got, want) {
+		t.Errorf("image part %v, want %v", got, want)
+	}
+}
+
+func TestCreateAIImageBase64(t *testing.T) {
+	stub := newStubProvider(t, generatedInvoice)
+	app := createAIApp(t, stub, true)
+	img := base64.StdEncoding.EncodeToString(testPNG(t))
+
+	for _, field := range []string{
+		`"image_base64":"` + img + `"`,
+		`"image":"data:image/png;base64,` + img + `"`,
+	} {
+		req := httptest.NewRequest("POST", "/create/ai", strings.NewReader(`{"prompt":"An invoice",`+field+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		if status, body := doRequest(t, app, req); status != 200 {
+			t.Fatalf("%s: status %d: %v", field, status, body)
+		}
+	}
+	for i, sent := range stub.requests() {
+		url, _ := imagePart(t, sent)["image_url"].(map[string]any)["url"].(string)
+		if url != "data:image/png;base64,"+img {
+			t.Errorf("request %d: image URL %.40s...", i, url)
+		}
+	}
+}
+
+func TestCreateAIImageRejected(t *testing.T) {
+	previous := aiImageMaxBytes
+	aiImageMaxBytes = 1024
+	t.Cleanup(func() { aiImageMaxBytes = previous })
+
+	tests := []struct {
+		name   string
+		vision bool
+		image  []byte
+		status int
+	}{
+		{"no vision provider", false, testPNG(t), 422},
+		{"not an image", true, []byte("%PDF-1.4 not an image"), 415},
+		{"too large", true, append(testPNG(t), make([]byte, 2048)...), 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubProvider(t, generatedInvoice)
+			app := createAIApp(t, stub, tt.vision)
+
+			body := `{"prompt":"An invoice","image_base64":"` + base64.StdEncoding.EncodeToString(tt.image) + `"}`
+			req := httptest.NewRequest("POST", "/create/ai", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if status, reply := doRequest(t, app, req); status != tt.status {
+				t.Errorf("status %d, want %d: %v", status, tt.status, reply)
+			}
+			if n := len(stub.requests()); n != 0 {
+				t.Errorf("provider got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+// jsonEqual compares two values by their JSON encoding
+func jsonEqual(a, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
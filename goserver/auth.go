@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiKey is a named bearer token accepted by checkAuth
+type apiKey struct {
+	Name   string
+	Admin  bool
+	secret []byte
+}
+
+// keyring holds every accepted API key. Several keys may be valid at once,
+// which is how rotation works: add the new key, migrate clients, drop the old one.
+type keyring struct {
+	keys []apiKey
+}
+
+var (
+	authEnabled bool
+	authKeys    *keyring
+
+	// authExempt lists paths served without a key. GET / (the builder UI) and
+	// the health probes are always public; UNAUTHENTICATED_ROUTES adds more
+	// for internal deployments.
+	authExempt = map[string]bool{
+		"/":              true,
+		"/healthz":       true,
+		"/readyz":        true,
+		"/healthz/live":  true,
+		"/healthz/ready": true,
+	}
+)
+
+// loadAuthExemptions adds the UNAUTHENTICATED_ROUTES paths to authExempt
+func loadAuthExemptions(paths []string) {
+	for _, path := range paths {
+		authExempt[path] = true
+	}
+}
+
+// loadAPIKeys reads keys from API_KEYS (comma-separated) and API_KEYS_FILE
+// (one per line). Each entry is "name:secret"; a bare secret is named key-N.
+// Keys in ADMIN_API_KEYS use the same format and may also call admin routes.
+func loadAPIKeys(cfg authConfig) (*keyring, error) {
+	entries := append([]string(nil), cfg.Keys...)
+	adminEntries := cfg.AdminKeys
+
+	if path := cfg.KeysFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading API_KEYS_FILE: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading API_KEYS_FILE: %w", err)
+		}
+	}
+
+	k := &keyring{}
+	for i, e := range append(entries, adminEntries...) {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		name, secret, found := strings.Cut(e, ":")
+		if !found {
+			name, secret = fmt.Sprintf("key-%d", len(k.keys)+1), e
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("API key %q has an empty secret", name)
+		}
+		k.keys = append(k.keys, apiKey{Name: name, Admin: i >= len(entries), secret: []byte(secret)})
+	}
+	return k, nil
+}
+
+// match returns the name of the key equal to token. Every key is compared
+// in constant time so timing doesn't reveal which prefix matched.
+func (k *keyring) match(token string) (apiKey, bool) {
+	var matched apiKey
+	found := false
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(token), key.secret) == 1 && !found {
+			matched = key
+			found = true
+		}
+	}
+	return matched, found
+}
+
+// checkAuth is installed for every route; paths in authExempt skip it.
+// It requires a valid "Authorization: Bearer <key>" header and stores
+// the matched key's name in Locals("api_key_name") for logging
+func checkAuth(res *fiber.Ctx) error {
+	if !authEnabled || authExempt[res.Path()] {
+		return res.Next()
+	}
+
+	token, ok := strings.CutPrefix(res.Get("Authorization"), "Bearer ")
+	if !ok {
+		return sendError(res, 401, "Unauthorized")
+	}
+
+	key, ok := authKeys.match(token)
+	if !ok {
+		return sendError(res, 401, "Unauthorized")
+	}
+
+	res.Locals("api_key_name", key.Name)
+	res.Locals("api_key_admin", key.Admin)
+	return res.Next()
+}
+
+// requireAdmin restricts a route to keys listed in ADMIN_API_KEYS
+func requireAdmin(res *fiber.Ctx) error {
+	if !authEnabled {
+		return res.Next()
+	}
+	if admin, _ := res.Locals("api_key_admin").(bool); !admin {
+		return sendError(res, 403, "Admin API key required")
+	}
+	return res.Next()
+}
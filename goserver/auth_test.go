@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// authApp enables auth with one user and one admin key and serves a health
+// route, a user route and an admin route behind checkAuth
+func authApp(t *testing.T) *fiber.App {
+	t.Helper()
+	keys, err := loadAPIKeys(authConfig{Keys: []string{"alice:user-secret"}, AdminKeys: []string{"ops:admin-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled, previous := authEnabled, authKeys
+	authEnabled, authKeys = true, keys
+	t.Cleanup(func() { authEnabled, authKeys = enabled, previous })
+
+	app := fiber.New()
+	app.Use(checkAuth)
+	ok := func(res *fiber.Ctx) error {
+		name, _ := res.Locals("api_key_name").(string)
+		return res.SendString(name)
+	}
+	app.Get("/healthz", ok)
+	app.Get("/readyz", ok)
+	app.Post("/html-pdf", ok)
+	app.Get("/stats", requireAdmin, ok)
+	return app
+}
+
+func TestCheckAuth(t *testing.T) {
+	app := authApp(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		status int
+		key    string
+	}{
+		{"missing key", "POST", "/html-pdf", "", 401, ""},
+		{"not a bearer token", "POST", "/html-pdf", "user-secret", 401, ""},
+		{"wrong key", "POST", "/html-pdf", "Bearer nope", 401, ""},
+		{"key prefix", "POST", "/html-pdf", "Bearer user-", 401, ""},
+		{"valid key", "POST", "/html-pdf", "Bearer user-secret", 200, "alice"},
+		{"admin key on user route", "POST", "/html-pdf", "Bearer admin-secret", 200, "ops"},
+		{"health without key", "GET", "/healthz", "", 200, ""},
+		{"ready without key", "GET", "/readyz", "", 200, ""},
+		{"admin route without key", "GET", "/stats", "", 401, ""},
+		{"admin route with user key", "GET", "/stats", "Bearer user-secret", 403, ""},
+		{"admin route with admin key", "GET", "/stats", "Bearer admin-secret", 200, "ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == 200 {
+				body, _ := io.ReadAll(resp.Body)
+				if got := string(body); got != tt.key {
+					t.Errorf("api_key_name %q, want %q", got, tt.key)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	app := authApp(t)
+	authEnabled = false
+
+	for _, path := range []string{"/html-pdf", "/stats"} {
+		method := "GET"
+		if path == "/html-pdf" {
+			method = "POST"
+		}
+		resp, err := app.Test(httptest.NewRequest(method, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("%s with auth disabled: status %d, want 200", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	keys, err := loadAPIKeys(authConfig{Keys: []string{"bare", " named:s2 "}, AdminKeys: []string{"root:s3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []apiKey{
+		{Name: "key-1", secret: []byte("bare")},
+		{Name: "named", secret: []byte("s2")},
+		{Name: "root", Admin: true, secret: []byte("s3")},
+	}
+	if len(keys.keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys.keys), len(want))
+	}
+	for i, key := range keys.keys {
+		if key.Name != want[i].Name || key.Admin != want[i].Admin || string(key.secret) != string(want[i].secret) {
+			t.Errorf("key %d = %+v, want %+v", i, key, want[i])
+		}
+	}
+
+	if _, err := loadAPIKeys(authConfig{Keys: []string{"empty:"}}); err == nil {
+		t.Error("key with an empty secret: no error")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// uploadRoutes accept base64 images, reference PDFs and attachments, so
+// they get the upload limit instead of the general one
+var uploadRoutes = map[string]bool{
+	"/create/ai":        true,
+	"/create/ai/refine": true,
+	"/invoice/send":     true,
+}
+
+// bodyLimits caps request bodies per route. The server itself is configured
+// with the larger of the two, so nothing bigger is ever buffered.
+type bodyLimits struct {
+	body   int
+	upload int
+}
+
+// serverLimit is the BodyLimit given to Fiber
+func (l bodyLimits) serverLimit() int {
+	return max(l.body, l.upload)
+}
+
+// handler rejects bodies over the route's limit with 413
+func (l bodyLimits) handler(res *fiber.Ctx) error {
+	limit := l.body
+	if uploadRoutes[res.Path()] {
+		limit = l.upload
+	}
+	// The raw body, so a compressed request is measured as sent
+	if len(res.Request().Body()) > limit {
+		return sendError(res, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+	}
+	return res.Next()
+}
+
+// sendValidationError reports a failed validate: 400 unless the error
+// carries its own status, as oversized fields do (413)
+func sendValidationError(res *fiber.Ctx, err error) error {
+	var se *statusError
+	if errors.As(err, &se) {
+		return sendError(res, se.status, se.Error())
+	}
+	return sendError(res, 400, err.Error())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/launcher/flags"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+var (
+	// browser is the shared Chromium instance. Renders use it while holding
+	// the render lock; it is only replaced with both that lock and browserMu
+	// held, so readers outside the lock go through currentBrowser.
+	browser         *rod.Browser
+	browserLauncher *launcher.Launcher
+	browserMu       sync.RWMutex
+
+	// browserSettings is the configuration the browser was launched with,
+	// kept for restarts after a crash
+	browserSettings browserConfig
+)
+
+// browserCheckTimeout bounds one health check of the browser
+const browserCheckTimeout = 10 * time.Second
+
+// initBrowser launches Chromium as configured and makes it the shared browser
+func initBrowser(cfg browserConfig) error {
+	l := launcher.New().
+		Leakless(false).
+		Headless(cfg.Headless).
+		NoSandbox(cfg.NoSandbox).
+		Set("disable-gpu").
+		Set("disable-software-rasterizer").
+		Set("disable-dev-shm-usage")
+	if cfg.Path != "" {
+		l = l.Bin(cfg.Path)
+	}
+	for name, value := range cfg.Flags {
+		if value == "" {
+			l.Set(flags.Flag(name))
+		} else {
+			l.Set(flags.Flag(name), value)
+		}
+	}
+	u, err := l.Launch()
+	if err != nil {
+		return err
+	}
+
+	b := rod.New().ControlURL(u)
+	if err := b.Connect(); err != nil {
+		l.Kill()
+		return err
+	}
+
+	browserMu.Lock()
+	browser, browserLauncher, browserSettings = b, l, cfg
+	browserMu.Unlock()
+	return nil
+}
+
+// browserFlags parses BROWSER_FLAGS: comma-separated Chromium switches with
+// or without the leading "--", optionally as name=value
+func browserFlags(list string) map[string]string {
+	parsed := make(map[string]string)
+	for _, flag := range strings.Split(list, ",") {
+		flag = strings.TrimLeft(strings.TrimSpace(flag), "-")
+		if flag == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(flag, "=")
+		parsed[name] = value
+	}
+	return parsed
+}
+
+// currentBrowser returns the browser for callers that don't hold the render lock
+func currentBrowser() *rod.Browser {
+	browserMu.RLock()
+	defer browserMu.RUnlock()
+	return browser
+}
+
+// checkBrowser opens a blank page and evaluates a trivial script in it
+func checkBrowser() error {
+	b := currentBrowser()
+	if b == nil {
+		return fmt.Errorf("browser not started")
+	}
+
+	page, err := b.Timeout(browserCheckTimeout).Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return err
+	}
+	defer page.Close()
+
+	_, err = page.Eval(`() => 1`)
+	return err
+}
+
+// restartBrowser kills the current browser and launches a new one. The old
+// one is closed before waiting for the render lock, so renders stuck on it
+// fail with an error and release the lock instead of hanging.
+func restartBrowser(cfg browserConfig, reason error) {
+	slog.Error("browser unhealthy, restarting", "error", reason)
+
+	browserMu.RLock()
+	old, oldLauncher := browser, browserLauncher
+	browserMu.RUnlock()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("closing unhealthy browser", "panic", r)
+			}
+		}()
+		if old != nil {
+			old.Close()
+		}
+		if oldLauncher != nil {
+			oldLauncher.Kill()
+		}
+	}()
+
+	release := acquireBrowser()
+	defer release()
+
+	if err := initBrowser(cfg); err != nil {
+		slog.Error("browser restart failed", "error", err)
+		return
+	}
+	metrics.browserRelaunches.Add(1)
+	promBrowserRestarts.add(1)
+	slog.Info("browser restarted")
+}
+
+// monitorBrowser checks the browser every cfg.HealthInterval and restarts it when the
+// check fails or times out
+func monitorBrowser(cfg browserConfig) {
+	// Export a zero sample so rate() works before the first restart
+	promBrowserRestarts.add(0)
+
+	ticker := time.NewTicker(cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := checkBrowser(); err != nil {
+			restartBrowser(cfg, err)
+		}
+	}
+}
+
+// browserErrorMessages are fragments of errors from a dead or unreachable
+// browser that don't unwrap to a typed error
+var browserErrorMessages = []string{
+	"process exited",
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"use of closed network connection",
+	"target closed",
+	"session with given id not found",
+	"websocket: close",
+}
+
+// errBrowserPanic wraps panics raised by rod while rendering
+var errBrowserPanic = errors.New("browser panic")
+
+// isBrowserError reports whether err means the browser process crashed or
+// its connection broke, as opposed to a problem with the page itself
+func isBrowserError(err error) bool {
+	if errors.Is(err, errBrowserPanic) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range browserErrorMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// generatePDFWithRetry renders html, restarting the browser and trying
+// again (up to maxAttempts in total) when the failure is the browser's.
+// Other errors, such as a bad wait_for selector, are returned at once.
+func generatePDFWithRetry(html string, opts pdfOptions, maxAttempts int) (io.ReadCloser, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		failed := currentBrowser()
+		stream, err := renderRecovered(html, opts)
+		if err == nil || attempt >= maxAttempts || !isBrowserError(err) {
+			return stream, err
+		}
+
+		slog.Warn("render failed on a browser error, retrying", "attempt", attempt, "max_attempts", maxAttempts, "error", err)
+		// Concurrent renders hit by the same crash restart it only once
+		browserMu.RLock()
+		current, cfg := browser, browserSettings
+		browserMu.RUnlock()
+		if current == failed {
+			restartBrowser(cfg, err)
+		}
+	}
+}
+
+// renderRecovered is generatePDFFromHTML with panics from a dying browser
+// connection turned into errors
+func renderRecovered(html string, opts pdfOptions) (stream io.ReadCloser, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errBrowserPanic, r)
+		}
+	}()
+	return generatePDFFromHTML(html, opts)
+}
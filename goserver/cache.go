@@ -0,0 +1,165 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pdfCache is a small in-memory LRU cache of rendered PDFs keyed by content hash.
+// A zero maxEntries disables it; a zero ttl keeps entries until evicted.
+type pdfCache struct {
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[string]*list.Element
+	mu         sync.Mutex
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type pdfCacheEntry struct {
+	key     string
+	pdf     []byte
+	expires time.Time
+}
+
+func newPDFCache(maxEntries int, ttl time.Duration) *pdfCache {
+	return &pdfCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Enabled reports whether the cache stores anything at all
+func (c *pdfCache) Enabled() bool {
+	return c.maxEntries > 0
+}
+
+// Get returns the cached PDF for key and marks it as recently used
+func (c *pdfCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := el.Value.(*pdfCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits.Add(1)
+	return entry.pdf, true
+}
+
+// Add stores a PDF, evicting the least recently used entry when full
+func (c *pdfCache) Add(key string, pdf []byte) {
+	if !c.Enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*pdfCacheEntry)
+		entry.pdf = pdf
+		entry.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&pdfCacheEntry{key: key, pdf: pdf, expires: expires})
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*pdfCacheEntry).key)
+	}
+}
+
+// Stats returns the cache counters for the stats output
+func (c *pdfCache) Stats() fiber.Map {
+	c.mu.Lock()
+	entries := c.ll.Len()
+	c.mu.Unlock()
+
+	return fiber.Map{
+		"enabled": c.Enabled(),
+		"entries": entries,
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+	}
+}
+
+// renderKey is the normalized form of a render request used for cache keys
+type renderKey struct {
+	URL     string     `json:"url,omitempty"`
+	HTML    string     `json:"html,omitempty"`
+	Options pdfOptions `json:"options"`
+	// Metadata changes the output, so it is part of the key
+	Metadata *pdfMetadata `json:"metadata,omitempty"`
+}
+
+// cacheKey returns the hex SHA-256 of the normalized render request
+func (k renderKey) cacheKey() string {
+	data, _ := json.Marshal(k)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// computeETag returns a strong ETag (quoted hex SHA-256) for the given bytes
+func computeETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkETag sets the ETag and Cache-Control headers and reports whether the
+// client's cached copy is current, in which case the caller should send 304
+func checkETag(res *fiber.Ctx, etag string, maxAge int) bool {
+	res.Set("ETag", etag)
+	if maxAge > 0 {
+		res.Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+	} else {
+		res.Set("Cache-Control", "private, no-cache")
+	}
+	return etagMatches(res.Get("If-None-Match"), etag)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// calcOptions turns on the calculation engine for POST /invoice
+type calcOptions struct {
+	// TaxRate is the percentage applied to rows without their own tax_rate
+	TaxRate float64 `json:"tax_rate,omitempty"`
+	// Discount is an absolute amount taken off the total
+	Discount float64 `json:"discount,omitempty"`
+	// Decimals is the number of decimals amounts are rounded to (default 2)
+	Decimals *int `json:"decimals,omitempty"`
+	// Prices are in BaseCurrency; when DisplayCurrency differs, every amount
+	// is converted at the current exchange rate before formatting
+	BaseCurrency    string `json:"base_currency,omitempty"`
+	DisplayCurrency string `json:"display_currency,omitempty"`
+}
+
+// Row fields read by the calculation engine, first match wins
+var (
+	quantityFields = []string{"quantity", "qty"}
+	priceFields    = []string{"price", "unit_price", "rate"}
+	taxRateFields  = []string{"tax_rate", "gst", "tax_percent"}
+)
+
+func (o *calcOptions) validate() error {
+	o.BaseCurrency = strings.ToUpper(strings.TrimSpace(o.BaseCurrency))
+	o.DisplayCurrency = strings.ToUpper(strings.TrimSpace(o.DisplayCurrency))
+	for _, code := range []string{o.BaseCurrency, o.DisplayCurrency} {
+		if code != "" && (len(code) != 3 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "") {
+			return fmt.Errorf("calculate: %q is not a three-letter currency code", code)
+		}
+	}
+	if (o.BaseCurrency == "") != (o.DisplayCurrency == "") {
+		return errors.New("calculate.base_currency and calculate.display_currency must be set together")
+	}
+	if o.TaxRate < 0 || o.TaxRate > 100 {
+		return errors.New("calculate.tax_rate must be between 0 and 100")
+	}
+	if o.Decimals != nil && (*o.Decimals < 0 || *o.Decimals > 6) {
+		return errors.New("calculate.decimals must be between 0 and 6")
+	}
+	return nil
+}
+
+func (o calcOptions) decimals() int {
+	if o.Decimals == nil {
+		return 2
+	}
+	return *o.Decimals
+}
+
+// calculateInvoice fills in row and invoice totals. Each row with a price
+// gets amount (quantity × price, quantity defaulting to 1), tax_amount and
+// line_total; data gets subtotal, tax_amount, discount_amount and
+// total_amount. Amounts are multiplied by rate, the exchange rate to the
+// display currency, and written as formatted strings.
+func calculateInvoice(data map[string]any, list []map[string]any, opts calcOptions, rate float64) {
+	decimals := opts.decimals()
+	format := func(v float64) string {
+		scale := math.Pow(10, float64(decimals))
+		return strconv.FormatFloat(math.Round(v*rate*scale)/scale, 'f', decimals, 64)
+	}
+
+	var subtotal, taxTotal float64
+	for _, row := range list {
+		price, ok := numberField(row, priceFields)
+		if !ok {
+			continue
+		}
+		qty, ok := numberField(row, quantityFields)
+		if !ok {
+			qty = 1
+		}
+		rate, ok := numberField(row, taxRateFields)
+		if !ok {
+			rate = opts.TaxRate
+		}
+
+		amount := qty * price
+		tax := amount * rate / 100
+		row["amount"] = format(amount)
+		row["tax_amount"] = format(tax)
+		row["line_total"] = format(amount + tax)
+
+		subtotal += amount
+		taxTotal += tax
+	}
+
+	data["subtotal"] = format(subtotal)
+	data["tax_amount"] = format(taxTotal)
+	data["discount_amount"] = format(opts.Discount)
+	data["total_amount"] = format(subtotal + taxTotal - opts.Discount)
+	if opts.DisplayCurrency != "" {
+		data["currency"] = opts.DisplayCurrency
+		data["exchange_rate"] = strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+}
+
+// numberField reads the first of fields present in row as a number. Numeric
+// strings such as "1,250.50" are accepted.
+func numberField(row map[string]any, fields []string) (float64, bool) {
+	for _, f := range fields {
+		switch v := row[f].(type) {
+		case float64:
+			return v, true
+		case json.Number:
+			n, err := v.Float64()
+			return n, err == nil
+		case string:
+			n, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(v), ",", ""), 64)
+			if err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
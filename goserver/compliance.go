@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// complianceRules are the placeholders an invoice needs to be valid in a
+// country. A required list such as line_items is satisfied by any
+// {{line_items.field}} placeholder as well as a plain {{line_items}}.
+type complianceRules struct {
+	Required []string
+	// Recommended fields are reported as warnings when missing
+	Recommended []string
+}
+
+// baseRequired is what every invoice needs, whatever the country
+var baseRequired = []string{"company_name", "invoice_number", "invoice_date", "line_items", "total_amount"}
+
+// vatRules covers countries with EU-style VAT invoices
+var vatRules = complianceRules{
+	Required:    []string{"company_address", "company_vat", "customer_name", "customer_address", "tax_amount"},
+	Recommended: []string{"customer_vat", "delivery_date", "subtotal"},
+}
+
+// complianceCountries maps ISO 3166-1 alpha-2 codes to their rules on top of
+// baseRequired; "" is the generic check used when no country is given
+var complianceCountries = map[string]complianceRules{
+	"":   {Recommended: []string{"customer_name", "tax_amount"}},
+	"AT": vatRules,
+	"BE": vatRules,
+	"DE": vatRules,
+	"ES": vatRules,
+	"FR": vatRules,
+	"IE": vatRules,
+	"IT": vatRules,
+	"NL": vatRules,
+	"PL": vatRules,
+	"GB": vatRules,
+	"US": {
+		Required:    []string{"customer_name"},
+		Recommended: []string{"company_address", "customer_address", "due_date", "tax_amount"},
+	},
+	"CA": {
+		Required:    []string{"company_address", "company_gst_number", "customer_name", "tax_amount"},
+		Recommended: []string{"customer_address", "due_date"},
+	},
+	"AU": {
+		Required:    []string{"company_abn", "customer_name", "tax_amount"},
+		Recommended: []string{"company_address", "customer_address"},
+	},
+	"IN": {
+		Required:    []string{"company_address", "company_gstin", "customer_name", "customer_address", "place_of_supply", "tax_amount"},
+		Recommended: []string{"customer_gstin", "hsn_code"},
+	},
+}
+
+// lineItemFields are the columns an itemised line_items list should have
+var lineItemFields = [][]string{
+	{"description", "name", "item"},
+	quantityFields,
+	priceFields,
+}
+
+// complianceReport is the result of POST /templates/:id/validate
+type complianceReport struct {
+	Country       string   `json:"country,omitempty"`
+	Passed        bool     `json:"passed"`
+	MissingFields []string `json:"missing_fields"`
+	Warnings      []string `json:"warnings"`
+}
+
+// checkCompliance reports which of the country's fields tpl lacks. The
+// country must be a key of complianceCountries.
+func checkCompliance(tpl, country string) complianceReport {
+	rules := complianceCountries[country]
+	vars := discoverVariables(tpl)
+	r := complianceReport{Country: country, MissingFields: []string{}, Warnings: []string{}}
+
+	for _, name := range append(append([]string{}, baseRequired...), rules.Required...) {
+		if !vars.has(name) {
+			r.MissingFields = append(r.MissingFields, name)
+		}
+	}
+	for _, name := range rules.Recommended {
+		if !vars.has(name) {
+			r.Warnings = append(r.Warnings, fmt.Sprintf("recommended field %s is missing", name))
+		}
+	}
+
+	if fields, ok := vars.Lists["line_items"]; ok {
+		for _, alternatives := range lineItemFields {
+			if !hasAnyField(fields, alternatives) {
+				r.Warnings = append(r.Warnings, fmt.Sprintf("line_items has no %s column", alternatives[0]))
+			}
+		}
+	}
+	if country == "" {
+		r.Warnings = append(r.Warnings, "no country given; only the generic fields were checked")
+	}
+
+	r.Passed = len(r.MissingFields) == 0
+	return r
+}
+
+func hasAnyField(fields, names []string) bool {
+	for _, f := range fields {
+		for _, n := range names {
+			if f == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// complianceCountryList is the supported country codes, for error messages
+func complianceCountryList() string {
+	var codes []string
+	for code := range complianceCountries {
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ", ")
+}
+
+func handleValidateTemplate(res *fiber.Ctx) error {
+	country := strings.ToUpper(strings.TrimSpace(res.Query("country")))
+	if _, ok := complianceCountries[country]; !ok {
+		return sendError(res, 400, fmt.Sprintf("unsupported country %q; supported: %s", country, complianceCountryList()))
+	}
+
+	t, err := getTemplate(db, res.Params("id"))
+	if err != nil {
+		return sendTemplateError(res, err)
+	}
+	return res.JSON(checkCompliance(t.HTMLContent, country))
+}
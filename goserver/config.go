@@ -0,0 +1,545 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything the server reads from its environment. It is loaded
+// once at startup, after the optional .env file, and handed to the components.
+type Config struct {
+	LogLevel string
+	DBPath   string
+	Listen   listenConfig
+	Browser  browserConfig
+	Auth     authConfig
+	CORS     corsConfig
+	Cache    cacheConfig
+	Limits   limitsConfig
+	Exchange exchangeConfig
+	Mail     mailConfig
+	Storage  storageConfig
+
+	// MetricsPublic serves /metrics without auth (METRICS_AUTH=none)
+	MetricsPublic bool
+	// AllowPrivateFetch lets the HTML preprocessors fetch internal addresses
+	AllowPrivateFetch bool
+	// WebhookSecret signs POST /pdf-async webhooks; without it they're refused
+	WebhookSecret string
+
+	// HolidaysFile adds public holidays for due date calculation
+	HolidaysFile string
+	// PDFTitleField is the data field /invoice PDFs take their title from;
+	// PDFKeywords are their comma-separated keywords
+	PDFTitleField string
+	PDFKeywords   string
+
+	IdempotencyTTL     time.Duration
+	IdempotencyPersist bool
+
+	// GroqAPIKey is the key of the default LLM provider (API_1)
+	GroqAPIKey string
+	// GeminiAPIKey adds Gemini as a fallback provider when set (GEMINI_API_KEY)
+	GeminiAPIKey string
+	// OllamaURL adds a local Ollama server running OllamaModel as the last
+	// fallback (OLLAMA_BASE_URL, OLLAMA_MODEL)
+	OllamaURL   string
+	OllamaModel string
+	// Azure adds an Azure OpenAI deployment as a fallback when its endpoint is set
+	Azure azureOpenAIConfig
+	// ProviderMaxIdle removes LLM providers unused for longer than this
+	// (PROVIDER_MAX_IDLE_DURATION, a Go duration, 24h by default; 0 keeps them)
+	ProviderMaxIdle time.Duration
+	// LLMProvidersFile replaces the providers above with those of a JSON or
+	// YAML file, see llmpool.LoadConfig (LLM_PROVIDERS_FILE). It is reloaded
+	// when it changes, checked every LLMProvidersReload
+	// (LLM_PROVIDERS_RELOAD_INTERVAL, a Go duration; 0 disables reloading).
+	LLMProvidersFile   string
+	LLMProvidersReload time.Duration
+	// LLMCacheSize caches that many LLM replies by request for LLMCacheTTL
+	// (LLM_CACHE_SIZE, 0 disables; LLM_CACHE_TTL_SECONDS), only those of
+	// requests with temperature 0 if LLMCacheDeterministic
+	// (LLM_CACHE_DETERMINISTIC_ONLY)
+	LLMCacheSize          int
+	LLMCacheTTL           time.Duration
+	LLMCacheDeterministic bool
+	// LLMMonthlyBudgets caps the monthly spend of LLM providers, in dollars by
+	// provider name (LLM_MONTHLY_BUDGETS=groq-fast=50,gemini-flash=20)
+	LLMMonthlyBudgets map[string]float64
+	// AIValidationRetries is how many times /create/ai re-prompts the model
+	// when the generated template fails checkTemplate
+	AIValidationRetries int
+	// AIRefineMinRetained is the fraction of a template's placeholders that
+	// /create/ai/refine requires to survive a revision
+	AIRefineMinRetained float64
+	// AIStripExternal removes external stylesheets and sources from
+	// generated templates along with scripts
+	AIStripExternal bool
+	// PdftoppmPath is the poppler tool that rasterizes /create/ai reference PDFs
+	PdftoppmPath string
+	// AIAllowPromptOverride lets /create/ai requests replace the system prompt
+	AIAllowPromptOverride bool
+	// SessionTTL expires /sessions conversations unused for this long
+	// (SESSION_TTL_MINUTES); each keeps its last MaxTurns exchanges (MAX_TURNS)
+	SessionTTL time.Duration
+	MaxTurns   int
+}
+
+type browserConfig struct {
+	Path           string
+	Headless       bool
+	NoSandbox      bool
+	Flags          map[string]string
+	HealthInterval time.Duration
+	// RenderAttempts is how many times an HTML render is tried when the
+	// browser crashes under it
+	RenderAttempts int
+}
+
+type authConfig struct {
+	Enabled bool
+	// Keys and AdminKeys are "name:secret" entries; see loadAPIKeys
+	Keys            []string
+	AdminKeys       []string
+	KeysFile        string
+	Unauthenticated []string
+}
+
+type corsConfig struct {
+	Enabled bool
+	Origins []string
+	MaxAge  int
+}
+
+type cacheConfig struct {
+	Enabled    bool
+	MaxEntries int
+	TTL        time.Duration
+	// MaxAge is the Cache-Control max-age sent with PDFs
+	MaxAge int
+}
+
+type exchangeConfig struct {
+	// Provider is openexchangerates, fixer, mock or "" for no conversion
+	Provider string
+	APIKey   string
+	TTL      time.Duration
+	// MockRates are the mock provider's CODE=rate pairs against USD
+	MockRates string
+}
+
+type mailConfig struct {
+	// From is the sender address of invoice emails
+	From     string
+	SMTPHost string
+	SMTPPort int
+	SMTPUser string
+	SMTPPass string
+	// SendGridKey selects SendGrid over SMTP when set
+	SendGridKey string
+}
+
+type azureOpenAIConfig struct {
+	Endpoint   string
+	APIKey     string
+	Deployment string
+	APIVersion string
+}
+
+type storageConfig struct {
+	Region string
+	// Endpoint replaces AWS for S3-compatible stores (MinIO, R2, GCS)
+	Endpoint  string
+	PathStyle bool
+	// PresignTTL is how long returned download URLs stay valid
+	PresignTTL time.Duration
+	// Static credentials; without them the instance role is used
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type limitsConfig struct {
+	RenderConcurrency   int
+	RenderQueueMax      int
+	RenderQueueTimeout  time.Duration
+	KeyRateLimit        int
+	KeyRateLimits       map[string]int
+	InlineImageMaxBytes int64
+	InlineCSSMaxBytes   int64
+	AIImageMaxBytes     int
+	// MaxBodyBytes caps request bodies; MaxUploadBytes those of the routes
+	// that take images, PDFs and attachments
+	MaxBodyBytes   int
+	MaxUploadBytes int
+	// InjectCSSMaxBytes caps the inject_css render option
+	InjectCSSMaxBytes int
+	// InventoryMax caps the links and images listed by /extract include=
+	InventoryMax int
+	// PDFMaxBytes rejects larger generated PDFs; PDFWarnBytes logs a warning
+	PDFMaxBytes  int64
+	PDFWarnBytes int64
+}
+
+// envReader reads typed environment variables and collects every problem,
+// so a bad deployment gets one error listing all of them
+type envReader struct {
+	problems []string
+}
+
+func (r *envReader) problem(format string, args ...any) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+func (r *envReader) str(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+func (r *envReader) bool(name string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		r.problem("%s: %q is not a boolean", name, v)
+		return def
+	}
+	return b
+}
+
+// int reads a non-negative integer
+func (r *envReader) int(name string, def int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		r.problem("%s: %q is not a non-negative integer", name, v)
+		return def
+	}
+	return n
+}
+
+// float reads a non-negative number
+func (r *envReader) float(name string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		r.problem("%s: %q is not a non-negative number", name, v)
+		return def
+	}
+	return f
+}
+
+// duration reads a non-negative integer count of unit
+func (r *envReader) duration(name string, def int, unit time.Duration) time.Duration {
+	return time.Duration(r.int(name, def)) * unit
+}
+
+// goDuration reads a non-negative Go duration such as 90s or 24h
+func (r *envReader) goDuration(name string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		r.problem("%s: %q is not a non-negative duration such as 24h", name, v)
+		return def
+	}
+	return d
+}
+
+// list reads a comma-separated list, dropping empty entries
+func (r *envReader) list(name string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// defaultBrowserPath keeps the Edge install used on the original Windows
+// deployment; elsewhere rod finds (or downloads) a Chromium itself
+func defaultBrowserPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Program Files (x86)\Microsoft\Edge\Application\msedge.exe`
+	}
+	return ""
+}
+
+// loadConfig reads and validates the configuration
+func loadConfig() (*Config, error) {
+	r := &envReader{}
+	cfg := &Config{
+		LogLevel: strings.ToLower(r.str("LOG_LEVEL", "info")),
+		DBPath:   r.str("DB_PATH", "invoice.db"),
+		Listen: listenConfig{
+			Addr:           r.str("LISTEN_ADDR", ":8080"),
+			CertFile:       r.str("TLS_CERT_FILE", ""),
+			KeyFile:        r.str("TLS_KEY_FILE", ""),
+			TrustedProxies: r.list("TRUSTED_PROXIES"),
+		},
+		Browser: browserConfig{
+			Path:           r.str("BROWSER_PATH", defaultBrowserPath()),
+			Headless:       r.bool("BROWSER_HEADLESS", true),
+			NoSandbox:      r.bool("BROWSER_NO_SANDBOX", true),
+			Flags:          browserFlags(os.Getenv("BROWSER_FLAGS")),
+			HealthInterval: r.duration("BROWSER_HEALTH_INTERVAL_SEC", 60, time.Second),
+			RenderAttempts: r.int("BROWSER_RENDER_ATTEMPTS", 2),
+		},
+		Auth: authConfig{
+			Enabled:         r.bool("AUTH_ENABLED", true),
+			Keys:            r.list("API_KEYS"),
+			AdminKeys:       r.list("ADMIN_API_KEYS"),
+			KeysFile:        r.str("API_KEYS_FILE", ""),
+			Unauthenticated: r.list("UNAUTHENTICATED_ROUTES"),
+		},
+		CORS: corsConfig{
+			Enabled: r.bool("CORS_ENABLED", true),
+			Origins: r.list("CORS_ALLOWED_ORIGINS"),
+			MaxAge:  r.int("CORS_MAX_AGE", 600),
+		},
+		Cache: cacheConfig{
+			Enabled:    r.bool("PDF_CACHE_ENABLED", false),
+			MaxEntries: r.int("MAX_PDF_CACHE_ENTRIES", 100),
+			TTL:        r.duration("PDF_CACHE_TTL_SECONDS", 600, time.Second),
+			MaxAge:     r.int("PDF_CACHE_MAX_AGE", 0),
+		},
+		Limits: limitsConfig{
+			RenderConcurrency:   r.int("RENDER_CONCURRENCY", 1),
+			RenderQueueMax:      r.int("RENDER_QUEUE_MAX", 20),
+			RenderQueueTimeout:  r.duration("RENDER_QUEUE_TIMEOUT_MS", 30000, time.Millisecond),
+			KeyRateLimit:        r.int("API_KEY_RATE_LIMIT", 60),
+			KeyRateLimits:       make(map[string]int),
+			InlineImageMaxBytes: int64(r.int("INLINE_IMAGE_MAX_BYTES", 2<<20)),
+			InlineCSSMaxBytes:   int64(r.int("INLINE_CSS_MAX_BYTES", 1<<20)),
+			AIImageMaxBytes:     r.int("AI_IMAGE_MAX_BYTES", 2<<20),
+			InventoryMax:        r.int("EXTRACT_INVENTORY_MAX", 500),
+			MaxBodyBytes:        r.int("REQUEST_MAX_BODY_BYTES", 5<<20),
+			MaxUploadBytes:      r.int("REQUEST_MAX_UPLOAD_BYTES", 16<<20),
+			InjectCSSMaxBytes:   r.int("PDF_INJECT_CSS_MAX_BYTES", 50<<10),
+			PDFMaxBytes:         int64(r.int("PDF_MAX_SIZE_BYTES", 50<<20)),
+			PDFWarnBytes:        int64(r.int("PDF_WARN_SIZE_BYTES", 10<<20)),
+		},
+		Exchange: exchangeConfig{
+			Provider:  strings.ToLower(r.str("EXCHANGE_RATE_PROVIDER", "")),
+			APIKey:    r.str("EXCHANGE_RATE_API_KEY", ""),
+			TTL:       r.duration("EXCHANGE_RATE_TTL_MINUTES", 60, time.Minute),
+			MockRates: r.str("EXCHANGE_RATE_MOCK_RATES", ""),
+		},
+		Mail: mailConfig{
+			From:        r.str("EMAIL_FROM", ""),
+			SMTPHost:    r.str("SMTP_HOST", ""),
+			SMTPPort:    r.int("SMTP_PORT", 587),
+			SMTPUser:    r.str("SMTP_USER", ""),
+			SMTPPass:    r.str("SMTP_PASS", ""),
+			SendGridKey: r.str("SENDGRID_API_KEY", ""),
+		},
+		Storage: storageConfig{
+			Region:          r.str("AWS_REGION", r.str("AWS_DEFAULT_REGION", "us-east-1")),
+			Endpoint:        strings.TrimRight(r.str("S3_ENDPOINT", ""), "/"),
+			PathStyle:       r.bool("S3_FORCE_PATH_STYLE", false),
+			PresignTTL:      r.duration("S3_PRESIGN_TTL_SECONDS", 3600, time.Second),
+			AccessKeyID:     r.str("AWS_ACCESS_KEY_ID", ""),
+			SecretAccessKey: r.str("AWS_SECRET_ACCESS_KEY", ""),
+			SessionToken:    r.str("AWS_SESSION_TOKEN", ""),
+		},
+		Azure: azureOpenAIConfig{
+			Endpoint:   strings.TrimSuffix(r.str("AZURE_OPENAI_ENDPOINT", ""), "/"),
+			APIKey:     r.str("AZURE_OPENAI_API_KEY", ""),
+			Deployment: r.str("AZURE_OPENAI_DEPLOYMENT", ""),
+			APIVersion: r.str("AZURE_OPENAI_API_VERSION", ""),
+		},
+		AllowPrivateFetch:     r.bool("ALLOW_PRIVATE_FETCH", false),
+		WebhookSecret:         r.str("WEBHOOK_SECRET", ""),
+		IdempotencyTTL:        r.duration("IDEMPOTENCY_TTL_SECONDS", 86400, time.Second),
+		IdempotencyPersist:    r.bool("IDEMPOTENCY_PERSIST", false),
+		GroqAPIKey:            r.str("API_1", ""),
+		GeminiAPIKey:          r.str("GEMINI_API_KEY", ""),
+		OllamaURL:             strings.TrimSuffix(r.str("OLLAMA_BASE_URL", ""), "/"),
+		OllamaModel:           r.str("OLLAMA_MODEL", "llama3.2"),
+		ProviderMaxIdle:       r.goDuration("PROVIDER_MAX_IDLE_DURATION", 24*time.Hour),
+		LLMProvidersFile:      r.str("LLM_PROVIDERS_FILE", ""),
+		LLMProvidersReload:    r.goDuration("LLM_PROVIDERS_RELOAD_INTERVAL", 30*time.Second),
+		LLMCacheSize:          r.int("LLM_CACHE_SIZE", 0),
+		LLMCacheTTL:           r.duration("LLM_CACHE_TTL_SECONDS", 3600, time.Second),
+		LLMCacheDeterministic: r.bool("LLM_CACHE_DETERMINISTIC_ONLY", false),
+		AIValidationRetries:   r.int("AI_VALIDATION_RETRIES", 2),
+		AIRefineMinRetained:   r.float("AI_REFINE_MIN_RETAINED", 0.8),
+		AIStripExternal:       r.bool("AI_STRIP_EXTERNAL_RESOURCES", true),
+		AIAllowPromptOverride: r.bool("AI_ALLOW_PROMPT_OVERRIDE", false),
+		SessionTTL:            r.duration("SESSION_TTL_MINUTES", 30, time.Minute),
+		MaxTurns:              r.int("MAX_TURNS", 20),
+		PdftoppmPath:          r.str("PDFTOPPM_PATH", "pdftoppm"),
+		HolidaysFile:          r.str("HOLIDAYS_FILE", ""),
+		PDFTitleField:         r.str("PDF_METADATA_TITLE_FIELD", "invoice_number"),
+		PDFKeywords:           r.str("PDF_METADATA_KEYWORDS", ""),
+	}
+
+	switch metricsAuth := r.str("METRICS_AUTH", "admin"); metricsAuth {
+	case "admin":
+	case "none":
+		cfg.MetricsPublic = true
+	default:
+		r.problem("METRICS_AUTH: %q must be admin or none", metricsAuth)
+	}
+
+	for _, entry := range r.list("API_KEY_RATE_LIMITS") {
+		name, limit, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(limit)
+		if !ok || err != nil || n < 0 {
+			r.problem("API_KEY_RATE_LIMITS: %q must be name=requests_per_minute", entry)
+			continue
+		}
+		cfg.Limits.KeyRateLimits[name] = n
+	}
+
+	cfg.LLMMonthlyBudgets = make(map[string]float64)
+	for _, entry := range r.list("LLM_MONTHLY_BUDGETS") {
+		name, limit, ok := strings.Cut(entry, "=")
+		n, err := strconv.ParseFloat(limit, 64)
+		if !ok || err != nil || n <= 0 {
+			r.problem("LLM_MONTHLY_BUDGETS: %q must be provider=dollars", entry)
+			continue
+		}
+		cfg.LLMMonthlyBudgets[name] = n
+	}
+
+	cfg.validate(r)
+	if len(r.problems) > 0 {
+		return nil, errors.New("invalid configuration:\n  - " + strings.Join(r.problems, "\n  - "))
+	}
+	return cfg, nil
+}
+
+// validate checks values that depend on each other or on the filesystem
+func (cfg *Config) validate(r *envReader) {
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		r.problem("LOG_LEVEL: %q must be debug, info, warn or error", cfg.LogLevel)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Listen.Addr); err != nil {
+		r.problem("LISTEN_ADDR: %v", err)
+	}
+	if (cfg.Listen.CertFile == "") != (cfg.Listen.KeyFile == "") {
+		r.problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	} else if cfg.Listen.TLS() {
+		if _, err := tls.LoadX509KeyPair(cfg.Listen.CertFile, cfg.Listen.KeyFile); err != nil {
+			r.problem("loading TLS certificate %s / key %s: %v", cfg.Listen.CertFile, cfg.Listen.KeyFile, err)
+		}
+	}
+	for _, p := range cfg.Listen.TrustedProxies {
+		if strings.Contains(p, "/") {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				r.problem("TRUSTED_PROXIES: invalid entry %q", p)
+			}
+		} else if net.ParseIP(p) == nil {
+			r.problem("TRUSTED_PROXIES: invalid entry %q", p)
+		}
+	}
+
+	if cfg.Browser.Path != "" {
+		if _, err := os.Stat(cfg.Browser.Path); err != nil {
+			r.problem("BROWSER_PATH: %v", err)
+		}
+	}
+
+	if cfg.Auth.Enabled && len(cfg.Auth.Keys) == 0 && len(cfg.Auth.AdminKeys) == 0 && cfg.Auth.KeysFile == "" {
+		r.problem("auth is enabled but no API keys are configured; set API_KEYS or API_KEYS_FILE (or AUTH_ENABLED=false)")
+	}
+
+	for _, origin := range cfg.CORS.Origins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			r.problem("CORS_ALLOWED_ORIGINS: %q must look like https://example.com or https://*.example.com", origin)
+		}
+	}
+
+	if cfg.AIRefineMinRetained > 1 {
+		r.problem("AI_REFINE_MIN_RETAINED must be between 0 and 1")
+	}
+	if cfg.SessionTTL <= 0 || cfg.MaxTurns < 1 {
+		r.problem("SESSION_TTL_MINUTES and MAX_TURNS must be at least 1")
+	}
+
+	switch cfg.Exchange.Provider {
+	case "openexchangerates", "fixer":
+		if cfg.Exchange.APIKey == "" {
+			r.problem("EXCHANGE_RATE_API_KEY is required for EXCHANGE_RATE_PROVIDER=%s", cfg.Exchange.Provider)
+		}
+	case "", "mock":
+	default:
+		r.problem("EXCHANGE_RATE_PROVIDER: %q must be openexchangerates, fixer or mock", cfg.Exchange.Provider)
+	}
+
+	if cfg.Mail.SMTPHost != "" || cfg.Mail.SendGridKey != "" {
+		if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+			r.problem("EMAIL_FROM must be a valid address when SMTP_HOST or SENDGRID_API_KEY is set")
+		}
+	}
+
+	if (cfg.Storage.AccessKeyID == "") != (cfg.Storage.SecretAccessKey == "") {
+		r.problem("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set together")
+	}
+	if cfg.Storage.PresignTTL < time.Second || cfg.Storage.PresignTTL > maxPresignTTL {
+		r.problem("S3_PRESIGN_TTL_SECONDS must be between 1 and %d", int(maxPresignTTL.Seconds()))
+	}
+	if cfg.Storage.Endpoint != "" {
+		if u, err := url.Parse(cfg.Storage.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.problem("S3_ENDPOINT: %q must be an http(s) URL", cfg.Storage.Endpoint)
+		}
+	}
+	if cfg.OllamaURL != "" {
+		if u, err := url.Parse(cfg.OllamaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.problem("OLLAMA_BASE_URL: %q must be an http(s) URL", cfg.OllamaURL)
+		}
+	}
+	if cfg.LLMProvidersFile != "" {
+		if _, err := os.Stat(cfg.LLMProvidersFile); err != nil {
+			r.problem("LLM_PROVIDERS_FILE: %v", err)
+		}
+	}
+	if cfg.LLMCacheSize < 0 || cfg.LLMCacheSize > 0 && cfg.LLMCacheTTL <= 0 {
+		r.problem("LLM_CACHE_SIZE must not be negative, and LLM_CACHE_TTL_SECONDS at least 1 with a cache")
+	}
+	if cfg.Azure.Endpoint != "" && (cfg.Azure.APIKey == "" || cfg.Azure.Deployment == "") {
+		r.problem("AZURE_OPENAI_ENDPOINT requires AZURE_OPENAI_API_KEY and AZURE_OPENAI_DEPLOYMENT")
+	}
+
+	if cfg.Browser.RenderAttempts < 1 {
+		r.problem("BROWSER_RENDER_ATTEMPTS must be at least 1")
+	}
+	if cfg.Limits.MaxBodyBytes < 1 || cfg.Limits.MaxUploadBytes < 1 {
+		r.problem("REQUEST_MAX_BODY_BYTES and REQUEST_MAX_UPLOAD_BYTES must be at least 1")
+	}
+	if cfg.Limits.PDFMaxBytes < 1 || cfg.Limits.PDFWarnBytes < 1 {
+		r.problem("PDF_MAX_SIZE_BYTES and PDF_WARN_SIZE_BYTES must be at least 1")
+	}
+	if cfg.Limits.RenderConcurrency < 1 {
+		r.problem("RENDER_CONCURRENCY must be at least 1")
+	}
+}
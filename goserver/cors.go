@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Authorization, X-Requested-With, Idempotency-Key, X-Request-Id, If-None-Match"
+	corsExposeHeaders = "X-Request-Id, X-Cache, Idempotency-Replayed, ETag, Retry-After, Content-Disposition, X-Invoice-Due-Date"
+)
+
+// corsPolicy decides which browser origins may call the API
+type corsPolicy struct {
+	enabled bool
+	// anyOrigin answers every origin with "*"; only used when no list is configured
+	anyOrigin bool
+	exact     map[string]bool
+	// suffixes holds wildcard entries: "https://*.example.com" allows any
+	// subdomain of example.com over https, but not example.com itself
+	suffixes []corsSuffix
+	maxAge   int
+}
+
+type corsSuffix struct {
+	scheme string
+	suffix string
+}
+
+// newCORSPolicy builds the policy from CORS_ENABLED, CORS_ALLOWED_ORIGINS and CORS_MAX_AGE
+func newCORSPolicy(cfg corsConfig) *corsPolicy {
+	p := &corsPolicy{
+		enabled: cfg.Enabled,
+		exact:   make(map[string]bool),
+		maxAge:  cfg.MaxAge,
+	}
+	if !p.enabled {
+		return p
+	}
+
+	for _, origin := range cfg.Origins {
+		origin = strings.TrimRight(origin, "/")
+		switch {
+		case origin == "":
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "://*")
+			p.suffixes = append(p.suffixes, corsSuffix{scheme: strings.ToLower(scheme), suffix: strings.ToLower(host)})
+		default:
+			p.exact[strings.ToLower(origin)] = true
+		}
+	}
+
+	if len(p.exact) == 0 && len(p.suffixes) == 0 && !p.anyOrigin {
+		slog.Warn("CORS_ALLOWED_ORIGINS is not set; allowing requests from any origin")
+		p.anyOrigin = true
+	}
+	return p
+}
+
+// allowed reports whether origin may make cross-origin requests
+func (p *corsPolicy) allowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, s := range p.suffixes {
+		if u.Scheme == s.scheme && strings.HasSuffix(u.Host, s.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler is the CORS middleware. Disallowed origins get no CORS headers,
+// so the browser blocks the response, and their preflights are refused.
+func (p *corsPolicy) handler(res *fiber.Ctx) error {
+	if !p.enabled {
+		return res.Next()
+	}
+
+	origin := res.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		// Not a browser cross-origin request
+		return res.Next()
+	}
+
+	if !p.anyOrigin {
+		res.Vary(fiber.HeaderOrigin)
+	}
+
+	if !p.allowed(origin) {
+		if res.Method() == fiber.MethodOptions {
+			return sendError(res, 403, "Origin not allowed")
+		}
+		return res.Next()
+	}
+
+	if p.anyOrigin {
+		res.Set(fiber.HeaderAccessControlAllowOrigin, "*")
+	} else {
+		res.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+	}
+	res.Set(fiber.HeaderAccessControlExposeHeaders, corsExposeHeaders)
+
+	if res.Method() == fiber.MethodOptions {
+		res.Set(fiber.HeaderAccessControlAllowMethods, corsAllowMethods)
+		res.Set(fiber.HeaderAccessControlAllowHeaders, corsAllowHeaders)
+		if p.maxAge > 0 {
+			res.Set(fiber.HeaderAccessControlMaxAge, strconv.Itoa(p.maxAge))
+		}
+		return res.SendStatus(fiber.StatusNoContent)
+	}
+
+	return res.Next()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// db is the SQLite database shared by everything that persists state
+var db *sql.DB
+
+// migrations create the schema; each statement must be idempotent
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS api_usage (
+		key_name   TEXT PRIMARY KEY,
+		renders    INTEGER NOT NULL DEFAULT 0,
+		ai_calls   INTEGER NOT NULL DEFAULT 0,
+		pdf_bytes  INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key        TEXT PRIMARY KEY,
+		body_hash  TEXT NOT NULL,
+		status     INTEGER NOT NULL,
+		headers    TEXT NOT NULL,
+		body       BLOB NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS templates (
+		id           TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		html_content TEXT NOT NULL,
+		description  TEXT NOT NULL DEFAULT '',
+		created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS schedules (
+		id              TEXT PRIMARY KEY,
+		cron            TEXT NOT NULL,
+		recipient_email TEXT NOT NULL DEFAULT '',
+		storage         TEXT NOT NULL DEFAULT '',
+		request         TEXT NOT NULL,
+		last_run_at     DATETIME,
+		last_status     TEXT NOT NULL DEFAULT '',
+		last_error      TEXT NOT NULL DEFAULT '',
+		last_url        TEXT NOT NULL DEFAULT '',
+		created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+}
+
+// addedColumns are columns added to existing tables after they were
+// created. SQLite can't add a column only if it is missing, so openDB
+// checks for each first.
+var addedColumns = []struct{ table, column, definition string }{
+	{"templates", "tags", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// openDB opens (creating if needed) the SQLite file at path and applies migrations
+func openDB(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range migrations {
+		if _, err := conn.Exec(stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("migrating %s: %w", path, err)
+		}
+	}
+	for _, c := range addedColumns {
+		if err := addColumn(conn, c.table, c.column, c.definition); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("migrating %s: %w", path, err)
+		}
+	}
+	return conn, nil
+}
+
+// addColumn adds column to table unless it is already there
+func addColumn(conn *sql.DB, table, column, definition string) error {
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = conn.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultPDFFilename = "result.pdf"
+	// maxFilenameRunes caps a sanitized filename, extension included
+	maxFilenameRunes = 150
+)
+
+// checkDisposition rejects Content-Disposition types other than inline and attachment
+func checkDisposition(d string) error {
+	switch d {
+	case "", "inline", "attachment":
+		return nil
+	}
+	return fmt.Errorf("disposition must be inline or attachment")
+}
+
+// sanitizeFilename makes a caller-supplied name safe for a header: control
+// and bidi override characters are dropped, path separators replaced, the
+// length capped and a .pdf extension enforced. Non-ASCII letters are kept.
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), isBidiControl(r):
+		case r == '/' || r == '\\':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	base := strings.TrimSpace(b.String())
+	if strings.HasSuffix(strings.ToLower(base), ".pdf") {
+		base = base[:len(base)-len(".pdf")]
+	}
+	base = strings.Trim(base, " .")
+
+	if runes := []rune(base); len(runes) > maxFilenameRunes-len(".pdf") {
+		base = strings.TrimRight(string(runes[:maxFilenameRunes-len(".pdf")]), " .")
+	}
+	if base == "" {
+		return defaultPDFFilename
+	}
+	return base + ".pdf"
+}
+
+// filenameFromPattern evaluates a filename containing text/template
+// actions, such as "invoice-{{.invoice_number}}.pdf", against data. Path
+// separators and control characters are removed from the result. A pattern
+// that fails to parse or execute, or that comes out empty, gives
+// "invoice-<unix time>.pdf". Names without actions are returned unchanged.
+func filenameFromPattern(pattern string, data map[string]any) string {
+	if !strings.Contains(pattern, "{{") {
+		return pattern
+	}
+	fallback := fmt.Sprintf("invoice-%d.pdf", time.Now().Unix())
+
+	tpl, err := template.New("filename").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return fallback
+	}
+	var b strings.Builder
+	if err := tpl.Execute(&limitedWriter{w: &b, n: 4 * maxFilenameRunes}, data); err != nil {
+		return fallback
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, b.String())
+	name = strings.TrimSpace(name)
+	if strings.Trim(strings.TrimSuffix(strings.ToLower(name), ".pdf"), " .") == "" {
+		return fallback
+	}
+	return name
+}
+
+// limitedWriter fails once more than n bytes are written, so a pattern
+// ranging over large data can't build a huge name
+type limitedWriter struct {
+	w interface{ WriteString(string) (int, error) }
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, fmt.Errorf("filename is too long")
+	}
+	l.n -= len(p)
+	return l.w.WriteString(string(p))
+}
+
+// isBidiControl matches the embedding, override and isolate characters that
+// can make "invoice<RLO>fdp.exe" display as "invoiceexe.pdf"
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// contentDisposition builds the header value per RFC 6266: a quoted ASCII
+// filename for old clients plus filename* (RFC 5987) when the name has
+// non-ASCII characters
+func contentDisposition(disposition, filename string) string {
+	if disposition == "" {
+		disposition = "inline"
+	}
+	filename = sanitizeFilename(filename)
+
+	var ascii strings.Builder
+	nonASCII := false
+	for _, r := range filename {
+		switch {
+		case r > unicode.MaxASCII:
+			ascii.WriteByte('_')
+			nonASCII = true
+		case r == '"':
+			ascii.WriteByte('\'')
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+
+	value := disposition + `; filename="` + ascii.String() + `"`
+	if nonASCII {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes everything outside RFC 5987's attr-char set
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xF])
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		filename    string
+		want        string
+	}{
+		{"default inline", "", "invoice.pdf", `inline; filename="invoice.pdf"`},
+		{"attachment", "attachment", "invoice", `attachment; filename="invoice.pdf"`},
+		{"empty name", "", "", `inline; filename="result.pdf"`},
+		{"CRLF header injection", "attachment", "a\r\nSet-Cookie: x=1.pdf", `attachment; filename="aSet-Cookie: x=1.pdf"`},
+		{"bare LF", "", "a\nb.pdf", `inline; filename="ab.pdf"`},
+		{"NUL and tab", "", "a\x00b\tc.pdf", `inline; filename="abc.pdf"`},
+		{"quotes", "", `say "hi".pdf`, `inline; filename="say 'hi'.pdf"`},
+		{"path separators", "", `../etc\passwd`, `inline; filename="_etc_passwd.pdf"`},
+		{"bidi override", "", "invoice\u202efdp.exe", `inline; filename="invoicefdp.exe.pdf"`},
+		{"invalid UTF-8", "", "in\xffvoice.pdf", `inline; filename="invoice.pdf"`},
+		{"UTF-8 umlaut", "attachment", "Rechnung-März.pdf", `attachment; filename="Rechnung-M_rz.pdf"; filename*=UTF-8''Rechnung-M%C3%A4rz.pdf`},
+		{"UTF-8 with spaces", "", "Facture été.pdf", `inline; filename="Facture _t_.pdf"; filename*=UTF-8''Facture%20%C3%A9t%C3%A9.pdf`},
+		{"UTF-8 CJK", "", "请求.pdf", `inline; filename="__.pdf"; filename*=UTF-8''%E8%AF%B7%E6%B1%82.pdf`},
+		{"UTF-8 with CRLF", "", "Über\r\nX: y.pdf", `inline; filename="_berX: y.pdf"; filename*=UTF-8''%C3%9CberX%3A%20y.pdf`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition(tt.disposition, tt.filename)
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if strings.ContainsAny(got, "\r\n\x00") {
+				t.Errorf("header value %q contains control characters", got)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	got := sanitizeFilename(strings.Repeat("ä", 200) + ".pdf")
+	if n := len([]rune(got)); n != maxFilenameRunes {
+		t.Errorf("got %d runes, want %d", n, maxFilenameRunes)
+	}
+	if !strings.HasSuffix(got, ".pdf") {
+		t.Errorf("%q lost its extension", got)
+	}
+}
+
+func TestFilenameFromPattern(t *testing.T) {
+	data := map[string]any{"invoice_number": "INV-7", "customer": "a/b\r\nc"}
+
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"invoice.pdf", "invoice.pdf"},
+		{"invoice-{{.invoice_number}}.pdf", "invoice-INV-7.pdf"},
+		{"{{.customer}}.pdf", "abc.pdf"},
+	}
+	for _, tt := range tests {
+		if got := filenameFromPattern(tt.pattern, data); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{"{{.missing}}.pdf", "{{.invoice_number", "{{\"\"}}.pdf"} {
+		if got := filenameFromPattern(pattern, data); !strings.HasPrefix(got, "invoice-") || got == "invoice-INV-7.pdf" {
+			t.Errorf("%q: got %q, want the invoice-<time>.pdf fallback", pattern, got)
+		}
+	}
+}
+
+func TestCheckDisposition(t *testing.T) {
+	for _, d := range []string{"", "inline", "attachment"} {
+		if err := checkDisposition(d); err != nil {
+			t.Errorf("%q: %v", d, err)
+		}
+	}
+	for _, d := range []string{"Inline", "form-data", "attachment\r\nX: y"} {
+		if err := checkDisposition(d); err == nil {
+			t.Errorf("%q: no error", d)
+		}
+	}
+}
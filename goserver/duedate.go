@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// isoDate is the layout dates are accepted and, by default, formatted in
+const isoDate = "2006-01-02"
+
+// dueDateOptions is the due_date_calculation field of POST /invoice
+type dueDateOptions struct {
+	// InvoiceDate defaults to data.invoice_date, then to today (UTC)
+	InvoiceDate string `json:"invoice_date,omitempty"`
+	NetDays     int    `json:"net_days"`
+	// EndOfMonth counts the net days from the end of the invoice month ("net 30 EOM")
+	EndOfMonth   bool `json:"end_of_month,omitempty"`
+	SkipWeekends bool `json:"skip_weekends,omitempty"`
+	// SkipHolidaysCountry moves the due date past that country's public holidays
+	SkipHolidaysCountry string `json:"skip_holidays_country,omitempty"`
+	// DateFormat is how due_date is written, e.g. DD/MM/YYYY; default YYYY-MM-DD
+	DateFormat string `json:"date_format,omitempty"`
+}
+
+// dateFormatTokens translates DateFormat to a Go layout
+var dateFormatTokens = strings.NewReplacer("YYYY", "2006", "MMMM", "January", "MMM", "Jan", "MM", "01", "DD", "02")
+
+func (o *dueDateOptions) validate() error {
+	if o.NetDays < 0 || o.NetDays > 365 {
+		return errors.New("due_date_calculation.net_days must be between 0 and 365")
+	}
+	o.SkipHolidaysCountry = strings.ToUpper(o.SkipHolidaysCountry)
+	if o.SkipHolidaysCountry != "" && !holidayCountries[o.SkipHolidaysCountry] {
+		return fmt.Errorf("due_date_calculation.skip_holidays_country %q is not supported; supported: %s",
+			o.SkipHolidaysCountry, holidayCountryList())
+	}
+	return nil
+}
+
+// layout is the Go layout for DateFormat
+func (o *dueDateOptions) layout() string {
+	if o.DateFormat == "" {
+		return isoDate
+	}
+	return dateFormatTokens.Replace(o.DateFormat)
+}
+
+// calculateDueDate sets data.due_date from the options and returns it. The
+// invoice date is parsed as YYYY-MM-DD or in DateFormat.
+func calculateDueDate(data map[string]any, opts dueDateOptions) (string, error) {
+	raw := opts.InvoiceDate
+	if raw == "" {
+		raw, _ = data["invoice_date"].(string)
+	}
+
+	start := time.Now().UTC().Truncate(24 * time.Hour)
+	if raw != "" {
+		var err error
+		if start, err = time.Parse(isoDate, raw); err != nil {
+			if start, err = time.Parse(opts.layout(), raw); err != nil {
+				return "", fmt.Errorf("due_date_calculation: invoice_date %q is not a YYYY-MM-DD date", raw)
+			}
+		}
+	}
+
+	if opts.EndOfMonth {
+		start = time.Date(start.Year(), start.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	}
+	due := start.AddDate(0, 0, opts.NetDays)
+	for (opts.SkipWeekends && isWeekend(due)) || isHoliday(opts.SkipHolidaysCountry, due) {
+		due = due.AddDate(0, 0, 1)
+	}
+
+	formatted := due.Format(opts.layout())
+	data["due_date"] = formatted
+	return formatted, nil
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
+
+// holidayRule produces one holiday in a given year
+type holidayRule func(year int) time.Time
+
+// fixed is a holiday on the same date every year
+func fixed(month time.Month, day int) holidayRule {
+	return func(year int) time.Time { return time.Date(year, month, day, 0, 0, 0, 0, time.UTC) }
+}
+
+// nthWeekday is the nth weekday of a month; n = -1 is the last one
+func nthWeekday(n int, weekday time.Weekday, month time.Month) holidayRule {
+	return func(year int) time.Time {
+		if n < 0 {
+			last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+			return last.AddDate(0, 0, -((int(last.Weekday()) - int(weekday) + 7) % 7))
+		}
+		first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		return first.AddDate(0, 0, (int(weekday)-int(first.Weekday())+7)%7+7*(n-1))
+	}
+}
+
+// easter is a holiday offset days from Easter Sunday
+func easter(offset int) holidayRule {
+	return func(year int) time.Time { return easterSunday(year).AddDate(0, 0, offset) }
+}
+
+// easterSunday uses the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+	a, b, c := year%19, year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// holidayRules are the national public holidays built in; dates are not
+// moved to observed days, and regional holidays are left to HOLIDAYS_FILE
+var holidayRules = map[string][]holidayRule{
+	"US": {
+		fixed(time.January, 1), nthWeekday(3, time.Monday, time.January), nthWeekday(3, time.Monday, time.February),
+		nthWeekday(-1, time.Monday, time.May), fixed(time.June, 19), fixed(time.July, 4),
+		nthWeekday(1, time.Monday, time.September), nthWeekday(2, time.Monday, time.October),
+		fixed(time.November, 11), nthWeekday(4, time.Thursday, time.November), fixed(time.December, 25),
+	},
+	"GB": {
+		fixed(time.January, 1), easter(-2), easter(1), nthWeekday(1, time.Monday, time.May),
+		nthWeekday(-1, time.Monday, time.May), nthWeekday(-1, time.Monday, time.August),
+		fixed(time.December, 25), fixed(time.December, 26),
+	},
+	"DE": {
+		fixed(time.January, 1), easter(-2), easter(1), fixed(time.May, 1), easter(39), easter(50),
+		fixed(time.October, 3), fixed(time.December, 25), fixed(time.December, 26),
+	},
+	"FR": {
+		fixed(time.January, 1), easter(1), fixed(time.May, 1), fixed(time.May, 8), easter(39), easter(50),
+		fixed(time.July, 14), fixed(time.August, 15), fixed(time.November, 1), fixed(time.November, 11),
+		fixed(time.December, 25),
+	},
+	"IN": {
+		fixed(time.January, 26), fixed(time.August, 15), fixed(time.October, 2),
+	},
+}
+
+var (
+	// extraHolidays are the dates from HOLIDAYS_FILE, by country
+	extraHolidays = map[string]map[string]bool{}
+	// holidayCountries are the countries with built-in or configured holidays
+	holidayCountries = map[string]bool{}
+)
+
+func init() {
+	for country := range holidayRules {
+		holidayCountries[country] = true
+	}
+}
+
+// isHoliday reports whether t is a public holiday in country; "" has none
+func isHoliday(country string, t time.Time) bool {
+	if country == "" {
+		return false
+	}
+	if extraHolidays[country][t.Format(isoDate)] {
+		return true
+	}
+	for _, rule := range holidayRules[country] {
+		if rule(t.Year()).Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func holidayCountryList() string {
+	codes := make([]string, 0, len(holidayCountries))
+	for code := range holidayCountries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ", ")
+}
+
+// loadHolidays reads HOLIDAYS_FILE: one "COUNTRY YYYY-MM-DD" per line, with
+// blank lines and # comments ignored. Countries not built in become
+// available for skip_holidays_country.
+func loadHolidays(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading HOLIDAYS_FILE: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("HOLIDAYS_FILE line %d: want \"COUNTRY YYYY-MM-DD\"", n)
+		}
+		if _, err := time.Parse(isoDate, fields[1]); err != nil {
+			return fmt.Errorf("HOLIDAYS_FILE line %d: %q is not a YYYY-MM-DD date", n, fields[1])
+		}
+		country := strings.ToUpper(fields[0])
+		if extraHolidays[country] == nil {
+			extraHolidays[country] = make(map[string]bool)
+		}
+		extraHolidays[country][fields[1]] = true
+		holidayCountries[country] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading HOLIDAYS_FILE: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errRatesNotConfigured is returned when a conversion is asked for but
+	// EXCHANGE_RATE_PROVIDER is unset
+	errRatesNotConfigured = errors.New("currency conversion is not configured; set EXCHANGE_RATE_PROVIDER")
+	// errUnknownCurrency is returned for currency codes the provider has no rate for
+	errUnknownCurrency = errors.New("unknown currency")
+	// errRatesUnavailable wraps failures to fetch rates
+	errRatesUnavailable = errors.New("exchange rates unavailable")
+)
+
+// exchangeErrorStatus maps a rate lookup error to a response status
+func exchangeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownCurrency):
+		return 400
+	case errors.Is(err, errRatesNotConfigured):
+		return 503
+	default:
+		return 502
+	}
+}
+
+// rateTable is a set of rates against one base currency
+type rateTable struct {
+	base  string
+	rates map[string]float64
+}
+
+// rateSource fetches the latest rate table
+type rateSource interface {
+	latest(ctx context.Context) (rateTable, error)
+}
+
+// exchangeRates caches a source's table for ttl. A nil source means
+// conversion is disabled.
+type exchangeRates struct {
+	source rateSource
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	table   rateTable
+	fetched time.Time
+}
+
+// rates is the server's exchange rate cache, set up from the config in main
+var rates = &exchangeRates{}
+
+// newExchangeRates builds the cache for the configured provider
+func newExchangeRates(cfg exchangeConfig) (*exchangeRates, error) {
+	r := &exchangeRates{ttl: cfg.TTL}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	switch cfg.Provider {
+	case "":
+	case "openexchangerates":
+		r.source = &httpRateSource{
+			client: client,
+			url:    "https://openexchangerates.org/api/latest.json?app_id=" + url.QueryEscape(cfg.APIKey),
+		}
+	case "fixer":
+		r.source = &httpRateSource{
+			client: client,
+			url:    "https://data.fixer.io/api/latest?access_key=" + url.QueryEscape(cfg.APIKey),
+		}
+	case "mock":
+		table, err := parseMockRates(cfg.MockRates)
+		if err != nil {
+			return nil, err
+		}
+		r.source = staticRates(table)
+	default:
+		return nil, fmt.Errorf("EXCHANGE_RATE_PROVIDER: %q must be openexchangerates, fixer or mock", cfg.Provider)
+	}
+	return r, nil
+}
+
+// rate returns how many units of to one unit of from is worth
+func (r *exchangeRates) rate(ctx context.Context, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if r.source == nil {
+		return 0, errRatesNotConfigured
+	}
+
+	table, err := r.current(ctx)
+	if err != nil {
+		return 0, err
+	}
+	fromRate, toRate := table.get(from), table.get(to)
+	switch {
+	case fromRate == 0:
+		return 0, fmt.Errorf("%w %s", errUnknownCurrency, from)
+	case toRate == 0:
+		return 0, fmt.Errorf("%w %s", errUnknownCurrency, to)
+	}
+	// Free plans only quote against one base, so convert through it
+	return toRate / fromRate, nil
+}
+
+func (t rateTable) get(currency string) float64 {
+	if currency == t.base {
+		return 1
+	}
+	return t.rates[currency]
+}
+
+// current returns the cached table, fetching it when it is older than ttl.
+// A failed fetch is an error even when an expired table is cached.
+func (r *exchangeRates) current(ctx context.Context) (rateTable, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.table.rates != nil && time.Since(r.fetched) < r.ttl {
+		return r.table, nil
+	}
+	table, err := r.source.latest(ctx)
+	if err != nil {
+		return rateTable{}, fmt.Errorf("%w: %v", errRatesUnavailable, err)
+	}
+	r.table, r.fetched = table, time.Now()
+	return table, nil
+}
+
+// httpRateSource reads the "latest" endpoint of Open Exchange Rates or
+// Fixer, which share a response shape
+type httpRateSource struct {
+	client *http.Client
+	url    string
+}
+
+func (s *httpRateSource) latest(ctx context.Context) (rateTable, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return rateTable{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return rateTable{}, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Base  string             `json:"base"`
+		Rates map[string]float64 `json:"rates"`
+		// Fixer reports errors in a 200 response
+		Success *bool `json:"success"`
+		Error   any   `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return rateTable{}, fmt.Errorf("status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || (body.Success != nil && !*body.Success) {
+		return rateTable{}, fmt.Errorf("status %d: %v", resp.StatusCode, body.Error)
+	}
+	if body.Base == "" || len(body.Rates) == 0 {
+		return rateTable{}, errors.New("response has no rates")
+	}
+	return rateTable{base: body.Base, rates: body.Rates}, nil
+}
+
+// staticRates is the mock provider, for tests and offline use
+type staticRates rateTable
+
+func (s staticRates) latest(context.Context) (rateTable, error) {
+	return rateTable(s), nil
+}
+
+// parseMockRates reads EXCHANGE_RATE_MOCK_RATES: comma-separated CODE=rate
+// pairs against USD, e.g. "EUR=0.92,GBP=0.79"
+func parseMockRates(list string) (rateTable, error) {
+	table := rateTable{base: "USD", rates: map[string]float64{}}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(pair, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || rate <= 0 {
+			return rateTable{}, fmt.Errorf("EXCHANGE_RATE_MOCK_RATES: %q must be CODE=rate", pair)
+		}
+		table.rates[strings.ToUpper(strings.TrimSpace(code))] = rate
+	}
+	return table, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// faviconMaxBytes caps a favicon downloaded for include_favicon_data
+	faviconMaxBytes = 512 << 10
+	// faviconFetchTimeout bounds the whole favicon download, fallbacks included
+	faviconFetchTimeout = 5 * time.Second
+)
+
+// addFaviconData downloads the page's favicon and adds it to meta as
+// favicon_data and favicon_size. The declared icon is tried first, then
+// /favicon.ico on the page's origin; if neither works meta keeps just the URL.
+func addFaviconData(ctx context.Context, meta fiber.Map, pageURL string) {
+	ctx, cancel := context.WithTimeout(ctx, faviconFetchTimeout)
+	defer cancel()
+
+	var candidates []string
+	if favicon, _ := meta["favicon"].(string); favicon != "" {
+		candidates = append(candidates, favicon)
+	}
+	if u, err := url.Parse(pageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		candidates = append(candidates, (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/favicon.ico"}).String())
+	}
+
+	for _, src := range candidates {
+		data, err := faviconBytes(ctx, src)
+		if err != nil {
+			slog.DebugContext(ctx, "favicon fetch failed", "url", src, "error", err)
+			continue
+		}
+		mediaType, ok := faviconMediaType(data.body, data.contentType)
+		if !ok {
+			slog.DebugContext(ctx, "favicon is not an image", "url", src, "content_type", data.contentType)
+			continue
+		}
+		meta["favicon_data"] = "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data.body)
+		meta["favicon_size"] = len(data.body)
+		return
+	}
+}
+
+type faviconFile struct {
+	body        []byte
+	contentType string
+}
+
+// faviconBytes reads an icon from a data: URL or over the network, with the
+// same private address rules as the other server-side fetches
+func faviconBytes(ctx context.Context, src string) (faviconFile, error) {
+	if strings.HasPrefix(src, "data:") {
+		body, contentType, err := decodeDataURL(src, faviconMaxBytes)
+		return faviconFile{body, contentType}, err
+	}
+	body, contentType, err := fetchURL(ctx, src, faviconMaxBytes)
+	return faviconFile{body, contentType}, err
+}
+
+// faviconMediaType settles the type of an icon. Servers often send ICO and
+// SVG files as octet-stream or XML, so those are recognised by content.
+func faviconMediaType(body []byte, contentType string) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "image/vnd.microsoft.icon" || bytes.HasPrefix(body, []byte{0, 0, 1, 0}):
+		return "image/x-icon", true
+	case mediaType == "image/svg+xml" || bytes.Contains(bytes.ToLower(body[:min(len(body), 1024)]), []byte("<svg")):
+		return "image/svg+xml", true
+	case strings.HasPrefix(mediaType, "image/"):
+		return mediaType, true
+	}
+	if sniffed := http.DetectContentType(body); strings.HasPrefix(sniffed, "image/") {
+		return sniffed, true
+	}
+	return "", false
+}
+
+// decodeDataURL returns the payload and media type of a base64 or
+// percent-encoded data: URL
+func decodeDataURL(src string, maxBytes int) ([]byte, string, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(src, "data:"), ",")
+	if !ok {
+		return nil, "", errors.New("malformed data URL")
+	}
+	var body []byte
+	if mediaType, isBase64 := strings.CutSuffix(header, ";base64"); isBase64 {
+		if base64.StdEncoding.DecodedLen(len(payload)) > maxBytes+3 {
+			return nil, "", fmt.Errorf("data URL is larger than %d bytes", maxBytes)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, "", errors.New("data URL is not valid base64")
+		}
+		body, header = decoded, mediaType
+	} else {
+		decoded, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, "", err
+		}
+		body = []byte(decoded)
+	}
+	if len(body) > maxBytes {
+		return nil, "", fmt.Errorf("data URL is larger than %d bytes", maxBytes)
+	}
+	return body, header, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// allowPrivateFetch disables the private address check (ALLOW_PRIVATE_FETCH)
+var allowPrivateFetch bool
+
+// errPrivateAddress is returned when a server-side fetch would reach an internal address
+var errPrivateAddress = errors.New("fetching private or loopback addresses is not allowed")
+
+// fetchClient is used for every server-side fetch of user-supplied URLs.
+// Its dialer refuses internal addresses (unless ALLOW_PRIVATE_FETCH=true) so
+// the HTML preprocessors can't be used to probe the local network. It
+// never uses a proxy: the dialer would then check the proxy's address
+// rather than the target's.
+var fetchClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if allowPrivateFetch {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConns:        20,
+		IdleConnTimeout:     30 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// isPrivateIP reports whether ip is loopback, link-local, private or unspecified
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkPublicURL fails unless rawURL is http(s) and its host resolves only
+// to public addresses, for URLs the browser loads rather than fetchClient.
+// Chromium resolves the name again, so this can't stop DNS rebinding.
+func checkPublicURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if allowPrivateFetch {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// fetchURL GETs an http(s) URL and returns its body and Content-Type,
+// failing if the body is larger than maxBytes
+func fetchURL(ctx context.Context, rawURL string, maxBytes int64) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned status %d", rawURL, resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", fmt.Errorf("%s is larger than %d bytes", rawURL, maxBytes)
+	}
+
+	// Read one byte past the limit so oversized bodies without a length are caught
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, "", fmt.Errorf("%s is larger than %d bytes", rawURL, maxBytes)
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
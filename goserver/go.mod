@@ -7,9 +7,19 @@ require (
 	github.com/gofiber/fiber/v2 v2.52.9
 )
 
+require github.com/mattn/go-sqlite3 v1.14.22
+
+require github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+
+require github.com/boombuler/barcode v1.0.1
+
+require github.com/robfig/cron/v3 v3.0.1
+
+require gopkg.in/yaml.v3 v3.0.1
+
 require (
 	github.com/andybalholm/brotli v1.1.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
 	github.com/klauspost/compress v1.17.9 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// browserProbeTimeout bounds the readiness check against the browser, and
+// dbProbeTimeout the one against SQLite
+const (
+	browserProbeTimeout = 2 * time.Second
+	dbProbeTimeout      = 2 * time.Second
+)
+
+// probeBrowser checks that the browser answers over CDP. It never takes the
+// render lock, so a long render can't make the probe fail.
+func probeBrowser() fiber.Map {
+	b := currentBrowser()
+	if b == nil {
+		return fiber.Map{"status": "down", "error": "browser not started"}
+	}
+	version, err := b.Timeout(browserProbeTimeout).Version()
+	if err != nil {
+		return fiber.Map{"status": "down", "error": err.Error()}
+	}
+	return fiber.Map{"status": "up", "version": version.Product}
+}
+
+// probePool reports the LLM pool state: "up" when a provider can take a
+// request, "degraded" when every provider is rate limited, "down" when empty
+func probePool(pool *llmpool.Pool) fiber.Map {
+	total := pool.ProviderCount()
+	available := pool.AvailableProviderCount()
+
+	status := "up"
+	switch {
+	case !pool.IsHealthy():
+		status = "down"
+	case available == 0:
+		status = "degraded"
+	}
+	return fiber.Map{"status": status, "providers": total, "available": available}
+}
+
+// probeDB pings the SQLite database
+func probeDB(ctx context.Context) fiber.Map {
+	if db == nil {
+		return fiber.Map{"status": "down", "error": "database not opened"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbProbeTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return fiber.Map{"status": "down", "error": err.Error()}
+	}
+	return fiber.Map{"status": "up"}
+}
+
+// healthz only says the process is serving requests
+func healthz(res *fiber.Ctx) error {
+	return res.JSON(fiber.Map{"status": "ok"})
+}
+
+// readyz probes the browser and the LLM pool. A degraded pool still reports
+// 200 so PDF traffic keeps flowing while AI generation waits for capacity.
+func readyz(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		browserStatus := probeBrowser()
+		poolStatus := probePool(pool)
+
+		status := "ready"
+		code := fiber.StatusOK
+		switch {
+		case browserStatus["status"] != "up" || poolStatus["status"] == "down":
+			status = "unavailable"
+			code = fiber.StatusServiceUnavailable
+		case poolStatus["status"] == "degraded":
+			status = "degraded"
+		}
+
+		return res.Status(code).JSON(fiber.Map{
+			"status":  status,
+			"browser": browserStatus,
+			"llm":     poolStatus,
+		})
+	}
+}
+
+// healthReady is the strict readiness probe for orchestrators: 200 only
+// while the browser is up, a provider can take a request right now and the
+// database answers. Unlike readyz, a rate limited pool counts as not ready.
+func healthReady(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		browserStatus := probeBrowser()
+		poolStatus := probePool(pool)
+		dbStatus := probeDB(res.UserContext())
+
+		status := "ready"
+		code := fiber.StatusOK
+		if browserStatus["status"] != "up" || poolStatus["status"] != "up" || dbStatus["status"] != "up" {
+			status = "unavailable"
+			code = fiber.StatusServiceUnavailable
+		}
+
+		return res.Status(code).JSON(fiber.Map{
+			"status":   status,
+			"browser":  browserStatus,
+			"llm":      poolStatus,
+			"database": dbStatus,
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// idempotencyStore remembers the response produced for an Idempotency-Key so
+// retried POSTs can be answered without rendering again. Entries live in
+// memory and, when conn is set, are written through to SQLite so replays
+// survive a restart.
+type idempotencyStore struct {
+	ttl     time.Duration
+	paths   map[string]bool
+	entries map[string]*idempotencyEntry
+	conn    *sql.DB
+	mu      sync.Mutex
+}
+
+// idempotencyEntry is a stored response. A pending entry marks a request
+// that is still being processed.
+type idempotencyEntry struct {
+	bodyHash string
+	pending  bool
+	status   int
+	headers  map[string]string
+	body     []byte
+	expires  time.Time
+}
+
+// skipReplayHeaders are response headers that belong to the individual
+// request rather than the stored response
+var skipReplayHeaders = map[string]bool{
+	"Content-Length": true,
+	"Date":           true,
+	"Server":         true,
+	"Vary":           true,
+	"X-Request-Id":   true,
+}
+
+func newIdempotencyStore(ttl time.Duration, conn *sql.DB, paths ...string) *idempotencyStore {
+	s := &idempotencyStore{
+		ttl:     ttl,
+		paths:   make(map[string]bool),
+		entries: make(map[string]*idempotencyEntry),
+		conn:    conn,
+	}
+	for _, p := range paths {
+		s.paths[p] = true
+	}
+	go s.sweepLoop()
+	return s
+}
+
+// handler is middleware for POST requests to the configured paths carrying an
+// Idempotency-Key header. Keys are scoped to the caller's API key; reusing a
+// key with a different body is rejected with 422, and reusing it while the
+// first request is still running with 409.
+func (s *idempotencyStore) handler(res *fiber.Ctx) error {
+	idemKey := res.Get("Idempotency-Key")
+	if idemKey == "" || res.Method() != fiber.MethodPost || !s.paths[res.Path()] {
+		return res.Next()
+	}
+	if len(idemKey) > 255 {
+		return sendError(res, 400, "Idempotency-Key must be at most 255 characters")
+	}
+
+	key := keyName(res) + "\x00" + idemKey
+	sum := sha256.Sum256(res.Body())
+	bodyHash := hex.EncodeToString(sum[:])
+
+	entry, reserved := s.begin(key, bodyHash)
+	switch {
+	case reserved:
+	case entry.bodyHash != bodyHash:
+		return sendError(res, 422, "Idempotency-Key was already used with a different request body")
+	case entry.pending:
+		return sendError(res, 409, "A request with this Idempotency-Key is still in progress")
+	default:
+		return s.replay(res, entry)
+	}
+
+	err := res.Next()
+
+	// Server failures are not stored, so the client can retry them, and a 304
+	// only means something to the conditional request that produced it
+	status := res.Response().StatusCode()
+	if err != nil || status >= 500 || status == fiber.StatusNotModified {
+		s.abandon(key)
+		return err
+	}
+
+	// Body() drains a streamed response into memory so it can be kept. A
+	// stream that failed part way leaves a 200 with a cut-off body, which
+	// must not be replayed; the client gets the error instead.
+	body := append([]byte(nil), res.Response().Body()...)
+	if streamErr, ok := res.Locals("pdf_stream_error").(error); ok {
+		s.abandon(key)
+		res.Response().Header.Del(fiber.HeaderContentDisposition)
+		return sendError(res, renderErrorStatus(streamErr), streamErr.Error())
+	}
+	headers := make(map[string]string)
+	res.Response().Header.VisitAll(func(k, v []byte) {
+		name := string(k)
+		if !skipReplayHeaders[name] && !strings.HasPrefix(name, "Access-Control-") {
+			headers[name] = string(v)
+		}
+	})
+	s.complete(key, &idempotencyEntry{
+		bodyHash: bodyHash,
+		status:   status,
+		headers:  headers,
+		body:     body,
+		expires:  time.Now().Add(s.ttl),
+	})
+	return nil
+}
+
+// replay writes a stored response
+func (s *idempotencyStore) replay(res *fiber.Ctx, entry *idempotencyEntry) error {
+	for k, v := range entry.headers {
+		res.Set(k, v)
+	}
+	res.Set("Idempotency-Replayed", "true")
+	return res.Status(entry.status).Send(entry.body)
+}
+
+// begin returns the live entry for key, or reserves key with a pending entry
+// and reports reserved=true when there is none
+func (s *idempotencyStore) begin(key, bodyHash string) (entry *idempotencyEntry, reserved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		ok = false
+	}
+	if !ok {
+		entry, ok = s.load(key)
+		if ok {
+			s.entries[key] = entry
+		}
+	}
+	if ok {
+		return entry, false
+	}
+
+	s.entries[key] = &idempotencyEntry{
+		bodyHash: bodyHash,
+		pending:  true,
+		expires:  time.Now().Add(s.ttl),
+	}
+	return nil, true
+}
+
+// complete replaces the pending entry for key with the finished response
+func (s *idempotencyStore) complete(key string, entry *idempotencyEntry) {
+	s.mu.Lock()
+	s.entries[key] = entry
+	s.mu.Unlock()
+
+	s.save(key, entry)
+}
+
+// abandon forgets a pending entry so the request can be retried
+func (s *idempotencyStore) abandon(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// load reads a persisted entry; callers hold s.mu
+func (s *idempotencyStore) load(key string) (*idempotencyEntry, bool) {
+	if s.conn == nil {
+		return nil, false
+	}
+
+	var (
+		entry   idempotencyEntry
+		headers string
+		expires int64
+	)
+	err := s.conn.QueryRow(
+		`SELECT body_hash, status, headers, body, expires_at FROM idempotency_keys WHERE key = ? AND expires_at > ?`,
+		key, time.Now().Unix(),
+	).Scan(&entry.bodyHash, &entry.status, &headers, &entry.body, &expires)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("loading idempotency key", "error", err)
+		}
+		return nil, false
+	}
+	if err := json.Unmarshal([]byte(headers), &entry.headers); err != nil {
+		return nil, false
+	}
+	entry.expires = time.Unix(expires, 0)
+	return &entry, true
+}
+
+// save persists a finished entry
+func (s *idempotencyStore) save(key string, entry *idempotencyEntry) {
+	if s.conn == nil {
+		return
+	}
+
+	headers, _ := json.Marshal(entry.headers)
+	_, err := s.conn.Exec(
+		`INSERT OR REPLACE INTO idempotency_keys (key, body_hash, status, headers, body, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		key, entry.bodyHash, entry.status, string(headers), entry.body, entry.expires.Unix(),
+	)
+	if err != nil {
+		slog.Error("saving idempotency key", "error", err)
+	}
+}
+
+// sweepLoop drops expired entries so keys that are never retried don't pile up
+func (s *idempotencyStore) sweepLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		s.mu.Lock()
+		for key, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+
+		if s.conn != nil {
+			if _, err := s.conn.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.Unix()); err != nil {
+				slog.Error("sweeping idempotency keys", "error", err)
+			}
+		}
+	}
+}
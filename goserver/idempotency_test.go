@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// failingReader yields data and then fails, as a render that breaks after
+// the first chunks does
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// idempotencyApp serves /pdf-html with streams from next behind an
+// idempotency store and counts the renders
+func idempotencyApp(t *testing.T, rendered *int, next func() io.Reader) *fiber.App {
+	t.Helper()
+	stubRendering(t)
+
+	store := newIdempotencyStore(time.Hour, nil, "/pdf-html")
+	app := fiber.New()
+	app.Use(store.handler)
+	app.Post("/pdf-html", func(res *fiber.Ctx) error {
+		*rendered++
+		return sendPDFStream(res, io.NopCloser(next()), "invoice.pdf", "attachment")
+	})
+	return app
+}
+
+type idempotentResponse struct {
+	status   int
+	body     string
+	replayed string
+	header   func(string) string
+}
+
+func postIdempotent(t *testing.T, app *fiber.App, key string) idempotentResponse {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/pdf-html", strings.NewReader(`{"html":"<p>1</p>"}`))
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return idempotentResponse{resp.StatusCode, string(body), resp.Header.Get("Idempotency-Replayed"), resp.Header.Get}
+}
+
+func TestIdempotencyReplaysStreamedPDF(t *testing.T) {
+	rendered := 0
+	app := idempotencyApp(t, &rendered, func() io.Reader { return strings.NewReader("%PDF-1.4 invoice") })
+
+	first := postIdempotent(t, app, "order-1")
+	if first.status != 200 || first.body != "%PDF-1.4 invoice" || first.replayed != "" {
+		t.Fatalf("first request: %d %q, replayed %q", first.status, first.body, first.replayed)
+	}
+	again := postIdempotent(t, app, "order-1")
+	if again.status != 200 || again.body != "%PDF-1.4 invoice" || again.replayed != "true" {
+		t.Errorf("retry: %d %q, replayed %q", again.status, again.body, again.replayed)
+	}
+	if again.header("X-Idempotent-Replayed") != "" {
+		t.Error("replay sent X-Idempotent-Replayed as well as Idempotency-Replayed")
+	}
+	if rendered != 1 {
+		t.Errorf("rendered %d times, want 1", rendered)
+	}
+}
+
+func TestIdempotencySkipsFailedStreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream func() io.Reader
+		status int
+	}{
+		{"render fails part way", func() io.Reader {
+			return &failingReader{data: "%PDF-1.4 half", err: errors.New("page crashed")}
+		}, 500},
+		{"too large", func() io.Reader { return strings.NewReader(strings.Repeat("x", 2<<20)) }, 422},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := 0
+			app := idempotencyApp(t, &rendered, tt.stream)
+
+			for i := range 2 {
+				got := postIdempotent(t, app, "order-1")
+				if got.status != tt.status || got.replayed != "" {
+					t.Errorf("request %d: status %d, replayed %q; want %d, not replayed", i+1, got.status, got.replayed, tt.status)
+				}
+				if got.header("Content-Disposition") != "" {
+					t.Errorf("request %d: error sent as attachment %q", i+1, got.header("Content-Disposition"))
+				}
+			}
+			// The retry renders again rather than replaying the failure
+			if rendered != 2 {
+				t.Errorf("rendered %d times, want 2", rendered)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-rod/rod"
+	"github.com/gofiber/fiber/v2"
+)
+
+// inventoryMax caps the distinct links and images listed by include=
+// (EXTRACT_INVENTORY_MAX)
+var inventoryMax = 500
+
+// extractOptions are the extras /extract and /extract-html collect from
+// the page they load
+type extractOptions struct {
+	// Thumbnail captures a viewport screenshot when set
+	Thumbnail *thumbnailOptions
+	// Links and Images list the page's outbound links and images
+	Links  bool
+	Images bool
+}
+
+// parseInclude reads a comma-separated include list such as "links,images"
+func (o *extractOptions) parseInclude(include string) error {
+	for _, item := range strings.Split(include, ",") {
+		switch strings.TrimSpace(item) {
+		case "":
+		case "links":
+			o.Links = true
+		case "images":
+			o.Images = true
+		default:
+			return fmt.Errorf("include: unknown value %q; use links and/or images", item)
+		}
+	}
+	return nil
+}
+
+// pageInventoryJS lists a page's links and images by absolute URL, each
+// once with a count of its occurrences. Text and alt come from the first
+// occurrence; image sizes are natural sizes of images that have loaded.
+// Past max distinct URLs further ones are dropped and *_truncated is set.
+const pageInventoryJS = `(max, wantLinks, wantImages) => {
+	const out = {};
+	const clean = (s) => (s || "").replace(/\s+/g, " ").trim() || undefined;
+	const collect = (key, elements, describe) => {
+		const seen = new Map();
+		for (const el of elements) {
+			const item = describe(el);
+			if (!item) continue;
+			const existing = seen.get(item.url);
+			if (existing) {
+				existing.count++;
+			} else if (seen.size >= max) {
+				out[key + "_truncated"] = true;
+			} else {
+				item.count = 1;
+				seen.set(item.url, item);
+			}
+		}
+		out[key] = [...seen.values()];
+	};
+
+	if (wantLinks) {
+		collect("links", document.querySelectorAll("a[href], area[href]"), (a) => {
+			const href = a.href;
+			if (!href || /^javascript:/i.test(href)) return null;
+			return { url: href, href, text: clean(a.innerText || a.textContent || a.getAttribute("aria-label")) };
+		});
+	}
+	if (wantImages) {
+		collect("images", document.querySelectorAll("img"), (img) => {
+			const src = img.currentSrc || img.src;
+			if (!src) return null;
+			const loaded = img.complete && img.naturalWidth > 0;
+			return {
+				url: src,
+				src,
+				alt: clean(img.getAttribute("alt")),
+				width: loaded ? img.naturalWidth : undefined,
+				height: loaded ? img.naturalHeight : undefined,
+			};
+		});
+	}
+	for (const key of ["links", "images"]) {
+		for (const item of out[key] || []) delete item.url;
+	}
+	return out;
+}`
+
+// inventory adds the requested link and image lists to meta
+func (o extractOptions) inventory(page *rod.Page, meta fiber.Map) error {
+	if !o.Links && !o.Images {
+		return nil
+	}
+	obj, err := page.Eval(pageInventoryJS, inventoryMax, o.Links, o.Images)
+	if err != nil {
+		return err
+	}
+	var lists map[string]any
+	if err := obj.Value.Unmarshal(&lists); err != nil {
+		return err
+	}
+	for k, v := range lists {
+		meta[k] = v
+	}
+	return nil
+}
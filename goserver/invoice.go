@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// placeholderRe matches {{name}} and {{list.field}} placeholders, the syntax
+// used by the editor and the AI system prompt
+var placeholderRe = regexp.MustCompile(`\{\{\s*(\w+)(?:\.(\w+))?\s*\}\}`)
+
+// invoiceRequest is the body of POST /invoice
+type invoiceRequest struct {
+	TemplateID string         `json:"template_id"`
+	Data       map[string]any `json:"data"`
+	// List fills the repeating row; {{list.x}}, {{items.x}} or any other
+	// dotted placeholder takes its rows from here unless data has an array
+	// under the same name
+	List []map[string]any `json:"list"`
+	// Mode is "pdf" (default) or "html", which returns the rendered
+	// template without starting a render, for live previews
+	Mode      string       `json:"mode,omitempty"`
+	Calculate *calcOptions `json:"calculate,omitempty"`
+	// DueDate computes data.due_date, which is also returned in the
+	// X-Invoice-Due-Date header
+	DueDate *dueDateOptions `json:"due_date_calculation,omitempty"`
+
+	// QRCode is encoded into a QR code stamped on the first page; position
+	// defaults to top-right and size to 30mm
+	QRCode         string `json:"qr_code,omitempty"`
+	QRCodePosition string `json:"qr_code_position,omitempty"`
+	QRCodeSizeMM   int    `json:"qr_code_size_mm,omitempty"`
+
+	// Barcode stamps a Code 128 or EAN-13 barcode, typically of the invoice number
+	Barcode *barcodeOptions `json:"barcode,omitempty"`
+
+	// Metadata overrides the PDF's title, author, subject and keywords,
+	// which otherwise come from the data; see invoiceMetadata
+	Metadata *pdfMetadata `json:"metadata_overrides,omitempty"`
+
+	// Storage archives the PDF and replies with a link instead of the file
+	Storage *storageDestination `json:"storage_destination,omitempty"`
+
+	// Filename may be a text/template pattern over Data, e.g.
+	// "invoice-{{.invoice_number}}.pdf"; it defaults to the template name
+	Filename    string `json:"filename,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+
+	// LenientMode renders even when data lacks placeholders the template
+	// uses, leaving them in place, instead of failing with 422
+	LenientMode bool `json:"lenient_mode,omitempty"`
+	pdfOptions
+}
+
+// renderTemplate substitutes data into tpl. The element enclosing a list's
+// placeholders (normally a <tr>) is repeated once per row, the same way the
+// editor wraps it in {{#each}} on export. Values are HTML-escaped; unknown
+// placeholders are left in place.
+func renderTemplate(tpl string, data map[string]any, list []map[string]any) string {
+	for _, name := range listNames(tpl) {
+		rows := list
+		if items, ok := data[name].([]any); ok {
+			rows = rowsOf(items)
+		}
+		tpl = expandList(tpl, name, rows)
+	}
+
+	return placeholderRe.ReplaceAllStringFunc(tpl, func(m string) string {
+		sub := placeholderRe.FindStringSubmatch(m)
+		if sub[2] != "" {
+			return m
+		}
+		v, ok := data[sub[1]]
+		if !ok {
+			return m
+		}
+		return html.EscapeString(formatValue(v))
+	})
+}
+
+// templateVariables are the placeholders a template expects, in order of first use
+type templateVariables struct {
+	Variables []string            `json:"variables"`
+	Lists     map[string][]string `json:"lists"`
+}
+
+// discoverVariables collects the scalar and list placeholders of tpl, the
+// same split the editor makes when exporting a template
+func discoverVariables(tpl string) templateVariables {
+	vars := templateVariables{Variables: []string{}, Lists: map[string][]string{}}
+	seen := make(map[string]bool)
+	for _, sub := range placeholderRe.FindAllStringSubmatch(tpl, -1) {
+		key := sub[1] + "." + sub[2]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if sub[2] == "" {
+			vars.Variables = append(vars.Variables, sub[1])
+		} else {
+			vars.Lists[sub[1]] = append(vars.Lists[sub[1]], sub[2])
+		}
+	}
+	return vars
+}
+
+// has reports whether name is a variable or a list
+func (v templateVariables) has(name string) bool {
+	if _, ok := v.Lists[name]; ok {
+		return true
+	}
+	for _, n := range v.Variables {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// names flattens the variables to "name" and "list.field" entries
+func (v templateVariables) names() []string {
+	names := append([]string{}, v.Variables...)
+	lists := make([]string, 0, len(v.Lists))
+	for list := range v.Lists {
+		lists = append(lists, list)
+	}
+	sort.Strings(lists)
+	for _, list := range lists {
+		for _, f := range v.Lists[list] {
+			names = append(names, list+"."+f)
+		}
+	}
+	return names
+}
+
+// missingFields returns the placeholders of tpl that data can't fill: scalar
+// names absent from data, and lists without rows, whether from data or list
+func missingFields(tpl string, data map[string]any, list []map[string]any) []string {
+	var missing []string
+	for _, name := range discoverVariables(tpl).Variables {
+		if _, ok := data[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	for _, name := range listNames(tpl) {
+		rows := list
+		if items, ok := data[name].([]any); ok {
+			rows = rowsOf(items)
+		}
+		if len(rows) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// listNames returns the list names used in dotted placeholders, in order of first use
+func listNames(tpl string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, sub := range placeholderRe.FindAllStringSubmatch(tpl, -1) {
+		if sub[2] != "" && !seen[sub[1]] {
+			seen[sub[1]] = true
+			names = append(names, sub[1])
+		}
+	}
+	return names
+}
+
+// rowsOf converts a decoded JSON array to rows, skipping non-objects
+func rowsOf(items []any) []map[string]any {
+	rows := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if row, ok := item.(map[string]any); ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// expandList repeats the element enclosing every {{name.x}} placeholder once per row
+func expandList(tpl, name string, rows []map[string]any) string {
+	re := regexp.MustCompile(`\{\{\s*` + regexp.QuoteMeta(name) + `\.(\w+)\s*\}\}`)
+	matches := re.FindAllStringIndex(tpl, -1)
+	if len(matches) == 0 {
+		return tpl
+	}
+
+	start, end, ok := enclosingElement(tpl, matches[0][0], matches[len(matches)-1][1])
+	if !ok {
+		return tpl
+	}
+
+	section := tpl[start:end]
+	var b strings.Builder
+	for _, row := range rows {
+		b.WriteString(re.ReplaceAllStringFunc(section, func(m string) string {
+			v, ok := row[re.FindStringSubmatch(m)[1]]
+			if !ok {
+				return ""
+			}
+			return html.EscapeString(formatValue(v))
+		}))
+	}
+	return tpl[:start] + b.String() + tpl[end:]
+}
+
+// enclosingElement finds the innermost element that contains [from, to) and
+// returns its bounds, opening tag to end of closing tag
+func enclosingElement(tpl string, from, to int) (start, end int, ok bool) {
+	lower := strings.ToLower(tpl)
+	for i := strings.LastIndexByte(lower[:from], '<'); i >= 0; i = strings.LastIndexByte(lower[:i], '<') {
+		tag := tagName(lower[i+1:])
+		if tag == "" {
+			// Closing tag, comment or doctype
+			continue
+		}
+		if end := closingTag(lower, tag, i+1); end >= to {
+			return i, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+// tagName reads the element name at the start of s
+func tagName(s string) string {
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || n > 0 && (s[n] >= '0' && s[n] <= '9' || s[n] == '-')) {
+		n++
+	}
+	return s[:n]
+}
+
+// closingTag returns the end of the tag that closes the element opened
+// before pos, counting nested elements of the same name, or -1
+func closingTag(lower, tag string, pos int) int {
+	depth := 1
+	for pos < len(lower) {
+		i := strings.IndexByte(lower[pos:], '<')
+		if i < 0 {
+			return -1
+		}
+		pos += i + 1
+		switch {
+		case strings.HasPrefix(lower[pos:], "/"+tag) && tagName(lower[pos+1:]) == tag:
+			depth--
+			if depth == 0 {
+				gt := strings.IndexByte(lower[pos:], '>')
+				if gt < 0 {
+					return -1
+				}
+				return pos + gt + 1
+			}
+		case tagName(lower[pos:]) == tag:
+			depth++
+		}
+	}
+	return -1
+}
+
+// formatValue renders a decoded JSON value as placeholder text
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case bool, int, int64:
+		return fmt.Sprint(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// isInvoicePreview reports whether res is an html-mode POST /invoice, which
+// renders no PDF and so bypasses the render limiter
+func isInvoicePreview(res *fiber.Ctx) bool {
+	if res.Path() != "/invoice" || !strings.HasPrefix(res.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return false
+	}
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	return json.Unmarshal(res.Body(), &body) == nil && body.Mode == "html"
+}
+
+// handleInvoice renders a stored template with the request's data and
+// returns the PDF, or the HTML in preview mode
+// statusError is an error with the HTTP status it should be reported with
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+// missingFieldsError fails a render whose data lacks template placeholders
+type missingFieldsError struct {
+	fields []string
+}
+
+func (e *missingFieldsError) Error() string {
+	return "data is missing template fields: " + strings.Join(e.fields, ", ")
+}
+
+// sendInvoiceError reports an error from buildInvoice or renderInvoicePDF
+func sendInvoiceError(res *fiber.Ctx, err error) error {
+	var mf *missingFieldsError
+	if errors.As(err, &mf) {
+		id, _ := res.Locals("request_id").(string)
+		return res.Status(422).JSON(fiber.Map{"error": mf.Error(), "missing_fields": mf.fields, "request_id": id})
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return sendError(res, se.status, se.Error())
+	}
+	return sendTemplateError(res, err)
+}
+
+// validate checks the request before anything is loaded or rendered
+func (body *invoiceRequest) validate() error {
+	if body.TemplateID == "" {
+		return errors.New("Missing template_id field in request body")
+	}
+	if body.Mode != "" && body.Mode != "pdf" && body.Mode != "html" {
+		return errors.New("mode must be pdf or html")
+	}
+	if err := body.Storage.validate("storage_destination"); err != nil {
+		return err
+	}
+	if body.Storage != nil && body.Mode == "html" {
+		return errors.New("storage_destination needs mode pdf")
+	}
+	if err := checkOverlayPosition("qr_code_position", body.QRCodePosition); err != nil {
+		return err
+	}
+	if body.QRCodeSizeMM != 0 && (body.QRCodeSizeMM < 10 || body.QRCodeSizeMM > 100) {
+		return errors.New("qr_code_size_mm must be between 10 and 100")
+	}
+	if body.Barcode != nil {
+		if err := body.Barcode.validate(); err != nil {
+			return err
+		}
+	}
+	if body.DueDate != nil {
+		if err := body.DueDate.validate(); err != nil {
+			return err
+		}
+	}
+	if body.Calculate != nil {
+		if err := body.Calculate.validate(); err != nil {
+			return err
+		}
+	}
+	if err := body.pdfOptions.validate(); err != nil {
+		return err
+	}
+	return checkDisposition(body.Disposition)
+}
+
+// buildInvoice loads the template, runs the calculations and returns the
+// rendered HTML with its overlays. A calculated due date is left in
+// body.Data["due_date"]. Unless body.LenientMode is set, data missing any
+// of the template's placeholders fails with a *missingFieldsError.
+func buildInvoice(ctx context.Context, body *invoiceRequest) (string, *invoiceTemplate, error) {
+	tpl, err := getTemplate(db, body.TemplateID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if body.Data == nil {
+		body.Data = make(map[string]any)
+	}
+	if body.DueDate != nil {
+		if _, err := calculateDueDate(body.Data, *body.DueDate); err != nil {
+			return "", nil, withStatus(400, err)
+		}
+	}
+	if body.Calculate != nil {
+		rate, err := rates.rate(ctx, body.Calculate.BaseCurrency, body.Calculate.DisplayCurrency)
+		if err != nil {
+			return "", nil, withStatus(exchangeErrorStatus(err), err)
+		}
+		calculateInvoice(body.Data, body.List, *body.Calculate, rate)
+	}
+	if !body.LenientMode {
+		if missing := missingFields(tpl.HTMLContent, body.Data, body.List); len(missing) > 0 {
+			return "", nil, &missingFieldsError{fields: missing}
+		}
+	}
+
+	rendered := renderTemplate(tpl.HTMLContent, body.Data, body.List)
+	if body.QRCode != "" {
+		qr, err := qrCodeElement(body.QRCode, body.QRCodePosition, body.QRCodeSizeMM)
+		if err != nil {
+			return "", nil, withStatus(422, err)
+		}
+		rendered = injectOverlay(rendered, qr)
+	}
+	if body.Barcode != nil {
+		bc, err := barcodeElement(body.Barcode)
+		if err != nil {
+			return "", nil, withStatus(422, err)
+		}
+		rendered = injectOverlay(rendered, bc)
+	}
+	return rendered, tpl, nil
+}
+
+// setDueDateHeader reports a calculated due date in X-Invoice-Due-Date
+func (body *invoiceRequest) setDueDateHeader(res *fiber.Ctx) {
+	if body.DueDate != nil {
+		res.Set("X-Invoice-Due-Date", formatValue(body.Data["due_date"]))
+	}
+}
+
+// renderInvoicePDF prints the rendered invoice with its metadata and works
+// out the filename. It is buffered rather than streamed, since the
+// metadata goes at the end.
+func renderInvoicePDF(ctx context.Context, body *invoiceRequest, rendered string, tpl *invoiceTemplate) ([]byte, string, error) {
+	pdf, err := readPDF(generatePDFWithRetry(body.pdfOptions.preprocess(ctx, rendered), body.pdfOptions, renderAttempts))
+	if err != nil {
+		return nil, "", withStatus(renderErrorStatus(err), err)
+	}
+	pdf = withMetadata(ctx, pdf, invoiceMetadata(body.Data, body.Metadata))
+
+	filename := filenameFromPattern(body.Filename, body.Data)
+	if filename == "" {
+		filename = tpl.Name
+	}
+	return pdf, filename, nil
+}
+
+func handleInvoice(res *fiber.Ctx) error {
+	var body invoiceRequest
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if err := body.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+
+	rendered, tpl, err := buildInvoice(res.UserContext(), &body)
+	if err != nil {
+		return sendInvoiceError(res, err)
+	}
+	body.setDueDateHeader(res)
+	if body.Mode == "html" {
+		res.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return res.SendString(rendered)
+	}
+
+	pdf, filename, err := renderInvoicePDF(res.UserContext(), &body, rendered, tpl)
+	if err != nil {
+		return sendInvoiceError(res, err)
+	}
+	if body.Storage != nil {
+		return sendStoredPDF(res, body.Storage, pdf, filename)
+	}
+	return sendPDF(res, pdf, filename, body.Disposition)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// jobTTL is how long a finished job and its PDF can be fetched
+	jobTTL = time.Hour
+	// jobQueueMax bounds the jobs waiting for a worker
+	jobQueueMax = 100
+
+	// webhookTimeout bounds each webhook delivery attempt
+	webhookTimeout = 5 * time.Second
+	// webhookRetries is how many times a failed delivery is retried
+	webhookRetries = 3
+	// webhookInlineMaxBytes is the largest PDF sent inline as pdf_base64
+	webhookInlineMaxBytes = 1 << 20
+)
+
+var (
+	// jobs runs POST /pdf-async renders in the background
+	jobs *jobQueue
+	// webhookSecret signs webhook deliveries (WEBHOOK_SECRET)
+	webhookSecret string
+
+	errJobNotFound = errors.New("job not found")
+)
+
+// Job statuses, and the webhook_status of jobs with a webhook_url
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "webhook_failed"
+)
+
+// pdfJob is one asynchronous HTML render
+type pdfJob struct {
+	ID            string     `json:"job_id"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	PDFURL        string     `json:"pdf_url,omitempty"`
+	Size          int        `json:"size,omitempty"`
+	WebhookStatus string     `json:"webhook_status,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+
+	request    asyncPDFRequest
+	ctx        context.Context
+	baseURL    string
+	pdf        []byte
+	expires    time.Time
+	webhookURL string
+}
+
+// asyncPDFRequest is the body of POST /pdf-async: /pdf-html's fields plus
+// an optional webhook called when the job finishes
+type asyncPDFRequest struct {
+	HTML       string         `json:"html"`
+	Filename   string         `json:"filename,omitempty"`
+	Data       map[string]any `json:"data,omitempty"`
+	Metadata   *pdfMetadata   `json:"metadata_overrides,omitempty"`
+	WebhookURL string         `json:"webhook_url,omitempty"`
+	pdfOptions
+}
+
+// jobQueue holds the jobs and feeds them to a fixed set of workers
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*pdfJob
+	pending chan *pdfJob
+}
+
+func newJobQueue(workers int) *jobQueue {
+	q := &jobQueue{
+		jobs:    make(map[string]*pdfJob),
+		pending: make(chan *pdfJob, jobQueueMax),
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		go q.work()
+	}
+	go q.sweepLoop()
+	return q
+}
+
+// submit queues a job, failing when the queue is full
+func (q *jobQueue) submit(job *pdfJob) bool {
+	q.mu.Lock()
+	q.jobs[job.ID] = job
+	q.mu.Unlock()
+
+	select {
+	case q.pending <- job:
+		return true
+	default:
+		q.mu.Lock()
+		delete(q.jobs, job.ID)
+		q.mu.Unlock()
+		return false
+	}
+}
+
+// get returns a copy of the job's public state and its PDF
+func (q *jobQueue) get(id string) (pdfJob, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return pdfJob{}, nil, errJobNotFound
+	}
+	return *job, job.pdf, nil
+}
+
+// update changes a job under the lock
+func (q *jobQueue) update(job *pdfJob, fn func(*pdfJob)) {
+	q.mu.Lock()
+	fn(job)
+	q.mu.Unlock()
+}
+
+func (q *jobQueue) work() {
+	for job := range q.pending {
+		q.run(job)
+	}
+}
+
+// run renders a job and then delivers its webhook
+func (q *jobQueue) run(job *pdfJob) {
+	q.update(job, func(j *pdfJob) { j.Status = jobRunning })
+
+	body := job.request
+	pdf, err := readPDF(generatePDFWithRetry(body.pdfOptions.preprocess(job.ctx, body.HTML), body.pdfOptions, renderAttempts))
+	if err == nil && body.Metadata != nil {
+		pdf = withMetadata(job.ctx, pdf, pdfMetadata{}.merge(body.Metadata))
+	}
+
+	q.update(job, func(j *pdfJob) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		j.expires = now.Add(jobTTL)
+		if err != nil {
+			j.Status, j.Error = jobFailed, err.Error()
+			return
+		}
+		j.Status, j.pdf, j.Size = jobSucceeded, pdf, len(pdf)
+		j.PDFURL = j.baseURL + "/jobs/" + j.ID + "/pdf"
+	})
+	if err != nil {
+		slog.ErrorContext(job.ctx, "async render failed", "job_id", job.ID, "error", err)
+	}
+
+	if job.webhookURL != "" {
+		status := webhookDelivered
+		if err := deliverWebhook(job.ctx, job.webhookURL, q.webhookPayload(job)); err != nil {
+			slog.WarnContext(job.ctx, "webhook delivery failed", "job_id", job.ID, "url", job.webhookURL, "error", err)
+			status = webhookFailed
+		}
+		q.update(job, func(j *pdfJob) { j.WebhookStatus = status })
+	}
+}
+
+// webhookPayload is the JSON posted to a job's webhook. Small PDFs are
+// included inline; every successful job has a download URL.
+func (q *jobQueue) webhookPayload(job *pdfJob) []byte {
+	q.mu.Lock()
+	payload := fiber.Map{"job_id": job.ID, "status": job.Status, "error": job.Error}
+	if job.Status == jobSucceeded {
+		payload["pdf_url"] = job.PDFURL
+		if len(job.pdf) <= webhookInlineMaxBytes {
+			payload["pdf_base64"] = base64.StdEncoding.EncodeToString(job.pdf)
+		}
+	}
+	q.mu.Unlock()
+
+	b, _ := json.Marshal(payload)
+	return b
+}
+
+// deliverWebhook posts payload, signed with HMAC-SHA256 in
+// X-Invoice-Signature, retrying failures with exponential backoff. The URL
+// is fetched under the same private address rules as other fetches.
+func deliverWebhook(ctx context.Context, webhookURL string, payload []byte) error {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(payload)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var err error
+	for attempt := 0; attempt <= webhookRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(1<<(attempt-1)) * time.Second):
+			}
+		}
+		if err = postWebhook(ctx, webhookURL, payload, signature); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func postWebhook(ctx context.Context, webhookURL string, payload []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Invoice-Signature", signature)
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sweepLoop drops finished jobs once their TTL is up
+func (q *jobQueue) sweepLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		q.mu.Lock()
+		for id, job := range q.jobs {
+			if !job.expires.IsZero() && now.After(job.expires) {
+				delete(q.jobs, id)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// handlePDFAsync queues an HTML render and answers 202 with the job
+func handlePDFAsync(res *fiber.Ctx) error {
+	var body asyncPDFRequest
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if body.HTML == "" {
+		return sendError(res, 400, "Missing html field in request body")
+	}
+	if err := body.pdfOptions.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+	if body.WebhookURL != "" {
+		u, err := url.Parse(body.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return sendError(res, 400, "webhook_url must be an http(s) URL")
+		}
+		if webhookSecret == "" {
+			return sendError(res, 503, "webhooks are disabled: WEBHOOK_SECRET is not set")
+		}
+	}
+	body.Filename = filenameFromPattern(body.Filename, body.Data)
+
+	// The job outlives the request, so it keeps only the request ID
+	requestID, _ := res.Locals("request_id").(string)
+	job := &pdfJob{
+		ID:         uuid.NewString(),
+		Status:     jobQueued,
+		CreatedAt:  time.Now().UTC(),
+		request:    body,
+		ctx:        context.WithValue(context.Background(), requestIDKey, requestID),
+		baseURL:    res.BaseURL(),
+		webhookURL: body.WebhookURL,
+	}
+	if job.webhookURL != "" {
+		job.WebhookStatus = webhookPending
+	}
+	if !jobs.submit(job) {
+		res.Set(fiber.HeaderRetryAfter, "30")
+		return sendError(res, 429, "Too many queued jobs")
+	}
+
+	res.Set(fiber.HeaderLocation, "/jobs/"+job.ID)
+	return res.Status(fiber.StatusAccepted).JSON(fiber.Map{"job_id": job.ID, "status": job.Status, "status_url": "/jobs/" + job.ID})
+}
+
+func handleGetJob(res *fiber.Ctx) error {
+	job, _, err := jobs.get(res.Params("id"))
+	if err != nil {
+		return sendError(res, 404, "Job not found")
+	}
+	return res.JSON(job)
+}
+
+// handleGetJobPDF downloads a finished job's PDF
+func handleGetJobPDF(res *fiber.Ctx) error {
+	job, pdf, err := jobs.get(res.Params("id"))
+	if err != nil {
+		return sendError(res, 404, "Job not found")
+	}
+	if job.Status != jobSucceeded {
+		return sendError(res, 409, "Job has no PDF; status is "+job.Status)
+	}
+	return sendPDF(res, pdf, job.request.Filename, "")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// renderLimiter bounds how many render requests run at once and how many may
+// wait for a slot. Requests beyond the queue, or that wait longer than
+// maxWait, get 429 instead of piling up on the browser.
+type renderLimiter struct {
+	paths    map[string]bool
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+	// skip exempts requests to a limited path that won't touch the browser
+	skip func(res *fiber.Ctx) bool
+
+	waiting  atomic.Int64
+	rejected atomic.Int64
+}
+
+func newRenderLimiter(concurrency, maxQueue int, maxWait time.Duration, paths ...string) *renderLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	l := &renderLimiter{
+		paths:    make(map[string]bool),
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: int64(maxQueue),
+		maxWait:  maxWait,
+	}
+	for _, p := range paths {
+		l.paths[p] = true
+	}
+	return l
+}
+
+// handler is the admission middleware for render endpoints
+func (l *renderLimiter) handler(res *fiber.Ctx) error {
+	if !l.paths[res.Path()] || (l.skip != nil && l.skip(res)) {
+		return res.Next()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if !l.wait(res) {
+			l.rejected.Add(1)
+			res.Set("Retry-After", strconv.Itoa(l.retryAfter()))
+			return sendError(res, 429, "Too many render requests queued, retry later")
+		}
+	}
+	defer func() { <-l.slots }()
+
+	return res.Next()
+}
+
+// wait queues for a slot, giving up when the queue is full, maxWait passes
+// or the server shuts down. fasthttp doesn't tell a handler when its client
+// disconnects, so a caller that went away keeps its place until maxWait.
+func (l *renderLimiter) wait(res *fiber.Ctx) bool {
+	if l.waiting.Add(1) > l.maxQueue {
+		l.waiting.Add(-1)
+		return false
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-res.Context().Done():
+		return false
+	}
+}
+
+// retryAfter suggests how many seconds a rejected client should back off
+func (l *renderLimiter) retryAfter() int {
+	return int(math.Max(1, math.Ceil(l.maxWait.Seconds())))
+}
+
+// Stats returns the limiter state for the stats output
+func (l *renderLimiter) Stats() fiber.Map {
+	return fiber.Map{
+		"in_flight":      len(l.slots),
+		"concurrency":    cap(l.slots),
+		"queued":         l.waiting.Load(),
+		"max_queue":      l.maxQueue,
+		"max_wait_ms":    l.maxWait.Milliseconds(),
+		"rejected_total": l.rejected.Load(),
+	}
+}
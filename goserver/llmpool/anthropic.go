@@ -0,0 +1,143 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DefaultAnthropicMaxTokens is the reply limit of Anthropic requests
+// without MaxTokens, which Anthropic requires
+const DefaultAnthropicMaxTokens = 4096
+
+// anthropicBlock is a content block of the Anthropic Messages API
+type anthropicBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+// anthropicImageSource is an inline base64 image or an image URL
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// anthropicUsage is the token usage of an Anthropic response
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicMessages converts chat messages to Anthropic's shape: system
+// messages become the top-level system blocks, and text and image_url
+// parts become text and image blocks
+func anthropicMessages(msgs []ChatMessage) ([]anthropicBlock, []anthropicMessage, error) {
+	var system []anthropicBlock
+	var messages []anthropicMessage
+
+	for i, msg := range msgs {
+		parts, err := messageParts(msg.Content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		blocks := make([]anthropicBlock, 0, len(parts))
+		for _, part := range parts {
+			block, err := anthropicContentBlock(part)
+			if err != nil {
+				return nil, nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			blocks = append(blocks, block)
+		}
+
+		if msg.Role == "system" {
+			for _, b := range blocks {
+				if b.Type != "text" {
+					return nil, nil, fmt.Errorf("message %d: system messages can only hold text", i)
+				}
+			}
+			system = append(system, blocks...)
+			continue
+		}
+		messages = append(messages, anthropicMessage{Role: msg.Role, Content: blocks})
+	}
+	return system, messages, nil
+}
+
+// anthropicContentBlock converts one message part
+func anthropicContentBlock(part MessagePart) (anthropicBlock, error) {
+	switch part.Type {
+	case "text":
+		return anthropicBlock{Type: "text", Text: part.Text}, nil
+	case "image_url":
+		if part.ImageURL == nil || part.ImageURL.URL == "" {
+			return anthropicBlock{}, fmt.Errorf("image_url part has no url")
+		}
+		source, err := anthropicImage(part.ImageURL.URL)
+		if err != nil {
+			return anthropicBlock{}, err
+		}
+		return anthropicBlock{Type: "image", Source: source}, nil
+	default:
+		return anthropicBlock{}, fmt.Errorf("unsupported message part type %q", part.Type)
+	}
+}
+
+// anthropicImage turns a data: URL into a base64 source and passes http(s)
+// URLs through as url sources
+func anthropicImage(url string) (*anthropicImageSource, error) {
+	if strings.HasPrefix(url, "data:") {
+		mediaType, data, ok := splitDataURL(url)
+		if !ok {
+			return nil, fmt.Errorf("image data URLs must be base64 with a media type")
+		}
+		return &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+	}
+	if strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://") {
+		return &anthropicImageSource{Type: "url", URL: url}, nil
+	}
+	return nil, fmt.Errorf("unsupported image url %.40q", url)
+}
+
+// splitDataURL returns the media type and payload of a base64 data: URL
+func splitDataURL(url string) (mediaType, data string, ok bool) {
+	header, data, found := strings.Cut(url, ",")
+	if !found || !strings.HasPrefix(header, "data:") {
+		return "", "", false
+	}
+	mediaType, isBase64 := strings.CutSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+	if !isBase64 || mediaType == "" {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
+
+// messageParts normalises message content to parts: a string is one text
+// part, and parts decoded from JSON as generic values are converted back
+func messageParts(content any) ([]MessagePart, error) {
+	switch c := content.(type) {
+	case string:
+		return []MessagePart{{Type: "text", Text: c}}, nil
+	case []MessagePart:
+		return c, nil
+	case nil:
+		return nil, fmt.Errorf("message has no content")
+	default:
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		var parts []MessagePart
+		if err := json.Unmarshal(b, &parts); err != nil {
+			return nil, fmt.Errorf("content must be a string or a list of parts")
+		}
+		return parts, nil
+	}
+}
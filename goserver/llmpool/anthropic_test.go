@@ -0,0 +1,137 @@
+package llmpool
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// assertJSON fails unless got is exactly want once want's whitespace is
+// removed. Maps marshal with sorted keys, so want lists them sorted.
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatalf("bad expected JSON: %v", err)
+	}
+	if !bytes.Equal(got, compact.Bytes()) {
+		t.Errorf("got  %s\nwant %s", got, compact.Bytes())
+	}
+}
+
+// multimodalRequest has a system prompt, a user turn with text and an
+// inline image, an assistant turn and a user turn with an image URL
+func multimodalRequest() *ChatRequest {
+	return &ChatRequest{Messages: []ChatMessage{
+		{Role: "system", Content: "Be brief"},
+		{Role: "user", Content: []MessagePart{
+			{Type: "text", Text: "Match this"},
+			{Type: "image_url", ImageURL: &ImageURLObject{URL: "data:image/png;base64,iVBORw0K"}},
+		}},
+		{Role: "assistant", Content: "Looks good"},
+		{Role: "user", Content: []MessagePart{
+			{Type: "image_url", ImageURL: &ImageURLObject{URL: "https://example.test/a.png"}},
+		}},
+	}}
+}
+
+func TestConvertMultimodal(t *testing.T) {
+	const openAIMessages = `[
+		{"role": "system", "content": "Be brief"},
+		{"role": "user", "content": [
+			{"type": "text", "text": "Match this"},
+			{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0K"}}
+		]},
+		{"role": "assistant", "content": "Looks good"},
+		{"role": "user", "content": [
+			{"type": "image_url", "image_url": {"url": "https://example.test/a.png"}}
+		]}
+	]`
+
+	tests := []struct {
+		provider *Provider
+		want     string
+	}{
+		{
+			&Provider{Name: "openai", Type: ProviderOpenAI, Model: "gpt-4o"},
+			`{"messages": ` + openAIMessages + `, "model": "gpt-4o", "stream": false}`,
+		},
+		{
+			&Provider{Name: "groq", Type: ProviderGroq, Model: "llama-vision"},
+			`{"messages": ` + openAIMessages + `, "model": "llama-vision", "stream": false}`,
+		},
+		{
+			&Provider{Name: "anthropic", Type: ProviderAnthropic, Model: "claude"},
+			`{
+				"max_tokens": 4096,
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "text", "text": "Match this"},
+						{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0K"}}
+					]},
+					{"role": "assistant", "content": [{"type": "text", "text": "Looks good"}]},
+					{"role": "user", "content": [
+						{"type": "image", "source": {"type": "url", "url": "https://example.test/a.png"}}
+					]}
+				],
+				"model": "claude",
+				"system": [{"type": "text", "text": "Be brief"}]
+			}`,
+		},
+	}
+	p := NewPool()
+	for _, tt := range tests {
+		t.Run(tt.provider.Type, func(t *testing.T) {
+			got, err := p.ConvertToProviderFormat(tt.provider, multimodalRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+// Parts decoded from JSON arrive as []any rather than []MessagePart
+func TestConvertAnthropicDecodedParts(t *testing.T) {
+	var req ChatRequest
+	err := json.Unmarshal([]byte(`{"messages": [{"role": "user", "content": [
+		{"type": "text", "text": "hi"},
+		{"type": "image_url", "image_url": {"url": "data:image/jpeg;base64,/9j/"}}
+	]}]}`), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewPool().ConvertToProviderFormat(&Provider{Name: "a", Type: ProviderAnthropic, Model: "claude"}, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, got, `{
+		"max_tokens": 4096,
+		"messages": [{"role": "user", "content": [
+			{"type": "text", "text": "hi"},
+			{"type": "image", "source": {"type": "base64", "media_type": "image/jpeg", "data": "/9j/"}}
+		]}],
+		"model": "claude"
+	}`)
+}
+
+func TestConvertAnthropicInvalidParts(t *testing.T) {
+	tests := map[string]ChatMessage{
+		"image in system message": {Role: "system", Content: []MessagePart{{Type: "image_url", ImageURL: &ImageURLObject{URL: "https://example.test/a.png"}}}},
+		"data URL without base64": {Role: "user", Content: []MessagePart{{Type: "image_url", ImageURL: &ImageURLObject{URL: "data:image/png,raw"}}}},
+		"data URL without type":   {Role: "user", Content: []MessagePart{{Type: "image_url", ImageURL: &ImageURLObject{URL: "data:;base64,AAAA"}}}},
+		"other URL scheme":        {Role: "user", Content: []MessagePart{{Type: "image_url", ImageURL: &ImageURLObject{URL: "ftp://example.test/a.png"}}}},
+		"image without URL":       {Role: "user", Content: []MessagePart{{Type: "image_url"}}},
+		"unknown part type":       {Role: "user", Content: []MessagePart{{Type: "audio"}}},
+		"no content":              {Role: "user"},
+	}
+	p := NewPool()
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &ChatRequest{Messages: []ChatMessage{msg}}
+			if _, err := p.ConvertToProviderFormat(&Provider{Name: "a", Type: ProviderAnthropic}, req); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
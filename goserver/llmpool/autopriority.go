@@ -0,0 +1,182 @@
+package llmpool
+
+import (
+	"sort"
+	"time"
+)
+
+// AutoPriorityConfig controls automatic de-prioritization of failing
+// providers. Zero fields take the defaults in parentheses.
+type AutoPriorityConfig struct {
+	Interval        time.Duration // how often stats are sampled (30s)
+	Window          time.Duration // error rate window for demotion (10m)
+	DemoteAbove     float64       // error rate that triggers demotion (0.20)
+	RecoverWindow   time.Duration // error rate window for recovery (5m)
+	RecoverBelow    float64       // error rate under which priority is restored (0.05)
+	MinRequests     int           // requests needed in Window before demoting (5)
+	PriorityPenalty int           // added to the priority of a demoted provider (1)
+}
+
+func (c AutoPriorityConfig) withDefaults() AutoPriorityConfig {
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.Window <= 0 {
+		c.Window = 10 * time.Minute
+	}
+	if c.DemoteAbove <= 0 {
+		c.DemoteAbove = 0.20
+	}
+	if c.RecoverWindow <= 0 {
+		c.RecoverWindow = 5 * time.Minute
+	}
+	if c.RecoverBelow <= 0 {
+		c.RecoverBelow = 0.05
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 5
+	}
+	if c.PriorityPenalty <= 0 {
+		c.PriorityPenalty = 1
+	}
+	return c
+}
+
+// statsSample is one reading of a provider's cumulative counters
+type statsSample struct {
+	at       time.Time
+	requests int
+	errors   int
+}
+
+// WithAutoPriority starts a background goroutine that demotes providers whose
+// recent error rate is too high and restores them once they recover. It
+// returns the pool for chaining.
+func (p *Pool) WithAutoPriority(cfg AutoPriorityConfig) *Pool {
+	cfg = cfg.withDefaults()
+	go p.autoPriorityLoop(cfg)
+	return p
+}
+
+func (p *Pool) autoPriorityLoop(cfg AutoPriorityConfig) {
+	history := make(map[string][]statsSample)
+	demotedAt := make(map[string]time.Time)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		stats := p.GetStats()
+		for name, st := range stats {
+			samples := history[name]
+			// Counters that went backwards were cleared by Reset; start over
+			if n := len(samples); n > 0 && st.TotalRequests < samples[n-1].requests {
+				samples = nil
+			}
+			samples = append(samples, statsSample{at: now, requests: st.TotalRequests, errors: st.Errors})
+			// Keep just enough history for the longer of the two windows
+			keepFrom := now.Add(-maxDuration(cfg.Window, cfg.RecoverWindow) - cfg.Interval)
+			for len(samples) > 1 && samples[0].at.Before(keepFrom) {
+				samples = samples[1:]
+			}
+			history[name] = samples
+
+			since, ok := demotedAt[name]
+			switch {
+			case !ok:
+				requests, rate := errorRate(samples, now.Add(-cfg.Window))
+				if requests >= cfg.MinRequests && rate > cfg.DemoteAbove {
+					if p.SetEffectivePriority(name, st.Priority+cfg.PriorityPenalty) {
+						demotedAt[name] = now
+						p.log().Warn("llmpool: demoting provider", "provider", name,
+							"priority", st.Priority+cfg.PriorityPenalty, "error_rate", rate, "window", cfg.Window)
+					}
+				}
+			case now.Sub(since) >= cfg.RecoverWindow:
+				// A demoted provider may see no traffic at all; no errors counts as recovered
+				if _, rate := errorRate(samples, now.Add(-cfg.RecoverWindow)); rate < cfg.RecoverBelow {
+					if p.SetEffectivePriority(name, st.Priority) {
+						delete(demotedAt, name)
+						p.log().Info("llmpool: restoring provider", "provider", name,
+							"priority", st.Priority, "error_rate", rate, "window", cfg.RecoverWindow)
+					}
+				}
+			}
+		}
+
+		// Forget providers that were removed from the pool
+		for name := range history {
+			if _, ok := stats[name]; !ok {
+				delete(history, name)
+				delete(demotedAt, name)
+			}
+		}
+	}
+}
+
+// errorRate returns the requests and error ratio between the first sample at
+// or after from and the latest sample
+func errorRate(samples []statsSample, from time.Time) (int, float64) {
+	if len(samples) < 2 {
+		return 0, 0
+	}
+	first := samples[0]
+	for _, s := range samples {
+		if !s.at.Before(from) {
+			first = s
+			break
+		}
+	}
+	last := samples[len(samples)-1]
+
+	requests := last.requests - first.requests
+	if requests <= 0 {
+		return 0, 0
+	}
+	return requests, float64(last.errors-first.errors) / float64(requests)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// SetEffectivePriority overrides the priority a provider is ordered by,
+// leaving its configured Priority untouched. Setting it back to Priority
+// clears the override. It reports whether the provider exists.
+func (p *Pool) SetEffectivePriority(name string, priority int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	found := false
+	for _, provider := range p.providers {
+		if provider.Name == name {
+			provider.effectivePriority = priority
+			provider.priorityOverridden = priority != provider.Priority
+			found = true
+		}
+	}
+	if found {
+		p.sortProviders()
+	}
+	return found
+}
+
+// effective returns the priority the provider is currently ordered by.
+// Callers must hold p.mu.
+func (pr *Provider) effective() int {
+	if pr.priorityOverridden {
+		return pr.effectivePriority
+	}
+	return pr.Priority
+}
+
+// sortProviders orders providers by effective priority, keeping the order
+// they were added in within a priority. Callers must hold p.mu.
+func (p *Pool) sortProviders() {
+	sort.SliceStable(p.providers, func(i, j int) bool {
+		return p.providers[i].effective() < p.providers[j].effective()
+	})
+}
@@ -0,0 +1,103 @@
+package llmpool
+
+import (
+	"errors"
+	"time"
+)
+
+// Circuit breaker states reported in ProviderStats. A provider's breaker
+// opens after the pool's cool-off threshold of consecutive failures (see
+// WithCoolOff) and stays open until CoolOffUntil. It is then half-open:
+// one probe request at a time is let through, and its outcome closes the
+// breaker or opens it again. Rejected credentials open it until
+// ResetProvider is called.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breakerState returns the provider's breaker state. Callers must hold pr.mu.
+func (pr *Provider) breakerState(now time.Time) string {
+	switch {
+	case pr.authTripped, now.Before(pr.CoolOffUntil):
+		return BreakerOpen
+	case !pr.CoolOffUntil.IsZero():
+		return BreakerHalfOpen
+	}
+	return BreakerClosed
+}
+
+// admit lets a request through the provider's breaker and counts it in
+// flight. For a half-open breaker only one probe is admitted. release must
+// be called once the request is done.
+func (p *Pool) admit(provider *Provider) (release func(), ok bool) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	probe := false
+	switch provider.breakerState(time.Now()) {
+	case BreakerOpen:
+		return nil, false
+	case BreakerHalfOpen:
+		if provider.probing {
+			return nil, false
+		}
+		provider.probing = true
+		probe = true
+	}
+
+	provider.InFlight++
+	return func() {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+
+		provider.InFlight--
+		if probe {
+			provider.probing = false
+		}
+	}, true
+}
+
+// tripOnAuth opens the provider's breaker for good when err says its
+// credentials were rejected; retrying can't fix a revoked key
+func (p *Pool) tripOnAuth(provider *Provider, err error) {
+	var pe *ProviderError
+	if !errors.As(err, &pe) || !pe.IsAuth() {
+		return
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if !provider.authTripped {
+		provider.authTripped = true
+		p.log().Warn("llmpool: provider rejected its credentials; skipping it until ResetProvider",
+			"provider", provider.Name, "status", pe.StatusCode)
+	}
+}
+
+// ResetProvider closes the named provider's breaker, including one opened
+// by rejected credentials, and clears its error counts, last error and
+// latency samples, which describe the failing provider. It reports
+// whether the provider exists.
+func (p *Pool) ResetProvider(name string) bool {
+	provider, ok := p.GetProviderByName(name)
+	if !ok {
+		return false
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.authTripped = false
+	provider.Errors = 0
+	provider.errorClasses = nil
+	provider.lastError = ""
+	provider.lastErrorAt = time.Time{}
+	provider.latency = latencyWindow{}
+	provider.firstToken = latencyWindow{}
+	provider.ConsecutiveErrors = 0
+	provider.CoolOffUntil = time.Time{}
+	return true
+}
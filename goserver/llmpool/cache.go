@@ -0,0 +1,172 @@
+package llmpool
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// responseCache is an LRU cache of replies by request content
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	resp    ChatResponse
+	expires time.Time
+}
+
+// EnableCache makes Chat and ChatWithProvider answer a request identical
+// to one answered in the last ttl from memory, keeping the size most
+// recently used replies. Cached replies have Cached set and are not
+// charged to rate limits, budgets or stats other than cache hits.
+// Streaming requests are never cached. It returns the pool for chaining.
+func (p *Pool) EnableCache(size int, ttl time.Duration) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cache = &responseCache{
+		size:    max(size, 1),
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	return p
+}
+
+// WithCacheMaxTemperature bypasses the cache enabled by EnableCache for
+// requests with a Temperature above limit or none, whose replies are meant
+// to vary; 0 caches only deterministic requests. It returns the pool for
+// chaining.
+func (p *Pool) WithCacheMaxTemperature(limit float64) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cacheMaxTemperature = &limit
+	return p
+}
+
+// cacheFor returns the pool's cache if req may be cached
+func (p *Pool) cacheFor(req *ChatRequest) *responseCache {
+	p.mu.RLock()
+	c, maxTemperature := p.cache, p.cacheMaxTemperature
+	p.mu.RUnlock()
+
+	if c == nil || req.Stream || maxTemperature != nil && !req.temperatureAtMost(*maxTemperature) {
+		return nil
+	}
+	return c
+}
+
+// temperatureAtMost reports whether req sets a temperature of at most
+// limit; the providers' defaults are well above 0
+func (r *ChatRequest) temperatureAtMost(limit float64) bool {
+	return r.Temperature != nil && *r.Temperature <= limit
+}
+
+// cacheKey hashes req, every field of which can change the reply, and the
+// provider it is for (empty for any provider)
+func cacheKey(provider string, req *ChatRequest) (string, bool) {
+	data, err := json.Marshal(struct {
+		Provider string       `json:"provider"`
+		Request  *ChatRequest `json:"request"`
+	}{provider, req})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// get returns a copy of the live reply cached under key
+func (c *responseCache) get(key string) (*ChatResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	resp := entry.resp
+	resp.ToolCalls = slices.Clone(resp.ToolCalls)
+	resp.Cached = true
+	return &resp, true
+}
+
+// put caches a copy of resp under key, evicting the least recently used
+// reply when full
+func (c *responseCache) put(key string, resp *ChatResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, resp: *resp, expires: time.Now().Add(c.ttl)}
+	entry.resp.ToolCalls = slices.Clone(resp.ToolCalls)
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cached answers req from the cache if it can. Otherwise it returns a
+// function that caches the reply of a successful send, or nil if req isn't
+// cached.
+func (p *Pool) cached(provider string, req *ChatRequest) (*ChatResponse, func(*ChatResponse)) {
+	c := p.cacheFor(req)
+	if c == nil {
+		return nil, nil
+	}
+	key, ok := cacheKey(provider, req)
+	if !ok {
+		return nil, nil
+	}
+	if resp, ok := c.get(key); ok {
+		p.countCache(resp.Provider, true)
+		return resp, nil
+	}
+	return nil, func(resp *ChatResponse) {
+		c.put(key, resp)
+		p.countCache(resp.Provider, false)
+	}
+}
+
+// countCache counts a cache hit or miss against the provider whose reply
+// was served or cached
+func (p *Pool) countCache(name string, hit bool) {
+	provider, ok := p.GetProviderByName(name)
+	if !ok {
+		return
+	}
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if hit {
+		provider.cacheHits++
+	} else {
+		provider.cacheMisses++
+	}
+}
@@ -0,0 +1,406 @@
+package llmpool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a provider configuration file, see LoadConfig
+type Config struct {
+	Providers []ProviderConfig `json:"providers" yaml:"providers"`
+}
+
+// ProviderConfig is one provider of a Config, with the fields of Provider
+// that can be configured. Timeout takes Go duration syntax, such as "90s".
+type ProviderConfig struct {
+	Name              string  `json:"name" yaml:"name"`
+	Type              string  `json:"type" yaml:"type"`
+	APIKey            string  `json:"api_key" yaml:"api_key"`
+	BaseURL           string  `json:"base_url" yaml:"base_url"`
+	Model             string  `json:"model" yaml:"model"`
+	Deployment        string  `json:"deployment" yaml:"deployment"`
+	APIVersion        string  `json:"api_version" yaml:"api_version"`
+	Priority          int     `json:"priority" yaml:"priority"`
+	Weight            int     `json:"weight" yaml:"weight"`
+	Vision            bool    `json:"vision" yaml:"vision"`
+	Timeout           string  `json:"timeout" yaml:"timeout"`
+	RequestsPerMinute int     `json:"requests_per_minute" yaml:"requests_per_minute"`
+	TokensPerMinute   int     `json:"tokens_per_minute" yaml:"tokens_per_minute"`
+	InputCostPer1K    float64 `json:"input_cost_per_1k" yaml:"input_cost_per_1k"`
+	OutputCostPer1K   float64 `json:"output_cost_per_1k" yaml:"output_cost_per_1k"`
+}
+
+// envRefRe matches ${NAME} references to environment variables
+var envRefRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// LoadConfig reads a provider configuration file: a list of providers, or
+// an object with a "providers" list. Files ending in .yaml or .yml are
+// YAML, anything else JSON. ${NAME} in string values is replaced by the
+// environment variable NAME, which keeps secrets out of the file. The
+// providers are validated, so a Config from LoadConfig can be given to
+// Reload.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = cfg.unmarshalYAML(data)
+	default:
+		data = bytes.TrimSpace(data)
+		if bytes.HasPrefix(data, []byte("[")) {
+			err = json.Unmarshal(data, &cfg.Providers)
+		} else {
+			err = json.Unmarshal(data, cfg)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range cfg.Providers {
+		if err := cfg.Providers[i].expandEnv(); err != nil {
+			return nil, fmt.Errorf("%s: provider %d: %w", path, i, err)
+		}
+	}
+	if _, err := cfg.providers(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// unmarshalYAML decodes a YAML configuration, which like JSON may be a
+// list of providers or a mapping with a providers key
+func (c *Config) unmarshalYAML(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	if doc.Content[0].Kind == yaml.SequenceNode {
+		return doc.Content[0].Decode(&c.Providers)
+	}
+	return doc.Content[0].Decode(c)
+}
+
+// expandEnv replaces ${NAME} references in the string fields. A reference
+// to an unset variable is an error rather than an empty key.
+func (pc *ProviderConfig) expandEnv() error {
+	var missing []string
+	expand := func(s string) string {
+		return envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envRefRe.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+	for _, field := range []*string{
+		&pc.Name, &pc.Type, &pc.APIKey, &pc.BaseURL, &pc.Model,
+		&pc.Deployment, &pc.APIVersion, &pc.Timeout,
+	} {
+		*field = expand(*field)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// keyRequired are the provider types that can't be used without an API key
+var keyRequired = map[string]bool{
+	ProviderGroq:        true,
+	ProviderAnthropic:   true,
+	ProviderGemini:      true,
+	ProviderAzureOpenAI: true,
+}
+
+// provider validates the configuration and returns the provider it describes
+func (pc *ProviderConfig) provider() (*Provider, error) {
+	if pc.Name == "" {
+		return nil, errors.New("provider without a name")
+	}
+	if keyRequired[pc.Type] && pc.APIKey == "" {
+		return nil, fmt.Errorf("provider %s: %s providers need an api_key", pc.Name, pc.Type)
+	}
+	if pc.Model == "" && pc.Type != ProviderAzureOpenAI {
+		return nil, fmt.Errorf("provider %s: model is required", pc.Name)
+	}
+	if pc.Priority < 0 || pc.Weight < 0 || pc.RequestsPerMinute < 0 || pc.TokensPerMinute < 0 ||
+		pc.InputCostPer1K < 0 || pc.OutputCostPer1K < 0 {
+		return nil, fmt.Errorf("provider %s: priority, weight, limits and costs must not be negative", pc.Name)
+	}
+
+	var timeout time.Duration
+	if pc.Timeout != "" {
+		d, err := time.ParseDuration(pc.Timeout)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("provider %s: timeout %q must be a duration such as 90s", pc.Name, pc.Timeout)
+		}
+		timeout = d
+	}
+
+	provider := &Provider{
+		Name:              pc.Name,
+		Type:              pc.Type,
+		APIKey:            pc.APIKey,
+		BaseURL:           strings.TrimSuffix(pc.BaseURL, "/"),
+		Model:             pc.Model,
+		Deployment:        pc.Deployment,
+		APIVersion:        pc.APIVersion,
+		Priority:          pc.Priority,
+		Weight:            pc.Weight,
+		Vision:            pc.Vision,
+		Timeout:           timeout,
+		RequestsPerMinute: pc.RequestsPerMinute,
+		TokensPerMinute:   pc.TokensPerMinute,
+		InputCostPer1K:    pc.InputCostPer1K,
+		OutputCostPer1K:   pc.OutputCostPer1K,
+	}
+	if err := provider.validate(); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// providers validates every provider of the configuration
+func (cfg *Config) providers() ([]*Provider, error) {
+	providers := make([]*Provider, 0, len(cfg.Providers))
+	seen := make(map[string]bool)
+	for i := range cfg.Providers {
+		provider, err := cfg.Providers[i].provider()
+		if err != nil {
+			return nil, err
+		}
+		if seen[provider.Name] {
+			return nil, fmt.Errorf("provider %s is configured twice", provider.Name)
+		}
+		seen[provider.Name] = true
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// sameEndpoint reports whether two providers send the same requests to the
+// same place, so that one can take over the other's state
+func sameEndpoint(a, b *Provider) bool {
+	return a.Type == b.Type && a.APIKey == b.APIKey && a.BaseURL == b.BaseURL &&
+		a.Model == b.Model && a.Deployment == b.Deployment && a.APIVersion == b.APIVersion &&
+		a.Timeout == b.Timeout
+}
+
+// Reload makes the pool's providers those of cfg. Providers no longer
+// configured are removed and new ones added. One whose endpoint, key,
+// model or timeout changed is replaced, keeping only its budget; otherwise
+// its priority, weight, limits and prices are updated in place, keeping
+// its usage stats, rate limit state and budget. An invalid cfg is
+// rejected with the pool left as it was. Each change is logged.
+func (p *Pool) Reload(cfg *Config) error {
+	configured, err := cfg.providers()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*Provider, len(p.providers))
+	for _, provider := range p.providers {
+		current[provider.Name] = provider
+	}
+
+	providers := make([]*Provider, 0, len(configured))
+	for _, next := range configured {
+		old, ok := current[next.Name]
+		delete(current, next.Name)
+		if !ok {
+			p.log().Info("llmpool: provider added", "provider", next.Name, "type", next.Type)
+			providers = append(providers, next)
+			continue
+		}
+		providers = append(providers, p.apply(old, next))
+	}
+	for name := range current {
+		p.log().Info("llmpool: provider removed", "provider", name)
+	}
+
+	p.providers = providers
+	p.sortProviders()
+	return nil
+}
+
+// apply changes old to the configuration of next and returns the provider
+// to keep: old updated in place, or next if the endpoint changed. Callers
+// must hold p.mu.
+func (p *Pool) apply(old, next *Provider) *Provider {
+	if !sameEndpoint(old, next) {
+		// A new key or model doesn't make the spend so far unspent
+		old.mu.Lock()
+		next.budget = old.budget
+		old.mu.Unlock()
+		p.log().Info("llmpool: provider replaced", "provider", next.Name, "type", next.Type)
+		return next
+	}
+	if old.update(next) {
+		p.log().Info("llmpool: provider updated", "provider", next.Name,
+			"priority", next.Priority, "weight", next.Weight,
+			"requests_per_minute", next.RequestsPerMinute, "tokens_per_minute", next.TokensPerMinute)
+	}
+	return old
+}
+
+// config returns the provider's configuration. Callers must hold p.mu.
+func (pr *Provider) config() ProviderConfig {
+	s := pr.snapshot()
+	pc := ProviderConfig{
+		Name:              s.Name,
+		Type:              s.Type,
+		APIKey:            s.APIKey,
+		BaseURL:           s.BaseURL,
+		Model:             s.Model,
+		Deployment:        s.Deployment,
+		APIVersion:        s.APIVersion,
+		Priority:          s.Priority,
+		Weight:            s.Weight,
+		Vision:            s.Vision,
+		RequestsPerMinute: s.RequestsPerMinute,
+		TokensPerMinute:   s.TokensPerMinute,
+		InputCostPer1K:    s.InputCostPer1K,
+		OutputCostPer1K:   s.OutputCostPer1K,
+	}
+	if s.Timeout > 0 {
+		pc.Timeout = s.Timeout.String()
+	}
+	return pc
+}
+
+// AddProviderConfig adds the provider pc describes, validated as
+// LoadConfig does. It fails with ErrProviderExists if the name is taken.
+func (p *Pool) AddProviderConfig(pc ProviderConfig) error {
+	provider, err := pc.provider()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, existing := range p.providers {
+		if existing.Name == provider.Name {
+			return fmt.Errorf("%w: %s", ErrProviderExists, provider.Name)
+		}
+	}
+	p.providers = append(p.providers, provider)
+	p.sortProviders()
+	p.log().Info("llmpool: provider added", "provider", provider.Name, "type", provider.Type)
+	return nil
+}
+
+// UpdateProvider changes the named provider's configuration with change,
+// validated as LoadConfig does, and applies it as Reload would. Requests
+// in flight finish with the configuration they started with. The name
+// can't be changed.
+func (p *Pool) UpdateProvider(name string, change func(*ProviderConfig)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, old := range p.providers {
+		if old.Name != name {
+			continue
+		}
+		pc := old.config()
+		change(&pc)
+		pc.Name = name
+		next, err := pc.provider()
+		if err != nil {
+			return err
+		}
+		p.providers[i] = p.apply(old, next)
+		p.sortProviders()
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+}
+
+// update copies the settings of next that can change without replacing
+// the provider, and reports whether any did. Callers must hold the pool's
+// mu, which guards Priority, Weight and Vision.
+func (pr *Provider) update(next *Provider) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	changed := pr.Priority != next.Priority || pr.Weight != next.Weight || pr.Vision != next.Vision ||
+		pr.RequestsPerMinute != next.RequestsPerMinute || pr.TokensPerMinute != next.TokensPerMinute ||
+		pr.InputCostPer1K != next.InputCostPer1K || pr.OutputCostPer1K != next.OutputCostPer1K
+
+	pr.Priority = next.Priority
+	pr.Weight = next.Weight
+	pr.Vision = next.Vision
+	pr.RequestsPerMinute = next.RequestsPerMinute
+	pr.TokensPerMinute = next.TokensPerMinute
+	pr.InputCostPer1K = next.InputCostPer1K
+	pr.OutputCostPer1K = next.OutputCostPer1K
+	return changed
+}
+
+// WatchConfig reloads the pool from the configuration file at path
+// whenever its modification time or size changes, checking every
+// interval until ctx is done. A file that fails to load is logged and the
+// providers are kept as they are.
+func (p *Pool) WatchConfig(ctx context.Context, path string, interval time.Duration) {
+	stamp := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	modTime, size := stamp()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			m, s := stamp()
+			if m.Equal(modTime) && s == size {
+				continue
+			}
+			modTime, size = m, s
+
+			cfg, err := LoadConfig(path)
+			if err == nil {
+				err = p.Reload(cfg)
+			}
+			if err != nil {
+				p.log().Error("llmpool: reloading provider configuration failed; keeping the current providers",
+					"path", path, "error", err)
+				continue
+			}
+			p.log().Info("llmpool: provider configuration reloaded", "path", path, "providers", len(cfg.Providers))
+		}
+	}()
+}
@@ -0,0 +1,108 @@
+package llmpool
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file named name and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	t.Setenv("TEST_GROQ_KEY", "gsk-secret")
+	t.Setenv("TEST_OLLAMA_HOST", "http://gpu-box:11434")
+
+	path := writeConfig(t, "providers.yaml", `
+# Groq first, the local model when it's down
+providers:
+  - name: groq
+    type: groq
+    api_key: ${TEST_GROQ_KEY}
+    base_url: https://api.groq.com/openai/v1
+    model: llama-3.3-70b-versatile
+    priority: 1
+    weight: 2
+    timeout: 90s
+    requests_per_minute: 30
+    input_cost_per_1k: 0.00059
+  - name: local
+    type: ollama
+    base_url: "${TEST_OLLAMA_HOST}/"
+    model: llama3.2
+    priority: 2
+    vision: true
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProviderConfig{
+		{Name: "groq", Type: ProviderGroq, APIKey: "gsk-secret", BaseURL: "https://api.groq.com/openai/v1", Model: "llama-3.3-70b-versatile",
+			Priority: 1, Weight: 2, Timeout: "90s", RequestsPerMinute: 30, InputCostPer1K: 0.00059},
+		{Name: "local", Type: ProviderOllama, BaseURL: "http://gpu-box:11434/", Model: "llama3.2",
+			Priority: 2, Vision: true},
+	}
+	if !reflect.DeepEqual(cfg.Providers, want) {
+		t.Errorf("providers\n%+v\nwant\n%+v", cfg.Providers, want)
+	}
+
+	p := NewPool()
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if local, ok := p.GetProviderByName("local"); !ok || local.BaseURL != "http://gpu-box:11434" {
+		t.Errorf("local provider %+v", local)
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"providers.json", `{"providers": [{"name": "a", "type": "openai", "base_url": "http://llm", "model": "m"}]}`},
+		{"providers.json", `[{"name": "a", "type": "openai", "base_url": "http://llm", "model": "m"}]`},
+		{"providers.yml", "- name: a\n  type: openai\n  base_url: http://llm\n  model: m\n"},
+		{"providers.YAML", "providers:\n  - {name: a, type: openai, base_url: \"http://llm\", model: m}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, tt.name, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []ProviderConfig{{Name: "a", Type: ProviderOpenAI, BaseURL: "http://llm", Model: "m"}}
+			if !reflect.DeepEqual(cfg.Providers, want) {
+				t.Errorf("providers %+v", cfg.Providers)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, file, content, want string
+	}{
+		{"unset variable", "p.yaml", "- {name: a, type: groq, model: m, api_key: '${TEST_UNSET_KEY}'}", "TEST_UNSET_KEY"},
+		{"bad YAML", "p.yaml", "providers: [name: a", "p.yaml"},
+		{"YAML is not JSON", "p.json", "providers:\n  - name: a\n", "p.json"},
+		{"invalid provider", "p.yml", "- {name: a, type: openai, base_url: http://llm}", "model is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.file, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package llmpool
+
+import (
+	"fmt"
+	"time"
+)
+
+// BudgetPeriod is how often a provider's budget starts over. Periods
+// follow the UTC calendar.
+type BudgetPeriod int
+
+const (
+	BudgetDaily BudgetPeriod = iota
+	BudgetWeekly
+	BudgetMonthly
+)
+
+// String returns the period name used in stats
+func (bp BudgetPeriod) String() string {
+	switch bp {
+	case BudgetDaily:
+		return "daily"
+	case BudgetWeekly:
+		return "weekly"
+	case BudgetMonthly:
+		return "monthly"
+	default:
+		return "unknown"
+	}
+}
+
+// start is the beginning of the period containing t; weeks start on Monday
+func (bp BudgetPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bp {
+	case BudgetWeekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case BudgetMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// next is the beginning of the period after the one starting at start
+func (bp BudgetPeriod) next(start time.Time) time.Time {
+	switch bp {
+	case BudgetWeekly:
+		return start.AddDate(0, 0, 7)
+	case BudgetMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// budget caps a provider's spend per period, guarded by Provider.mu
+type budget struct {
+	limit  float64
+	period BudgetPeriod
+	start  time.Time // of the current period
+	spent  float64
+}
+
+// roll starts a new period once now has left the current one
+func (b *budget) roll(now time.Time) {
+	if start := b.period.start(now); !start.Equal(b.start) {
+		b.start = start
+		b.spent = 0
+	}
+}
+
+// BudgetStats is a provider's spend in the current budget period
+type BudgetStats struct {
+	Period   string    `json:"period"`
+	Limit    float64   `json:"limit"`
+	Spent    float64   `json:"spent"`
+	ResetsAt time.Time `json:"resets_at"`
+	Exceeded bool      `json:"exceeded"`
+}
+
+// cost is what usage costs at the provider's prices
+func (pr *Provider) cost(usage tokenUsage) float64 {
+	return float64(usage.PromptTokens)/1000*pr.InputCostPer1K +
+		float64(usage.CompletionTokens)/1000*pr.OutputCostPer1K
+}
+
+// charge adds the cost of resp's usage to the provider's total and budget
+func (p *Pool) charge(provider *Provider, resp *ChatResponse) {
+	if resp == nil {
+		return
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	cost := provider.cost(resp.Usage)
+	if cost == 0 {
+		return
+	}
+	provider.TotalCost += cost
+	if b := provider.budget; b != nil {
+		b.roll(time.Now())
+		b.spent += cost
+		if b.spent >= b.limit && b.spent-cost < b.limit {
+			p.log().Warn("llmpool: provider budget exceeded; skipping it until the period ends",
+				"provider", provider.Name, "spent", b.spent, "limit", b.limit, "resets_at", b.period.next(b.start))
+		}
+	}
+}
+
+// overBudget reports whether the provider has spent its budget for the
+// current period. Callers must hold pr.mu.
+func (pr *Provider) overBudget(now time.Time) bool {
+	if pr.budget == nil {
+		return false
+	}
+	pr.budget.roll(now)
+	return pr.budget.spent >= pr.budget.limit
+}
+
+// budgetStats returns the provider's budget state, or nil without a
+// budget. Callers must hold pr.mu.
+func (pr *Provider) budgetStats(now time.Time) *BudgetStats {
+	b := pr.budget
+	if b == nil {
+		return nil
+	}
+	b.roll(now)
+	return &BudgetStats{
+		Period:   b.period.String(),
+		Limit:    b.limit,
+		Spent:    b.spent,
+		ResetsAt: b.period.next(b.start),
+		Exceeded: b.spent >= b.limit,
+	}
+}
+
+// SetBudget caps what the named provider may cost per period, priced by
+// its InputCostPer1K and OutputCostPer1K. Once the spend reaches limit the
+// provider is skipped, and ChatWithProvider fails with ErrBudgetExceeded,
+// until the next period. Spend so far in the current period is kept when
+// a budget is replaced. A zero limit removes the budget.
+func (p *Pool) SetBudget(name string, limit float64, period BudgetPeriod) error {
+	if limit < 0 {
+		return fmt.Errorf("budget for %s: limit must not be negative", name)
+	}
+	provider, ok := p.GetProviderByName(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if limit == 0 {
+		provider.budget = nil
+		return nil
+	}
+	b := &budget{limit: limit, period: period}
+	b.roll(time.Now())
+	if old := provider.budget; old != nil && old.period == period && old.start.Equal(b.start) {
+		b.spent = old.spent
+	}
+	provider.budget = b
+	return nil
+}
+
+// Budget returns the named provider's spend against its budget, and false
+// if it has no budget or doesn't exist
+func (p *Pool) Budget(name string) (BudgetStats, bool) {
+	provider, ok := p.GetProviderByName(name)
+	if !ok {
+		return BudgetStats{}, false
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	stats := provider.budgetStats(time.Now())
+	if stats == nil {
+		return BudgetStats{}, false
+	}
+	return *stats, true
+}
@@ -0,0 +1,233 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoProviders is returned when the pool has no providers to try
+	ErrNoProviders = errors.New("no providers available")
+	// ErrNoVisionProvider is returned for image requests when no provider has Vision set
+	ErrNoVisionProvider = errors.New("no provider supports image input")
+	// ErrNoToolProvider is returned for requests with tools when no provider's type supports them
+	ErrNoToolProvider = errors.New("no provider supports tool calling")
+	// ErrAllProvidersFailed is returned by Chat, as a *FailoverError, when
+	// every attempt failed
+	ErrAllProvidersFailed = errors.New("all providers failed")
+	// ErrProviderNotFound is returned when a provider is requested by an unknown name
+	ErrProviderNotFound = errors.New("provider not found")
+	// ErrProviderExists is returned when adding a provider under a name in use
+	ErrProviderExists = errors.New("provider already exists")
+	// ErrProviderUnavailable is the class of a provider's 5xx replies. With
+	// no StatusCode it is returned by ChatWithProvider when the named
+	// provider is rate limited or cooling off.
+	ErrProviderUnavailable = errors.New("provider is unavailable")
+	// ErrAllProvidersRateLimited is returned, as a *RateLimitError, when
+	// every provider able to serve a request is at its rate limits
+	ErrAllProvidersRateLimited = errors.New("all providers are rate limited")
+	// ErrProviderTimeout is returned, in a ProviderError, when a request to
+	// a provider outlasted its timeout; see Provider.Timeout
+	ErrProviderTimeout = errors.New("request timed out")
+	// ErrBudgetExceeded is returned when the providers able to serve a
+	// request have spent their budgets; see Pool.SetBudget
+	ErrBudgetExceeded = errors.New("provider budget exceeded")
+	// ErrContentFiltered is returned when a provider's safety filters refused
+	// the prompt or withheld the reply, instead of an empty response
+	ErrContentFiltered = errors.New("blocked by the provider's content filter")
+	// ErrInvalidJSON is returned, in a ProviderError, when the reply to a
+	// request for ResponseFormatJSON doesn't parse
+	ErrInvalidJSON = errors.New("reply is not valid JSON")
+)
+
+// The classes of a provider's error replies, which a ProviderError wraps
+// with the provider's message. 5xx replies are ErrProviderUnavailable and
+// prompts refused by a content filter ErrContentFiltered.
+var (
+	// ErrRateLimited is a 429; ProviderError.RetryAfter says how long the
+	// provider asked to wait, if it did
+	ErrRateLimited = errors.New("rate limited by the provider")
+	// ErrAuth is a 401 or 403: the provider rejected its credentials
+	ErrAuth = errors.New("provider rejected the credentials")
+	// ErrBadRequest is any other 4xx: the provider won't take the request as sent
+	ErrBadRequest = errors.New("provider rejected the request")
+)
+
+// RateLimitError is ErrAllProvidersRateLimited with the earliest time a
+// provider will have capacity again. Until is zero if none will without
+// ResetProvider.
+type RateLimitError struct {
+	Until time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Until.IsZero() {
+		return ErrAllProvidersRateLimited.Error()
+	}
+	return fmt.Sprintf("%v until %s", ErrAllProvidersRateLimited, e.Until.Format(time.RFC3339))
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrAllProvidersRateLimited
+}
+
+// ProviderError is a failed call to one provider. StatusCode is 0 when the
+// request never got an HTTP response; otherwise Err is the reply's class,
+// such as ErrRateLimited, with the provider's message. Anything that looks
+// like a credential is redacted from Body and Error.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	// RetryAfter is the wait the provider asked for, if any
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	var msg string
+	switch {
+	case e.StatusCode != 0 && e.Err != nil:
+		msg = fmt.Sprintf("provider %s returned status %d: %v", e.Provider, e.StatusCode, e.Err)
+	case e.StatusCode != 0:
+		msg = fmt.Sprintf("provider %s returned status %d: %s", e.Provider, e.StatusCode, e.Body)
+	default:
+		msg = fmt.Sprintf("provider %s: %v", e.Provider, e.Err)
+	}
+	return redact(msg, "")
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// IsAuth reports whether the provider rejected the configured credentials
+func (e *ProviderError) IsAuth() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// statusError is the ProviderError for a reply from provider with a status
+// other than 200, classified, and redacted of the provider's key
+func statusError(provider *Provider, resp *http.Response, body []byte) *ProviderError {
+	text := redact(string(body), provider.APIKey)
+	return &ProviderError{
+		Provider:   provider.Name,
+		StatusCode: resp.StatusCode,
+		Body:       text,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Err:        classify(resp.StatusCode, text),
+	}
+}
+
+// providerError is the error JSON of the provider APIs. OpenAI, Groq and
+// Azure send {"error": {"message", "type", "code"}}, Anthropic adds
+// {"type": "error"} around the same, Gemini has a "status" in place of the
+// type and a numeric code, and Ollama sends {"error": "message"}.
+type providerError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    any    `json:"code"`
+	Status  string `json:"status"`
+}
+
+// contentFilterCodes are the error codes of prompts refused by a content
+// filter, which come as a plain 400
+var contentFilterCodes = map[string]bool{
+	"content_filter":           true,
+	"content_policy_violation": true,
+	"content_filtered":         true,
+}
+
+// classify returns the class of an error reply, wrapped with the message
+// from its body if the provider sent one
+func classify(status int, body string) error {
+	var reply struct {
+		Error json.RawMessage `json:"error"`
+	}
+	var detail providerError
+	if json.Unmarshal([]byte(body), &reply) == nil && len(reply.Error) > 0 {
+		if json.Unmarshal(reply.Error, &detail.Message) != nil {
+			json.Unmarshal(reply.Error, &detail)
+		}
+	}
+	code, _ := detail.Code.(string)
+
+	var class error
+	switch {
+	case status == http.StatusTooManyRequests:
+		class = ErrRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		class = ErrAuth
+	case contentFilterCodes[code] || contentFilterCodes[detail.Type]:
+		class = ErrContentFiltered
+	case status >= 500:
+		class = ErrProviderUnavailable
+	default:
+		class = ErrBadRequest
+	}
+	if detail.Message == "" {
+		return class
+	}
+	return fmt.Errorf("%w: %s", class, detail.Message)
+}
+
+// keyPatterns match the credential formats of the providers and generic
+// bearer, key and token assignments. The first group, if any, is kept.
+var keyPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(?:sk|gsk|xai)[-_][A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{30,}`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]{12,}`),
+	regexp.MustCompile(`(?i)((?:api[_-]?key|key|token|secret)["']?\s*[:=]\s*["']?)[A-Za-z0-9._~+/=-]{12,}`),
+}
+
+// redact replaces apiKey and anything that looks like a credential in s
+func redact(s, apiKey string) string {
+	if apiKey != "" {
+		s = strings.ReplaceAll(s, apiKey, "[REDACTED]")
+	}
+	for _, re := range keyPatterns {
+		s = re.ReplaceAllString(s, "${1}[REDACTED]")
+	}
+	return s
+}
+
+// FailoverError ends a Chat that tried providers without success. Err is
+// ErrAllProvidersFailed, or what stopped the failover early, such as a
+// *RateLimitError; Attempts holds each attempt's error in order. It
+// unwraps to Err and the last attempt's error.
+type FailoverError struct {
+	Err      error
+	Attempts []error
+}
+
+func (e *FailoverError) Error() string {
+	msg := e.Err.Error()
+	var timedOut []string
+	for _, err := range e.Attempts {
+		var pe *ProviderError
+		if errors.Is(err, ErrProviderTimeout) && errors.As(err, &pe) {
+			timedOut = append(timedOut, pe.Provider)
+		}
+	}
+	if len(timedOut) > 0 {
+		msg += fmt.Sprintf(" (timed out: %s)", strings.Join(timedOut, ", "))
+	}
+	return msg + ", last error: " + e.Attempts[len(e.Attempts)-1].Error()
+}
+
+func (e *FailoverError) Unwrap() []error {
+	return []error{e.Err, e.Attempts[len(e.Attempts)-1]}
+}
+
+// failover returns err, which ends a Chat, with the errors of its attempts
+func failover(err error, attempts []error) error {
+	if len(attempts) == 0 {
+		return err
+	}
+	return &FailoverError{Err: err, Attempts: attempts}
+}
@@ -0,0 +1,53 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Values of ChatRequest.ResponseFormat
+const (
+	ResponseFormatText = "text"
+	ResponseFormatJSON = "json_object"
+)
+
+// jsonInstruction asks for JSON from providers without a JSON mode
+const jsonInstruction = "Output only valid JSON:\n"
+
+// wantsJSON reports whether req asks for a JSON reply
+func (r *ChatRequest) wantsJSON() bool {
+	return r.ResponseFormat == ResponseFormatJSON
+}
+
+// withJSONInstruction returns msgs with jsonInstruction put in front of the
+// last user message, leaving msgs itself untouched
+func withJSONInstruction(msgs []ChatMessage) []ChatMessage {
+	out := append([]ChatMessage(nil), msgs...)
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i].Role != "user" {
+			continue
+		}
+		switch content := out[i].Content.(type) {
+		case string:
+			out[i].Content = jsonInstruction + content
+		case []MessagePart:
+			parts := append([]MessagePart{{Type: "text", Text: jsonInstruction}}, content...)
+			out[i].Content = parts
+		}
+		return out
+	}
+	return out
+}
+
+// checkFormat fails a reply to a JSON mode request that isn't JSON, so Chat
+// tries another provider. A reply of tool calls has no content to check.
+func (r *ChatRequest) checkFormat(resp *ChatResponse) error {
+	if !r.wantsJSON() || len(resp.ToolCalls) > 0 {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(resp.Content), &v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	return nil
+}
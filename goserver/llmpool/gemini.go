@@ -0,0 +1,191 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// geminiPart is a part of Gemini content: text or an inline base64 image
+type geminiPart struct {
+	Text       string            `json:"text,omitempty"`
+	InlineData *geminiInlineData `json:"inline_data,omitempty"`
+}
+
+type geminiInlineData struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+// geminiRequest is the body of a generateContent call
+type geminiRequest struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	GenerationConfig  struct {
+		Temperature      *float64 `json:"temperature,omitempty"`
+		TopP             *float64 `json:"topP,omitempty"`
+		MaxOutputTokens  int      `json:"maxOutputTokens,omitempty"`
+		StopSequences    []string `json:"stopSequences,omitempty"`
+		FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+		PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+		Seed             *int     `json:"seed,omitempty"`
+		ResponseMimeType string   `json:"responseMimeType,omitempty"`
+	} `json:"generationConfig"`
+}
+
+// geminiResponse is a generateContent reply, or one event of a stream
+type geminiResponse struct {
+	ResponseID   string `json:"responseId"`
+	ModelVersion string `json:"modelVersion"`
+	Candidates   []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// geminiBlockReasons are the finish reasons of a reply withheld by Gemini's filters
+var geminiBlockReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+	"IMAGE_SAFETY":       true,
+}
+
+// newGeminiRequest converts req to the generateContent format. Assistant
+// messages take Gemini's "model" role and system messages become the
+// system instruction.
+func newGeminiRequest(req *ChatRequest) (*geminiRequest, error) {
+	out := &geminiRequest{}
+	out.GenerationConfig.Temperature = req.Temperature
+	out.GenerationConfig.TopP = req.TopP
+	out.GenerationConfig.MaxOutputTokens = req.MaxTokens
+	out.GenerationConfig.StopSequences = req.Stop
+	out.GenerationConfig.FrequencyPenalty = req.FrequencyPenalty
+	out.GenerationConfig.PresencePenalty = req.PresencePenalty
+	out.GenerationConfig.Seed = req.Seed
+	if req.wantsJSON() {
+		out.GenerationConfig.ResponseMimeType = "application/json"
+	}
+
+	for i, msg := range req.Messages {
+		parts, err := messageParts(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		content := geminiContent{Parts: make([]geminiPart, 0, len(parts))}
+		for _, part := range parts {
+			gp, err := geminiContentPart(part)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			content.Parts = append(content.Parts, gp)
+		}
+
+		switch msg.Role {
+		case "system":
+			if out.SystemInstruction == nil {
+				out.SystemInstruction = &geminiContent{}
+			}
+			out.SystemInstruction.Parts = append(out.SystemInstruction.Parts, content.Parts...)
+			continue
+		case "assistant":
+			content.Role = "model"
+		default:
+			content.Role = "user"
+		}
+		out.Contents = append(out.Contents, content)
+	}
+	return out, nil
+}
+
+// geminiContentPart converts one message part. Gemini only takes inline
+// images, so image URLs must be data: URLs.
+func geminiContentPart(part MessagePart) (geminiPart, error) {
+	switch part.Type {
+	case "text":
+		return geminiPart{Text: part.Text}, nil
+	case "image_url":
+		if part.ImageURL == nil || part.ImageURL.URL == "" {
+			return geminiPart{}, fmt.Errorf("image_url part has no url")
+		}
+		mediaType, data, ok := splitDataURL(part.ImageURL.URL)
+		if !ok {
+			return geminiPart{}, fmt.Errorf("images must be base64 data URLs")
+		}
+		return geminiPart{InlineData: &geminiInlineData{MimeType: mediaType, Data: data}}, nil
+	default:
+		return geminiPart{}, fmt.Errorf("unsupported message part type %q", part.Type)
+	}
+}
+
+// geminiEndpoint is the generateContent URL of the request's model; streams
+// use streamGenerateContent with server-sent events
+func geminiEndpoint(provider *Provider, req *ChatRequest) string {
+	model := url.PathEscape(strings.TrimPrefix(req.model(provider), "models/"))
+	if req.Stream {
+		return provider.BaseURL + "/models/" + model + ":streamGenerateContent?alt=sse"
+	}
+	return provider.BaseURL + "/models/" + model + ":generateContent"
+}
+
+// decode copies the reply into resp and returns its text. A prompt or
+// reply withheld by the safety filters is an ErrContentFiltered.
+func (r *geminiResponse) decode(resp *ChatResponse) (string, error) {
+	if r.ResponseID != "" {
+		resp.ID = r.ResponseID
+	}
+	if r.ModelVersion != "" {
+		resp.Model = r.ModelVersion
+	}
+	if u := r.UsageMetadata; u != nil {
+		resp.Usage = tokenUsage{
+			PromptTokens:     u.PromptTokenCount,
+			CompletionTokens: u.CandidatesTokenCount,
+			TotalTokens:      u.TotalTokenCount,
+		}
+	}
+
+	if reason := r.PromptFeedback.BlockReason; reason != "" {
+		return "", fmt.Errorf("%w: prompt blocked (%s)", ErrContentFiltered, reason)
+	}
+	if len(r.Candidates) == 0 {
+		return "", nil
+	}
+	candidate := r.Candidates[0]
+	if geminiBlockReasons[candidate.FinishReason] {
+		return "", fmt.Errorf("%w: finish reason %s", ErrContentFiltered, candidate.FinishReason)
+	}
+
+	var text strings.Builder
+	for _, part := range candidate.Content.Parts {
+		text.WriteString(part.Text)
+	}
+	return text.String(), nil
+}
+
+func decodeGeminiEvent(data []byte, resp *ChatResponse) (string, bool, error) {
+	var event geminiResponse
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", false, fmt.Errorf("decoding stream event: %w", err)
+	}
+	delta, err := event.decode(resp)
+	// The stream simply ends after the chunk carrying the finish reason
+	done := len(event.Candidates) > 0 && event.Candidates[0].FinishReason != ""
+	return delta, done, err
+}
@@ -0,0 +1,133 @@
+package llmpool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func geminiProvider(baseURL string) *Provider {
+	return &Provider{Name: "gemini", Type: ProviderGemini, APIKey: "g-key", BaseURL: baseURL, Model: "gemini-2.0-flash", Vision: true}
+}
+
+// geminiFixtureRequest is the chat request testdata/gemini_request.json
+// is the conversion of
+func geminiFixtureRequest() *ChatRequest {
+	return &ChatRequest{
+		Messages: []ChatMessage{
+			{Role: "system", Content: "You design invoice templates."},
+			{Role: "user", Content: []MessagePart{
+				{Type: "text", Text: "Design an invoice like this"},
+				{Type: "image_url", ImageURL: &ImageURLObject{URL: "data:image/png;base64,iVBORw0KGgo="}},
+			}},
+			{Role: "assistant", Content: "Which currency?"},
+			{Role: "user", Content: "EUR"},
+		},
+		Temperature: Ptr(0.2),
+		MaxTokens:   1024,
+		Stop:        []string{"<!-- end -->"},
+	}
+}
+
+func TestGeminiRequestFixture(t *testing.T) {
+	got, err := NewPool().ConvertToProviderFormat(geminiProvider("http://gemini.test"), geminiFixtureRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, got, string(fixture(t, "gemini_request.json")))
+}
+
+func TestGeminiChat(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, fixture(t, "gemini_response.json")))
+	p := newTestPool(t, geminiProvider(stub.URL+"/v1beta"))
+
+	resp, err := p.Chat(context.Background(), geminiFixtureRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := stub.only(t)
+	if sent.URL != "/v1beta/models/gemini-2.0-flash:generateContent" {
+		t.Errorf("URL %s", sent.URL)
+	}
+	if key := sent.Header.Get("x-goog-api-key"); key != "g-key" {
+		t.Errorf("x-goog-api-key %q", key)
+	}
+	assertJSON(t, sent.Body, string(fixture(t, "gemini_request.json")))
+
+	want := ChatResponse{
+		ID:       "resp-abc123",
+		Content:  "<html><body>{{invoice_number}}</body></html>",
+		Model:    "gemini-2.0-flash-001",
+		Usage:    tokenUsage{PromptTokens: 321, CompletionTokens: 45, TotalTokens: 366},
+		Provider: "gemini",
+	}
+	if resp.ID != want.ID || resp.Content != want.Content || resp.Model != want.Model || resp.Usage != want.Usage || resp.Provider != want.Provider {
+		t.Errorf("got %+v\nwant %+v", *resp, want)
+	}
+}
+
+func TestGeminiBlocked(t *testing.T) {
+	blockedReply := bytes.Replace(fixture(t, "gemini_response.json"), []byte(`"STOP"`), []byte(`"SAFETY"`), 1)
+
+	for name, body := range map[string][]byte{
+		"prompt": fixture(t, "gemini_blocked.json"),
+		"reply":  blockedReply,
+	} {
+		t.Run(name, func(t *testing.T) {
+			stub := newStubServer(t, replyWith(200, body))
+			p := newTestPool(t, geminiProvider(stub.URL))
+
+			_, err := p.ChatWithProvider(context.Background(), "gemini", &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}})
+			if !errors.Is(err, ErrContentFiltered) {
+				t.Errorf("error %v, want ErrContentFiltered", err)
+			}
+			if stub.hits() != 1 {
+				t.Errorf("%d requests; a filtered reply is not retried", stub.hits())
+			}
+		})
+	}
+}
+
+func TestGeminiStream(t *testing.T) {
+	stub := newStubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(fixture(t, "gemini_stream.txt"))
+	})
+	p := newTestPool(t, geminiProvider(stub.URL))
+
+	var chunks []string
+	resp, err := p.ChatStream(context.Background(), geminiFixtureRequest(), func(c StreamChunk) error {
+		chunks = append(chunks, c.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := stub.only(t); sent.URL != "/models/gemini-2.0-flash:streamGenerateContent?alt=sse" {
+		t.Errorf("URL %s", sent.URL)
+	}
+	if got := strings.Join(chunks, "|"); got != "<html>|{{total}}|</html>" {
+		t.Errorf("chunks %s", got)
+	}
+	if resp.Content != "<html>{{total}}</html>" || resp.ID != "resp-stream" {
+		t.Errorf("response %+v", *resp)
+	}
+	if want := (tokenUsage{PromptTokens: 321, CompletionTokens: 9, TotalTokens: 330}); resp.Usage != want {
+		t.Errorf("usage %+v, want %+v", resp.Usage, want)
+	}
+}
+
+func TestGeminiImageURL(t *testing.T) {
+	req := &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: []MessagePart{
+		{Type: "image_url", ImageURL: &ImageURLObject{URL: "https://example.test/a.png"}},
+	}}}}
+	_, err := NewPool().ConvertToProviderFormat(geminiProvider("http://gemini.test"), req)
+	if err == nil {
+		t.Error("image URL accepted; Gemini only takes inline data")
+	}
+}
@@ -0,0 +1,46 @@
+package llmpool
+
+import (
+	"slices"
+	"time"
+)
+
+// IdleCleanupInterval is how often WithIdleCleanup looks for idle providers
+const IdleCleanupInterval = time.Hour
+
+// WithIdleCleanup starts a background goroutine that removes providers
+// unused for longer than maxIdle, so stale ones stop skewing error rate
+// statistics. Providers that were never used are kept: they are
+// configured and waiting for their turn, and so is the last provider left.
+// It returns the pool for chaining.
+func (p *Pool) WithIdleCleanup(maxIdle time.Duration) *Pool {
+	go func() {
+		ticker := time.NewTicker(IdleCleanupInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			p.removeIdle(now, maxIdle)
+		}
+	}()
+	return p
+}
+
+// removeIdle removes the providers last used more than maxIdle before now,
+// as RemoveProvider does, but never the last one
+func (p *Pool) removeIdle(now time.Time, maxIdle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, provider := range slices.Clone(p.providers) {
+		provider.mu.Lock()
+		lastUsed := provider.LastUsed
+		provider.mu.Unlock()
+
+		if lastUsed.IsZero() || now.Sub(lastUsed) <= maxIdle || len(p.providers) == 1 {
+			continue
+		}
+		p.removeProvider(provider.Name)
+		p.log().Warn("llmpool: removed idle provider",
+			"provider", provider.Name, "last_used", lastUsed, "max_idle", maxIdle)
+	}
+}
@@ -0,0 +1,147 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"time"
+)
+
+// latencySamples is how many recent requests a provider's latency
+// percentiles are computed over. A fixed window keeps memory bounded and
+// lets the percentiles follow a provider that slows down.
+const latencySamples = 256
+
+// latencyWindow is a ring buffer of the latest latencySamples durations.
+// Guarded by Provider.mu.
+type latencyWindow struct {
+	samples [latencySamples]time.Duration
+	next    int
+	full    bool
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// LatencyStats summarizes a provider's recent request durations. They are
+// reported in milliseconds in JSON.
+type LatencyStats struct {
+	Samples int
+	Average time.Duration
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+}
+
+func (s LatencyStats) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return json.Marshal(map[string]any{
+		"samples": s.Samples,
+		"avg_ms":  ms(s.Average),
+		"p50_ms":  ms(s.P50),
+		"p95_ms":  ms(s.P95),
+		"p99_ms":  ms(s.P99),
+	})
+}
+
+// stats computes the window's average and nearest-rank percentiles
+func (w *latencyWindow) stats() LatencyStats {
+	n := w.next
+	if w.full {
+		n = latencySamples
+	}
+	if n == 0 {
+		return LatencyStats{}
+	}
+	sorted := slices.Clone(w.samples[:n])
+	slices.Sort(sorted)
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	rank := func(p int) time.Duration {
+		return sorted[(p*n+99)/100-1]
+	}
+	return LatencyStats{
+		Samples: n,
+		Average: total / time.Duration(n),
+		P50:     rank(50),
+		P95:     rank(95),
+		P99:     rank(99),
+	}
+}
+
+// Error classes counted in ProviderStats.ErrorsByClass
+const (
+	ErrorClassRateLimited     = "rate_limited"
+	ErrorClassAuth            = "auth"
+	ErrorClassBadRequest      = "bad_request"
+	ErrorClassContentFiltered = "content_filtered"
+	ErrorClassInvalidJSON     = "invalid_json"
+	ErrorClassTimeout         = "timeout"
+	ErrorClassUnavailable     = "unavailable"
+	ErrorClassNetwork         = "network"
+	ErrorClassOther           = "other"
+)
+
+// errorClass returns the class of a failed provider request
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return ErrorClassRateLimited
+	case errors.Is(err, ErrAuth):
+		return ErrorClassAuth
+	case errors.Is(err, ErrBadRequest):
+		return ErrorClassBadRequest
+	case errors.Is(err, ErrContentFiltered):
+		return ErrorClassContentFiltered
+	case errors.Is(err, ErrInvalidJSON):
+		return ErrorClassInvalidJSON
+	case errors.Is(err, ErrProviderTimeout):
+		return ErrorClassTimeout
+	case errors.Is(err, ErrProviderUnavailable):
+		return ErrorClassUnavailable
+	case errors.As(err, &netErr):
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// recordLatency adds the duration of a complete round trip to the
+// provider's window
+func (p *Pool) recordLatency(provider *Provider, d time.Duration) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.latency.add(d)
+}
+
+// recordFirstToken adds the time a stream took to deliver its first content
+func (p *Pool) recordFirstToken(provider *Provider, d time.Duration) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.firstToken.add(d)
+}
+
+// recordError notes a failed request, retried or not, as the provider's
+// last error and counts it by class
+func (p *Pool) recordError(provider *Provider, err error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.lastError = err.Error()
+	provider.lastErrorAt = time.Now()
+	if provider.errorClasses == nil {
+		provider.errorClasses = make(map[string]int)
+	}
+	provider.errorClasses[errorClass(err)]++
+}
@@ -0,0 +1,128 @@
+package llmpool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// modelList is the reply of the model listing endpoints, which page
+// differently per provider type
+type modelList struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+	// Anthropic pages with has_more and last_id
+	HasMore bool   `json:"has_more"`
+	LastID  string `json:"last_id"`
+	// Gemini lists "models/..." names and pages with nextPageToken; Ollama
+	// lists its local models by name
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// ListModels asks the named provider which models it serves and returns
+// their IDs, in the form its Model field takes
+func (p *Pool) ListModels(ctx context.Context, name string) ([]string, error) {
+	provider, ok := p.GetProviderByName(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+	}
+
+	var models []string
+	page := ""
+	for {
+		list, err := p.fetchModels(ctx, provider, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range list.Data {
+			models = append(models, m.ID)
+		}
+		for _, m := range list.Models {
+			models = append(models, strings.TrimPrefix(m.Name, "models/"))
+		}
+
+		switch {
+		case list.HasMore && list.LastID != "":
+			page = list.LastID
+		case list.NextPageToken != "":
+			page = list.NextPageToken
+		default:
+			return models, nil
+		}
+	}
+}
+
+// fetchModels gets one page of the provider's model list
+func (p *Pool) fetchModels(ctx context.Context, provider *Provider, page string) (*modelList, error) {
+	query := url.Values{}
+	var endpoint string
+	switch provider.Type {
+	case ProviderGroq, ProviderOpenAI, ProviderGemini:
+		endpoint = provider.BaseURL + "/models"
+		if page != "" {
+			query.Set("pageToken", page)
+		}
+	case ProviderAnthropic:
+		endpoint = provider.BaseURL + "/models"
+		query.Set("limit", "1000")
+		if page != "" {
+			query.Set("after_id", page)
+		}
+	case ProviderOllama:
+		endpoint = provider.BaseURL + "/api/tags"
+	case ProviderAzureOpenAI:
+		// The models the resource can deploy, not its deployments
+		endpoint = provider.BaseURL + "/openai/models"
+		query.Set("api-version", provider.apiVersion())
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %s", provider.Type)
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
+	setAuthHeaders(httpReq, provider)
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(provider, resp, body)
+	}
+
+	var list modelList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: fmt.Errorf("decoding model list: %w", err)}
+	}
+	return &list, nil
+}
+
+// HasModel reports whether model is in a list from ListModels. Ollama
+// lists tagged names, so "llama3.2" matches "llama3.2:latest".
+func HasModel(models []string, model string) bool {
+	for _, m := range models {
+		if m == model || m == model+":latest" {
+			return true
+		}
+	}
+	return false
+}
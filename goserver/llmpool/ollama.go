@@ -0,0 +1,141 @@
+package llmpool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultOllamaTimeout is the request timeout of Ollama providers without
+// their own Timeout; local models can take minutes to answer
+const DefaultOllamaTimeout = 5 * time.Minute
+
+// ollamaMessage is a message of Ollama's /api/chat. Images are bare base64.
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Format   string          `json:"format,omitempty"` // "json" for JSON mode
+	Options  struct {
+		Temperature      *float64 `json:"temperature,omitempty"`
+		TopP             *float64 `json:"top_p,omitempty"`
+		NumPredict       int      `json:"num_predict,omitempty"`
+		Stop             []string `json:"stop,omitempty"`
+		FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+		PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+		Seed             *int     `json:"seed,omitempty"`
+	} `json:"options"`
+}
+
+// ollamaResponse is an /api/chat reply, or one line of a stream. The last
+// line of a stream has Done set and carries the token counts.
+type ollamaResponse struct {
+	Model   string `json:"model"`
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+// newOllamaRequest converts req to /api/chat: text parts are joined and
+// images must be base64 data URLs
+func newOllamaRequest(provider *Provider, req *ChatRequest) (*ollamaRequest, error) {
+	out := &ollamaRequest{Model: req.model(provider), Stream: req.Stream}
+	out.Options.Temperature = req.Temperature
+	out.Options.TopP = req.TopP
+	out.Options.NumPredict = req.MaxTokens
+	out.Options.Stop = req.Stop
+	out.Options.FrequencyPenalty = req.FrequencyPenalty
+	out.Options.PresencePenalty = req.PresencePenalty
+	out.Options.Seed = req.Seed
+	if req.wantsJSON() {
+		out.Format = "json"
+	}
+
+	for i, msg := range req.Messages {
+		parts, err := messageParts(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		m := ollamaMessage{Role: msg.Role}
+		var text []string
+		for _, part := range parts {
+			switch part.Type {
+			case "text":
+				text = append(text, part.Text)
+			case "image_url":
+				if part.ImageURL == nil {
+					return nil, fmt.Errorf("message %d: image_url part has no url", i)
+				}
+				_, data, ok := splitDataURL(part.ImageURL.URL)
+				if !ok {
+					return nil, fmt.Errorf("message %d: images must be base64 data URLs", i)
+				}
+				m.Images = append(m.Images, data)
+			default:
+				return nil, fmt.Errorf("message %d: unsupported message part type %q", i, part.Type)
+			}
+		}
+		m.Content = strings.Join(text, "\n")
+		out.Messages = append(out.Messages, m)
+	}
+	return out, nil
+}
+
+// decode copies the reply's model and token counts into resp and returns its text
+func (r *ollamaResponse) decode(resp *ChatResponse) (string, error) {
+	if r.Error != "" {
+		return "", fmt.Errorf("ollama: %s", r.Error)
+	}
+	resp.Model = r.Model
+	if r.Done {
+		resp.Usage = tokenUsage{
+			PromptTokens:     r.PromptEvalCount,
+			CompletionTokens: r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+		}
+	}
+	return r.Message.Content, nil
+}
+
+func decodeOllamaEvent(data []byte, resp *ChatResponse) (string, bool, error) {
+	var event ollamaResponse
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", false, fmt.Errorf("decoding stream event: %w", err)
+	}
+	delta, err := event.decode(resp)
+	return delta, event.Done, err
+}
+
+// readJSONLines is readSSE for Ollama's newline-delimited JSON streams
+func readJSONLines(r io.Reader, fn func(data []byte) (done bool, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxStreamLine)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		done, err := fn([]byte(line))
+		if err != nil || done {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,186 @@
+package llmpool
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func ollamaProvider(baseURL string) *Provider {
+	return &Provider{Name: "ollama", Type: ProviderOllama, BaseURL: baseURL, Model: "llava:13b", Vision: true}
+}
+
+func TestOllamaChat(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, []byte(`{
+		"model": "llava:13b",
+		"created_at": "2026-10-17T10:00:00Z",
+		"message": {"role": "assistant", "content": "<p>{{total}}</p>"},
+		"done": true,
+		"done_reason": "stop",
+		"total_duration": 5191566416,
+		"prompt_eval_count": 26,
+		"eval_count": 298
+	}`)))
+	p := newTestPool(t, ollamaProvider(stub.URL))
+
+	resp, err := p.Chat(context.Background(), &ChatRequest{
+		Messages: []ChatMessage{
+			{Role: "system", Content: "You design invoices."},
+			{Role: "user", Content: []MessagePart{
+				{Type: "text", Text: "Like this"},
+				{Type: "image_url", ImageURL: &ImageURLObject{URL: "data:image/png;base64,iVBORw0KGgo="}},
+				{Type: "text", Text: "but in blue"},
+			}},
+		},
+		Temperature: Ptr(0.3),
+		MaxTokens:   500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := stub.only(t)
+	if sent.Method != "POST" || sent.URL != "/api/chat" {
+		t.Errorf("%s %s", sent.Method, sent.URL)
+	}
+	if auth := sent.Header.Get("Authorization"); auth != "" {
+		t.Errorf("Authorization %q sent without an API key", auth)
+	}
+	assertJSON(t, sent.Body, `{
+		"model": "llava:13b",
+		"messages": [
+			{"role": "system", "content": "You design invoices."},
+			{"role": "user", "content": "Like this\nbut in blue", "images": ["iVBORw0KGgo="]}
+		],
+		"stream": false,
+		"options": {"temperature": 0.3, "num_predict": 500}
+	}`)
+
+	if resp.Content != "<p>{{total}}</p>" || resp.Model != "llava:13b" || resp.Provider != "ollama" {
+		t.Errorf("response %+v", *resp)
+	}
+	if want := (tokenUsage{PromptTokens: 26, CompletionTokens: 298, TotalTokens: 324}); resp.Usage != want {
+		t.Errorf("usage %+v, want %+v", resp.Usage, want)
+	}
+}
+
+func TestOllamaAPIKey(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, []byte(`{"model": "llama3", "message": {"content": "{\"total\": 1}"}, "done": true}`)))
+	provider := ollamaProvider(stub.URL)
+	provider.APIKey = "behind-a-proxy"
+	p := newTestPool(t, provider)
+
+	if _, err := p.Chat(context.Background(), &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}, ResponseFormat: ResponseFormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+	sent := stub.only(t)
+	if auth := sent.Header.Get("Authorization"); auth != "Bearer behind-a-proxy" {
+		t.Errorf("Authorization %q", auth)
+	}
+	if !strings.Contains(string(sent.Body), `"format":"json"`) {
+		t.Errorf("JSON mode not asked for: %s", sent.Body)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	stub := newStubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte(`{"model":"llava:13b","message":{"role":"assistant","content":"<p>"},"done":false}
+{"model":"llava:13b","message":{"role":"assistant","content":"{{total}}"},"done":false}
+
+{"model":"llava:13b","message":{"role":"assistant","content":"</p>"},"done":false}
+{"model":"llava:13b","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":12,"eval_count":3}
+`))
+	})
+	p := newTestPool(t, ollamaProvider(stub.URL))
+
+	var chunks []string
+	resp, err := p.ChatStream(context.Background(), &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}}, func(c StreamChunk) error {
+		chunks = append(chunks, c.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(stub.only(t).Body); !strings.Contains(body, `"stream":true`) {
+		t.Errorf("stream not asked for: %s", body)
+	}
+	if !slices.Equal(chunks, []string{"<p>", "{{total}}", "</p>"}) {
+		t.Errorf("chunks %q", chunks)
+	}
+	if resp.Content != "<p>{{total}}</p>" {
+		t.Errorf("content %q", resp.Content)
+	}
+	if want := (tokenUsage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}); resp.Usage != want {
+		t.Errorf("usage %+v, want %+v", resp.Usage, want)
+	}
+}
+
+func TestOllamaTruncatedStream(t *testing.T) {
+	stub := newStubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"model":"llava:13b","message":{"content":"<p>"},"done":false}` + "\n"))
+	})
+	p := newTestPool(t, ollamaProvider(stub.URL))
+
+	_, err := p.ChatStreamWithProvider(context.Background(), "ollama", &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}}, func(StreamChunk) error { return nil })
+	if err == nil {
+		t.Fatal("a stream ending without done succeeded")
+	}
+}
+
+func TestOllamaErrors(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+	}{
+		"model not pulled": {404, `{"error": "model \"llava:13b\" not found, try pulling it first"}`},
+		"error in reply":   {200, `{"error": "out of memory"}`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			stub := newStubServer(t, replyWith(tt.status, []byte(tt.body)))
+			p := newTestPool(t, ollamaProvider(stub.URL))
+
+			_, err := p.ChatWithProvider(context.Background(), "ollama", &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}})
+			if err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestOllamaImageURL(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, []byte(`{"done": true}`)))
+	p := newTestPool(t, ollamaProvider(stub.URL))
+
+	_, err := p.Chat(context.Background(), &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: []MessagePart{
+		{Type: "image_url", ImageURL: &ImageURLObject{URL: "https://example.test/a.png"}},
+	}}}})
+	if err == nil {
+		t.Error("image URL accepted; Ollama only takes inline images")
+	}
+	if stub.hits() != 0 {
+		t.Errorf("%d requests sent for an invalid request", stub.hits())
+	}
+}
+
+func TestOllamaListModels(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, []byte(`{"models": [
+		{"name": "llava:13b", "model": "llava:13b", "size": 8000000000},
+		{"name": "llama3.1:8b", "model": "llama3.1:8b", "size": 4700000000}
+	]}`)))
+	p := newTestPool(t, ollamaProvider(stub.URL))
+
+	models, err := p.ListModels(context.Background(), "ollama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := stub.only(t); sent.Method != "GET" || sent.URL != "/api/tags" {
+		t.Errorf("%s %s", sent.Method, sent.URL)
+	}
+	if !slices.Equal(models, []string{"llava:13b", "llama3.1:8b"}) {
+		t.Errorf("models %q", models)
+	}
+}
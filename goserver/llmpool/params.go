@@ -0,0 +1,15 @@
+package llmpool
+
+// Ptr returns a pointer to v, for ChatRequest's optional parameters:
+// Temperature: llmpool.Ptr(0.2)
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// setParam sets body[key] to *v if v is set, leaving the provider's
+// default otherwise
+func setParam[T any](body map[string]any, key string, v *T) {
+	if v != nil {
+		body[key] = *v
+	}
+}
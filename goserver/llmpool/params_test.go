@@ -0,0 +1,140 @@
+package llmpool
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSamplingParameters(t *testing.T) {
+	unset := &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}}
+	// Temperature 0 is set, not unset, and must reach the provider
+	set := &ChatRequest{
+		Messages:         []ChatMessage{{Role: "user", Content: "hi"}},
+		Temperature:      Ptr(0.0),
+		MaxTokens:        100,
+		TopP:             Ptr(0.9),
+		Stop:             []string{"END"},
+		FrequencyPenalty: Ptr(0.5),
+		PresencePenalty:  Ptr(-0.5),
+		Seed:             Ptr(42),
+	}
+
+	const openAISet = `{
+		"frequency_penalty": 0.5,
+		"max_tokens": 100,
+		"messages": [{"role": "user", "content": "hi"}],
+		"model": "m",
+		"presence_penalty": -0.5,
+		"seed": 42,
+		"stop": ["END"],
+		"stream": false,
+		"temperature": 0,
+		"top_p": 0.9
+	}`
+	tests := []struct {
+		provider   *Provider
+		unset, set string
+	}{
+		{
+			&Provider{Name: "openai", Type: ProviderOpenAI, Model: "m"},
+			`{"messages": [{"role": "user", "content": "hi"}], "model": "m", "stream": false}`,
+			openAISet,
+		},
+		{
+			&Provider{Name: "groq", Type: ProviderGroq, Model: "m"},
+			`{"messages": [{"role": "user", "content": "hi"}], "model": "m", "stream": false}`,
+			openAISet,
+		},
+		{
+			&Provider{Name: "azure", Type: ProviderAzureOpenAI, Deployment: "d", Model: "m"},
+			`{"messages": [{"role": "user", "content": "hi"}], "stream": false}`,
+			`{
+				"frequency_penalty": 0.5,
+				"max_tokens": 100,
+				"messages": [{"role": "user", "content": "hi"}],
+				"presence_penalty": -0.5,
+				"seed": 42,
+				"stop": ["END"],
+				"stream": false,
+				"temperature": 0,
+				"top_p": 0.9
+			}`,
+		},
+		{
+			&Provider{Name: "anthropic", Type: ProviderAnthropic, Model: "m"},
+			`{"max_tokens": 4096, "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}], "model": "m"}`,
+			`{
+				"max_tokens": 100,
+				"messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}],
+				"model": "m",
+				"stop_sequences": ["END"],
+				"temperature": 0,
+				"top_p": 0.9
+			}`,
+		},
+		{
+			&Provider{Name: "gemini", Type: ProviderGemini, Model: "m"},
+			`{"contents": [{"role": "user", "parts": [{"text": "hi"}]}], "generationConfig": {}}`,
+			`{
+				"contents": [{"role": "user", "parts": [{"text": "hi"}]}],
+				"generationConfig": {
+					"temperature": 0,
+					"topP": 0.9,
+					"maxOutputTokens": 100,
+					"stopSequences": ["END"],
+					"frequencyPenalty": 0.5,
+					"presencePenalty": -0.5,
+					"seed": 42
+				}
+			}`,
+		},
+		{
+			&Provider{Name: "ollama", Type: ProviderOllama, Model: "m"},
+			`{"model": "m", "messages": [{"role": "user", "content": "hi"}], "stream": false, "options": {}}`,
+			`{
+				"model": "m",
+				"messages": [{"role": "user", "content": "hi"}],
+				"stream": false,
+				"options": {
+					"temperature": 0,
+					"top_p": 0.9,
+					"num_predict": 100,
+					"stop": ["END"],
+					"frequency_penalty": 0.5,
+					"presence_penalty": -0.5,
+					"seed": 42
+				}
+			}`,
+		},
+	}
+	p := NewPool()
+	for _, tt := range tests {
+		t.Run(tt.provider.Type, func(t *testing.T) {
+			got, err := p.ConvertToProviderFormat(tt.provider, unset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, got, tt.unset)
+
+			got, err = p.ConvertToProviderFormat(tt.provider, set)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, got, tt.set)
+		})
+	}
+}
+
+// A request decoded from JSON keeps an explicit 0 apart from a missing field
+func TestSamplingParametersFromJSON(t *testing.T) {
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(`{"messages": [], "temperature": 0, "seed": 0}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Temperature == nil || *req.Temperature != 0 || req.Seed == nil || *req.Seed != 0 {
+		t.Errorf("explicit zeros lost: temperature %v, seed %v", req.Temperature, req.Seed)
+	}
+	if req.TopP != nil || req.FrequencyPenalty != nil || req.PresencePenalty != nil {
+		t.Errorf("missing fields set: %+v", req)
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"math"
 	"net/http"
-	"sort"
+	"net/url"
+	"slices"
 	"sync"
 	"time"
 )
@@ -17,8 +21,17 @@ const (
 	ProviderGroq      = "groq"
 	ProviderOpenAI    = "openai"
 	ProviderAnthropic = "anthropic"
+	ProviderGemini    = "gemini"
+	// ProviderOllama is a local Ollama server; the API key is optional
+	ProviderOllama = "ollama"
+	// ProviderAzureOpenAI is an Azure OpenAI deployment; Deployment picks
+	// the model and Model is ignored
+	ProviderAzureOpenAI = "azure-openai"
 )
 
+// DefaultAzureAPIVersion is the api-version of Azure providers without an APIVersion
+const DefaultAzureAPIVersion = "2024-10-21"
+
 // Provider represents an LLM API provider
 type Provider struct {
 	Name     string `json:"name"`
@@ -27,16 +40,68 @@ type Provider struct {
 	BaseURL  string `json:"base_url"`
 	Model    string `json:"model"`
 	Priority int    `json:"priority"` // Lower number = higher priority
-
-	// Rate limiting
-	RequestsPerMinute int       `json:"requests_per_minute"`
-	RequestCount      int       `json:"-"`
-	LastReset         time.Time `json:"-"`
-
-	// Usage tracking
+	Weight   int    `json:"weight"`   // Share of picks among equal priorities, or in WeightedRoundRobin mode (default 1)
+	Vision   bool   `json:"vision"`   // Model accepts image_url message parts
+
+	// Retry is how transient failures are retried on this provider before
+	// failing over; nil uses DefaultRetryPolicy
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// Azure OpenAI deployment name and api-version
+	Deployment string `json:"deployment,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+
+	// Timeout bounds each request, instead of the pool client's timeout,
+	// and for streams the wait for each chunk. ChatRequest.Timeout
+	// overrides it; Ollama providers default to DefaultOllamaTimeout.
+	Timeout time.Duration `json:"timeout"`
+
+	// Prices in dollars per 1000 prompt and completion tokens, for TotalCost
+	// and budgets; see Pool.SetBudget
+	InputCostPer1K  float64 `json:"input_cost_per_1k"`
+	OutputCostPer1K float64 `json:"output_cost_per_1k"`
+
+	// Rate limits, paced by token buckets; zero means unlimited. Requests
+	// are charged an estimate of their tokens, see WithTokenCounter.
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute"`
+	limiter           rateLimiter
+
+	// Usage tracking. Retried attempts count as Retries, not Errors or
+	// TotalRequests.
 	TotalRequests int       `json:"-"`
 	Errors        int       `json:"-"`
+	Retries       int       `json:"-"`
 	LastUsed      time.Time `json:"-"`
+	InFlight      int       `json:"-"` // requests being sent, retries included
+	TotalCost     float64   `json:"-"`
+	budget        *budget
+
+	// Recent round trip durations, stream times to first token, and the
+	// failed attempts; see ProviderStats
+	latency      latencyWindow
+	firstToken   latencyWindow
+	lastError    string
+	lastErrorAt  time.Time
+	errorClasses map[string]int
+
+	// Requests answered from the pool's cache with this provider's
+	// replies, and those whose reply from it was cached
+	cacheHits   int
+	cacheMisses int
+
+	// Circuit breaker: open until CoolOffUntil after repeated failures; see
+	// Pool.WithCoolOff and BreakerOpen
+	ConsecutiveErrors int       `json:"-"`
+	CoolOffUntil      time.Time `json:"-"`
+	authTripped       bool      // credentials rejected; open until ResetProvider
+	probing           bool      // a half-open probe is in flight
+
+	currentWeight int // smooth weighted round-robin state, guarded by Pool.selMu
+
+	// Priority override set by SetEffectivePriority, guarded by Pool.mu
+	effectivePriority  int
+	priorityOverridden bool
 
 	mu sync.Mutex `json:"-"`
 }
@@ -58,38 +123,97 @@ type ChatMessage struct {
 	Content any    `json:"content"` // string or []MessagePart
 }
 
-// ChatRequest represents the standardized request format
+// ChatRequest represents the standardized request format. Unset sampling
+// parameters are left out of the provider request so its defaults apply;
+// see Ptr for setting the pointer fields.
 type ChatRequest struct {
-	Messages    []ChatMessage `json:"messages"`
-	Model       string        `json:"model,omitempty"`
-	Temperature float64       `json:"temperature,omitempty"`
-	MaxTokens   int           `json:"max_tokens,omitempty"`
-	Stream      bool          `json:"stream,omitempty"`
+	Messages []ChatMessage `json:"messages"`
+	// Model replaces the provider's Model, except on Azure, which serves
+	// its deployment's model
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	// MaxTokens of 0 leaves the limit to the provider, except Anthropic,
+	// which requires one and gets DefaultAnthropicMaxTokens
+	MaxTokens int      `json:"max_tokens,omitempty"`
+	TopP      *float64 `json:"top_p,omitempty"`
+	// Stop ends the reply at the first of these sequences
+	Stop []string `json:"stop,omitempty"`
+	// FrequencyPenalty, PresencePenalty and Seed are left out of Anthropic
+	// requests, which don't take them
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stream           bool     `json:"stream,omitempty"`
+	// Tools are functions the model may call; see ChatResponse.ToolCalls.
+	// Requests with tools only go to OpenAI-compatible and Anthropic
+	// providers, and streams don't report the calls.
+	Tools []ToolDefinition `json:"tools,omitempty"`
+	// ResponseFormat is ResponseFormatText (the default) or
+	// ResponseFormatJSON, which uses the provider's JSON mode and fails
+	// over replies that aren't JSON. Anthropic has no JSON mode and is
+	// only asked for JSON in the last user message, so its replies fail
+	// over more often.
+	ResponseFormat string `json:"response_format,omitempty"`
+
+	// WaitForCapacity makes Chat wait for a rate limited provider, as the
+	// pool does with WithWaitForCapacity
+	WaitForCapacity bool `json:"-"`
+	// Timeout replaces the providers' Timeout for this request. The
+	// context's deadline still applies.
+	Timeout time.Duration `json:"-"`
 }
 
 // ChatResponse represents the standardized response format
 type ChatResponse struct {
-	ID      string `json:"id"`
-	Content string `json:"content"`
-	Model   string `json:"model"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-	Provider string `json:"provider"`
+	ID       string     `json:"id"`
+	Content  string     `json:"content"`
+	Model    string     `json:"model"`
+	Usage    tokenUsage `json:"usage"`
+	Provider string     `json:"provider"`
+	// ToolCalls are the calls to ChatRequest.Tools the model made instead
+	// of, or along with, Content
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// Cached is set on a reply served from the pool's cache
+	Cached bool `json:"cached,omitempty"`
 }
 
 // ProviderStats contains statistics for a provider
 type ProviderStats struct {
 	Type              string    `json:"type"`
 	Priority          int       `json:"priority"`
+	EffectivePriority int       `json:"effective_priority"`
 	RequestsPerMinute int       `json:"requests_per_minute"`
-	CurrentRequests   int       `json:"current_requests"`
+	TokensPerMinute   int       `json:"tokens_per_minute"`
+	CurrentRequests   int       `json:"current_requests"` // share of the rate limits in use, i.e. not yet refilled
+	CurrentTokens     int       `json:"current_tokens"`
 	TotalRequests     int       `json:"total_requests"`
 	Errors            int       `json:"errors"`
+	Retries           int       `json:"retries"`
+	InFlight          int       `json:"in_flight"`
+	TotalCost         float64   `json:"total_cost"`
 	LastUsed          time.Time `json:"last_used"`
 	SuccessRate       float64   `json:"success_rate"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	CoolOffUntil      time.Time `json:"cool_off_until"`
+	// BreakerState is closed, open or half_open; NextProbeAt is when an
+	// open breaker lets a probe through (zero if it waits for ResetProvider)
+	BreakerState string    `json:"breaker_state"`
+	NextProbeAt  time.Time `json:"next_probe_at"`
+	// Budget is the spend in the current budget period, if there is a budget
+	Budget *BudgetStats `json:"budget,omitempty"`
+	// Latency covers the last requests' round trips, body included;
+	// TimeToFirstToken the wait for the first content of the last streams
+	Latency          LatencyStats `json:"latency"`
+	TimeToFirstToken LatencyStats `json:"time_to_first_token"`
+	// LastError is the last failed attempt, retries included, and
+	// ErrorsByClass counts them by their ErrorClass
+	LastError     string         `json:"last_error,omitempty"`
+	LastErrorAt   time.Time      `json:"last_error_at"`
+	ErrorsByClass map[string]int `json:"errors_by_class,omitempty"`
+	// CacheHits counts requests answered from the cache with the
+	// provider's replies, CacheMisses those it answered and were cached
+	CacheHits   int `json:"cache_hits"`
+	CacheMisses int `json:"cache_misses"`
 }
 
 // Pool manages multiple LLM providers with load balancing and failover
@@ -97,6 +221,90 @@ type Pool struct {
 	providers []*Provider
 	mu        sync.RWMutex
 	client    *http.Client
+
+	// Selection state
+	mode   SelectionMode
+	rrNext int
+	selMu  sync.Mutex
+
+	observer func(RequestEvent)
+	logger   *slog.Logger
+
+	// A provider failing coolOffThreshold times in a row is skipped for coolOffDuration
+	coolOffThreshold int
+	coolOffDuration  time.Duration
+
+	tokenCounter    func(*ChatRequest) int
+	waitForCapacity bool
+
+	// Replies by request, see EnableCache; nil when disabled
+	cache               *responseCache
+	cacheMaxTemperature *float64
+}
+
+// Default cool-off policy
+const (
+	DefaultCoolOffThreshold = 3
+	DefaultCoolOffDuration  = 30 * time.Second
+)
+
+// RequestEvent describes one completed provider call, for metrics collection
+type RequestEvent struct {
+	Provider         string
+	Type             string
+	Duration         time.Duration
+	Success          bool
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// WithObserver registers fn to be called after every provider call and returns the pool for chaining
+func (p *Pool) WithObserver(fn func(RequestEvent)) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.observer = fn
+	return p
+}
+
+// observe reports a finished provider call to the observer, if any
+func (p *Pool) observe(provider *Provider, start time.Time, resp *ChatResponse) {
+	p.mu.RLock()
+	fn := p.observer
+	p.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+
+	event := RequestEvent{
+		Provider: provider.Name,
+		Type:     provider.Type,
+		Duration: time.Since(start),
+		Success:  resp != nil,
+	}
+	if resp != nil {
+		event.PromptTokens = resp.Usage.PromptTokens
+		event.CompletionTokens = resp.Usage.CompletionTokens
+	}
+	fn(event)
+}
+
+// WithLogger sets the logger for the pool's warnings (slog.Default if
+// unset) and returns the pool for chaining
+func (p *Pool) WithLogger(logger *slog.Logger) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.logger = logger
+	return p
+}
+
+// log returns the pool's logger
+func (p *Pool) log() *slog.Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return slog.Default()
 }
 
 // NewPool creates a new provider pool
@@ -106,48 +314,110 @@ func NewPool() *Pool {
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		coolOffThreshold: DefaultCoolOffThreshold,
+		coolOffDuration:  DefaultCoolOffDuration,
 	}
 }
 
 // NewPoolWithClient creates a new provider pool with a custom HTTP client
 func NewPoolWithClient(client *http.Client) *Pool {
 	return &Pool{
-		providers: make([]*Provider, 0),
-		client:    client,
+		providers:        make([]*Provider, 0),
+		client:           client,
+		coolOffThreshold: DefaultCoolOffThreshold,
+		coolOffDuration:  DefaultCoolOffDuration,
 	}
 }
 
-// AddProvider adds a provider to the pool
-func (p *Pool) AddProvider(provider *Provider) {
+// WithCoolOff sets how many consecutive errors open a provider's circuit
+// breaker and how long it stays open before a probe, and returns the pool
+// for chaining. A zero threshold disables the breaker, except for rejected
+// credentials.
+func (p *Pool) WithCoolOff(threshold int, duration time.Duration) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.coolOffThreshold = threshold
+	p.coolOffDuration = duration
+	return p
+}
+
+// AddProvider adds a provider to the pool. It fails, leaving the pool
+// unchanged, for a provider that could never send a request.
+func (p *Pool) AddProvider(provider *Provider) error {
+	if err := provider.validate(); err != nil {
+		return err
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	provider.LastReset = time.Now()
 	p.providers = append(p.providers, provider)
+	p.sortProviders()
+	return nil
+}
 
-	// Sort by priority (Groq first if same priority)
-	sort.Slice(p.providers, func(i, j int) bool {
-		if p.providers[i].Priority == p.providers[j].Priority {
-			return p.providers[i].Type == ProviderGroq
+// validate checks the fields a provider's type requires
+func (pr *Provider) validate() error {
+	switch pr.Type {
+	case ProviderGroq, ProviderOpenAI, ProviderAnthropic, ProviderGemini, ProviderOllama:
+	case ProviderAzureOpenAI:
+		if pr.Deployment == "" {
+			return fmt.Errorf("provider %s: azure-openai providers need a Deployment", pr.Name)
 		}
-		return p.providers[i].Priority < p.providers[j].Priority
-	})
+	default:
+		return fmt.Errorf("provider %s: unsupported provider type: %s", pr.Name, pr.Type)
+	}
+	if pr.BaseURL == "" {
+		return fmt.Errorf("provider %s: BaseURL is required", pr.Name)
+	}
+	return nil
 }
 
 // RemoveProvider removes a provider from the pool
 func (p *Pool) RemoveProvider(name string) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	return p.removeProvider(name)
+}
 
+// removeProvider removes the named provider. Callers must hold p.mu.
+func (p *Pool) removeProvider(name string) bool {
 	for i, provider := range p.providers {
 		if provider.Name == name {
-			p.providers = append(p.providers[:i], p.providers[i+1:]...)
+			p.providers = slices.Delete(p.providers, i, i+1)
 			return true
 		}
 	}
 	return false
 }
 
+// Reset zeroes every provider's counters, cache counts, latency samples
+// and last error and refills its rate limits, e.g. between benchmark runs. Cool-off state and budget
+// spend are kept: a provider that is failing or out of budget stays skipped.
+func (p *Pool) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, provider := range p.providers {
+		provider.mu.Lock()
+		provider.limiter = rateLimiter{}
+		provider.TotalRequests = 0
+		provider.Errors = 0
+		provider.Retries = 0
+		provider.TotalCost = 0
+		provider.LastUsed = time.Time{}
+		provider.latency = latencyWindow{}
+		provider.firstToken = latencyWindow{}
+		provider.lastError = ""
+		provider.lastErrorAt = time.Time{}
+		provider.errorClasses = nil
+		provider.cacheHits = 0
+		provider.cacheMisses = 0
+		provider.mu.Unlock()
+	}
+}
+
 // GetProviders returns a copy of all providers (without sensitive data)
 func (p *Pool) GetProviders() []Provider {
 	p.mu.RLock()
@@ -155,138 +425,389 @@ func (p *Pool) GetProviders() []Provider {
 
 	providers := make([]Provider, len(p.providers))
 	for i, provider := range p.providers {
-		providers[i] = *provider
+		providers[i] = provider.snapshot()
 		providers[i].APIKey = "***" // Hide API key
 	}
 	return providers
 }
 
-// CanUseProvider checks if a provider can be used (rate limit check)
+// snapshot returns a copy of the provider's fields without its mutex
+func (pr *Provider) snapshot() Provider {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	return Provider{
+		Name:              pr.Name,
+		Type:              pr.Type,
+		APIKey:            pr.APIKey,
+		BaseURL:           pr.BaseURL,
+		Model:             pr.Model,
+		Priority:          pr.Priority,
+		Weight:            pr.Weight,
+		Vision:            pr.Vision,
+		Retry:             pr.Retry,
+		Deployment:        pr.Deployment,
+		APIVersion:        pr.APIVersion,
+		Timeout:           pr.Timeout,
+		RequestsPerMinute: pr.RequestsPerMinute,
+		TokensPerMinute:   pr.TokensPerMinute,
+		TotalRequests:     pr.TotalRequests,
+		Errors:            pr.Errors,
+		Retries:           pr.Retries,
+		LastUsed:          pr.LastUsed,
+		InFlight:          pr.InFlight,
+		InputCostPer1K:    pr.InputCostPer1K,
+		OutputCostPer1K:   pr.OutputCostPer1K,
+		TotalCost:         pr.TotalCost,
+		ConsecutiveErrors: pr.ConsecutiveErrors,
+		CoolOffUntil:      pr.CoolOffUntil,
+	}
+}
+
+// CanUseProvider checks if a provider can be used: its breaker lets
+// requests through, it is under both rate limits and within its budget
 func (p *Pool) CanUseProvider(provider *Provider) bool {
+	return p.canServe(provider, 0)
+}
+
+// canServe is CanUseProvider for a request estimated at tokens
+func (p *Pool) canServe(provider *Provider, tokens int) bool {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
 
 	now := time.Now()
 
-	// Reset rate limit counter every minute
-	if now.Sub(provider.LastReset) >= time.Minute {
-		provider.RequestCount = 0
-		provider.LastReset = now
+	switch provider.breakerState(now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if provider.probing {
+			return false
+		}
+	}
+
+	return !provider.overBudget(now) && provider.hasCapacity(now, tokens)
+}
+
+// checkUsable returns the error of ChatWithProvider for a provider that
+// can't take a request estimated at tokens, or nil if it can
+func (p *Pool) checkUsable(provider *Provider, tokens int) error {
+	if p.canServe(provider, tokens) {
+		return nil
 	}
+	provider.mu.Lock()
+	overBudget := provider.overBudget(time.Now())
+	provider.mu.Unlock()
 
-	return provider.RequestCount < provider.RequestsPerMinute
+	if overBudget {
+		return &ProviderError{Provider: provider.Name, Err: ErrBudgetExceeded}
+	}
+	return &ProviderError{Provider: provider.Name, Err: ErrProviderUnavailable}
 }
 
-// SelectProvider selects the best available provider
+// SelectProvider selects the best available provider. When every provider
+// is at its rate limits it returns a *RateLimitError rather than a
+// provider that would refuse the request.
 func (p *Pool) SelectProvider() (*Provider, error) {
+	return p.selectProviderFor(&ChatRequest{}, 0, nil)
+}
+
+// selectProviderFor picks a provider able to serve req, estimated at tokens:
+// requests carrying images only go to providers flagged with Vision, and
+// those with tools to providers that support them.
+// Providers in tried already failed req and are only picked again once
+// every eligible provider has been tried.
+func (p *Pool) selectProviderFor(req *ChatRequest, tokens int, tried map[*Provider]bool) (*Provider, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	// First, try to find an available provider by priority
+	vision := req.hasImages()
+	tools := len(req.Tools) > 0
+	eligible := func(provider *Provider) bool {
+		return (!vision || provider.Vision) && (!tools || provider.supportsTools())
+	}
+
+	selected := p.pick(func(provider *Provider) bool {
+		return eligible(provider) && !tried[provider] && p.canServe(provider, tokens)
+	})
+	if selected == nil && p.allTried(eligible, tried) {
+		selected = p.pick(func(provider *Provider) bool {
+			return eligible(provider) && p.canServe(provider, tokens)
+		})
+	}
+	if selected != nil {
+		return selected, nil
+	}
+
 	for _, provider := range p.providers {
+		if eligible(provider) {
+			return nil, p.unavailable(eligible, tokens)
+		}
+	}
+	if vision {
+		return nil, ErrNoVisionProvider
+	}
+	if tools {
+		return nil, ErrNoToolProvider
+	}
+	return nil, ErrNoProviders
+}
+
+// allTried reports whether every eligible provider is in tried. Callers
+// must hold p.mu (read).
+func (p *Pool) allTried(eligible func(*Provider) bool, tried map[*Provider]bool) bool {
+	if len(tried) == 0 {
+		return false
+	}
+	for _, provider := range p.providers {
+		if eligible(provider) && !tried[provider] {
+			return false
+		}
+	}
+	return true
+}
+
+// pick selects among the providers for which usable is true according to
+// the selection mode. Callers must hold p.mu (read).
+func (p *Pool) pick(usable func(*Provider) bool) *Provider {
+	p.selMu.Lock()
+	defer p.selMu.Unlock()
+
+	switch p.mode {
+	case RoundRobinMode:
+		return p.selectRoundRobin(usable)
+	case WeightedRoundRobin:
+		return p.selectWeighted(p.providers, usable)
+	case LeastLoadedMode, WeightedLeastLoaded:
+		return p.selectLeastLoaded(usable, p.mode == WeightedLeastLoaded)
+	}
+
+	// Priority mode: the best tier with a usable provider, shared out
+	// among its providers by weight
+	for start := 0; start < len(p.providers); {
+		end := start + 1
+		for end < len(p.providers) && p.providers[end].effective() == p.providers[start].effective() {
+			end++
+		}
+		if selected := p.selectWeighted(p.providers[start:end], usable); selected != nil {
+			return selected
+		}
+		start = end
+	}
+	return nil
+}
+
+// hasImages reports whether any message carries an image part
+func (r *ChatRequest) hasImages() bool {
+	for _, msg := range r.Messages {
+		parts, ok := msg.Content.([]MessagePart)
+		if !ok {
+			continue
+		}
+		for _, part := range parts {
+			if part.ImageURL != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SelectProviderByType returns the first available provider of the given type, in priority order
+func (p *Pool) SelectProviderByType(providerType string) (*Provider, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	found := false
+	for _, provider := range p.providers {
+		if provider.Type != providerType {
+			continue
+		}
+		found = true
 		if p.CanUseProvider(provider) {
 			return provider, nil
 		}
 	}
 
-	// If all providers are rate limited, return the one with the lowest usage
-	if len(p.providers) == 0 {
-		return nil, fmt.Errorf("no providers available")
+	if found {
+		return nil, fmt.Errorf("all providers of type %s are rate limited", providerType)
 	}
+	return nil, fmt.Errorf("no providers of type %s", providerType)
+}
+
+// SelectProviderByName returns the named provider regardless of its availability
+func (p *Pool) SelectProviderByName(name string) (*Provider, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	// Return the provider that was used least recently
-	leastRecent := p.providers[0]
-	for _, provider := range p.providers[1:] {
-		if provider.LastUsed.Before(leastRecent.LastUsed) {
-			leastRecent = provider
+	for _, provider := range p.providers {
+		if provider.Name == name {
+			if !p.CanUseProvider(provider) {
+				p.log().Warn("llmpool: provider selected by name while unavailable", "provider", name)
+			}
+			return provider, nil
 		}
 	}
+	return nil, fmt.Errorf("%w: %s", ErrProviderNotFound, name)
+}
 
-	return leastRecent, nil
+// GetProviderByName returns the pool's own provider struct, not a copy, for
+// inspection by tests and admin tooling. Its fields change under the
+// provider's mutex while requests run: read or modify them only between
+// provider.Lock and provider.Unlock.
+func (p *Pool) GetProviderByName(name string) (*Provider, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, provider := range p.providers {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return nil, false
 }
 
+// Lock locks the provider's stats and rate limit state; see GetProviderByName
+func (pr *Provider) Lock() { pr.mu.Lock() }
+
+// Unlock unlocks the provider locked by Lock
+func (pr *Provider) Unlock() { pr.mu.Unlock() }
+
 // UpdateProviderStats updates provider statistics
 func (p *Pool) UpdateProviderStats(provider *Provider, success bool) {
 	provider.mu.Lock()
 	defer provider.mu.Unlock()
 
-	provider.RequestCount++
 	provider.TotalRequests++
 	provider.LastUsed = time.Now()
 
-	if !success {
-		provider.Errors++
+	if success {
+		provider.ConsecutiveErrors = 0
+		provider.CoolOffUntil = time.Time{}
+		return
+	}
+
+	provider.Errors++
+	provider.ConsecutiveErrors++
+	if p.coolOffThreshold > 0 && provider.ConsecutiveErrors >= p.coolOffThreshold {
+		provider.CoolOffUntil = provider.LastUsed.Add(p.coolOffDuration)
+		p.log().Warn("llmpool: provider cooling off after repeated failures",
+			"provider", provider.Name, "consecutive_errors", provider.ConsecutiveErrors, "until", provider.CoolOffUntil)
 	}
 }
 
 // ConvertToProviderFormat converts standardized request to provider-specific format
 func (p *Pool) ConvertToProviderFormat(provider *Provider, req *ChatRequest) ([]byte, error) {
 	switch provider.Type {
-	case ProviderGroq, ProviderOpenAI:
-		// Both use OpenAI-compatible format
+	case ProviderGroq, ProviderOpenAI, ProviderAzureOpenAI:
+		// All use OpenAI-compatible format
 		openaiReq := map[string]interface{}{
-			"model":       provider.Model,
-			"messages":    req.Messages,
-			"temperature": req.Temperature,
-			"max_tokens":  req.MaxTokens,
-			"stream":      req.Stream,
+			"messages": req.Messages,
+			"stream":   req.Stream,
+		}
+		setParam(openaiReq, "temperature", req.Temperature)
+		setParam(openaiReq, "top_p", req.TopP)
+		setParam(openaiReq, "frequency_penalty", req.FrequencyPenalty)
+		setParam(openaiReq, "presence_penalty", req.PresencePenalty)
+		setParam(openaiReq, "seed", req.Seed)
+		if req.MaxTokens > 0 {
+			openaiReq["max_tokens"] = req.MaxTokens
+		}
+		if len(req.Stop) > 0 {
+			openaiReq["stop"] = req.Stop
+		}
+		// Azure serves the deployment's model whatever is asked for
+		if provider.Type != ProviderAzureOpenAI {
+			openaiReq["model"] = req.model(provider)
+		}
+		// Groq reports stream usage unasked; the others only with include_usage
+		if req.Stream && provider.Type != ProviderGroq {
+			openaiReq["stream_options"] = map[string]any{"include_usage": true}
+		}
+		if req.wantsJSON() {
+			openaiReq["response_format"] = map[string]any{"type": ResponseFormatJSON}
+		}
+		if len(req.Tools) > 0 {
+			openaiReq["tools"] = openAITools(req.Tools)
 		}
 		return json.Marshal(openaiReq)
 
 	case ProviderAnthropic:
-		// Convert to Anthropic format
-		var systemMsg string
-		var messages []map[string]string
-
-		for _, msg := range req.Messages {
-			if msg.Role == "system" {
-				systemMsg = msg.Content.(string)
-			} else {
-				messages = append(messages, map[string]string{
-					"role":    msg.Role,
-					"content": msg.Content.(string),
-				})
-			}
+		// Anthropic has no JSON mode, so it is asked in the prompt
+		msgs := req.Messages
+		if req.wantsJSON() {
+			msgs = withJSONInstruction(msgs)
+		}
+		system, messages, err := anthropicMessages(msgs)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", provider.Name, err)
 		}
 
+		maxTokens := req.MaxTokens
+		if maxTokens == 0 {
+			maxTokens = DefaultAnthropicMaxTokens
+		}
 		anthropicReq := map[string]interface{}{
-			"model":       provider.Model,
-			"max_tokens":  req.MaxTokens,
-			"temperature": req.Temperature,
-			"messages":    messages,
+			"model":      req.model(provider),
+			"max_tokens": maxTokens,
+			"messages":   messages,
+		}
+		setParam(anthropicReq, "temperature", req.Temperature)
+		setParam(anthropicReq, "top_p", req.TopP)
+		if len(req.Stop) > 0 {
+			anthropicReq["stop_sequences"] = req.Stop
 		}
 
-		if systemMsg != "" {
-			anthropicReq["system"] = systemMsg
+		if len(system) > 0 {
+			anthropicReq["system"] = system
+		}
+		if len(req.Tools) > 0 {
+			anthropicReq["tools"] = anthropicTools(req.Tools)
+		}
+		if req.Stream {
+			anthropicReq["stream"] = true
 		}
 
 		return json.Marshal(anthropicReq)
 
+	case ProviderGemini:
+		geminiReq, err := newGeminiRequest(req)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", provider.Name, err)
+		}
+		return json.Marshal(geminiReq)
+
+	case ProviderOllama:
+		ollamaReq, err := newOllamaRequest(provider, req)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", provider.Name, err)
+		}
+		return json.Marshal(ollamaReq)
+
 	default:
 		return nil, fmt.Errorf("unsupported provider type: %s", provider.Type)
 	}
 }
 
-// ParseProviderResponse parses provider-specific response to standardized format
+// ParseProviderResponse parses provider-specific response to standardized
+// format. A reply withheld by a content filter is an ErrContentFiltered.
 func (p *Pool) ParseProviderResponse(provider *Provider, body []byte) (*ChatResponse, error) {
 	var response ChatResponse
 	response.Provider = provider.Name
 
 	switch provider.Type {
-	case ProviderGroq, ProviderOpenAI:
+	case ProviderGroq, ProviderOpenAI, ProviderAzureOpenAI:
 		var openaiResp struct {
 			ID      string `json:"id"`
 			Model   string `json:"model"`
 			Choices []struct {
 				Message struct {
-					Content string `json:"content"`
+					Content   string           `json:"content"`
+					ToolCalls []openAIToolCall `json:"tool_calls"`
 				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
 			} `json:"choices"`
-			Usage struct {
-				PromptTokens     int `json:"prompt_tokens"`
-				CompletionTokens int `json:"completion_tokens"`
-				TotalTokens      int `json:"total_tokens"`
-			} `json:"usage"`
+			Usage tokenUsage `json:"usage"`
 		}
 
 		if err := json.Unmarshal(body, &openaiResp); err != nil {
@@ -298,7 +819,16 @@ func (p *Pool) ParseProviderResponse(provider *Provider, body []byte) (*ChatResp
 		response.Usage = openaiResp.Usage
 
 		if len(openaiResp.Choices) > 0 {
-			response.Content = openaiResp.Choices[0].Message.Content
+			choice := openaiResp.Choices[0]
+			if choice.FinishReason == "content_filter" && choice.Message.Content == "" {
+				return nil, fmt.Errorf("%w: finish reason content_filter", ErrContentFiltered)
+			}
+			response.Content = choice.Message.Content
+			if choice.FinishReason == "tool_calls" {
+				for _, call := range choice.Message.ToolCalls {
+					response.ToolCalls = append(response.ToolCalls, call.toolCall())
+				}
+			}
 		}
 
 	case ProviderAnthropic:
@@ -306,17 +836,22 @@ func (p *Pool) ParseProviderResponse(provider *Provider, body []byte) (*ChatResp
 			ID      string `json:"id"`
 			Model   string `json:"model"`
 			Content []struct {
-				Text string `json:"text"`
+				Type  string          `json:"type"`
+				Text  string          `json:"text"`
+				ID    string          `json:"id"`
+				Name  string          `json:"name"`
+				Input json.RawMessage `json:"input"`
 			} `json:"content"`
-			Usage struct {
-				InputTokens  int `json:"input_tokens"`
-				OutputTokens int `json:"output_tokens"`
-			} `json:"usage"`
+			StopReason string         `json:"stop_reason"`
+			Usage      anthropicUsage `json:"usage"`
 		}
 
 		if err := json.Unmarshal(body, &anthropicResp); err != nil {
 			return nil, err
 		}
+		if anthropicResp.StopReason == "refusal" && len(anthropicResp.Content) == 0 {
+			return nil, fmt.Errorf("%w: stop reason refusal", ErrContentFiltered)
+		}
 
 		response.ID = anthropicResp.ID
 		response.Model = anthropicResp.Model
@@ -324,10 +859,39 @@ func (p *Pool) ParseProviderResponse(provider *Provider, body []byte) (*ChatResp
 		response.Usage.CompletionTokens = anthropicResp.Usage.OutputTokens
 		response.Usage.TotalTokens = anthropicResp.Usage.InputTokens + anthropicResp.Usage.OutputTokens
 
-		if len(anthropicResp.Content) > 0 {
-			response.Content = anthropicResp.Content[0].Text
+		for _, block := range anthropicResp.Content {
+			switch {
+			case block.Type == "text" && response.Content == "":
+				response.Content = block.Text
+			case block.Type == "tool_use" && anthropicResp.StopReason == "tool_use":
+				response.ToolCalls = append(response.ToolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: block.Input})
+			}
 		}
 
+	case ProviderGemini:
+		var geminiResp geminiResponse
+		if err := json.Unmarshal(body, &geminiResp); err != nil {
+			return nil, err
+		}
+
+		content, err := geminiResp.decode(&response)
+		if err != nil {
+			return nil, err
+		}
+		response.Content = content
+
+	case ProviderOllama:
+		var ollamaResp ollamaResponse
+		if err := json.Unmarshal(body, &ollamaResp); err != nil {
+			return nil, err
+		}
+
+		content, err := ollamaResp.decode(&response)
+		if err != nil {
+			return nil, err
+		}
+		response.Content = content
+
 	default:
 		return nil, fmt.Errorf("unsupported provider type: %s", provider.Type)
 	}
@@ -335,88 +899,210 @@ func (p *Pool) ParseProviderResponse(provider *Provider, body []byte) (*ChatResp
 	return &response, nil
 }
 
-// Chat sends a chat request using the best available provider
+// Chat sends a chat request using the best available provider, failing
+// over to the others. It never sends to a provider at its rate limits:
+// when all are, it fails with a *RateLimitError or, if asked to, waits.
 func (p *Pool) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	maxRetries := len(p.providers)
-	var lastErr error
+	resp, store := p.cached("", req)
+	if resp != nil {
+		return resp, nil
+	}
+
+	maxRetries := p.ProviderCount()
+	tokens := p.estimateTokens(req)
+	tried := make(map[*Provider]bool)
+	var attempts []error
 
 	for retry := 0; retry < maxRetries; retry++ {
-		provider, err := p.SelectProvider()
+		provider, err := p.nextProvider(ctx, req, tokens, tried)
 		if err != nil {
-			return nil, err
+			return nil, failover(err, attempts)
 		}
+		tried[provider] = true
 
-		// Convert request to provider format
-		reqBody, err := p.ConvertToProviderFormat(provider, req)
+		chatResp, err := p.send(ctx, provider, req, tokens)
 		if err != nil {
-			lastErr = err
+			attempts = append(attempts, err)
 			continue
 		}
-
-		// Build endpoint URL
-		var endpoint string
-		switch provider.Type {
-		case ProviderGroq:
-			endpoint = provider.BaseURL + "/chat/completions"
-		case ProviderOpenAI:
-			endpoint = provider.BaseURL + "/chat/completions"
-		case ProviderAnthropic:
-			endpoint = provider.BaseURL + "/messages"
+		if store != nil {
+			store(chatResp)
 		}
+		return chatResp, nil
+	}
 
-		// Create HTTP request
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(reqBody))
-		if err != nil {
-			lastErr = err
-			continue
-		}
+	if len(attempts) == 0 {
+		return nil, ErrNoProviders
+	}
+	return nil, failover(ErrAllProvidersFailed, attempts)
+}
+
+// ChatWithTimeout is Chat bounded by timeout, for callers without a context
+func (p *Pool) ChatWithTimeout(timeout time.Duration, req *ChatRequest) (*ChatResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.Chat(ctx, req)
+}
+
+// newHTTPRequest builds the provider-specific HTTP request for req
+func (p *Pool) newHTTPRequest(ctx context.Context, provider *Provider, req *ChatRequest) (*http.Request, error) {
+	// Convert request to provider format
+	reqBody, err := p.ConvertToProviderFormat(provider, req)
+	if err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
+
+	// Build endpoint URL
+	var endpoint string
+	switch provider.Type {
+	case ProviderGroq:
+		endpoint = provider.BaseURL + "/chat/completions"
+	case ProviderOpenAI:
+		endpoint = provider.BaseURL + "/chat/completions"
+	case ProviderAnthropic:
+		endpoint = provider.BaseURL + "/messages"
+	case ProviderGemini:
+		endpoint = geminiEndpoint(provider, req)
+	case ProviderOllama:
+		endpoint = provider.BaseURL + "/api/chat"
+	case ProviderAzureOpenAI:
+		endpoint = azureEndpoint(provider)
+	}
+
+	// Create HTTP request
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
 
-		// Set headers
-		httpReq.Header.Set("Content-Type", "application/json")
-		switch provider.Type {
-		case ProviderGroq, ProviderOpenAI:
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	setAuthHeaders(httpReq, provider)
+
+	return httpReq, nil
+}
+
+// setAuthHeaders sets the provider's credentials, and API version where
+// the provider wants one, on httpReq
+func setAuthHeaders(httpReq *http.Request, provider *Provider) {
+	switch provider.Type {
+	case ProviderGroq, ProviderOpenAI, ProviderOllama:
+		// Local OpenAI-compatible servers (vLLM) and Ollama run without a key
+		if provider.APIKey != "" {
 			httpReq.Header.Set("Authorization", "Bearer "+provider.APIKey)
-		case ProviderAnthropic:
-			httpReq.Header.Set("x-api-key", provider.APIKey)
-			httpReq.Header.Set("anthropic-version", "2023-06-01")
 		}
+	case ProviderAnthropic:
+		httpReq.Header.Set("x-api-key", provider.APIKey)
+		httpReq.Header.Set("anthropic-version", "2023-06-01")
+	case ProviderGemini:
+		httpReq.Header.Set("x-goog-api-key", provider.APIKey)
+	case ProviderAzureOpenAI:
+		httpReq.Header.Set("api-key", provider.APIKey)
+	}
+}
 
-		// Send request
-		resp, err := p.client.Do(httpReq)
-		if err != nil {
-			p.UpdateProviderStats(provider, false)
-			lastErr = err
-			continue
-		}
+// azureEndpoint is the chat completions URL of an Azure OpenAI deployment
+func azureEndpoint(provider *Provider) string {
+	return provider.BaseURL + "/openai/deployments/" + url.PathEscape(provider.Deployment) +
+		"/chat/completions?api-version=" + url.QueryEscape(provider.apiVersion())
+}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
+// apiVersion is the Azure api-version to request
+func (pr *Provider) apiVersion() string {
+	if pr.APIVersion == "" {
+		return DefaultAzureAPIVersion
+	}
+	return pr.APIVersion
+}
 
-		if err != nil {
-			p.UpdateProviderStats(provider, false)
-			lastErr = err
-			continue
-		}
+// attempt makes one request to provider, bounded by timeoutFor. The
+// caller records the outcome in the provider's stats.
+func (p *Pool) attempt(ctx context.Context, provider *Provider, req *ChatRequest) (*ChatResponse, error) {
+	reqCtx := ctx
+	timeout := p.timeoutFor(provider, req)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			p.UpdateProviderStats(provider, false)
-			lastErr = fmt.Errorf("provider %s returned status %d: %s", provider.Name, resp.StatusCode, string(body))
-			continue
-		}
+	httpReq, err := p.newHTTPRequest(reqCtx, provider, req)
+	if err != nil {
+		return nil, err
+	}
 
-		// Parse response
-		chatResp, err := p.ParseProviderResponse(provider, body)
-		if err != nil {
-			p.UpdateProviderStats(provider, false)
-			lastErr = err
-			continue
-		}
+	// Send request
+	start := time.Now()
+	resp, err := p.untimedClient().Do(httpReq)
+	if err != nil {
+		p.observe(provider, start, nil)
+		return nil, requestFailed(ctx, reqCtx, provider, timeout, err)
+	}
 
-		p.UpdateProviderStats(provider, true)
-		return chatResp, nil
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		p.observe(provider, start, nil)
+		return nil, requestFailed(ctx, reqCtx, provider, timeout, err)
 	}
+	p.recordLatency(provider, time.Since(start))
 
-	return nil, fmt.Errorf("all providers failed, last error: %v", lastErr)
+	if resp.StatusCode != http.StatusOK {
+		p.observe(provider, start, nil)
+		return nil, statusError(provider, resp, body)
+	}
+
+	// Parse response
+	chatResp, err := p.ParseProviderResponse(provider, body)
+	if err == nil {
+		err = req.checkFormat(chatResp)
+	}
+	if err != nil {
+		p.observe(provider, start, nil)
+		return nil, &ProviderError{Provider: provider.Name, Err: err}
+	}
+
+	p.observe(provider, start, chatResp)
+	return chatResp, nil
+}
+
+// ChatWithProvider sends the request to the named provider only, without
+// falling back to others. It fails with ErrProviderUnavailable rather than
+// exceed the provider's rate limit, and with ErrBudgetExceeded its budget.
+func (p *Pool) ChatWithProvider(ctx context.Context, name string, req *ChatRequest) (*ChatResponse, error) {
+	provider, err := p.SelectProviderByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if req.hasImages() && !provider.Vision {
+		return nil, fmt.Errorf("%w: %s", ErrNoVisionProvider, name)
+	}
+	if len(req.Tools) > 0 && !provider.supportsTools() {
+		return nil, fmt.Errorf("%w: %s", ErrNoToolProvider, name)
+	}
+	resp, store := p.cached(name, req)
+	if resp != nil {
+		return resp, nil
+	}
+	tokens := p.estimateTokens(req)
+	if err := p.checkUsable(provider, tokens); err != nil {
+		return nil, err
+	}
+	resp, err = p.send(ctx, provider, req, tokens)
+	if err == nil && store != nil {
+		store(resp)
+	}
+	return resp, err
+}
+
+// model is the model to request from provider: the request's override, or
+// the provider's configured model
+func (r *ChatRequest) model(provider *Provider) string {
+	if r.Model != "" {
+		return r.Model
+	}
+	return provider.Model
 }
 
 // GetStats returns statistics for all providers
@@ -425,10 +1111,17 @@ func (p *Pool) GetStats() map[string]ProviderStats {
 	defer p.mu.RUnlock()
 
 	stats := make(map[string]ProviderStats)
+	now := time.Now()
 
 	for _, provider := range p.providers {
 		provider.mu.Lock()
 
+		provider.refill(now)
+		nextProbe := provider.CoolOffUntil
+		if provider.authTripped {
+			nextProbe = time.Time{}
+		}
+
 		successRate := 0.0
 		if provider.TotalRequests > 0 {
 			successRate = float64(provider.TotalRequests-provider.Errors) / float64(provider.TotalRequests) * 100
@@ -437,12 +1130,30 @@ func (p *Pool) GetStats() map[string]ProviderStats {
 		stats[provider.Name] = ProviderStats{
 			Type:              provider.Type,
 			Priority:          provider.Priority,
+			EffectivePriority: provider.effective(),
 			RequestsPerMinute: provider.RequestsPerMinute,
-			CurrentRequests:   provider.RequestCount,
+			TokensPerMinute:   provider.TokensPerMinute,
+			CurrentRequests:   inUse(provider.RequestsPerMinute, provider.limiter.requests),
+			CurrentTokens:     inUse(provider.TokensPerMinute, provider.limiter.tokens),
 			TotalRequests:     provider.TotalRequests,
 			Errors:            provider.Errors,
+			Retries:           provider.Retries,
+			InFlight:          provider.InFlight,
+			TotalCost:         provider.TotalCost,
 			LastUsed:          provider.LastUsed,
 			SuccessRate:       successRate,
+			ConsecutiveErrors: provider.ConsecutiveErrors,
+			CoolOffUntil:      provider.CoolOffUntil,
+			BreakerState:      provider.breakerState(now),
+			NextProbeAt:       nextProbe,
+			Budget:            provider.budgetStats(now),
+			Latency:           provider.latency.stats(),
+			TimeToFirstToken:  provider.firstToken.stats(),
+			LastError:         provider.lastError,
+			LastErrorAt:       provider.lastErrorAt,
+			ErrorsByClass:     maps.Clone(provider.errorClasses),
+			CacheHits:         provider.cacheHits,
+			CacheMisses:       provider.cacheMisses,
 		}
 		provider.mu.Unlock()
 	}
@@ -450,6 +1161,14 @@ func (p *Pool) GetStats() map[string]ProviderStats {
 	return stats
 }
 
+// inUse is how much of a per-minute limit its bucket is missing
+func inUse(limit int, available float64) int {
+	if limit == 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(limit) - available))
+}
+
 // ProviderCount returns the number of providers in the pool
 func (p *Pool) ProviderCount() int {
 	p.mu.RLock()
@@ -457,6 +1176,20 @@ func (p *Pool) ProviderCount() int {
 	return len(p.providers)
 }
 
+// AvailableProviderCount returns how many providers are currently under their rate limit
+func (p *Pool) AvailableProviderCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	count := 0
+	for _, provider := range p.providers {
+		if p.CanUseProvider(provider) {
+			count++
+		}
+	}
+	return count
+}
+
 // IsHealthy checks if the pool has at least one available provider
 func (p *Pool) IsHealthy() bool {
 	p.mu.RLock()
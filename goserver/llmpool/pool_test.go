@@ -0,0 +1,172 @@
+package llmpool
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// stubServer stands in for a provider API. It keeps every request it gets
+// and answers with respond.
+type stubServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []stubRequest
+}
+
+// stubRequest is a request a stubServer got
+type stubRequest struct {
+	Method string
+	URL    string // path and query
+	Header http.Header
+	Body   []byte
+}
+
+func newStubServer(t *testing.T, respond http.HandlerFunc) *stubServer {
+	t.Helper()
+	s := &stubServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, stubRequest{Method: r.Method, URL: r.URL.RequestURI(), Header: r.Header.Clone(), Body: body})
+		s.mu.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// hits is how many requests the server got
+func (s *stubServer) hits() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// only returns the single request the server got
+func (s *stubServer) only(t *testing.T) stubRequest {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) != 1 {
+		t.Fatalf("server got %d requests, want 1", len(s.requests))
+	}
+	return s.requests[0]
+}
+
+// replyWith answers every request with status and body as JSON
+func replyWith(status int, body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// openAIReply is a chat completion answering content
+func openAIReply(content string) []byte {
+	return []byte(`{"id": "chatcmpl-1", "model": "stub-model", "choices": [{"index": 0, "message": {"role": "assistant", "content": "` +
+		content + `"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`)
+}
+
+// fixture reads a file of testdata
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newTestPool returns a pool of providers, failing the test if one is invalid
+func newTestPool(t *testing.T, providers ...*Provider) *Pool {
+	t.Helper()
+	p := NewPool()
+	for _, provider := range providers {
+		if err := p.AddProvider(provider); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func azureProvider(baseURL string) *Provider {
+	return &Provider{Name: "azure", Type: ProviderAzureOpenAI, APIKey: "az-key", BaseURL: baseURL, Deployment: "gpt-4o-prod", Model: "ignored"}
+}
+
+func TestAzureRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment string
+		apiVersion string
+		url        string
+	}{
+		{"default api-version", "gpt-4o-prod", "", "/openai/deployments/gpt-4o-prod/chat/completions?api-version=" + DefaultAzureAPIVersion},
+		{"own api-version", "gpt-4o-prod", "2025-01-01-preview", "/openai/deployments/gpt-4o-prod/chat/completions?api-version=2025-01-01-preview"},
+		{"deployment escaped", "invoices eu/1", "2024-10-21", "/openai/deployments/invoices%20eu%2F1/chat/completions?api-version=2024-10-21"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubServer(t, replyWith(200, openAIReply("hi")))
+			provider := azureProvider(stub.URL)
+			provider.Deployment, provider.APIVersion = tt.deployment, tt.apiVersion
+			p := newTestPool(t, provider)
+
+			resp, err := p.Chat(context.Background(), &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}, Model: "gpt-4o-mini"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Content != "hi" || resp.Provider != "azure" {
+				t.Errorf("response %+v", *resp)
+			}
+
+			sent := stub.only(t)
+			if sent.Method != "POST" || sent.URL != tt.url {
+				t.Errorf("%s %s, want POST %s", sent.Method, sent.URL, tt.url)
+			}
+			if key := sent.Header.Get("api-key"); key != "az-key" {
+				t.Errorf("api-key %q", key)
+			}
+			if auth := sent.Header.Get("Authorization"); auth != "" {
+				t.Errorf("Authorization %q sent to Azure", auth)
+			}
+			// The deployment decides the model
+			assertJSON(t, sent.Body, `{"messages": [{"role": "user", "content": "hi"}], "stream": false}`)
+		})
+	}
+}
+
+func TestAzureValidation(t *testing.T) {
+	provider := azureProvider("https://example.openai.azure.com")
+	provider.Deployment = ""
+	if err := NewPool().AddProvider(provider); err == nil {
+		t.Error("Azure provider without a Deployment added")
+	}
+}
+
+func TestAzureListModels(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, []byte(`{"data": [{"id": "gpt-4o"}, {"id": "gpt-4o-mini"}]}`)))
+	p := newTestPool(t, azureProvider(stub.URL))
+
+	models, err := p.ListModels(context.Background(), "azure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := stub.only(t)
+	if want := "/openai/models?api-version=" + DefaultAzureAPIVersion; sent.URL != want {
+		t.Errorf("URL %s, want %s", sent.URL, want)
+	}
+	if key := sent.Header.Get("api-key"); key != "az-key" {
+		t.Errorf("api-key %q", key)
+	}
+	if !slices.Equal(models, []string{"gpt-4o", "gpt-4o-mini"}) {
+		t.Errorf("models %q", models)
+	}
+}
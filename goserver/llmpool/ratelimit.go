@@ -0,0 +1,240 @@
+package llmpool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// rateLimiter holds a provider's token buckets for RequestsPerMinute and
+// TokensPerMinute. Both refill continuously at their per-minute rate up to
+// one minute's worth, so after a burst requests are paced instead of
+// refused until a fixed window ends. Guarded by Provider.mu.
+type rateLimiter struct {
+	requests float64
+	// tokens goes negative when replies use more than was estimated; the
+	// debt is paid off by the refill
+	tokens float64
+	at     time.Time // last refill; zero means both buckets are full
+}
+
+// refill tops the buckets up for the time elapsed since the last refill
+func (pr *Provider) refill(now time.Time) {
+	l := &pr.limiter
+	if l.at.IsZero() {
+		l.requests = float64(pr.RequestsPerMinute)
+		l.tokens = float64(pr.TokensPerMinute)
+		l.at = now
+		return
+	}
+	minutes := now.Sub(l.at).Minutes()
+	if minutes <= 0 {
+		return
+	}
+	l.requests = math.Min(l.requests+minutes*float64(pr.RequestsPerMinute), float64(pr.RequestsPerMinute))
+	l.tokens = math.Min(l.tokens+minutes*float64(pr.TokensPerMinute), float64(pr.TokensPerMinute))
+	l.at = now
+}
+
+// tokensNeeded is how full the token bucket must be to send a request
+// estimated at tokens. A request larger than the whole limit only waits
+// for a full bucket.
+func (pr *Provider) tokensNeeded(tokens int) float64 {
+	return math.Max(1, math.Min(float64(tokens), float64(pr.TokensPerMinute)))
+}
+
+// hasCapacity reports whether a request estimated at tokens fits in both
+// buckets. Callers must hold pr.mu.
+func (pr *Provider) hasCapacity(now time.Time, tokens int) bool {
+	pr.refill(now)
+	if pr.RequestsPerMinute > 0 && pr.limiter.requests < 1 {
+		return false
+	}
+	return pr.TokensPerMinute == 0 || pr.limiter.tokens >= pr.tokensNeeded(tokens)
+}
+
+// capacityAt is when a request estimated at tokens will fit in both
+// buckets. Callers must hold pr.mu.
+func (pr *Provider) capacityAt(now time.Time, tokens int) time.Time {
+	pr.refill(now)
+	at := now
+	if pr.RequestsPerMinute > 0 && pr.limiter.requests < 1 {
+		at = later(at, now.Add(minutesOf((1-pr.limiter.requests)/float64(pr.RequestsPerMinute))))
+	}
+	if need := pr.tokensNeeded(tokens); pr.TokensPerMinute > 0 && pr.limiter.tokens < need {
+		at = later(at, now.Add(minutesOf((need-pr.limiter.tokens)/float64(pr.TokensPerMinute))))
+	}
+	return at
+}
+
+func minutesOf(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// take charges one request and its token estimate to the provider's
+// buckets as it is sent
+func (p *Pool) take(provider *Provider, tokens int) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.refill(time.Now())
+	if provider.RequestsPerMinute > 0 {
+		provider.limiter.requests--
+	}
+	if provider.TokensPerMinute > 0 {
+		provider.limiter.tokens -= float64(tokens)
+	}
+}
+
+// settle replaces a request's token estimate with the tokens it used. A
+// reply without usage keeps the estimate; a failed request uses none.
+func (p *Pool) settle(provider *Provider, estimate int, resp *ChatResponse) {
+	used := 0
+	if resp != nil {
+		used = resp.Usage.TotalTokens
+		if used == 0 {
+			used = estimate
+		}
+	}
+	if used == estimate || provider.TokensPerMinute == 0 {
+		return
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.limiter.tokens = math.Min(provider.limiter.tokens+float64(estimate-used), float64(provider.TokensPerMinute))
+}
+
+// WithTokenCounter sets how prompt tokens are estimated before a request
+// is sent, replacing the default of four characters per token, and
+// returns the pool for chaining
+func (p *Pool) WithTokenCounter(count func(*ChatRequest) int) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tokenCounter = count
+	return p
+}
+
+// estimateTokens is the token cost req is charged before it is sent: its
+// prompt estimate plus MaxTokens, which providers reserve for the reply
+func (p *Pool) estimateTokens(req *ChatRequest) int {
+	p.mu.RLock()
+	count := p.tokenCounter
+	p.mu.RUnlock()
+
+	if count != nil {
+		return count(req) + req.MaxTokens
+	}
+
+	chars := 0
+	for _, msg := range req.Messages {
+		parts, err := messageParts(msg.Content)
+		if err != nil {
+			continue
+		}
+		for _, part := range parts {
+			chars += len(part.Text)
+		}
+	}
+	return (chars+3)/4 + req.MaxTokens
+}
+
+// WithWaitForCapacity makes Chat and ChatStream wait, when every provider
+// able to serve a request is at its rate limits, until one has capacity
+// again, as ChatRequest.WaitForCapacity does for one request. They don't
+// wait for capacity that frees up after the context's deadline, and fail
+// at once with a *RateLimitError instead. It returns the pool for chaining.
+func (p *Pool) WithWaitForCapacity() *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.waitForCapacity = true
+	return p
+}
+
+// waitsForCapacity reports whether Chat waits for capacity to send req
+func (p *Pool) waitsForCapacity(req *ChatRequest) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.waitForCapacity || req.WaitForCapacity
+}
+
+// minCapacityWait keeps waiters from spinning on a provider whose
+// capacity is only held up by a half-open probe
+const minCapacityWait = 50 * time.Millisecond
+
+// unavailable returns the error for a request estimated at tokens that no
+// eligible provider can take: ErrBudgetExceeded if they are out of budget,
+// otherwise a *RateLimitError with the earliest time one of them has
+// capacity. Callers must hold p.mu (read).
+func (p *Pool) unavailable(eligible func(*Provider) bool, tokens int) error {
+	now := time.Now()
+	var earliest time.Time
+	overBudget := false
+	for _, provider := range p.providers {
+		if !eligible(provider) {
+			continue
+		}
+		provider.mu.Lock()
+		switch {
+		case provider.overBudget(now):
+			overBudget = true
+		case !provider.authTripped:
+			at := later(provider.capacityAt(now, tokens), provider.CoolOffUntil)
+			if earliest.IsZero() || at.Before(earliest) {
+				earliest = at
+			}
+		}
+		provider.mu.Unlock()
+	}
+	if earliest.IsZero() && overBudget {
+		return ErrBudgetExceeded
+	}
+	return &RateLimitError{Until: earliest}
+}
+
+// awaitCapacity waits until the time in rl, or returns rl if it won't come
+// before ctx's deadline
+func awaitCapacity(ctx context.Context, rl *RateLimitError) error {
+	if rl.Until.IsZero() {
+		return rl
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(rl.Until) {
+		return rl
+	}
+
+	timer := time.NewTimer(max(time.Until(rl.Until), minCapacityWait))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// nextProvider selects the provider for the next attempt at req, waiting
+// for capacity if the pool or req asks for it
+func (p *Pool) nextProvider(ctx context.Context, req *ChatRequest, tokens int, tried map[*Provider]bool) (*Provider, error) {
+	wait := p.waitsForCapacity(req)
+	for {
+		provider, err := p.selectProviderFor(req, tokens, tried)
+		var rl *RateLimitError
+		if !wait || !errors.As(err, &rl) {
+			return provider, err
+		}
+		if err := awaitCapacity(ctx, rl); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package llmpool
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func limitedProvider(name, baseURL string, rpm, tpm int) *Provider {
+	return &Provider{Name: name, Type: ProviderOpenAI, APIKey: "k", BaseURL: baseURL, Model: "m", RequestsPerMinute: rpm, TokensPerMinute: tpm}
+}
+
+func hello() *ChatRequest {
+	return &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}}
+}
+
+func TestNoRequestWithoutCapacity(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+	p := newTestPool(t,
+		limitedProvider("a", stub.URL, 1, 0),
+		limitedProvider("b", stub.URL, 1, 0),
+	)
+
+	// One request per provider uses up both
+	for range 2 {
+		if _, err := p.Chat(context.Background(), hello()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.hits() != 2 {
+		t.Fatalf("%d requests, want 2", stub.hits())
+	}
+
+	start := time.Now()
+	_, err := p.Chat(context.Background(), hello())
+	var rl *RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("error %v, want a *RateLimitError", err)
+	}
+	if !errors.Is(err, ErrAllProvidersRateLimited) {
+		t.Errorf("error %v doesn't match ErrAllProvidersRateLimited", err)
+	}
+	// A request a minute refills in at most a minute
+	if rl.Until.Before(start) || rl.Until.After(start.Add(time.Minute+time.Second)) {
+		t.Errorf("Until %s, want within a minute of %s", rl.Until, start)
+	}
+
+	_, err = p.ChatStream(context.Background(), hello(), func(StreamChunk) error { return nil })
+	if !errors.As(err, &rl) {
+		t.Errorf("stream error %v, want a *RateLimitError", err)
+	}
+	_, err = p.ChatWithProvider(context.Background(), "a", hello())
+	if err == nil {
+		t.Error("ChatWithProvider sent to a provider at its limit")
+	}
+
+	if stub.hits() != 2 {
+		t.Errorf("%d requests, want none past the limits", stub.hits())
+	}
+}
+
+func TestNoRequestWithoutTokenCapacity(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+	p := newTestPool(t, limitedProvider("a", stub.URL, 0, 1000)).
+		WithTokenCounter(func(req *ChatRequest) int { return 600 })
+
+	if _, err := p.Chat(context.Background(), hello()); err != nil {
+		t.Fatal(err)
+	}
+	// The reply's usage of 15 tokens gave back most of the estimate
+	if _, err := p.Chat(context.Background(), hello()); err != nil {
+		t.Fatal(err)
+	}
+
+	p.WithTokenCounter(func(req *ChatRequest) int { return 990 })
+	_, err := p.Chat(context.Background(), hello())
+	var rl *RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("error %v, want a *RateLimitError", err)
+	}
+	if stub.hits() != 2 {
+		t.Errorf("%d requests, want 2", stub.hits())
+	}
+}
+
+func TestWaitForCapacityPastDeadline(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+	p := newTestPool(t, limitedProvider("a", stub.URL, 1, 0)).WithWaitForCapacity()
+
+	if _, err := p.Chat(context.Background(), hello()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Capacity is back in a minute, after the deadline, so no waiting
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := p.Chat(ctx, hello())
+	var rl *RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("error %v, want a *RateLimitError", err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("waited %s for capacity past the deadline", waited)
+	}
+	if stub.hits() != 1 {
+		t.Errorf("%d requests, want 1", stub.hits())
+	}
+}
+
+func TestRateLimitErrorMessage(t *testing.T) {
+	err := &RateLimitError{Until: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)}
+	if !strings.Contains(err.Error(), "2026-10-17T12:00:00Z") {
+		t.Errorf("%q doesn't say when", err.Error())
+	}
+	if (&RateLimitError{}).Error() != ErrAllProvidersRateLimited.Error() {
+		t.Errorf("%q", (&RateLimitError{}).Error())
+	}
+}
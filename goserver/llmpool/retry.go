@@ -0,0 +1,166 @@
+package llmpool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy retries a provider's transient failures (429, 502, 503, 504,
+// timeouts and network errors) with exponential backoff and jitter. A Retry-After
+// from the provider replaces the computed delay.
+type RetryPolicy struct {
+	MaxRetries int           // retries after the first attempt
+	BaseDelay  time.Duration // delay before the first retry, doubled for each next one
+	MaxDelay   time.Duration // cap on any single delay, Retry-After included
+}
+
+// DefaultRetryPolicy applies to providers without their own Retry
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 2,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   10 * time.Second,
+}
+
+// retryPolicy returns the provider's policy with zero delays defaulted
+func (pr *Provider) retryPolicy() RetryPolicy {
+	if pr.Retry == nil {
+		return DefaultRetryPolicy
+	}
+	policy := *pr.Retry
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return policy
+}
+
+// delay is the wait before retry number n (from 0): the provider's
+// Retry-After if it sent one, otherwise BaseDelay*2^n with jitter
+func (rp RetryPolicy) delay(n int, err error) time.Duration {
+	var pe *ProviderError
+	if errors.As(err, &pe) && pe.RetryAfter > 0 {
+		return min(pe.RetryAfter, rp.MaxDelay)
+	}
+	d := min(rp.BaseDelay<<n, rp.MaxDelay)
+	// Jitter in [d/2, d) keeps clients that failed together from retrying together
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryable reports whether err is worth retrying on the same provider.
+// Other failures, such as 400, 401, 403 and 422, fail over at once.
+func retryable(err error) bool {
+	var pe *ProviderError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	switch pe.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case 0:
+		var netErr net.Error
+		return errors.As(pe.Err, &netErr) || errors.Is(pe.Err, io.ErrUnexpectedEOF) ||
+			errors.Is(pe.Err, ErrProviderTimeout)
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// send makes a request to provider, retrying transient failures under the
+// provider's RetryPolicy, and records the outcome in its stats. A retry
+// waits for the provider's rate limits too, and is not attempted when that
+// takes longer than MaxDelay or when it would outlast ctx's deadline; the
+// error is returned so the caller can fail over.
+func (p *Pool) send(ctx context.Context, provider *Provider, req *ChatRequest, tokens int) (*ChatResponse, error) {
+	release, ok := p.admit(provider)
+	if !ok {
+		return nil, &ProviderError{Provider: provider.Name, Err: ErrProviderUnavailable}
+	}
+	defer release()
+
+	policy := provider.retryPolicy()
+	for n := 0; ; n++ {
+		p.take(provider, tokens)
+		resp, err := p.attempt(ctx, provider, req)
+		p.settle(provider, tokens, resp)
+		if err == nil {
+			p.charge(provider, resp)
+			p.UpdateProviderStats(provider, true)
+			return resp, nil
+		}
+		p.recordError(provider, err)
+		if n >= policy.MaxRetries || !retryable(err) || ctx.Err() != nil {
+			p.UpdateProviderStats(provider, false)
+			p.tripOnAuth(provider, err)
+			return nil, err
+		}
+
+		wait := policy.delay(n, err)
+		capacity := p.capacityWait(provider, tokens)
+		if capacity > policy.MaxDelay {
+			p.UpdateProviderStats(provider, false)
+			return nil, err
+		}
+		wait = max(wait, capacity)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			p.UpdateProviderStats(provider, false)
+			return nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			p.UpdateProviderStats(provider, false)
+			return nil, err
+		case <-timer.C:
+		}
+		// Concurrent requests may have used up the capacity waited for
+		if p.capacityWait(provider, tokens) > 0 {
+			p.UpdateProviderStats(provider, false)
+			return nil, err
+		}
+		p.recordRetry(provider)
+	}
+}
+
+// capacityWait is how long until provider's rate limits let through a
+// request estimated at tokens, 0 if they do now
+func (p *Pool) capacityWait(provider *Provider, tokens int) time.Duration {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	now := time.Now()
+	return provider.capacityAt(now, tokens).Sub(now)
+}
+
+// recordRetry counts a failed attempt that is about to be retried. It used
+// up rate limit like any request but is not an error of the provider.
+func (p *Pool) recordRetry(provider *Provider) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.Retries++
+	provider.LastUsed = time.Now()
+}
@@ -0,0 +1,68 @@
+package llmpool
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingOnce answers 503 to the first request and ok after that
+func failingOnce() http.HandlerFunc {
+	var calls atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			replyWith(503, []byte(`{"error": {"message": "overloaded"}}`))(w, r)
+			return
+		}
+		replyWith(200, openAIReply("ok"))(w, r)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	stub := newStubServer(t, failingOnce())
+	provider := limitedProvider("a", stub.URL, 0, 0)
+	provider.Retry = &RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}
+	p := newTestPool(t, provider)
+
+	resp, err := p.Chat(context.Background(), hello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "ok" || stub.hits() != 2 {
+		t.Errorf("%q after %d requests, want ok after 2", resp.Content, stub.hits())
+	}
+	if stats := p.GetStats()["a"]; stats.Retries != 1 {
+		t.Errorf("%d retries, want 1", stats.Retries)
+	}
+}
+
+func TestRetryWithoutCapacityFailsOver(t *testing.T) {
+	limited := newStubServer(t, failingOnce())
+	other := newStubServer(t, replyWith(200, openAIReply("from b")))
+
+	// a's one request a minute is spent on the failed attempt; waiting a
+	// minute for the retry is longer than MaxDelay
+	a := limitedProvider("a", limited.URL, 1, 0)
+	a.Priority = 1
+	a.Retry = &RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	b := limitedProvider("b", other.URL, 0, 0)
+	b.Priority = 2
+	p := newTestPool(t, a, b)
+
+	start := time.Now()
+	resp, err := p.Chat(context.Background(), hello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Provider != "b" {
+		t.Errorf("answered by %s, want b", resp.Provider)
+	}
+	if limited.hits() != 1 {
+		t.Errorf("a got %d requests, want 1 within its limit", limited.hits())
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("took %s; it should fail over instead of waiting", waited)
+	}
+}
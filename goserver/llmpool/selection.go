@@ -0,0 +1,123 @@
+package llmpool
+
+// SelectionMode controls how SelectProvider chooses among usable providers
+type SelectionMode int
+
+const (
+	// PriorityMode always prefers the highest priority providers that are not
+	// rate limited, taking turns among those of equal priority in proportion
+	// to Provider.Weight
+	PriorityMode SelectionMode = iota
+	// RoundRobinMode cycles through all usable providers regardless of priority
+	RoundRobinMode
+	// WeightedRoundRobin cycles through usable providers in proportion to Provider.Weight
+	WeightedRoundRobin
+	// LeastLoadedMode picks the usable provider with the fewest requests in
+	// flight, preferring higher priority on ties
+	LeastLoadedMode
+	// WeightedLeastLoaded is LeastLoadedMode with in-flight requests
+	// divided by Provider.Weight (weighted least connections)
+	WeightedLeastLoaded
+)
+
+// String returns the mode name used in logs and stats
+func (m SelectionMode) String() string {
+	switch m {
+	case PriorityMode:
+		return "priority"
+	case RoundRobinMode:
+		return "round_robin"
+	case WeightedRoundRobin:
+		return "weighted_round_robin"
+	case LeastLoadedMode:
+		return "least_loaded"
+	case WeightedLeastLoaded:
+		return "weighted_least_loaded"
+	default:
+		return "unknown"
+	}
+}
+
+// WithSelectionMode sets the provider selection mode and returns the pool for chaining
+func (p *Pool) WithSelectionMode(mode SelectionMode) *Pool {
+	p.selMu.Lock()
+	defer p.selMu.Unlock()
+
+	p.mode = mode
+	return p
+}
+
+// weight returns the provider's weight, treating unset weights as 1
+func (pr *Provider) weight() int {
+	if pr.Weight <= 0 {
+		return 1
+	}
+	return pr.Weight
+}
+
+// selectRoundRobin returns the next usable provider after the last one picked.
+// Callers must hold p.mu (read) and p.selMu.
+func (p *Pool) selectRoundRobin(usable func(*Provider) bool) *Provider {
+	n := len(p.providers)
+	for i := 0; i < n; i++ {
+		idx := (p.rrNext + i) % n
+		if usable(p.providers[idx]) {
+			p.rrNext = (idx + 1) % n
+			return p.providers[idx]
+		}
+	}
+	return nil
+}
+
+// selectWeighted implements smooth weighted round-robin over providers:
+// every usable one gains its weight, the largest wins and pays back the
+// total, which spreads picks evenly instead of in bursts. Callers must hold
+// p.mu (read) and p.selMu.
+func (p *Pool) selectWeighted(providers []*Provider, usable func(*Provider) bool) *Provider {
+	var best *Provider
+	total := 0
+
+	for _, provider := range providers {
+		if !usable(provider) {
+			continue
+		}
+		w := provider.weight()
+		provider.currentWeight += w
+		total += w
+		if best == nil || provider.currentWeight > best.currentWeight {
+			best = provider
+		}
+	}
+
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+// selectLeastLoaded returns the usable provider with the fewest requests in
+// flight, relative to its weight if weighted. Providers are in priority
+// order, so ties go to the higher priority. Callers must hold p.mu (read).
+func (p *Pool) selectLeastLoaded(usable func(*Provider) bool, weighted bool) *Provider {
+	var best *Provider
+	bestLoad, bestWeight := 0, 1
+
+	for _, provider := range p.providers {
+		if !usable(provider) {
+			continue
+		}
+		provider.mu.Lock()
+		load := provider.InFlight
+		provider.mu.Unlock()
+
+		w := 1
+		if weighted {
+			w = provider.weight()
+		}
+		// load/w < bestLoad/bestWeight, without the division
+		if best == nil || load*bestWeight < bestLoad*w {
+			best, bestLoad, bestWeight = provider, load, w
+		}
+	}
+	return best
+}
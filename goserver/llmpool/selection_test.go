@@ -0,0 +1,89 @@
+package llmpool
+
+import (
+	"context"
+	"maps"
+	"testing"
+)
+
+func weightedProvider(name, baseURL string, priority, weight int) *Provider {
+	return &Provider{Name: name, Type: ProviderOpenAI, APIKey: "k", BaseURL: baseURL, Model: "m", Priority: priority, Weight: weight}
+}
+
+// distribute sends n requests through p and counts them by provider
+func distribute(t *testing.T, p *Pool, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for range n {
+		resp, err := p.Chat(context.Background(), hello())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[resp.Provider]++
+	}
+	return counts
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	tests := []struct {
+		name string
+		mode SelectionMode
+		// priorities of a, b and c, weighted 3, 2 and 1
+		priorities [3]int
+		want       map[string]int
+	}{
+		{"equal priority", PriorityMode, [3]int{1, 1, 1}, map[string]int{"a": 150, "b": 100, "c": 50}},
+		{"weighted round robin", WeightedRoundRobin, [3]int{1, 2, 3}, map[string]int{"a": 150, "b": 100, "c": 50}},
+		{"higher priority first", PriorityMode, [3]int{2, 1, 1}, map[string]int{"b": 200, "c": 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+			p := newTestPool(t,
+				weightedProvider("a", stub.URL, tt.priorities[0], 3),
+				weightedProvider("b", stub.URL, tt.priorities[1], 2),
+				weightedProvider("c", stub.URL, tt.priorities[2], 1),
+			).WithSelectionMode(tt.mode)
+
+			if got := distribute(t, p, 300); !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Smooth weighted round robin interleaves picks rather than sending a
+// provider's whole share in a row
+func TestWeightedInterleaves(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+	p := newTestPool(t,
+		weightedProvider("a", stub.URL, 1, 5),
+		weightedProvider("b", stub.URL, 1, 1),
+		weightedProvider("c", stub.URL, 1, 1),
+	)
+
+	var order string
+	for range 7 {
+		resp, err := p.Chat(context.Background(), hello())
+		if err != nil {
+			t.Fatal(err)
+		}
+		order += resp.Provider
+	}
+	if order != "aabacaa" {
+		t.Errorf("order %s, want aabacaa", order)
+	}
+}
+
+func TestWeightedSkipsLimited(t *testing.T) {
+	stub := newStubServer(t, replyWith(200, openAIReply("ok")))
+	a := weightedProvider("a", stub.URL, 1, 2)
+	a.RequestsPerMinute = 10
+	p := newTestPool(t, a, weightedProvider("b", stub.URL, 1, 1))
+
+	// a's share would be 200, but it stops at its limit and b takes the rest
+	got := distribute(t, p, 300)
+	if want := map[string]int{"a": 10, "b": 290}; !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,358 @@
+package llmpool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrStreamingUnsupported is returned for provider types ChatStream can't parse
+var ErrStreamingUnsupported = errors.New("streaming is not supported for this provider type")
+
+// maxStreamLine bounds one server-sent event line
+const maxStreamLine = 1 << 20
+
+// StreamChunk is one piece of a streamed reply
+type StreamChunk struct {
+	Content string `json:"content"`
+}
+
+// ChatStream sends req with streaming enabled and calls fn with each chunk
+// as it arrives. The returned response carries the accumulated content
+// and the usage the provider reports at the end of the stream.
+// A provider that fails before sending any content is skipped like in
+// Chat; once content has been passed to fn, errors are returned as they
+// are. An error from fn stops the stream and is returned unchanged.
+func (p *Pool) ChatStream(ctx context.Context, req *ChatRequest, fn func(StreamChunk) error) (*ChatResponse, error) {
+	streamReq := *req
+	streamReq.Stream = true
+
+	maxRetries := p.ProviderCount()
+	tokens := p.estimateTokens(&streamReq)
+	tried := make(map[*Provider]bool)
+	var attempts []error
+
+	for retry := 0; retry < maxRetries; retry++ {
+		provider, err := p.nextProvider(ctx, &streamReq, tokens, tried)
+		if err != nil {
+			return nil, failover(err, attempts)
+		}
+		tried[provider] = true
+
+		chatResp, started, err := p.sendStream(ctx, provider, &streamReq, tokens, fn)
+		if err == nil {
+			return chatResp, nil
+		}
+		if started {
+			return nil, err
+		}
+		attempts = append(attempts, err)
+	}
+
+	if len(attempts) == 0 {
+		return nil, ErrNoProviders
+	}
+	return nil, failover(ErrAllProvidersFailed, attempts)
+}
+
+// ChatStreamWithProvider is ChatStream against the named provider only,
+// with the same checks as ChatWithProvider
+func (p *Pool) ChatStreamWithProvider(ctx context.Context, name string, req *ChatRequest, fn func(StreamChunk) error) (*ChatResponse, error) {
+	streamReq := *req
+	streamReq.Stream = true
+
+	provider, err := p.SelectProviderByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if streamReq.hasImages() && !provider.Vision {
+		return nil, fmt.Errorf("%w: %s", ErrNoVisionProvider, name)
+	}
+	if len(streamReq.Tools) > 0 && !provider.supportsTools() {
+		return nil, fmt.Errorf("%w: %s", ErrNoToolProvider, name)
+	}
+	tokens := p.estimateTokens(&streamReq)
+	if err := p.checkUsable(provider, tokens); err != nil {
+		return nil, err
+	}
+	resp, _, err := p.sendStream(ctx, provider, &streamReq, tokens, fn)
+	return resp, err
+}
+
+// sendStream makes one streaming request to provider, charged tokens
+// until its usage is known. started reports whether any content reached fn.
+// Rather than the whole reply, timeoutFor bounds the wait for the response
+// and then for each event.
+func (p *Pool) sendStream(ctx context.Context, provider *Provider, req *ChatRequest, tokens int, fn func(StreamChunk) error) (resp *ChatResponse, started bool, err error) {
+	decode, ok := streamDecoderFor(provider)
+	if !ok {
+		return nil, false, &ProviderError{Provider: provider.Name, Err: ErrStreamingUnsupported}
+	}
+	release, ok := p.admit(provider)
+	if !ok {
+		return nil, false, &ProviderError{Provider: provider.Name, Err: ErrProviderUnavailable}
+	}
+	defer release()
+
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	idle := p.timeoutFor(provider, req)
+	keepAlive := func() {}
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			cancel(fmt.Errorf("%w: no data for %s", ErrProviderTimeout, idle))
+		})
+		defer timer.Stop()
+		keepAlive = func() { timer.Reset(idle) }
+	}
+
+	httpReq, err := p.newHTTPRequest(streamCtx, provider, req)
+	if err != nil {
+		return nil, false, err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	// used is what the request is settled with on return: nil for a
+	// failure, otherwise the reply as far as it got
+	var used *ChatResponse
+	p.take(provider, tokens)
+	defer func() { p.settle(provider, tokens, used) }()
+
+	start := time.Now()
+	httpResp, err := p.untimedClient().Do(httpReq)
+	if err != nil {
+		err = &ProviderError{Provider: provider.Name, Err: streamFailure(streamCtx, err)}
+		p.UpdateProviderStats(provider, false)
+		p.recordError(provider, err)
+		p.observe(provider, start, nil)
+		return nil, false, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(httpResp.Body, 64<<10))
+		p.UpdateProviderStats(provider, false)
+		p.recordLatency(provider, time.Since(start))
+		p.observe(provider, start, nil)
+		err := statusError(provider, httpResp, body)
+		p.recordError(provider, err)
+		p.tripOnAuth(provider, err)
+		return nil, false, err
+	}
+
+	resp = &ChatResponse{Provider: provider.Name}
+	var content strings.Builder
+	var callbackErr error
+
+	read := readSSE
+	if provider.Type == ProviderOllama {
+		read = readJSONLines
+	}
+	err = read(httpResp.Body, func(data []byte) (bool, error) {
+		keepAlive()
+		delta, done, err := decode(data, resp)
+		if err != nil || delta == "" {
+			return done, err
+		}
+		if !started {
+			p.recordFirstToken(provider, time.Since(start))
+		}
+		started = true
+		content.WriteString(delta)
+		if err := fn(StreamChunk{Content: delta}); err != nil {
+			callbackErr = err
+			return false, err
+		}
+		return done, nil
+	})
+
+	switch {
+	case callbackErr != nil:
+		// The caller gave up; that says nothing about the provider, but
+		// what was generated so far is paid for
+		used = resp
+		p.charge(provider, resp)
+		p.UpdateProviderStats(provider, true)
+		return nil, started, callbackErr
+	case err != nil && ctx.Err() != nil:
+		used = resp
+		p.charge(provider, resp)
+		p.UpdateProviderStats(provider, true)
+		return nil, started, ctx.Err()
+	case err != nil:
+		err = &ProviderError{Provider: provider.Name, Err: streamFailure(streamCtx, err)}
+		p.UpdateProviderStats(provider, false)
+		p.recordError(provider, err)
+		p.observe(provider, start, nil)
+		return nil, started, err
+	}
+
+	resp.Content = content.String()
+	p.recordLatency(provider, time.Since(start))
+	used = resp
+	p.charge(provider, resp)
+	p.UpdateProviderStats(provider, true)
+	p.observe(provider, start, resp)
+	return resp, started, nil
+}
+
+// streamFailure returns the idle timeout that cancelled streamCtx, if that
+// is what ended the stream, and err otherwise
+func streamFailure(streamCtx context.Context, err error) error {
+	if cause := context.Cause(streamCtx); errors.Is(cause, ErrProviderTimeout) {
+		return cause
+	}
+	return err
+}
+
+// streamDecoder decodes the data of one event into resp, returning any new
+// content and whether the stream is complete
+type streamDecoder func(data []byte, resp *ChatResponse) (delta string, done bool, err error)
+
+// streamDecoderFor returns the decoder for provider's stream format
+func streamDecoderFor(provider *Provider) (streamDecoder, bool) {
+	switch provider.Type {
+	case ProviderGroq, ProviderOpenAI, ProviderAzureOpenAI:
+		return decodeOpenAIEvent, true
+	case ProviderAnthropic:
+		return decodeAnthropicEvent, true
+	case ProviderGemini:
+		return decodeGeminiEvent, true
+	case ProviderOllama:
+		return decodeOllamaEvent, true
+	}
+	return nil, false
+}
+
+// tokenUsage is the usage object of OpenAI-compatible responses
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAIStreamEvent is one "data:" payload of an OpenAI-compatible stream.
+// With stream_options.include_usage the last event carries the usage;
+// Groq puts it under x_groq instead.
+type openAIStreamEvent struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *tokenUsage `json:"usage"`
+	XGroq *struct {
+		Usage *tokenUsage `json:"usage"`
+	} `json:"x_groq"`
+}
+
+func decodeOpenAIEvent(data []byte, resp *ChatResponse) (string, bool, error) {
+	if string(data) == "[DONE]" {
+		return "", true, nil
+	}
+
+	var event openAIStreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", false, fmt.Errorf("decoding stream event: %w", err)
+	}
+	if resp.ID == "" {
+		resp.ID, resp.Model = event.ID, event.Model
+	}
+
+	usage := event.Usage
+	if usage == nil && event.XGroq != nil {
+		usage = event.XGroq.Usage
+	}
+	if usage != nil {
+		resp.Usage = *usage
+	}
+
+	var delta strings.Builder
+	for _, choice := range event.Choices {
+		delta.WriteString(choice.Delta.Content)
+	}
+	return delta.String(), false, nil
+}
+
+// anthropicStreamEvent is one event of an Anthropic Messages stream. The
+// input tokens arrive with message_start and the running output count
+// with message_delta.
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		ID    string         `json:"id"`
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func decodeAnthropicEvent(data []byte, resp *ChatResponse) (string, bool, error) {
+	var event anthropicStreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", false, fmt.Errorf("decoding stream event: %w", err)
+	}
+
+	switch event.Type {
+	case "message_start":
+		resp.ID, resp.Model = event.Message.ID, event.Message.Model
+		resp.Usage.PromptTokens = event.Message.Usage.InputTokens
+		resp.Usage.CompletionTokens = event.Message.Usage.OutputTokens
+	case "content_block_delta":
+		if event.Delta.Type == "text_delta" {
+			return event.Delta.Text, false, nil
+		}
+	case "message_delta":
+		if event.Usage != nil {
+			if event.Usage.InputTokens > 0 {
+				resp.Usage.PromptTokens = event.Usage.InputTokens
+			}
+			resp.Usage.CompletionTokens = event.Usage.OutputTokens
+		}
+	case "message_stop":
+		return "", true, nil
+	case "error":
+		return "", false, fmt.Errorf("%s: %s", event.Error.Type, event.Error.Message)
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	return "", false, nil
+}
+
+// readSSE passes the data of each server-sent event to fn until fn reports
+// the stream done. Ending before that is an io.ErrUnexpectedEOF.
+func readSSE(r io.Reader, fn func(data []byte) (done bool, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxStreamLine)
+
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			// Blank separators, comments and event: lines
+			continue
+		}
+		done, err := fn([]byte(strings.TrimSpace(data)))
+		if err != nil || done {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
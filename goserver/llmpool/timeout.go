@@ -0,0 +1,42 @@
+package llmpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// timeoutFor is how long one request to provider may take: the request's
+// Timeout, else the provider's, else the pool client's. For streams it
+// bounds the wait for each chunk instead.
+func (p *Pool) timeoutFor(provider *Provider, req *ChatRequest) time.Duration {
+	switch {
+	case req.Timeout > 0:
+		return req.Timeout
+	case provider.Timeout > 0:
+		return provider.Timeout
+	case provider.Type == ProviderOllama:
+		return DefaultOllamaTimeout
+	}
+	return p.client.Timeout
+}
+
+// untimedClient is the pool client without its timeout; requests are
+// bounded by their context instead, see timeoutFor
+func (p *Pool) untimedClient() *http.Client {
+	client := *p.client
+	client.Timeout = 0
+	return &client
+}
+
+// requestFailed wraps err from a request to provider made with reqCtx, a
+// child of ctx bounded by timeout. The request running out of its own
+// time, rather than the caller's, is an ErrProviderTimeout.
+func requestFailed(ctx, reqCtx context.Context, provider *Provider, timeout time.Duration, err error) *ProviderError {
+	if ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", ErrProviderTimeout, timeout)
+	}
+	return &ProviderError{Provider: provider.Name, Err: err}
+}
@@ -0,0 +1,77 @@
+package llmpool
+
+import "encoding/json"
+
+// ToolDefinition is a function the model may call instead of answering
+type ToolDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON Schema of the function's arguments
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a call the model asked for, with its arguments as JSON
+type ToolCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// supportsTools reports whether the provider's type passes on tool definitions
+func (pr *Provider) supportsTools() bool {
+	switch pr.Type {
+	case ProviderGroq, ProviderOpenAI, ProviderAzureOpenAI, ProviderAnthropic:
+		return true
+	}
+	return false
+}
+
+// openAITools converts tools to OpenAI's function tools
+func openAITools(tools []ToolDefinition) []map[string]any {
+	out := make([]map[string]any, 0, len(tools))
+	for _, tool := range tools {
+		out = append(out, map[string]any{
+			"type":     "function",
+			"function": tool,
+		})
+	}
+	return out
+}
+
+// anthropicTools converts tools to Anthropic's shape, which calls the
+// schema input_schema and requires one
+func anthropicTools(tools []ToolDefinition) []map[string]any {
+	out := make([]map[string]any, 0, len(tools))
+	for _, tool := range tools {
+		schema := tool.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object"}`)
+		}
+		t := map[string]any{"name": tool.Name, "input_schema": schema}
+		if tool.Description != "" {
+			t["description"] = tool.Description
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// openAIToolCall is a tool call in an OpenAI-compatible reply. The
+// arguments are a string holding JSON.
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// toolCall converts the call, keeping arguments that aren't valid JSON as
+// a JSON string
+func (c openAIToolCall) toolCall() ToolCall {
+	args := json.RawMessage(c.Function.Arguments)
+	if !json.Valid(args) {
+		args, _ = json.Marshal(c.Function.Arguments)
+	}
+	return ToolCall{ID: c.ID, Name: c.Function.Name, Arguments: args}
+}
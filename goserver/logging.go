@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ctxKey is the type of context keys set by this package
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// requestIDFrom returns the request ID carried by ctx, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// contextHandler adds the request ID from the log call's context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// parseLogLevel maps LOG_LEVEL (debug, info, warn, error) to a slog level
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// setupLogging installs a JSON slog logger at the given level as the default
+func setupLogging(level string) {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: parseLogLevel(level)})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// fatal logs a startup failure and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLogger assigns every request an ID (reusing a sane incoming
+// X-Request-Id), exposes it to handlers via Locals and the user context,
+// echoes it back and logs the request once it completes
+func requestLogger(res *fiber.Ctx) error {
+	id := res.Get("X-Request-Id")
+	if id == "" || len(id) > 128 {
+		id = uuid.NewString()
+	}
+	res.Locals("request_id", id)
+	res.SetUserContext(context.WithValue(res.UserContext(), requestIDKey, id))
+	res.Set("X-Request-Id", id)
+
+	start := time.Now()
+	err := res.Next()
+
+	status := res.Response().StatusCode()
+	if fe, ok := err.(*fiber.Error); ok {
+		status = fe.Code
+	} else if err != nil {
+		status = 500
+	}
+
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(res.UserContext(), level, "request",
+		"method", res.Method(),
+		"path", res.Path(),
+		"ip", res.IP(),
+		"status", status,
+		"duration_ms", time.Since(start).Milliseconds(),
+		"key", keyName(res),
+	)
+	return err
+}
+
+// sendError writes the standard JSON error body, which always carries the
+// request ID so client reports can be matched to server logs
+func sendError(res *fiber.Ctx, status int, message string) error {
+	if status >= 500 {
+		slog.ErrorContext(res.UserContext(), "request failed", "path", res.Path(), "status", status, "error", message)
+	}
+	id, _ := res.Locals("request_id").(string)
+	return res.Status(status).JSON(fiber.Map{"error": message, "request_id": id})
+}
+
+// errorHandler renders errors returned by handlers (including Fiber's own
+// 404/405) in the same JSON shape as sendError
+func errorHandler(res *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	if fe, ok := err.(*fiber.Error); ok {
+		status = fe.Code
+	}
+	return sendError(res, status, err.Error())
+}
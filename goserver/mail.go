@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// mailAttempts is how many times a transient delivery failure is tried
+	mailAttempts = 3
+	// maxAttachmentBytes caps the decoded size of the extra attachments of one email
+	maxAttachmentBytes = 10 << 20
+)
+
+var (
+	// errMailNotConfigured is returned when neither SMTP nor SendGrid is set up
+	errMailNotConfigured = errors.New("email delivery is not configured; set SMTP_HOST or SENDGRID_API_KEY")
+
+	// mailer delivers POST /invoice/send emails; nil when unconfigured
+	mailer mailSender
+	// mailFrom is the sender of those emails (EMAIL_FROM)
+	mailFrom string
+)
+
+// emailAttachment is an attached file, with its content base64-encoded in requests
+type emailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content_base64"`
+}
+
+// emailMessage is one HTML email with attachments
+type emailMessage struct {
+	From        string
+	To          []string
+	Subject     string
+	BodyHTML    string
+	Attachments []emailAttachment
+}
+
+// mailSender delivers a message and returns its message ID
+type mailSender interface {
+	send(ctx context.Context, msg *emailMessage) (string, error)
+}
+
+// newMailer picks SendGrid when its key is set, else SMTP, else nothing
+func newMailer(cfg mailConfig) mailSender {
+	switch {
+	case cfg.SendGridKey != "":
+		return &sendGridMailer{apiKey: cfg.SendGridKey, client: &http.Client{Timeout: 30 * time.Second}}
+	case cfg.SMTPHost != "":
+		return &smtpMailer{cfg: cfg}
+	default:
+		return nil
+	}
+}
+
+// sendMail delivers msg, retrying transient failures with a growing pause
+func sendMail(ctx context.Context, m mailSender, msg *emailMessage) (string, error) {
+	if m == nil {
+		return "", errMailNotConfigured
+	}
+	var err error
+	for attempt := 1; attempt <= mailAttempts; attempt++ {
+		var id string
+		if id, err = m.send(ctx, msg); err == nil || !isTransientMailError(err) {
+			return id, err
+		}
+		if attempt < mailAttempts {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+	}
+	return "", err
+}
+
+// transientMailError marks a failure worth retrying
+type transientMailError struct{ err error }
+
+func (e *transientMailError) Error() string { return e.err.Error() }
+func (e *transientMailError) Unwrap() error { return e.err }
+
+// isTransientMailError reports 4xx SMTP replies, network failures and
+// errors marked transient by a sender
+func isTransientMailError(err error) bool {
+	var tp *textproto.Error
+	if errors.As(err, &tp) {
+		return tp.Code >= 400 && tp.Code < 500
+	}
+	var transient *transientMailError
+	var netErr net.Error
+	return errors.As(err, &transient) || errors.As(err, &netErr)
+}
+
+// smtpMailer sends through an SMTP server: implicit TLS on port 465,
+// otherwise STARTTLS when the server offers it
+type smtpMailer struct {
+	cfg mailConfig
+}
+
+func (s *smtpMailer) send(ctx context.Context, msg *emailMessage) (string, error) {
+	id := messageID(msg.From)
+	data, err := buildMIMEMessage(msg, id)
+	if err != nil {
+		return "", err
+	}
+
+	addr := net.JoinHostPort(s.cfg.SMTPHost, strconv.Itoa(s.cfg.SMTPPort))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if s.cfg.SMTPPort == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.cfg.SMTPHost}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	c, err := smtp.NewClient(conn, s.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && s.cfg.SMTPPort != 465 {
+		if err := c.StartTLS(&tls.Config{ServerName: s.cfg.SMTPHost}); err != nil {
+			return "", err
+		}
+	}
+	if s.cfg.SMTPUser != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.SMTPUser, s.cfg.SMTPPass, s.cfg.SMTPHost)); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Mail(addressOf(msg.From)); err != nil {
+		return "", err
+	}
+	for _, to := range msg.To {
+		if err := c.Rcpt(addressOf(to)); err != nil {
+			return "", err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return id, c.Quit()
+}
+
+// buildMIMEMessage renders msg as multipart/mixed: the HTML body, then the
+// attachments
+func buildMIMEMessage(msg *emailMessage, id string) ([]byte, error) {
+	var b bytes.Buffer
+	boundary := strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	fmt.Fprintf(&b, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", id)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", boundary)
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := io.WriteString(qp, msg.BodyHTML); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("\r\n")
+
+	for _, a := range msg.Attachments {
+		name := mime.QEncoding.Encode("utf-8", a.Filename)
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: %s; name=%q\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=%q\r\n\r\n",
+			boundary, a.ContentType, name, name)
+		encoded := base64.StdEncoding.EncodeToString(a.Content)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// messageID makes a Message-ID in the sender's domain
+func messageID(from string) string {
+	domain := "localhost"
+	if _, d, ok := strings.Cut(addressOf(from), "@"); ok {
+		domain = d
+	}
+	return "<" + uuid.NewString() + "@" + domain + ">"
+}
+
+// addressOf returns the bare address of "Name <addr>"
+func addressOf(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return s
+}
+
+// sendGridMailer sends through SendGrid's v3 API
+type sendGridMailer struct {
+	apiKey string
+	client *http.Client
+}
+
+func (s *sendGridMailer) send(ctx context.Context, msg *emailMessage) (string, error) {
+	type address struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+	toAddress := func(s string) address {
+		if a, err := mail.ParseAddress(s); err == nil {
+			return address{Email: a.Address, Name: a.Name}
+		}
+		return address{Email: s}
+	}
+
+	var to []address
+	for _, t := range msg.To {
+		to = append(to, toAddress(t))
+	}
+	type attachment struct {
+		Content  string `json:"content"`
+		Type     string `json:"type"`
+		Filename string `json:"filename"`
+	}
+	attachments := []attachment{}
+	for _, a := range msg.Attachments {
+		attachments = append(attachments, attachment{
+			Content:  base64.StdEncoding.EncodeToString(a.Content),
+			Type:     a.ContentType,
+			Filename: a.Filename,
+		})
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"personalizations": []map[string]any{{"to": to}},
+		"from":             toAddress(msg.From),
+		"subject":          msg.Subject,
+		"content":          []map[string]string{{"type": "text/html", "value": msg.BodyHTML}},
+		"attachments":      attachments,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		err := fmt.Errorf("sendgrid returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return "", &transientMailError{err}
+		}
+		return "", err
+	}
+	return resp.Header.Get("X-Message-Id"), nil
+}
+
+// invoiceSendRequest is the body of POST /invoice/send: an invoice request
+// plus the email it is attached to
+type invoiceSendRequest struct {
+	invoiceRequest
+	To          []string          `json:"to"`
+	Subject     string            `json:"subject"`
+	BodyHTML    string            `json:"body_html"`
+	Attachments []emailAttachment `json:"attachments,omitempty"`
+}
+
+// validate checks the email fields and fills in attachment types
+func (body *invoiceSendRequest) validate() error {
+	if len(body.To) == 0 {
+		return errors.New("to must list at least one recipient")
+	}
+	for _, to := range body.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid recipient %q", to)
+		}
+	}
+	if strings.TrimSpace(body.Subject) == "" {
+		return errors.New("subject is required")
+	}
+	if strings.ContainsAny(body.Subject, "\r\n") {
+		return errors.New("subject must be a single line")
+	}
+
+	total := 0
+	for i := range body.Attachments {
+		a := &body.Attachments[i]
+		if a.Filename == "" || strings.ContainsAny(a.Filename, "\r\n") {
+			return errors.New("every attachment needs a single-line filename")
+		}
+		if a.ContentType == "" {
+			a.ContentType = http.DetectContentType(a.Content)
+		} else if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+			return fmt.Errorf("attachment %s has an invalid content_type", a.Filename)
+		}
+		total += len(a.Content)
+	}
+	if total > maxAttachmentBytes {
+		return fmt.Errorf("attachments exceed %d bytes", maxAttachmentBytes)
+	}
+	return body.invoiceRequest.validate()
+}
+
+// handleInvoiceSend renders an invoice like POST /invoice and emails it
+func handleInvoiceSend(res *fiber.Ctx) error {
+	var body invoiceSendRequest
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if err := body.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+	if mailer == nil {
+		return sendError(res, 503, errMailNotConfigured.Error())
+	}
+
+	rendered, tpl, err := buildInvoice(res.UserContext(), &body.invoiceRequest)
+	if err != nil {
+		return sendInvoiceError(res, err)
+	}
+	body.setDueDateHeader(res)
+	pdf, filename, err := renderInvoicePDF(res.UserContext(), &body.invoiceRequest, rendered, tpl)
+	if err != nil {
+		return sendInvoiceError(res, err)
+	}
+	recordRender(res, len(pdf))
+
+	msg := &emailMessage{
+		From:     mailFrom,
+		To:       body.To,
+		Subject:  body.Subject,
+		BodyHTML: body.BodyHTML,
+		Attachments: append([]emailAttachment{{
+			Filename:    sanitizeFilename(filename),
+			ContentType: "application/pdf",
+			Content:     pdf,
+		}}, body.Attachments...),
+	}
+	id, err := sendMail(res.UserContext(), mailer, msg)
+	if err != nil {
+		slog.ErrorContext(res.UserContext(), "sending invoice email failed", "error", err)
+		requestID, _ := res.Locals("request_id").(string)
+		return res.Status(502).JSON(fiber.Map{"accepted": false, "error": "email delivery failed: " + err.Error(), "request_id": requestID})
+	}
+	return res.JSON(fiber.Map{"message_id": id, "accepted": true})
+}
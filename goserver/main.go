@@ -1,137 +1,504 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html"
 	"io"
-	"log"
-	"os"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
 	"regexp"
-
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"server/llmpool"
 
 	"github.com/go-rod/rod"
-	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
 )
 
 var (
-	browser *rod.Browser
-	lock    sync.Mutex
+	lock     sync.Mutex
+	pdfStore *pdfCache
+
+	// pdfMaxAge is the Cache-Control max-age (seconds) sent with PDFs
+	pdfMaxAge int
+	// renderAttempts bounds the tries of an HTML render when the browser crashes
+	renderAttempts int
+	// pdfMaxBytes rejects larger PDFs; past pdfWarnBytes a warning is logged
+	pdfMaxBytes, pdfWarnBytes int64
+
+	errPDFTooLarge = withStatus(422, errors.New("generated PDF exceeds maximum size"))
 )
 
-func initBrowser() {
-	path := "C:\\Program Files (x86)\\Microsoft\\Edge\\Application\\msedge.exe" // <- change if needed
-	u := launcher.New().
-		Bin(path).
-		Leakless(false).
-		Headless(true).
-		NoSandbox(true).
-		Set("disable-gpu").
-		Set("disable-software-rasterizer").
-		Set("disable-dev-shm-usage").
-		MustLaunch()
-	browser = rod.New().ControlURL(u).MustConnect()
+// renderCached returns the PDF for key from pdfStore when useCache is set,
+// otherwise (or on a miss) it renders and stores the result
+func renderCached(res *fiber.Ctx, key string, useCache bool, render func() ([]byte, error)) ([]byte, error) {
+	if !useCache || !pdfStore.Enabled() {
+		return render()
+	}
+
+	if pdf, ok := pdfStore.Get(key); ok {
+		res.Set("X-Cache", "HIT")
+		return pdf, nil
+	}
+
+	pdf, err := render()
+	if err != nil {
+		return nil, err
+	}
+	pdfStore.Add(key, pdf)
+	res.Set("X-Cache", "MISS")
+	return pdf, nil
 }
 
-func extractMetadata(url string) (fiber.Map, error) {
-	lock.Lock()
-	defer lock.Unlock()
+// pageMetadataJS collects a page's title, favicon and link preview tags in
+// one pass. Tags that are missing or empty are left out, and URLs are
+// resolved against the page so relative og:image and icon links work.
+const pageMetadataJS = `() => {
+	const meta = {};
+	const set = (key, value) => {
+		value = (value || "").trim();
+		if (value) meta[key] = value;
+	};
+	const abs = (value) => {
+		try { return new URL(value, document.baseURI).href; } catch (e) { return value; }
+	};
+	const content = (selector) => {
+		const el = document.querySelector(selector);
+		return el ? el.getAttribute("content") : "";
+	};
+	const link = (selector) => {
+		const el = document.querySelector(selector);
+		return el && el.getAttribute("href") ? abs(el.getAttribute("href")) : "";
+	};
+
+	set("title", document.title);
+	// icon and shortcut icon beat apple-touch-icon, whatever the order
+	set("favicon", link("link[rel~='icon' i]") || link("link[rel='apple-touch-icon' i]") || link("link[rel*='icon' i]"));
+	set("description", content("meta[name='description' i]"));
+	set("og_title", content("meta[property='og:title']"));
+	set("og_description", content("meta[property='og:description']"));
+	const ogImage = content("meta[property='og:image']");
+	if (ogImage) set("og_image", abs(ogImage));
+	set("og_site_name", content("meta[property='og:site_name']"));
+	for (const field of ["card", "site", "creator", "title", "description", "image"]) {
+		let value = content("meta[name='twitter:" + field + "'], meta[property='twitter:" + field + "']");
+		if (field === "image" && value) value = abs(value);
+		set("twitter_" + field, value);
+	}
+	set("canonical", link("link[rel='canonical' i]"));
+	set("charset", document.characterSet);
+	set("lang", document.documentElement.lang);
+	return meta;
+}`
+
+// pageMetadata reads the title, favicon and preview tags of a loaded page,
+// plus whatever extra asks for: link and image lists, and a PNG of the
+// viewport. A page that doesn't finish loading in time still yields its
+// tags when a thumbnail was asked for; the thumbnail is skipped and noted
+// instead. It returns errors rather than panicking, since the browser can
+// be restarted under it.
+func pageMetadata(url string, extra extractOptions) (fiber.Map, []byte, error) {
+	release := acquireBrowser()
+	defer release()
+
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer page.Close()
 
-	page := browser.MustPage(url)
-	defer page.MustClose()
+	var opts pdfOptions
+	thumbnail := extra.Thumbnail
+	if thumbnail != nil {
+		opts.ViewportWidth, opts.ViewportHeight = thumbnail.Width, thumbnail.Height
+	}
+	loadErr := opts.navigate(page, url)
+	if loadErr != nil && (thumbnail == nil || !errors.Is(loadErr, context.DeadlineExceeded)) {
+		return nil, nil, loadErr
+	}
 
-	page.MustWaitLoad()
+	page = page.Timeout(pageReadTimeout)
+	obj, err := page.Eval(pageMetadataJS)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tags map[string]string
+	if err := obj.Value.Unmarshal(&tags); err != nil {
+		return nil, nil, err
+	}
 
-	title := page.MustEval(`() => document.title`).String()
-	favicon := page.MustEval(`() => {
-		const l = document.querySelector("link[rel*='icon']");
-		return l ? l.href : "";
-	}`).String()
+	// title and favicon predate the other tags and are always present
+	meta := fiber.Map{"title": tags["title"], "favicon": tags["favicon"]}
+	for k, v := range tags {
+		meta[k] = v
+	}
+	if err := extra.inventory(page, meta); err != nil {
+		return nil, nil, err
+	}
 
-	return fiber.Map{"title": title, "favicon": favicon, "address": url}, nil
+	if thumbnail == nil {
+		return meta, nil, nil
+	}
+	if loadErr != nil {
+		meta["screenshot_skipped"] = fmt.Sprintf("page did not finish loading within %s", navigationTimeout)
+		return meta, nil, nil
+	}
+	png, err := capturePNG(page, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, png, nil
 }
 
-func extractMetadataFromHTML(html string) (fiber.Map, error) {
-	lock.Lock()
-	defer lock.Unlock()
+// pageReadTimeout bounds reading tags and screenshots from a loaded page
+const pageReadTimeout = 15 * time.Second
 
-	page := browser.MustPage("")
-	defer page.MustClose()
+// thumbnailOptions size the /extract screenshot (default 1200x630, the
+// usual link preview image)
+type thumbnailOptions struct {
+	Width  int `query:"width"`
+	Height int `query:"height"`
+}
+
+// handleExtract reads a page's metadata (GET /extract?url=)
+func handleExtract(res *fiber.Ctx) error {
+	u := res.Query("url")
+	if u == "" {
+		return sendError(res, 400, "Missing ?url param")
+	}
 
+	// screenshot=true adds a base64 PNG of the viewport to the JSON;
+	// screenshot=binary sends it as a multipart part instead
+	var extra extractOptions
+	switch mode := res.Query("screenshot"); mode {
+	case "", "false":
+	case "true", "binary":
+		thumbnail := &thumbnailOptions{Width: 1200, Height: 630}
+		if err := res.QueryParser(thumbnail); err != nil {
+			return sendError(res, 400, "Invalid query parameters")
+		}
+		if err := (pdfOptions{ViewportWidth: thumbnail.Width, ViewportHeight: thumbnail.Height}).validate(); err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		// Chromium doesn't dial through fetchClient, so the address
+		// check has to happen before it navigates
+		if err := checkPublicURL(res.UserContext(), u); err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		extra.Thumbnail = thumbnail
+	default:
+		return sendError(res, 400, "screenshot must be true, false or binary")
+	}
+	// include=links,images lists the page's links and images
+	if err := extra.parseInclude(res.Query("include")); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+
+	meta, png, err := extractMetadata(u, extra)
+	if err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	if res.QueryBool("include_favicon_data") {
+		addFaviconData(res.UserContext(), meta, u)
+	}
+
+	if png != nil && res.Query("screenshot") == "binary" {
+		return sendMetadataWithScreenshot(res, meta, png)
+	}
+	if png != nil {
+		meta["screenshot"] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	}
+	return res.JSON(meta)
+}
+
+func extractMetadata(url string, extra extractOptions) (fiber.Map, []byte, error) {
+	meta, png, err := pageMetadata(url, extra)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta["address"] = url
+	return meta, png, nil
+}
+
+func extractMetadataFromHTML(html string, extra extractOptions) (fiber.Map, error) {
 	// URL encode the HTML to handle special characters
 	encodedHTML := base64.StdEncoding.EncodeToString([]byte(html))
-	page.MustNavigate("data:text/html;base64," + encodedHTML)
-	page.MustWaitLoad()
-	title := page.MustEval(`() => document.title`).String()
-	favicon := page.MustEval(`() => {
-		const l = document.querySelector("link[rel*='icon']");
-		return l ? l.href : "";
-	}`).String()
-
-	return fiber.Map{"title": title, "favicon": favicon, "source": "html_content"}, nil
+	meta, _, err := pageMetadata("data:text/html;base64,"+encodedHTML, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	meta["source"] = "html_content"
+	return meta, nil
 }
 
-func generatePDF(url string) ([]byte, error) {
-	lock.Lock()
-	defer lock.Unlock()
+// sendMetadataWithScreenshot replies multipart/form-data with the
+// metadata as a JSON "metadata" part and the PNG as a "screenshot" file
+func sendMetadataWithScreenshot(res *fiber.Ctx, meta fiber.Map, png []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="metadata"`)
+	header.Set("Content-Type", "application/json")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(meta); err != nil {
+		return err
+	}
 
-	page := browser.MustPage(url)
-	defer page.MustClose()
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="screenshot"; filename="screenshot.png"`)
+	header.Set("Content-Type", "image/png")
+	if part, err = w.CreatePart(header); err != nil {
+		return err
+	}
+	part.Write(png)
+	if err := w.Close(); err != nil {
+		return err
+	}
 
-	page.MustWaitLoad()
-	zero := 0.0
-	reader, err := page.PDF(&proto.PagePrintToPDF{
+	res.Set(fiber.HeaderContentType, w.FormDataContentType())
+	return res.Send(body.Bytes())
+}
+
+// pdfStream is the body of a rendered PDF. The page stays open until the
+// stream is closed, since Chromium serves the data from the page's session.
+type pdfStream struct {
+	reader  *rod.StreamReader
+	page    *rod.Page
+	cleanup func()
+}
+
+func (s *pdfStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// Close releases the CDP stream handle and then the page
+func (s *pdfStream) Close() error {
+	err := s.reader.Close()
+	s.cleanup()
+	if closeErr := s.page.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// printPDF prints an already loaded page. The browser lock only guards page
+// setup and printing; reading the returned stream happens after it is released.
+func printPDF(page *rod.Page, opts pdfOptions, cleanup func()) (io.ReadCloser, error) {
+	margin := opts.MarginMM / 25.4
+	req := &proto.PagePrintToPDF{
 		PrintBackground: true,
-		MarginTop:       &zero,
-		MarginBottom:    &zero,
-		MarginLeft:      &zero,
-		MarginRight:     &zero,
-	})
+		Landscape:       opts.Orientation == "landscape",
+		MarginTop:       &margin,
+		MarginBottom:    &margin,
+		MarginLeft:      &margin,
+		MarginRight:     &margin,
+	}
+	if opts.PageScale != 0 {
+		req.Scale = &opts.PageScale
+	}
+	if size, ok := paperSizes[strings.ToLower(opts.PaperFormat)]; ok {
+		req.PaperWidth, req.PaperHeight = &size[0], &size[1]
+	}
+
+	reader, err := page.PDF(req)
 	if err != nil {
+		cleanup()
+		page.Close()
 		return nil, err
 	}
-	defer reader.Close()
-
-	return io.ReadAll(reader)
+	return &pdfStream{reader: reader, page: page, cleanup: cleanup}, nil
 }
 
-func generatePDFFromHTML(html string) ([]byte, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func generatePDF(url string, opts pdfOptions) (io.ReadCloser, error) {
+	release := acquireBrowser()
+	defer release()
 
-	page := browser.MustPage("")
-	defer page.MustClose()
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return nil, err
+	}
+	stopIntercept, err := opts.interceptRequests(page, url)
+	if err != nil {
+		page.Close()
+		return nil, err
+	}
+	if err := opts.navigate(page, url); err != nil {
+		stopIntercept()
+		page.Close()
+		return nil, err
+	}
 
+	return printPDF(page, opts, stopIntercept)
+}
+
+func generatePDFFromHTML(html string, opts pdfOptions) (io.ReadCloser, error) {
 	// URL encode the HTML to handle special characters
 	encodedHTML := base64.StdEncoding.EncodeToString([]byte(html))
-	page.MustNavigate("data:text/html;base64," + encodedHTML)
-	page.MustWaitLoad()
-	zero := 0.0
-	reader, err := page.PDF(&proto.PagePrintToPDF{
-		PrintBackground: true,
-		MarginTop:       &zero,
-		MarginBottom:    &zero,
-		MarginLeft:      &zero,
-		MarginRight:     &zero,
+	return generatePDF("data:text/html;base64,"+encodedHTML, opts)
+}
+
+// generateScreenshotFromHTML renders html and captures it as a PNG
+func generateScreenshotFromHTML(html string, opts pdfOptions, fullPage bool) ([]byte, error) {
+	release := acquireBrowser()
+	defer release()
+
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	pageURL := "data:text/html;base64," + base64.StdEncoding.EncodeToString([]byte(html))
+	stopIntercept, err := opts.interceptRequests(page, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer stopIntercept()
+
+	if err := opts.navigate(page, pageURL); err != nil {
+		return nil, err
+	}
+
+	return capturePNG(page, fullPage)
+}
+
+// capturePNG screenshots a loaded page, the viewport or the full page
+func capturePNG(page *rod.Page, fullPage bool) ([]byte, error) {
+	return page.Screenshot(fullPage, &proto.PageCaptureScreenshot{
+		Format: proto.PageCaptureScreenshotFormatPng,
 	})
+}
+
+// readPDF buffers a whole PDF stream, reading no more than pdfMaxBytes so
+// a runaway render fails with errPDFTooLarge instead of exhausting memory
+func readPDF(stream io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	pdf, err := io.ReadAll(io.LimitReader(stream, pdfMaxBytes+1))
 	if err != nil {
 		return nil, err
 	}
-	defer reader.Close()
+	if int64(len(pdf)) > pdfMaxBytes {
+		slog.Warn("generated PDF exceeds maximum size", "max_bytes", pdfMaxBytes)
+		return nil, errPDFTooLarge
+	}
+	if int64(len(pdf)) > pdfWarnBytes {
+		slog.Warn("large PDF generated", "size_bytes", len(pdf), "warn_bytes", pdfWarnBytes)
+	}
+	return pdf, nil
+}
 
-	return io.ReadAll(reader)
+// sendPDFStream streams a rendered PDF to the client as Chromium produces
+// it. fasthttp closes the stream, and with it the page, once the body is
+// written or the connection drops. The size isn't known up front, so
+// X-PDF-Size-Bytes comes as a trailer, and a PDF over pdfMaxBytes aborts
+// the connection part way. A failed stream is noted in
+// Locals("pdf_stream_error") for middleware that reads the body.
+func sendPDFStream(res *fiber.Ctx, stream io.ReadCloser, filename, disposition string) error {
+	resp := res.Response()
+	// The body is read after the handler returns, so the note goes on the
+	// request context, which lives until then, rather than through res
+	reqCtx := res.Context()
+	resp.Header.Set("Content-Type", "application/pdf")
+	resp.Header.Set("Content-Disposition", contentDisposition(disposition, filename))
+	if err := resp.Header.SetTrailer("X-PDF-Size-Bytes"); err != nil {
+		return err
+	}
+	return res.SendStream(&limitedPDF{
+		limited: io.LimitReader(stream, pdfMaxBytes+1),
+		stream:  stream,
+		key:     keyName(res),
+		setSize: func(n int64) { resp.Header.Set("X-PDF-Size-Bytes", strconv.FormatInt(n, 10)) },
+		failed:  func(err error) { reqCtx.SetUserValue("pdf_stream_error", err) },
+	})
 }
-func checkAuth(res *fiber.Ctx) error {
-	if res.Get("Authorization") != "Bearer 123" {
-		return res.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+
+// limitedPDF is a PDF stream cut off with errPDFTooLarge past pdfMaxBytes.
+// At the end it sets the size trailer and records the render, as sendPDF
+// does for buffered PDFs; a read error is passed to failed.
+type limitedPDF struct {
+	limited io.Reader
+	stream  io.Closer
+	key     string
+	setSize func(int64)
+	failed  func(error)
+	n       int64
+}
+
+func (l *limitedPDF) Read(p []byte) (int, error) {
+	n, err := l.limited.Read(p)
+	l.n += int64(n)
+	switch {
+	case l.n > pdfMaxBytes:
+		slog.Warn("generated PDF exceeds maximum size", "max_bytes", pdfMaxBytes)
+		l.failed(errPDFTooLarge)
+		return 0, errPDFTooLarge
+	case err == io.EOF:
+		l.setSize(l.n)
+	case err != nil:
+		l.failed(err)
+	}
+	return n, err
+}
+
+func (l *limitedPDF) Close() error {
+	if l.n <= pdfMaxBytes {
+		if l.n > pdfWarnBytes {
+			slog.Warn("large PDF generated", "size_bytes", l.n, "warn_bytes", pdfWarnBytes)
+		}
+		recordRenderBytes(l.key, int(l.n))
+	}
+	return l.stream.Close()
+}
+
+// sendPDF writes a buffered PDF and records it against the caller's API key
+func sendPDF(res *fiber.Ctx, pdf []byte, filename, disposition string) error {
+	recordRender(res, len(pdf))
+	res.Response().Header.Set("Content-Type", "application/pdf")
+	res.Response().Header.Set("X-PDF-Size-Bytes", strconv.Itoa(len(pdf)))
+	res.Response().Header.Set("Content-Disposition", contentDisposition(disposition, filename))
+	return res.Send(pdf)
+}
+
+// uploadedHTML returns the "html" file of a multipart request, or "" when
+// there is none; the body limit already bounds its size
+func uploadedHTML(res *fiber.Ctx) (string, error) {
+	file, err := res.FormFile("html")
+	if err != nil {
+		return "", nil
+	}
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("reading html upload: %w", err)
 	}
-	return res.Next()
+	return string(data), nil
 }
 
 const systemPrompt string = `
@@ -191,239 +558,558 @@ type AIResponse struct {
 	Response string `json:"response"`
 }
 
-func cleanAIHTML(aiResp string) string {
-	// Step 1: Strip ```html and ``` markers
-	re := regexp.MustCompile("(?s)```html\\s*(.*?)\\s*```")
-	matches := re.FindStringSubmatch(aiResp)
-	var cleaned string
-	if len(matches) > 1 {
-		cleaned = matches[1]
+// suspiciousHTML flags content an invoice template has no business containing
+var suspiciousHTML = []struct {
+	what string
+	re   *regexp.Regexp
+}{
+	{"a <script> element", regexp.MustCompile(`(?i)<script\b`)},
+	{"an inline event handler", regexp.MustCompile(`(?i)\son[a-z]+\s*=`)},
+	{"a javascript: URL", regexp.MustCompile(`(?i)javascript:`)},
+	{"an <iframe>, <object> or <embed> element", regexp.MustCompile(`(?i)<(iframe|object|embed)\b`)},
+}
+
+// cleanAIHTML extracts the HTML from a model reply and sanitizes it. The
+// warnings describe anything that was stripped or looks wrong, and removed
+// lists what sanitizeHTML took out, for the client to surface.
+func cleanAIHTML(aiResp string) (string, []string, []string) {
+	warnings := []string{}
+
+	// Step 1: Take the largest fenced block that contains markup, else cut
+	// the document out of the surrounding prose
+	cleaned, outside, fenced := largestHTMLBlock(aiResp)
+	if fenced {
+		warnings = append(warnings, "stripped markdown code fences from the model output")
 	} else {
-		cleaned = aiResp
+		cleaned, outside = extractHTMLDocument(aiResp)
+	}
+	if strings.TrimSpace(outside) != "" {
+		warnings = append(warnings, "discarded text outside the HTML")
 	}
 
 	// Step 2: Unescape \u003c, \u003e, etc.
-	return html.UnescapeString(cleaned)
-}
-
-func main() {
-	initBrowser()
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	pool := llmpool.NewPool()
-	pool.AddProvider(&llmpool.Provider{
-		Name:              "groq-fast",
-		Type:              llmpool.ProviderGroq,
-		APIKey:            os.Getenv("API_1"),
-		BaseURL:           "https://api.groq.com/openai/v1",
-		Model:             "meta-llama/llama-4-maverick-17b-128e-instruct",
-		Priority:          1,
-		RequestsPerMinute: 30,
-	})
+	cleaned = html.UnescapeString(cleaned)
 
-	app := fiber.New()
+	// Step 3: Undo markdown escaping of placeholders and typographic quotes
+	// around attribute values
+	if unescaped := escapedBraces.Replace(cleaned); unescaped != cleaned {
+		cleaned = unescaped
+		warnings = append(warnings, `unescaped \{\{ placeholder braces`)
+	}
+	if straight := tagRe.ReplaceAllStringFunc(cleaned, smartQuotes.Replace); straight != cleaned {
+		cleaned = straight
+		warnings = append(warnings, "replaced smart quotes in the markup")
+	}
 
-	app.Use(func(res *fiber.Ctx) error {
-		res.Set("Access-Control-Allow-Origin", "*")
-		res.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		res.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+	if !htmlTagRe.MatchString(cleaned) {
+		warnings = append(warnings, "output does not look like HTML")
+	}
+	cleaned, removed := sanitizeHTML(cleaned)
+	if len(removed) > 0 {
+		warnings = append(warnings, "removed unsafe content from the model output")
+	}
+	return cleaned, warnings, removed
+}
 
-		if res.Method() == "OPTIONS" {
-			return res.SendStatus(200)
-		}
+var (
+	// htmlTagRe matches anything that looks like a tag
+	htmlTagRe     = regexp.MustCompile(`<[a-zA-Z!/][^>]*>`)
+	escapedBraces = strings.NewReplacer(`\{\{`, "{{", `\}\}`, "}}", `\{{`, "{{", `\}}`, "}}")
+	smartQuotes   = strings.NewReplacer("\u201c", `"`, "\u201d", `"`, "\u201e", `"`, "\u2018", "'", "\u2019", "'")
+)
 
-		return res.Next()
-	})
-	app.Post("/create/ai", checkAuth, func(res *fiber.Ctx) error {
-		var body struct {
-			Message     string `json:"prompt"`
-			Base64Image string `json:"image,omitempty"`
+// largestHTMLBlock finds the markdown code blocks in a reply, with or
+// without a language tag, and returns the largest one containing markup
+// along with everything outside it. A block left open by a truncated reply
+// runs to the end. ok is false when no block contains markup.
+func largestHTMLBlock(reply string) (block, outside string, ok bool) {
+	type span struct{ start, end, outerStart, outerEnd int }
+	var blocks []span
+
+	open := -1
+	var current span
+	for pos := 0; ; {
+		i := strings.Index(reply[pos:], "```")
+		if i < 0 {
+			break
 		}
-
-		if err := res.BodyParser(&body); err != nil {
-			return res.Status(400).JSON(fiber.Map{"error": "Invalid JSON body"})
-		}
-		var messages []llmpool.ChatMessage
-
-		if body.Base64Image != "" {
-			// Send text + image as structured message
-			messages = []llmpool.ChatMessage{
-				{
-					Role: "user",
-					Content: []llmpool.MessagePart{
-						{Type: "text", Text: body.Message},
-						{Type: "image_url", ImageURL: &llmpool.ImageURLObject{
-							URL: body.Base64Image,
-						}},
-					},
-				},
+		i += pos
+		if open < 0 {
+			// The language tag runs to the end of the fence line
+			bodyStart := len(reply)
+			if nl := strings.IndexByte(reply[i:], '\n'); nl >= 0 {
+				bodyStart = i + nl + 1
 			}
-		} else {
-			// Plain text message only
-			messages = []llmpool.ChatMessage{
-				{Role: "user", Content: body.Message},
+			if lt := strings.IndexByte(reply[i:bodyStart], '<'); lt >= 0 {
+				// ```html<div> on a single line
+				bodyStart = i + lt
 			}
+			open, current = bodyStart, span{start: bodyStart, outerStart: i}
+			pos = bodyStart
+			continue
 		}
+		current.end, current.outerEnd = i, i+3
+		blocks = append(blocks, current)
+		open = -1
+		pos = i + 3
+	}
+	if open >= 0 {
+		current.end, current.outerEnd = len(reply), len(reply)
+		blocks = append(blocks, current)
+	}
 
-		// Use the pool
-
-		req := &llmpool.ChatRequest{
-			Messages:    append([]llmpool.ChatMessage{{Role: "system", Content: systemPrompt}}, messages...),
-			Temperature: 0.7,
-			MaxTokens:   8000,
+	best := -1
+	for i, b := range blocks {
+		if htmlTagRe.MatchString(reply[b.start:b.end]) && (best < 0 || b.end-b.start > blocks[best].end-blocks[best].start) {
+			best = i
 		}
+	}
+	if best < 0 {
+		return "", "", false
+	}
+	b := blocks[best]
+	return strings.TrimSpace(reply[b.start:b.end]), reply[:b.outerStart] + reply[b.outerEnd:], true
+}
 
-		resp, err := pool.Chat(context.Background(), req)
-		if err != nil {
-			log.Fatal(err)
+// extractHTMLDocument cuts the HTML out of an unfenced reply: from <!doctype
+// or <html to the last </html>, or else from the first tag to the last one
+func extractHTMLDocument(reply string) (doc, outside string) {
+	lower := strings.ToLower(reply)
+	start := strings.Index(lower, "<!doctype")
+	if start < 0 {
+		start = strings.Index(lower, "<html")
+	}
+	end := -1
+	if start >= 0 {
+		if i := strings.LastIndex(lower, "</html>"); i > start {
+			end = i + len("</html>")
 		}
-		//fmt.Print(resp.Content)
+	}
+	if start < 0 {
+		if loc := htmlTagRe.FindStringIndex(reply); loc != nil {
+			start = loc[0]
+		}
+	}
+	if start < 0 {
+		return strings.TrimSpace(reply), ""
+	}
+	if end < 0 {
+		end = strings.LastIndexByte(reply, '>') + 1
+	}
+	return reply[start:end], reply[:start] + reply[end:]
+}
 
-		return res.Status(200).JSON(fiber.Map{"response": cleanAIHTML(resp.Content)})
+func main() {
+	// Containers get their configuration from the real environment; .env is
+	// only a convenience for local runs
+	envErr := godotenv.Load()
 
-	})
-	app.Get("/", func(res *fiber.Ctx) error {
-		return res.SendFile("../index.html")
-	})
-	// Extract metadata from URL
-	app.Get("/extract", func(res *fiber.Ctx) error {
-		u := res.Query("url")
-		if u == "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Missing ?url param"})
-		}
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("loading configuration", "error", err)
+	}
+	setupLogging(cfg.LogLevel)
+	if envErr != nil {
+		slog.Debug("no .env file loaded", "error", envErr)
+	}
+	if cfg.GroqAPIKey == "" && cfg.LLMProvidersFile == "" {
+		slog.Warn("API_1 is not set; /create/ai will fail until an LLM provider key is configured")
+	}
 
-		meta, err := extractMetadata(u)
+	if err := initBrowser(cfg.Browser); err != nil {
+		fatal("starting browser failed", "error", err)
+	}
+
+	// Response caching is opt-in: PDF_CACHE_ENABLED=true turns it on
+	pdfCacheSize := 0
+	if cfg.Cache.Enabled {
+		pdfCacheSize = cfg.Cache.MaxEntries
+	}
+	pdfStore = newPDFCache(pdfCacheSize, cfg.Cache.TTL)
+
+	pdfMaxAge = cfg.Cache.MaxAge
+	renderAttempts = cfg.Browser.RenderAttempts
+	pdfMaxBytes, pdfWarnBytes = cfg.Limits.PDFMaxBytes, cfg.Limits.PDFWarnBytes
+	inlineImageMaxBytes = cfg.Limits.InlineImageMaxBytes
+	inlineCSSMaxBytes = cfg.Limits.InlineCSSMaxBytes
+	allowPrivateFetch = cfg.AllowPrivateFetch
+	aiImageMaxBytes = cfg.Limits.AIImageMaxBytes
+	inventoryMax = cfg.Limits.InventoryMax
+	injectCSSMaxBytes = cfg.Limits.InjectCSSMaxBytes
+	stripExternalResources = cfg.AIStripExternal
+	pdfTitleField = cfg.PDFTitleField
+	pdftoppmPath = cfg.PdftoppmPath
+	mailer, mailFrom = newMailer(cfg.Mail), cfg.Mail.From
+	storage = newS3Client(cfg.Storage)
+	webhookSecret = cfg.WebhookSecret
+	pdfKeywords = cfg.PDFKeywords
+	if err := loadHolidays(cfg.HolidaysFile); err != nil {
+		fatal("loading holidays failed", "error", err)
+	}
+	if rates, err = newExchangeRates(cfg.Exchange); err != nil {
+		fatal("configuring exchange rates failed", "error", err)
+	}
+
+	// Auth is on unless explicitly disabled, and then it needs at least one key
+	authEnabled = cfg.Auth.Enabled
+	authKeys, err = loadAPIKeys(cfg.Auth)
+	if err != nil {
+		fatal("loading API keys failed", "error", err)
+	}
+	if authEnabled && len(authKeys.keys) == 0 {
+		fatal("auth is enabled but no API keys are configured; set API_KEYS or API_KEYS_FILE (or AUTH_ENABLED=false)")
+	}
+	if cfg.MetricsPublic {
+		authExempt["/metrics"] = true
+	}
+	loadAuthExemptions(cfg.Auth.Unauthenticated)
+
+	db, err = openDB(cfg.DBPath)
+	if err != nil {
+		fatal("opening database failed", "path", cfg.DBPath, "error", err)
+	}
+
+	// Idempotency-Key replays are kept in memory, and in SQLite with IDEMPOTENCY_PERSIST=true
+	var idempotencyDB *sql.DB
+	if cfg.IdempotencyPersist {
+		idempotencyDB = db
+	}
+	idemp := newIdempotencyStore(cfg.IdempotencyTTL, idempotencyDB, renderEndpoints...)
+
+	// A browser that stops answering is killed and relaunched
+	if cfg.Browser.HealthInterval > 0 {
+		go monitorBrowser(cfg.Browser)
+	}
+
+	usage = newUsageTracker(cfg.Limits.KeyRateLimit, cfg.Limits.KeyRateLimits)
+	if err := usage.load(db); err != nil {
+		slog.Error("loading usage counters failed", "error", err)
+	}
+	go usage.persistLoop(db, 30*time.Second)
+
+	jobs = newJobQueue(cfg.Limits.RenderConcurrency)
+	if scheduler, err = startScheduler(db); err != nil {
+		fatal("starting scheduler failed", "error", err)
+	}
+
+	// Renders beyond RENDER_CONCURRENCY wait in a bounded queue, then get 429
+	limiter := newRenderLimiter(
+		cfg.Limits.RenderConcurrency,
+		cfg.Limits.RenderQueueMax,
+		cfg.Limits.RenderQueueTimeout,
+		renderEndpoints...,
+	)
+	limiter.skip = isInvoicePreview
+
+	pool := llmpool.NewPool().
+		WithLogger(slog.Default().With("component", "llmpool")).
+		WithObserver(observeLLM).
+		WithAutoPriority(llmpool.AutoPriorityConfig{})
+	if cfg.LLMProvidersFile != "" {
+		providersCfg, err := llmpool.LoadConfig(cfg.LLMProvidersFile)
 		if err != nil {
-			return res.Status(500).JSON(fiber.Map{"error": err.Error()})
+			fatal("loading LLM providers failed", "error", err)
+		}
+		if err := pool.Reload(providersCfg); err != nil {
+			fatal("loading LLM providers failed", "error", err)
 		}
+		if cfg.LLMProvidersReload > 0 {
+			pool.WatchConfig(context.Background(), cfg.LLMProvidersFile, cfg.LLMProvidersReload)
+		}
+	} else {
+		for _, provider := range builtinProviders(cfg) {
+			if err := pool.AddProvider(provider); err != nil {
+				fatal("adding LLM provider failed", "provider", provider.Name, "error", err)
+			}
+		}
+	}
+	if cfg.ProviderMaxIdle > 0 {
+		pool.WithIdleCleanup(cfg.ProviderMaxIdle)
+	}
+	if cfg.LLMCacheSize > 0 {
+		pool.EnableCache(cfg.LLMCacheSize, cfg.LLMCacheTTL)
+		if cfg.LLMCacheDeterministic {
+			pool.WithCacheMaxTemperature(0)
+		}
+	}
+	for name, limit := range cfg.LLMMonthlyBudgets {
+		if err := pool.SetBudget(name, limit, llmpool.BudgetMonthly); err != nil {
+			fatal("setting LLM budget failed", "provider", name, "error", err)
+		}
+	}
+	go checkProviderModels(pool)
+
+	// Bodies are capped per route; Fiber refuses anything over the largest cap
+	limits := bodyLimits{body: cfg.Limits.MaxBodyBytes, upload: cfg.Limits.MaxUploadBytes}
+	appConfig := fiber.Config{ErrorHandler: errorHandler, BodyLimit: limits.serverLimit()}
+	cfg.Listen.apply(&appConfig)
+	app := fiber.New(appConfig)
+
+	app.Use(requestLogger)
+	app.Use(countHTTPRequests)
+	app.Use(newCORSPolicy(cfg.CORS).handler)
+	app.Use(checkAuth)
+	app.Use(limits.handler)
+	app.Get("/healthz", healthz)
+	app.Get("/readyz", readyz(pool))
+	app.Get("/healthz/live", healthz)
+	app.Get("/healthz/ready", healthReady(pool))
+	app.Use(rateLimitKey)
+	app.Use(idemp.handler)
+	app.Use(limiter.handler)
+	app.Use(metrics.trackRenders)
+
+	// Prometheus scrape endpoint; admin-only unless METRICS_AUTH=none
+	if cfg.MetricsPublic {
+		app.Get("/metrics", servePrometheus)
+	} else {
+		app.Get("/metrics", requireAdmin, servePrometheus)
+	}
 
-		return res.JSON(meta)
+	// Render metrics, cache counters and LLM provider statistics (admin only)
+	app.Get("/stats", requireAdmin, func(res *fiber.Ctx) error {
+		return res.JSON(fiber.Map{
+			"render":    metrics.snapshot(),
+			"limiter":   limiter.Stats(),
+			"pdf_cache": pdfStore.Stats(),
+			"llm":       pool.GetStats(),
+		})
 	})
 
-	// Extract metadata from HTML content
-	app.Post("/extract-html", func(res *fiber.Ctx) error {
+	// Per-key usage accounting (admin only)
+	app.Get("/usage", requireAdmin, func(res *fiber.Ctx) error {
+		return res.JSON(usage.snapshot())
+	})
+	app.Post("/usage/reset", requireAdmin, func(res *fiber.Ctx) error {
+		usage.reset(res.Query("key"))
+		return res.JSON(usage.snapshot())
+	})
+
+	// Zero the LLM provider counters, e.g. between load tests
+	app.Post("/admin/pool/reset", requireAdmin, func(res *fiber.Ctx) error {
+		pool.Reset()
+		return res.JSON(pool.GetStats())
+	})
+	app.Get("/providers/:name/models", requireAdmin, handleProviderModels(pool))
+	app.Get("/admin/providers", requireAdmin, handleListProviders(pool))
+	app.Post("/admin/providers", requireAdmin, handleAddProvider(pool))
+	app.Patch("/admin/providers/:name", requireAdmin, handleUpdateProvider(pool))
+	app.Delete("/admin/providers/:name", requireAdmin, handleRemoveProvider(pool))
+	app.Post("/admin/providers/:name/reset", requireAdmin, handleResetProvider(pool))
+
+	app.Post("/create/ai", handleCreateAI(pool, cfg))
+
+	// Revise an existing template following an instruction. The template is
+	// replayed as the model's earlier answer so it edits rather than redesigns.
+	app.Post("/create/ai/refine", func(res *fiber.Ctx) error {
 		var body struct {
-			HTML string `json:"html"`
+			HTML        string `json:"html" form:"html"`
+			Instruction string `json:"instruction" form:"instruction"`
+			// MinRetained overrides AI_REFINE_MIN_RETAINED for this request
+			MinRetained float64 `json:"min_retained,omitempty" form:"min_retained"`
+			ImageBase64 string  `json:"image_base64,omitempty" form:"image_base64"`
+			Base64Image string  `json:"image,omitempty" form:"-"`
+			Provider    string  `json:"provider,omitempty" form:"provider"`
+			Model       string  `json:"model,omitempty" form:"model"`
+			// DocumentType is the preset the template was generated with
+			DocumentType string `json:"document_type,omitempty" form:"document_type"`
 		}
 
 		if err := res.BodyParser(&body); err != nil {
-			return res.Status(400).JSON(fiber.Map{"error": "Invalid JSON body"})
+			return sendError(res, 400, "Invalid JSON body")
 		}
-
-		if body.HTML == "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Missing html field in request body"})
+		if strings.TrimSpace(body.HTML) == "" || strings.TrimSpace(body.Instruction) == "" {
+			return sendError(res, 400, "html and instruction are required")
+		}
+		preset, err := presetFor(body.DocumentType)
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		if body.MinRetained < 0 || body.MinRetained > 1 {
+			return sendError(res, 400, "min_retained must be between 0 and 1")
+		}
+		minRetained := cfg.AIRefineMinRetained
+		if body.MinRetained > 0 {
+			minRetained = body.MinRetained
 		}
 
-		meta, err := extractMetadataFromHTML(body.HTML)
+		image, err := requestImage(res, body.ImageBase64, body.Base64Image)
 		if err != nil {
-			return res.Status(500).JSON(fiber.Map{"error": err.Error()})
+			return sendError(res, imageErrorStatus(err), err.Error())
 		}
 
-		return res.JSON(meta)
-	})
+		target, err := providerTarget(pool, body.Provider)
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
 
-	// Generate PDF from URL
-	app.Get("/pdf", func(res *fiber.Ctx) error {
-		u := res.Query("url")
-		if u == "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Missing ?url param"})
+		req := &llmpool.ChatRequest{
+			Messages: []llmpool.ChatMessage{
+				{Role: "system", Content: preset.prompt()},
+				userMessage("Create the "+preset.Title+" template.", image),
+				{Role: "assistant", Content: body.HTML},
+				{Role: "user", Content: body.Instruction + "\n\nReturn the complete modified HTML only. Keep the existing placeholders unless the change requires otherwise."},
+			},
+			Model:       body.Model,
+			Temperature: llmpool.Ptr(0.4),
+			MaxTokens:   8000,
 		}
 
-		pdf, err := generatePDF(u)
+		result, err := generateTemplate(res.UserContext(), target.chat, req, cfg.AIValidationRetries, refineCheck(preset.check, body.HTML, minRetained))
 		if err != nil {
-			return res.Status(500).JSON(fiber.Map{"error": err.Error()})
+			return sendLLMError(res, err)
 		}
+		return sendTemplateResult(res, result, fiber.Map{"changes": compareVariables(body.HTML, result.HTML)})
+	})
 
-		res.Response().Header.Set("Content-Type", "application/pdf")
-		res.Response().Header.Set("Content-Disposition", "inline; filename=result.pdf")
-		return res.Send(pdf)
+	// Multi-turn template conversations kept in memory
+	sessions := newSessionStore(pool, cfg.SessionTTL, cfg.MaxTurns, cfg.AIValidationRetries)
+	app.Post("/sessions", sessions.handleCreate)
+	app.Post("/sessions/:id/message", sessions.handleMessage)
+	app.Get("/sessions/:id/history", sessions.handleHistory)
+	app.Delete("/sessions/:id", sessions.handleDelete)
+
+	// Stored templates and the template + data → PDF workflow
+	app.Get("/templates", handleListTemplates)
+	app.Post("/templates", handleCreateTemplate)
+	app.Post("/templates/lint", handleLintTemplate)
+	app.Post("/templates/search", handleSearchTemplates)
+	app.Get("/templates/:id", handleGetTemplate)
+	app.Put("/templates/:id", handleUpdateTemplate)
+	app.Delete("/templates/:id", handleDeleteTemplate)
+	app.Post("/templates/:id/validate", handleValidateTemplate)
+	app.Post("/templates/:id/duplicate", handleDuplicateTemplate)
+
+	// Recurring invoices
+	app.Get("/schedules", handleListSchedules)
+	app.Post("/schedules", handleCreateSchedule)
+	app.Get("/schedules/:id", handleGetSchedule)
+	app.Delete("/schedules/:id", handleDeleteSchedule)
+	app.Post("/template/schema", handleTemplateSchema)
+	app.Post("/invoice", handleInvoice)
+	app.Post("/invoice/send", handleInvoiceSend)
+
+	app.Get("/", func(res *fiber.Ctx) error {
+		return res.SendFile("../index.html")
 	})
+	app.Get("/extract", handleExtract)
 
-	// Generate PDF from HTML content
-	app.Post("/pdf-html", func(res *fiber.Ctx) error {
+	// Extract metadata from HTML content
+	app.Post("/extract-html", func(res *fiber.Ctx) error {
 		var body struct {
-			HTML     string `json:"html"`
-			Filename string `json:"filename,omitempty"`
+			HTML string `json:"html"`
+			// IncludeFaviconData inlines the favicon as a data: URL
+			IncludeFaviconData bool `json:"include_favicon_data,omitempty"`
+			// Include lists links and/or images, e.g. "links,images"
+			Include string `json:"include,omitempty"`
 		}
 
 		if err := res.BodyParser(&body); err != nil {
-			return res.Status(400).JSON(fiber.Map{"error": "Invalid JSON body"})
+			return sendError(res, 400, "Invalid JSON body")
 		}
 
 		if body.HTML == "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Missing html field in request body"})
+			return sendError(res, 400, "Missing html field in request body")
 		}
 
-		pdf, err := generatePDFFromHTML(body.HTML)
-		if err != nil {
-			return res.Status(500).JSON(fiber.Map{"error": err.Error()})
+		var extra extractOptions
+		if err := extra.parseInclude(body.Include); err != nil {
+			return sendError(res, 400, err.Error())
 		}
 
-		filename := "result.pdf"
-		if body.Filename != "" {
-			filename = body.Filename
+		meta, err := extractMetadataFromHTML(body.HTML, extra)
+		if err != nil {
+			return sendError(res, 500, err.Error())
+		}
+		if body.IncludeFaviconData {
+			addFaviconData(res.UserContext(), meta, "")
 		}
 
-		res.Response().Header.Set("Content-Type", "application/pdf")
-		res.Response().Header.Set("Content-Disposition", "inline; filename="+filename)
-		return res.Send(pdf)
+		return res.JSON(meta)
 	})
 
-	// Unified PDF endpoint that supports both URL and HTML
-	app.Post("/pdf-unified", func(res *fiber.Ctx) error {
+	pdfs := newPDFHandlers()
+	app.Get("/pdf", pdfs.handleURL)
+	app.Post("/pdf-url", pdfs.handleURLBody)
+	app.Post("/pdf-html", pdfs.handleHTML)
+	app.Post("/pdf-unified", pdfs.handleUnified)
+
+	// Render HTML in the background; poll the job or get a webhook
+	app.Post("/pdf-async", handlePDFAsync)
+	app.Get("/jobs/:id", handleGetJob)
+	app.Get("/jobs/:id/pdf", handleGetJobPDF)
+
+	// Capture a PNG screenshot of HTML content
+	app.Post("/screenshot-html", func(res *fiber.Ctx) error {
 		var body struct {
-			URL      string `json:"url,omitempty"`
-			HTML     string `json:"html,omitempty"`
-			Filename string `json:"filename,omitempty"`
+			HTML     string `json:"html"`
+			FullPage bool   `json:"full_page,omitempty"`
+			pdfOptions
 		}
 
 		if err := res.BodyParser(&body); err != nil {
-			return res.Status(400).JSON(fiber.Map{"error": "Invalid JSON body"})
+			return sendError(res, 400, "Invalid JSON body")
 		}
 
-		if body.URL == "" && body.HTML == "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Either url or html field is required"})
-		}
-
-		if body.URL != "" && body.HTML != "" {
-			return res.Status(400).JSON(fiber.Map{"error": "Provide either url or html, not both"})
+		if body.HTML == "" {
+			return sendError(res, 400, "Missing html field in request body")
 		}
 
-		var pdf []byte
-		var err error
-
-		if body.URL != "" {
-			pdf, err = generatePDF(body.URL)
-		} else {
-			pdf, err = generatePDFFromHTML(body.HTML)
+		if err := body.pdfOptions.validate(); err != nil {
+			return sendValidationError(res, err)
 		}
 
+		png, err := generateScreenshotFromHTML(body.pdfOptions.preprocess(res.Context(), body.HTML), body.pdfOptions, body.FullPage)
 		if err != nil {
-			return res.Status(500).JSON(fiber.Map{"error": err.Error()})
+			return sendError(res, renderErrorStatus(err), err.Error())
 		}
 
-		filename := "result.pdf"
-		if body.Filename != "" {
-			filename = body.Filename
-		}
+		res.Response().Header.Set("Content-Type", "image/png")
+		return res.Send(png)
+	})
 
-		res.Response().Header.Set("Content-Type", "application/pdf")
-		res.Response().Header.Set("Content-Disposition", "inline; filename="+filename)
-		return res.Send(pdf)
+	slog.Info("listening", "url", cfg.Listen.URL())
+	slog.Debug("endpoints", "routes", []string{
+		"Get /                - get index file",
+		"POST /create/ai      - generate template via ai pool (SSE with Accept: text/event-stream)",
+		"POST /create/ai/refine - revise a template following an instruction",
+		"POST /sessions       - Start a template conversation; POST /sessions/:id/message to continue it",
+		"GET  /sessions/:id/history - A conversation's messages; DELETE /sessions/:id to end it",
+		"GET  /extract        - Extract metadata from URL (&screenshot=true for a thumbnail)",
+		"POST /extract-html   - Extract metadata from HTML content",
+		"GET  /pdf            - Generate PDF from URL",
+		"POST /pdf-url        - Generate PDF from URL (JSON body, supports cookies)",
+		"POST /pdf-html       - Generate PDF from HTML content (JSON, or multipart with an html file)",
+		"POST /pdf-unified    - Generate PDF from either URL or HTML",
+		"POST /pdf-async      - Queue an HTML render; GET /jobs/:id for status, webhook_url to be called back",
+		"POST /screenshot-html - Capture a PNG screenshot of HTML content",
+		"GET  /templates      - List stored templates, ?tags=a,b to filter (POST to create)",
+		"POST /templates/search - Find templates by tags, name and creation time, paginated",
+		"GET  /templates/:id  - Get a template (PUT to update, DELETE to remove)",
+		"POST /templates/:id/validate - Check a template's required fields (?country=DE)",
+		"POST /templates/:id/duplicate - Copy a template under a new id",
+		"POST /templates/lint - Report template markup mistakes by line and column",
+		"POST /schedules      - Render (and store or email) an invoice on a cron schedule",
+		"GET  /schedules      - List schedules; GET/DELETE /schedules/:id for one",
+		"POST /template/schema - JSON Schema of a template's data (html or template_id)",
+		"POST /invoice        - Render a stored template with data to PDF",
+		"POST /invoice/send   - Render an invoice and email it as an attachment",
+		"GET  /healthz        - Liveness probe",
+		"GET  /readyz         - Readiness probe (browser + LLM pool)",
+		"GET  /healthz/live   - Liveness probe for orchestrators",
+		"GET  /healthz/ready  - Strict readiness probe (browser, an available provider, database)",
+		"GET  /metrics        - Prometheus metrics",
+		"GET  /stats          - Render metrics and LLM provider stats (admin)",
+		"GET  /usage          - Per-key usage counters (admin)",
+		"POST /usage/reset    - Reset usage counters (admin)",
+		"POST /admin/pool/reset - Reset LLM provider counters (admin)",
+		"GET  /providers/:name/models - Models an LLM provider serves (admin)",
+		"GET  /admin/providers - LLM providers with stats; POST to add (admin)",
+		"PATCH /admin/providers/:name - Change a provider's key, model, priority or limits; DELETE to remove (admin)",
+		"POST /admin/providers/:name/reset - Close a provider's circuit breaker (admin)",
 	})
 
-	log.Println("Running at http://localhost:8080")
-	log.Println("Endpoints:")
-	log.Println("  Get /                - get index file")
-	log.Println("  POST /create/ai      - generate template via ai pool")
-	log.Println("  GET  /extract        - Extract metadata from URL")
-	log.Println("  POST /extract-html   - Extract metadata from HTML content")
-	log.Println("  GET  /pdf            - Generate PDF from URL")
-	log.Println("  POST /pdf-html       - Generate PDF from HTML content")
-	log.Println("  POST /pdf-unified    - Generate PDF from either URL or HTML")
-
-	log.Fatal(app.Listen(":8080"))
+	if err := cfg.Listen.listen(app); err != nil {
+		fatal("server stopped", "error", err)
+	}
 }
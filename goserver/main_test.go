@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// stubRendering points the render settings a handler reads at test values
+// and restores them when the test ends
+func stubRendering(t *testing.T) {
+	t.Helper()
+	prevUsage, prevStore, prevMaxAge := usage, pdfStore, pdfMaxAge
+	prevMax, prevWarn := pdfMaxBytes, pdfWarnBytes
+	t.Cleanup(func() {
+		usage, pdfStore, pdfMaxAge = prevUsage, prevStore, prevMaxAge
+		pdfMaxBytes, pdfWarnBytes = prevMax, prevWarn
+	})
+
+	usage, pdfStore, pdfMaxAge = newUsageTracker(0, nil), newPDFCache(0, 0), 60
+	pdfMaxBytes, pdfWarnBytes = 1<<20, 1<<20
+}
+
+// pdfApp serves the PDF endpoints with a renderer that returns *page and
+// counts the renders
+func pdfApp(t *testing.T, page *string, rendered *int) *fiber.App {
+	t.Helper()
+	stubRendering(t)
+	render := func(string, pdfOptions) (io.ReadCloser, error) {
+		*rendered++
+		return io.NopCloser(strings.NewReader(*page)), nil
+	}
+	pdfs := &pdfHandlers{renderURL: render, renderHTML: render}
+
+	app := fiber.New()
+	app.Get("/pdf", pdfs.handleURL)
+	app.Post("/pdf-html", pdfs.handleHTML)
+	app.Post("/pdf-unified", pdfs.handleUnified)
+	return app
+}
+
+// requestPDF sends a GET with query, or a POST with a JSON body
+func requestPDF(t *testing.T, app *fiber.App, method, target, body, ifNoneMatch string) (status int, etag, cacheControl string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get("Cache-Control")
+}
+
+func TestETagNotModified(t *testing.T) {
+	tests := []struct {
+		name, method, target, body, invalid string
+	}{
+		{"html", "POST", "/pdf-html", `{"html":"<p>Invoice</p>"}`, `{"html":"<p>Invoice</p>","disposition":"evil"}`},
+		{"unified", "POST", "/pdf-unified", `{"html":"<p>Invoice</p>"}`, `{"html":"<p>Invoice</p>","disposition":"evil"}`},
+		{"url", "GET", "/pdf?url=https://example.com/invoice", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, rendered := "%PDF-1.4 invoice", 0
+			app := pdfApp(t, &page, &rendered)
+
+			status, etag, cacheControl := requestPDF(t, app, tt.method, tt.target, tt.body, "")
+			if status != 200 || etag == "" {
+				t.Fatalf("first request: status %d, ETag %q", status, etag)
+			}
+			if cacheControl != "private, max-age=60" {
+				t.Errorf("Cache-Control = %q", cacheControl)
+			}
+
+			for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+				status, again, _ := requestPDF(t, app, tt.method, tt.target, tt.body, ifNoneMatch)
+				if status != fiber.StatusNotModified {
+					t.Errorf("If-None-Match %s: status %d, want 304", ifNoneMatch, status)
+				}
+				if again != etag {
+					t.Errorf("If-None-Match %s: ETag %q, want %q", ifNoneMatch, again, etag)
+				}
+			}
+			if status, _, _ := requestPDF(t, app, tt.method, tt.target, tt.body, `"stale"`); status != 200 {
+				t.Errorf("stale If-None-Match: status %d, want 200", status)
+			}
+
+			// A bad request is rejected even when its tag matches
+			invalidTarget := tt.target + "&disposition=evil"
+			if tt.invalid != "" {
+				invalidTarget = tt.target
+			}
+			if status, _, _ := requestPDF(t, app, tt.method, invalidTarget, tt.invalid, etag); status != 400 {
+				t.Errorf("invalid request with a matching ETag: status %d, want 400", status)
+			}
+		})
+	}
+}
+
+// HTML requests are tagged before rendering, so a match renders nothing
+func TestETagSkipsRender(t *testing.T) {
+	page, rendered := "%PDF-1.4 invoice", 0
+	app := pdfApp(t, &page, &rendered)
+	body := `{"html":"<p>Invoice</p>"}`
+
+	_, etag, _ := requestPDF(t, app, "POST", "/pdf-html", body, "")
+	for range 3 {
+		requestPDF(t, app, "POST", "/pdf-html", body, etag)
+	}
+	if rendered != 1 {
+		t.Errorf("rendered %d times, want 1", rendered)
+	}
+}
+
+// A URL's tag comes from the PDF, so it changes when the page does
+func TestETagFollowsURLContent(t *testing.T) {
+	page, rendered := "%PDF-1.4 draft", 0
+	app := pdfApp(t, &page, &rendered)
+	target := "/pdf?url=https://example.com/invoice"
+
+	_, draft, _ := requestPDF(t, app, "GET", target, "", "")
+	if draft != computeETag([]byte(page)) {
+		t.Errorf("ETag %s, want the PDF's %s", draft, computeETag([]byte(page)))
+	}
+
+	page = "%PDF-1.4 final"
+	status, final, _ := requestPDF(t, app, "GET", target, "", draft)
+	if status != 200 || final == draft {
+		t.Errorf("changed page: status %d, ETag %s; want 200 and a new tag", status, final)
+	}
+}
+
+func TestETagChangesWithOptions(t *testing.T) {
+	page, rendered := "%PDF-1.4 invoice", 0
+	app := pdfApp(t, &page, &rendered)
+
+	bodies := []string{
+		`{"html":"<p>Invoice</p>"}`,
+		`{"html":"<p>Invoice</p>","paper_format":"A4"}`,
+		`{"html":"<p>Invoice</p>","paper_format":"A4","orientation":"landscape"}`,
+		`{"html":"<p>Invoice</p>","margin_mm":10}`,
+		`{"html":"<p>Invoice</p>","page_scale":0.5}`,
+		`{"html":"<p>Receipt</p>"}`,
+	}
+	seen := make(map[string]string)
+	for _, body := range bodies {
+		_, etag, _ := requestPDF(t, app, "POST", "/pdf-html", body, "")
+		if other, ok := seen[etag]; ok {
+			t.Errorf("%s and %s share ETag %s", other, body, etag)
+		}
+		seen[etag] = body
+	}
+
+	// A tag for other options doesn't match
+	_, a4, _ := requestPDF(t, app, "POST", "/pdf-html", bodies[1], "")
+	if status, _, _ := requestPDF(t, app, "POST", "/pdf-html", bodies[0], a4); status != 200 {
+		t.Errorf("ETag of other options: status %d, want 200", status)
+	}
+}
+
+func TestCleanAIHTML(t *testing.T) {
+	const (
+		fences   = "stripped markdown code fences from the model output"
+		prose    = "discarded text outside the HTML"
+		braces   = `unescaped \{\{ placeholder braces`
+		quotes   = "replaced smart quotes in the markup"
+		notHTML  = "output does not look like HTML"
+		unsafe   = "removed unsafe content from the model output"
+		document = "<!DOCTYPE html><html><body><p>{{company_name}}</p></body></html>"
+	)
+
+	tests := []struct {
+		name     string
+		reply    string
+		want     string
+		warnings []string
+		removed  []string
+	}{
+		{"bare HTML", "<div>{{a}}</div>", "<div>{{a}}</div>", nil, nil},
+		{"html fence with prose around it", "Here is your invoice:\n```html\n" + document + "\n```\nLet me know if you need changes!", document, []string{fences, prose}, nil},
+		{"fence without language tag", "```\n<div>{{a}}</div>\n```", "<div>{{a}}</div>", []string{fences}, nil},
+		{"fence and markup on one line", "```html<div>{{a}}</div>```", "<div>{{a}}</div>", []string{fences}, nil},
+		{"CSS block before HTML block", "First the styles:\n```css\nbody { margin: 0 }\n```\nThen the page:\n```html\n" + document + "\n```", document, []string{fences, prose}, nil},
+		{"largest of two HTML blocks", "```html\n<p>x</p>\n```\nor better:\n```html\n<div><p>{{a}}</p><p>{{b}}</p></div>\n```", "<div><p>{{a}}</p><p>{{b}}</p></div>", []string{fences, prose}, nil},
+		{"truncated fenced block", "```html\n<div>{{a}}</div><table><tr><td>{{list.x}}</td>", "<div>{{a}}</div><table><tr><td>{{list.x}}</td>", []string{fences}, nil},
+		{"leading and trailing prose", "Sure! Here it is.\n" + document + "\nHope this helps.", document, []string{prose}, nil},
+		{"prose around a fragment", "Note: <div>{{a}}</div> is the template.", "<div>{{a}}</div>", []string{prose}, nil},
+		{"truncated JSON wrapper", `{"template": "<div>{{a}}</div><p>{{b}}`, "<div>{{a}}</div><p>", []string{prose}, nil},
+		{"escaped braces", `<p>\{\{invoice_number\}\} \{{total}}</p>`, "<p>{{invoice_number}} {{total}}</p>", []string{braces}, nil},
+		{"smart quotes in attributes", "<td class=“total”>“{{total}}”</td>", "<td class=\"total\">“{{total}}”</td>", []string{quotes}, nil},
+		{"HTML entities", "&lt;div&gt;{{a}}&lt;/div&gt;", "<div>{{a}}</div>", nil, nil},
+		{"script in fenced output", "```html\n<div>{{a}}<script>x()</script></div>\n```", "<div>{{a}}</div>", []string{fences, unsafe}, []string{"<script> element"}},
+		{"no HTML at all", "I cannot help with that.", "I cannot help with that.", []string{notHTML}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings, removed := cleanAIHTML(tt.reply)
+			if got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+			if !slices.Equal(warnings, tt.warnings) {
+				t.Errorf("warnings %q, want %q", warnings, tt.warnings)
+			}
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed %q, want %q", removed, tt.removed)
+			}
+		})
+	}
+}
+
+// The browser doesn't dial through fetchClient, so /extract checks the
+// address itself before taking a screenshot
+func TestExtractScreenshotPrivateURL(t *testing.T) {
+	app := fiber.New()
+	app.Get("/extract", handleExtract)
+
+	for _, target := range []string{
+		"http://127.0.0.1:8080/admin",
+		"http://localhost/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/",
+		"http://10.0.0.5/",
+		"file:///etc/passwd",
+	} {
+		for _, mode := range []string{"true", "binary"} {
+			req := httptest.NewRequest("GET", "/extract?screenshot="+mode+"&url="+url.QueryEscape(target), nil)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("%s with screenshot=%s: status %d, want 400", target, mode, resp.StatusCode)
+			}
+		}
+	}
+}
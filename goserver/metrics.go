@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// latencySamples is how many recent render durations feed the percentiles
+const latencySamples = 1024
+
+// endpointCounters counts renders per endpoint
+type endpointCounters struct {
+	Requests atomic.Int64
+	Errors   atomic.Int64
+}
+
+// latencyRing keeps the most recent render durations in a fixed-size ring
+type latencyRing struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencySamples
+}
+
+// percentiles returns the requested quantiles (0-1) of the recorded samples
+func (r *latencyRing) percentiles(qs ...float64) []time.Duration {
+	r.mu.Lock()
+	sorted := append([]time.Duration(nil), r.samples...)
+	r.mu.Unlock()
+
+	out := make([]time.Duration, len(qs))
+	if len(sorted) == 0 {
+		return out
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, q := range qs {
+		out[i] = sorted[int(q*float64(len(sorted)-1))]
+	}
+	return out
+}
+
+// renderMetrics collects the render-side counters served by /stats. Everything
+// on the hot path is an atomic so recording adds no lock contention.
+type renderMetrics struct {
+	started   time.Time
+	endpoints map[string]*endpointCounters
+	latency   latencyRing
+
+	queueDepth        atomic.Int64
+	lockWaitTotal     atomic.Int64 // nanoseconds
+	lockAcquisitions  atomic.Int64
+	browserRelaunches atomic.Int64
+}
+
+// renderEndpoints are the routes that drive the browser. They are tracked in
+// the render metrics and admitted through the render limiter.
+var renderEndpoints = []string{"/pdf", "/pdf-url", "/pdf-html", "/pdf-unified", "/screenshot-html", "/extract", "/extract-html", "/invoice", "/invoice/send"}
+
+var metrics = newRenderMetrics(renderEndpoints...)
+
+// newRenderMetrics registers the endpoints whose renders are tracked
+func newRenderMetrics(endpoints ...string) *renderMetrics {
+	m := &renderMetrics{
+		started:   time.Now(),
+		endpoints: make(map[string]*endpointCounters),
+	}
+	for _, ep := range endpoints {
+		m.endpoints[ep] = &endpointCounters{}
+	}
+	return m
+}
+
+// trackRenders is middleware recording count, errors and latency for tracked endpoints
+func (m *renderMetrics) trackRenders(res *fiber.Ctx) error {
+	counters, ok := m.endpoints[res.Path()]
+	if !ok {
+		return res.Next()
+	}
+
+	start := time.Now()
+	err := res.Next()
+
+	counters.Requests.Add(1)
+	if err != nil || res.Response().StatusCode() >= 500 {
+		counters.Errors.Add(1)
+	} else {
+		elapsed := time.Since(start)
+		m.latency.add(elapsed)
+		observeRender(res.Path(), elapsed)
+	}
+	return err
+}
+
+// acquireBrowser takes the render lock, tracking queue depth and wait time.
+// The returned func releases it.
+func acquireBrowser() func() {
+	metrics.queueDepth.Add(1)
+	start := time.Now()
+	lock.Lock()
+	metrics.queueDepth.Add(-1)
+	metrics.lockWaitTotal.Add(int64(time.Since(start)))
+	metrics.lockAcquisitions.Add(1)
+	return lock.Unlock
+}
+
+// snapshot returns the render metrics as JSON-friendly values
+func (m *renderMetrics) snapshot() fiber.Map {
+	endpoints := fiber.Map{}
+	for ep, c := range m.endpoints {
+		endpoints[ep] = fiber.Map{"requests": c.Requests.Load(), "errors": c.Errors.Load()}
+	}
+
+	p := m.latency.percentiles(0.50, 0.95)
+
+	avgWait := time.Duration(0)
+	if n := m.lockAcquisitions.Load(); n > 0 {
+		avgWait = time.Duration(m.lockWaitTotal.Load() / n)
+	}
+
+	return fiber.Map{
+		"uptime_seconds":     int64(time.Since(m.started).Seconds()),
+		"endpoints":          endpoints,
+		"latency_p50_ms":     p[0].Milliseconds(),
+		"latency_p95_ms":     p[1].Milliseconds(),
+		"queue_depth":        m.queueDepth.Load(),
+		"lock_wait_avg_ms":   avgWait.Milliseconds(),
+		"browser_relaunches": m.browserRelaunches.Load(),
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/ean"
+	"github.com/skip2/go-qrcode"
+)
+
+// Overlays are codes stamped onto the first page of an invoice, positioned
+// absolutely so they don't disturb the template's layout
+
+const (
+	// overlayMarginMM is the distance from the page edges
+	overlayMarginMM = 10
+	// overlayDPI is the resolution raster codes are generated at
+	overlayDPI = 300
+
+	defaultQRSizeMM = 30
+
+	defaultBarcodeWidthMM  = 50
+	defaultBarcodeHeightMM = 15
+	// barcodeQuietZone is the blank margin, in modules, either side of a barcode
+	barcodeQuietZone = 10
+)
+
+// overlayPositions maps a position name to its CSS offsets
+var overlayPositions = map[string]string{
+	"top-left":     fmt.Sprintf("top:%dmm;left:%dmm", overlayMarginMM, overlayMarginMM),
+	"top-right":    fmt.Sprintf("top:%dmm;right:%dmm", overlayMarginMM, overlayMarginMM),
+	"bottom-left":  fmt.Sprintf("bottom:%dmm;left:%dmm", overlayMarginMM, overlayMarginMM),
+	"bottom-right": fmt.Sprintf("bottom:%dmm;right:%dmm", overlayMarginMM, overlayMarginMM),
+}
+
+// errInvalidCode is returned for code values that can't be encoded
+var errInvalidCode = errors.New("invalid code")
+
+// checkOverlayPosition rejects unknown positions; "" means top-right
+func checkOverlayPosition(field, position string) error {
+	if _, ok := overlayPositions[position]; position != "" && !ok {
+		return fmt.Errorf("%s must be top-left, top-right, bottom-left or bottom-right", field)
+	}
+	return nil
+}
+
+// overlayStyle is the inline style placing an element at position
+func overlayStyle(position string, widthMM, heightMM float64) string {
+	if position == "" {
+		position = "top-right"
+	}
+	return fmt.Sprintf("position:absolute;%s;width:%gmm;height:%gmm;z-index:1000",
+		overlayPositions[position], widthMM, heightMM)
+}
+
+// qrCodeElement renders value as a QR code <img> with the PNG inlined as a data URI
+func qrCodeElement(value, position string, sizeMM int) (string, error) {
+	if sizeMM == 0 {
+		sizeMM = defaultQRSizeMM
+	}
+	pixels := int(math.Ceil(float64(sizeMM) / 25.4 * overlayDPI))
+	png, err := qrcode.Encode(value, qrcode.Medium, pixels)
+	if err != nil {
+		return "", fmt.Errorf("%w: qr_code: %v", errInvalidCode, err)
+	}
+
+	return fmt.Sprintf(`<img class="invoice-qr-code" alt="%s" src="data:image/png;base64,%s" style="%s">`,
+		html.EscapeString(value), base64.StdEncoding.EncodeToString(png),
+		overlayStyle(position, float64(sizeMM), float64(sizeMM))), nil
+}
+
+// barcodeOptions is the barcode field of POST /invoice
+type barcodeOptions struct {
+	// Type is "code128" (any ASCII) or "ean13" (13 digits, check digit included)
+	Type     string  `json:"type"`
+	Value    string  `json:"value"`
+	Position string  `json:"position,omitempty"`
+	WidthMM  float64 `json:"width_mm,omitempty"`
+	HeightMM float64 `json:"height_mm,omitempty"`
+}
+
+// validate checks the options; the value itself is checked when encoding
+func (o *barcodeOptions) validate() error {
+	if o.Type != "code128" && o.Type != "ean13" {
+		return errors.New("barcode.type must be code128 or ean13")
+	}
+	if o.WidthMM != 0 && (o.WidthMM < 10 || o.WidthMM > 150) {
+		return errors.New("barcode.width_mm must be between 10 and 150")
+	}
+	if o.HeightMM != 0 && (o.HeightMM < 5 || o.HeightMM > 60) {
+		return errors.New("barcode.height_mm must be between 5 and 60")
+	}
+	return checkOverlayPosition("barcode.position", o.Position)
+}
+
+// encode builds the barcode for the value
+func (o *barcodeOptions) encode() (barcode.Barcode, error) {
+	switch o.Type {
+	case "ean13":
+		if len(o.Value) != 13 || strings.Trim(o.Value, "0123456789") != "" {
+			return nil, fmt.Errorf("%w: barcode: ean13 value must be exactly 13 digits", errInvalidCode)
+		}
+		code, err := ean.Encode(o.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: barcode: ean13 check digit does not match", errInvalidCode)
+		}
+		return code, nil
+	default:
+		for _, r := range o.Value {
+			if r > 127 {
+				return nil, fmt.Errorf("%w: barcode: code128 value must be ASCII", errInvalidCode)
+			}
+		}
+		code, err := code128.Encode(o.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: barcode: %v", errInvalidCode, err)
+		}
+		return code, nil
+	}
+}
+
+// barcodeElement renders the barcode as inline SVG, one rect per bar, so it
+// stays sharp at any print resolution
+func barcodeElement(o *barcodeOptions) (string, error) {
+	code, err := o.encode()
+	if err != nil {
+		return "", err
+	}
+	width, height := o.WidthMM, o.HeightMM
+	if width == 0 {
+		width = defaultBarcodeWidthMM
+	}
+	if height == 0 {
+		height = defaultBarcodeHeightMM
+	}
+	position := o.Position
+	if position == "" {
+		// Clear of the QR code's top-right default
+		position = "bottom-right"
+	}
+
+	modules := code.Bounds().Dx()
+	var bars strings.Builder
+	for x := 0; x < modules; {
+		if !isDark(code, x) {
+			x++
+			continue
+		}
+		start := x
+		for x < modules && isDark(code, x) {
+			x++
+		}
+		fmt.Fprintf(&bars, `<rect x="%d" y="0" width="%d" height="1"/>`, start+barcodeQuietZone, x-start)
+	}
+
+	return fmt.Sprintf(`<svg class="invoice-barcode" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d 1" preserveAspectRatio="none" style="%s;background:#fff"><title>%s</title>%s</svg>`,
+		modules+2*barcodeQuietZone, overlayStyle(position, width, height),
+		html.EscapeString(o.Value), bars.String()), nil
+}
+
+func isDark(code barcode.Barcode, x int) bool {
+	r, _, _, _ := code.At(x, 0).RGBA()
+	return r == 0
+}
+
+// injectOverlay adds element at the end of the document body
+func injectOverlay(doc, element string) string {
+	if i := strings.LastIndex(strings.ToLower(doc), "</body>"); i >= 0 {
+		return doc[:i] + element + doc[i:]
+	}
+	return doc + element
+}
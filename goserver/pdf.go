@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pdfHandlers serves the PDF endpoints. Pages are rendered by renderURL and
+// renderHTML, which are Chromium outside tests.
+type pdfHandlers struct {
+	renderURL  func(url string, opts pdfOptions) (io.ReadCloser, error)
+	renderHTML func(html string, opts pdfOptions) (io.ReadCloser, error)
+}
+
+func newPDFHandlers() *pdfHandlers {
+	return &pdfHandlers{
+		renderURL: generatePDF,
+		renderHTML: func(html string, opts pdfOptions) (io.ReadCloser, error) {
+			return generatePDFWithRetry(html, opts, renderAttempts)
+		},
+	}
+}
+
+// handleURL renders the ?url page (GET /pdf)
+func (h *pdfHandlers) handleURL(res *fiber.Ctx) error {
+	u := res.Query("url")
+	if u == "" {
+		return sendError(res, 400, "Missing ?url param")
+	}
+
+	var opts pdfOptions
+	if err := res.QueryParser(&opts); err != nil {
+		return sendError(res, 400, "Invalid query parameters")
+	}
+	cookies, err := decodeCookieParam(res.Query("cookies"))
+	if err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	opts.Cookies = cookies
+	if err := opts.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+	if err := checkDisposition(res.Query("disposition")); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+
+	// URL content can change underneath us, so caching needs an explicit opt-in
+	useCache := res.QueryBool("cache_url") && !res.QueryBool("no_cache")
+	return h.sendURL(res, u, opts, useCache, res.Query("filename"), res.Query("disposition"))
+}
+
+// handleURLBody renders a URL given with options, such as session cookies,
+// in a JSON body (POST /pdf-url)
+func (h *pdfHandlers) handleURLBody(res *fiber.Ctx) error {
+	var body struct {
+		URL         string `json:"url"`
+		Filename    string `json:"filename,omitempty"`
+		Disposition string `json:"disposition,omitempty"`
+		NoCache     bool   `json:"no_cache,omitempty"`
+		CacheURL    bool   `json:"cache_url,omitempty"`
+		pdfOptions
+	}
+
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	if body.URL == "" {
+		return sendError(res, 400, "Missing url field in request body")
+	}
+
+	if err := body.pdfOptions.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+
+	if err := checkDisposition(body.Disposition); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+
+	return h.sendURL(res, body.URL, body.pdfOptions, body.CacheURL && !body.NoCache, body.Filename, body.Disposition)
+}
+
+// handleHTML renders HTML content given as JSON, or as multipart/form-data
+// with the page as an "html" file (POST /pdf-html)
+func (h *pdfHandlers) handleHTML(res *fiber.Ctx) error {
+	var body struct {
+		HTML string `json:"html" form:"html"`
+		// Filename may be a text/template pattern over Data, e.g.
+		// "invoice-{{.invoice_number}}.pdf"
+		Filename    string         `json:"filename,omitempty" form:"filename"`
+		Data        map[string]any `json:"data,omitempty"`
+		Disposition string         `json:"disposition,omitempty"`
+		NoCache     bool           `json:"no_cache,omitempty"`
+		// Metadata sets the PDF's title, author, subject and keywords
+		Metadata *pdfMetadata `json:"metadata_overrides,omitempty"`
+		// Storage archives the PDF and replies with a link instead
+		Storage *storageDestination `json:"storage_destination,omitempty" form:"-"`
+		pdfOptions
+	}
+
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	uploaded, err := uploadedHTML(res)
+	if err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	if uploaded != "" {
+		body.HTML = uploaded
+	}
+
+	if body.HTML == "" {
+		return sendError(res, 400, "Missing html field in request body")
+	}
+
+	if err := body.pdfOptions.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+	if err := body.Storage.validate("storage_destination"); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	if err := checkDisposition(body.Disposition); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+
+	// For HTML input the ETag is keyed on the request, so a match skips
+	// rendering entirely; it comes after validation so a bad request
+	// never gets a 304
+	key := renderKey{HTML: body.HTML, Options: body.pdfOptions, Metadata: body.Metadata}.cacheKey()
+	if body.Storage == nil && checkETag(res, `"`+key+`"`, pdfMaxAge) {
+		return res.SendStatus(fiber.StatusNotModified)
+	}
+	body.Filename = filenameFromPattern(body.Filename, body.Data)
+
+	render := func() (io.ReadCloser, error) {
+		return h.renderHTML(body.pdfOptions.preprocess(res.Context(), body.HTML), body.pdfOptions)
+	}
+
+	// Skip the cache unless the bytes must be kept around, amended
+	// with metadata or uploaded
+	useCache := !body.NoCache && pdfStore.Enabled()
+	if !useCache && body.Metadata == nil && body.Storage == nil {
+		stream, err := render()
+		if err != nil {
+			return sendError(res, renderErrorStatus(err), err.Error())
+		}
+		return sendPDFStream(res, stream, body.Filename, body.Disposition)
+	}
+
+	pdf, err := renderCached(res, key, useCache, func() ([]byte, error) {
+		pdf, err := readPDF(render())
+		if err != nil || body.Metadata == nil {
+			return pdf, err
+		}
+		return withMetadata(res.UserContext(), pdf, pdfMetadata{}.merge(body.Metadata)), nil
+	})
+	if err != nil {
+		return sendError(res, renderErrorStatus(err), err.Error())
+	}
+
+	if body.Storage != nil {
+		return sendStoredPDF(res, body.Storage, pdf, body.Filename)
+	}
+	return sendPDF(res, pdf, body.Filename, body.Disposition)
+}
+
+// handleUnified renders either a URL or HTML (POST /pdf-unified)
+func (h *pdfHandlers) handleUnified(res *fiber.Ctx) error {
+	var body struct {
+		URL  string `json:"url,omitempty"`
+		HTML string `json:"html,omitempty"`
+		// Filename may be a text/template pattern over Data
+		Filename    string         `json:"filename,omitempty"`
+		Data        map[string]any `json:"data,omitempty"`
+		Disposition string         `json:"disposition,omitempty"`
+		NoCache     bool           `json:"no_cache,omitempty"`
+		CacheURL    bool           `json:"cache_url,omitempty"`
+	}
+
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	if body.URL == "" && body.HTML == "" {
+		return sendError(res, 400, "Either url or html field is required")
+	}
+
+	if body.URL != "" && body.HTML != "" {
+		return sendError(res, 400, "Provide either url or html, not both")
+	}
+
+	if err := checkDisposition(body.Disposition); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	body.Filename = filenameFromPattern(body.Filename, body.Data)
+
+	render := func() (io.ReadCloser, error) {
+		if body.URL != "" {
+			return h.renderURL(body.URL, pdfOptions{})
+		}
+		return h.renderHTML(body.HTML, pdfOptions{})
+	}
+
+	// URL renders can change between calls, so only HTML input gets a
+	// request-derived ETag that can short-circuit rendering
+	key := renderKey{URL: body.URL, HTML: body.HTML}.cacheKey()
+	if body.HTML != "" && checkETag(res, `"`+key+`"`, pdfMaxAge) {
+		return res.SendStatus(fiber.StatusNotModified)
+	}
+
+	useCache := !body.NoCache && (body.HTML != "" || body.CacheURL) && pdfStore.Enabled()
+	if !useCache {
+		stream, err := render()
+		if err != nil {
+			return sendError(res, renderErrorStatus(err), err.Error())
+		}
+		return sendPDFStream(res, stream, body.Filename, body.Disposition)
+	}
+
+	pdf, err := renderCached(res, key, useCache, func() ([]byte, error) {
+		return readPDF(render())
+	})
+	if err != nil {
+		return sendError(res, renderErrorStatus(err), err.Error())
+	}
+
+	return sendPDF(res, pdf, body.Filename, body.Disposition)
+}
+
+// sendURL renders url and replies with the PDF. The ETag is derived from
+// the rendered bytes, so a stable page yields a stable tag.
+func (h *pdfHandlers) sendURL(res *fiber.Ctx, url string, opts pdfOptions, useCache bool, filename, disposition string) error {
+	pdf, err := renderCached(res, renderKey{URL: url, Options: opts}.cacheKey(), useCache, func() ([]byte, error) {
+		return readPDF(h.renderURL(url, opts))
+	})
+	if err != nil {
+		return sendError(res, renderErrorStatus(err), err.Error())
+	}
+
+	if checkETag(res, computeETag(pdf), pdfMaxAge) {
+		return res.SendStatus(fiber.StatusNotModified)
+	}
+
+	return sendPDF(res, pdf, filename, disposition)
+}
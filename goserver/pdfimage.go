@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// aiPDFMaxBytes caps the decoded size of a /create/ai reference PDF
+	aiPDFMaxBytes = 10 << 20
+	// pdfRasterTimeout bounds one run of pdftoppm
+	pdfRasterTimeout = 30 * time.Second
+)
+
+var (
+	// pdftoppmPath is the poppler rasterizer used for reference PDFs (PDFTOPPM_PATH)
+	pdftoppmPath = "pdftoppm"
+
+	// pdfRasterDPIs are tried in turn until the page fits aiImageMaxBytes
+	pdfRasterDPIs = []int{150, 100, 72}
+
+	errInvalidPDF           = errors.New("invalid pdf")
+	errPDFRasterUnavailable = errors.New("pdf references are not available: pdftoppm is not installed")
+	errPDFReferenceTooLarge = errors.New("pdf is too large")
+)
+
+// pdfReferenceImage renders one page (1-based, 0 meaning the first) of a
+// base64 or data: URL PDF to a PNG data URL for the vision flow. The image
+// is held to the same limits as a directly uploaded one.
+func pdfReferenceImage(ctx context.Context, encoded string, page int) (string, error) {
+	if header, payload, ok := strings.Cut(encoded, ","); ok && strings.HasPrefix(header, "data:") {
+		encoded = payload
+	}
+	if base64.StdEncoding.DecodedLen(len(encoded)) > aiPDFMaxBytes+3 {
+		return "", errPDFReferenceTooLarge
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("pdf_base64 is not valid base64")
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", fmt.Errorf("%w: pdf_base64 does not contain a PDF", errInvalidPDF)
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	dir, err := os.MkdirTemp("", "pdfref")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(input, data, 0o600); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pdfRasterTimeout)
+	defer cancel()
+
+	for _, dpi := range pdfRasterDPIs {
+		png, err := rasterizePDFPage(ctx, input, filepath.Join(dir, "page"), page, dpi)
+		if err != nil {
+			return "", err
+		}
+		if len(png) <= aiImageMaxBytes {
+			return imageDataURL(png)
+		}
+	}
+	return "", errImageTooLarge
+}
+
+// rasterizePDFPage runs pdftoppm on one page of input
+func rasterizePDFPage(ctx context.Context, input, outRoot string, page, dpi int) ([]byte, error) {
+	n := strconv.Itoa(page)
+	cmd := exec.CommandContext(ctx, pdftoppmPath, "-png", "-singlefile", "-r", strconv.Itoa(dpi), "-f", n, "-l", n, input, outRoot)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, errPDFRasterUnavailable
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("rendering pdf page: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("%w: %s", errInvalidPDF, strings.TrimSpace(stderr.String()))
+	}
+
+	png, err := os.ReadFile(outRoot + ".png")
+	if errors.Is(err, os.ErrNotExist) {
+		// pdftoppm succeeds without output for pages past the end
+		return nil, fmt.Errorf("%w: page %d does not exist", errInvalidPDF, page)
+	}
+	return png, err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf16"
+)
+
+// pdfMetadata is the document information written into a PDF; empty
+// fields are left out
+type pdfMetadata struct {
+	Title    string `json:"title,omitempty"`
+	Author   string `json:"author,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+}
+
+// merge returns m with the non-empty fields of overrides replacing its own
+func (m pdfMetadata) merge(overrides *pdfMetadata) pdfMetadata {
+	if overrides == nil {
+		return m
+	}
+	for _, f := range []struct{ dst, src *string }{
+		{&m.Title, &overrides.Title},
+		{&m.Author, &overrides.Author},
+		{&m.Subject, &overrides.Subject},
+		{&m.Keywords, &overrides.Keywords},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	return m
+}
+
+var (
+	// errXRefStream is returned for PDFs whose cross-reference section is a
+	// stream, which setPDFMetadata doesn't write
+	errXRefStream = errors.New("pdf uses a cross-reference stream")
+
+	startXRefRe = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	sizeRe      = regexp.MustCompile(`/Size\s+(\d+)`)
+	rootRe      = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+	idRe        = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+	infoRefRe   = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+)
+
+// setPDFMetadata sets the document information dictionary of a PDF, as an
+// incremental update appended to the file: a new Info object, an xref
+// section for it and a trailer pointing back at the original. Creator,
+// Producer and any field meta leaves empty are kept from the original Info
+// dictionary.
+func setPDFMetadata(pdf []byte, meta pdfMetadata, created time.Time) ([]byte, error) {
+	m := startXRefRe.FindSubmatch(pdf)
+	if m == nil {
+		return nil, errors.New("pdf has no startxref")
+	}
+	prevXRef, _ := strconv.Atoi(string(m[1]))
+	if prevXRef >= len(pdf) || !bytes.HasPrefix(pdf[prevXRef:], []byte("xref")) {
+		return nil, errXRefStream
+	}
+
+	trailerAt := bytes.LastIndex(pdf, []byte("trailer"))
+	if trailerAt < prevXRef {
+		return nil, errors.New("pdf has no trailer")
+	}
+	trailer := pdf[trailerAt:]
+	size := sizeRe.FindSubmatch(trailer)
+	root := rootRe.FindSubmatch(trailer)
+	if size == nil || root == nil {
+		return nil, errors.New("pdf trailer has no /Size or /Root")
+	}
+	objNum, _ := strconv.Atoi(string(size[1]))
+
+	var info bytes.Buffer
+	for _, entry := range []struct{ key, value string }{
+		{"Title", meta.Title},
+		{"Author", meta.Author},
+		{"Subject", meta.Subject},
+		{"Keywords", meta.Keywords},
+	} {
+		if entry.value != "" {
+			fmt.Fprintf(&info, "/%s %s ", entry.key, pdfTextString(entry.value))
+		} else if value := originalInfoEntry(pdf, trailer, entry.key); value != nil {
+			// Chromium titles the PDF from the page's <title>
+			fmt.Fprintf(&info, "/%s %s ", entry.key, value)
+		}
+	}
+	date := pdfDate(created)
+	fmt.Fprintf(&info, "/CreationDate %s /ModDate %s", date, date)
+	for _, key := range []string{"Creator", "Producer"} {
+		if value := originalInfoEntry(pdf, trailer, key); value != nil {
+			fmt.Fprintf(&info, " /%s %s", key, value)
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(pdf)+1024))
+	out.Write(pdf)
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	objAt := out.Len()
+	fmt.Fprintf(out, "%d 0 obj\n<< %s >>\nendobj\n", objNum, info.String())
+	xrefAt := out.Len()
+	fmt.Fprintf(out, "xref\n%d 1\n%010d 00000 n\r\n", objNum, objAt)
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root %s /Info %d 0 R /Prev %d", objNum+1, root[1], objNum, prevXRef)
+	if id := idRe.Find(trailer); id != nil {
+		out.WriteString(" ")
+		out.Write(id)
+	}
+	fmt.Fprintf(out, " >>\nstartxref\n%d\n%%%%EOF\n", xrefAt)
+	return out.Bytes(), nil
+}
+
+// originalInfoEntry returns the raw literal string stored under key in the
+// Info dictionary the trailer points at, or nil
+func originalInfoEntry(pdf, trailer []byte, key string) []byte {
+	ref := infoRefRe.FindSubmatch(trailer)
+	if ref == nil {
+		return nil
+	}
+	obj := regexp.MustCompile(`(?s)(?:^|\s)` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj\s*<<(.*?)>>\s*endobj`).FindSubmatch(pdf)
+	if obj == nil {
+		return nil
+	}
+	value := regexp.MustCompile(`/` + key + `\s*(\([^()\\]*\)|<[0-9A-Fa-f]*>)`).FindSubmatch(obj[1])
+	if value == nil {
+		return nil
+	}
+	return value[1]
+}
+
+// pdfTextString encodes s as a UTF-16BE hex string, which needs no escaping
+// and holds any character
+func pdfTextString(s string) string {
+	var b bytes.Buffer
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// pdfDate formats t as a PDF date string in UTC
+func pdfDate(t time.Time) string {
+	return t.UTC().Format("(D:20060102150405+00'00')")
+}
+
+// invoiceMetadata is the default metadata of an /invoice PDF: the title
+// from data[pdfTitleField], the author from company_name and the configured
+// keywords, with the request's overrides on top
+func invoiceMetadata(data map[string]any, overrides *pdfMetadata) pdfMetadata {
+	meta := pdfMetadata{
+		Title:    formatValue(data[pdfTitleField]),
+		Author:   formatValue(data["company_name"]),
+		Subject:  "Invoice",
+		Keywords: pdfKeywords,
+	}
+	return meta.merge(overrides)
+}
+
+// withMetadata is setPDFMetadata for handlers: a PDF it can't update is
+// logged and sent as rendered rather than failing the request
+func withMetadata(ctx context.Context, pdf []byte, meta pdfMetadata) []byte {
+	updated, err := setPDFMetadata(pdf, meta, time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "could not set pdf metadata", "error", err)
+		return pdf
+	}
+	return updated
+}
+
+var (
+	// pdfTitleField is the data field /invoice PDFs are titled with (PDF_METADATA_TITLE_FIELD)
+	pdfTitleField = "invoice_number"
+	// pdfKeywords are the comma-separated keywords of /invoice PDFs (PDF_METADATA_KEYWORDS)
+	pdfKeywords string
+)
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"html"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// inlineImageMaxBytes caps each image downloaded by inlineImages
+	inlineImageMaxBytes int64 = 2 << 20
+	// inlineCSSMaxBytes caps each stylesheet downloaded by inlineStylesheets
+	inlineCSSMaxBytes int64 = 1 << 20
+)
+
+// maxCSSImportDepth bounds how deep @import chains are followed
+const maxCSSImportDepth = 3
+
+// preprocess applies the HTML rewrites requested in o before rendering
+func (o pdfOptions) preprocess(ctx context.Context, doc string) string {
+	if o.InlineCSS {
+		doc = inlineStylesheets(ctx, doc, inlineCSSMaxBytes)
+	}
+	if o.InlineImages {
+		doc = inlineImages(ctx, doc, inlineImageMaxBytes)
+	}
+	return doc
+}
+
+// imgSrcRe matches the src attribute of <img> tags pointing at http(s) URLs
+var imgSrcRe = regexp.MustCompile(`(?i)(<img\b[^>]*?\bsrc\s*=\s*)(["'])(https?://[^"']+)(["'])`)
+
+// inlineImages downloads every external <img src> and replaces it with a data:
+// URI, so the browser never needs network access to render them. Images that
+// fail to download or exceed maxBytes keep their original URL.
+func inlineImages(ctx context.Context, doc string, maxBytes int64) string {
+	dataURIs := make(map[string]string)
+
+	return imgSrcRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		m := imgSrcRe.FindStringSubmatch(tag)
+		src := html.UnescapeString(m[3])
+
+		dataURI, seen := dataURIs[src]
+		if !seen {
+			dataURI = fetchImageDataURI(ctx, src, maxBytes)
+			dataURIs[src] = dataURI
+		}
+		if dataURI == "" {
+			return tag
+		}
+		return m[1] + m[2] + dataURI + m[4]
+	})
+}
+
+// fetchImageDataURI returns src as a base64 data: URI, or "" if it can't be inlined
+func fetchImageDataURI(ctx context.Context, src string, maxBytes int64) string {
+	body, contentType, err := fetchURL(ctx, src, maxBytes)
+	if err != nil {
+		slog.WarnContext(ctx, "inline image fetch failed", "url", src, "error", err)
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(body)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		slog.WarnContext(ctx, "inline image is not an image", "url", src, "media_type", mediaType)
+		return ""
+	}
+
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(body)
+}
+
+var (
+	// linkTagRe matches whole <link> tags; rel and href are checked separately
+	// because attribute order varies
+	linkTagRe = regexp.MustCompile(`(?i)<link\b[^>]*>`)
+	attrRe    = regexp.MustCompile(`(?i)\b(rel|href|media)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	// cssImportRe matches @import "x.css" media; and @import url(x.css) media;
+	cssImportRe = regexp.MustCompile(`(?i)@import\s+(?:url\(\s*)?["']?([^"')\s;]+)["']?\s*\)?\s*([^;]*);`)
+	cssURLRe    = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+)
+
+// tagAttrs returns the rel, href and media attributes of a tag, lowercasing names
+func tagAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRe.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+	}
+	return attrs
+}
+
+// inlineStylesheets replaces <link rel="stylesheet" href="http..."> tags with
+// <style> blocks holding the fetched CSS, following @import chains. Sheets
+// that can't be fetched keep their <link> tag.
+func inlineStylesheets(ctx context.Context, doc string, maxBytes int64) string {
+	return linkTagRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		attrs := tagAttrs(tag)
+		if !strings.Contains(strings.ToLower(attrs["rel"]), "stylesheet") {
+			return tag
+		}
+		href := attrs["href"]
+		if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+			return tag
+		}
+
+		css, err := fetchStylesheet(ctx, href, maxBytes, 0, map[string]bool{})
+		if err != nil {
+			slog.WarnContext(ctx, "inline stylesheet fetch failed", "url", href, "error", err)
+			return tag
+		}
+
+		// Closing tags inside the CSS would end the <style> element early
+		css = strings.ReplaceAll(css, "</style", `<\/style`)
+		if media := attrs["media"]; media != "" {
+			return `<style media="` + html.EscapeString(media) + `">` + css + "</style>"
+		}
+		return "<style>" + css + "</style>"
+	})
+}
+
+// fetchStylesheet downloads a stylesheet, resolves its relative url()
+// references and recursively inlines its @imports. visited breaks cycles.
+func fetchStylesheet(ctx context.Context, sheetURL string, maxBytes int64, depth int, visited map[string]bool) (string, error) {
+	base, err := url.Parse(sheetURL)
+	if err != nil {
+		return "", err
+	}
+
+	body, _, err := fetchURL(ctx, sheetURL, maxBytes)
+	if err != nil {
+		return "", err
+	}
+	visited[sheetURL] = true
+	css := string(body)
+
+	// Inline imports first so their url()s are resolved against their own sheet
+	css = cssImportRe.ReplaceAllStringFunc(css, func(rule string) string {
+		m := cssImportRe.FindStringSubmatch(rule)
+		ref, err := base.Parse(m[1])
+		if err != nil {
+			return rule
+		}
+		abs := ref.String()
+		if visited[abs] {
+			return ""
+		}
+		if depth+1 > maxCSSImportDepth {
+			return `@import url("` + abs + `") ` + m[2] + ";"
+		}
+
+		imported, err := fetchStylesheet(ctx, abs, maxBytes, depth+1, visited)
+		if err != nil {
+			slog.WarnContext(ctx, "inline stylesheet import failed", "url", abs, "error", err)
+			return `@import url("` + abs + `") ` + m[2] + ";"
+		}
+		if media := strings.TrimSpace(m[2]); media != "" {
+			return "@media " + media + " {\n" + imported + "\n}"
+		}
+		return imported
+	})
+
+	return cssURLRe.ReplaceAllStringFunc(css, func(ref string) string {
+		m := cssURLRe.FindStringSubmatch(ref)
+		target := strings.TrimSpace(m[2])
+		if strings.HasPrefix(target, "data:") || strings.HasPrefix(target, "#") {
+			return ref
+		}
+		abs, err := base.Parse(target)
+		if err != nil {
+			return ref
+		}
+		return `url("` + abs.String() + `")`
+	}), nil
+}
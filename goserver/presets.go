@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// promptPreset adapts /create/ai to one kind of document. Adding a document
+// type is a new entry in promptPresets.
+type promptPreset struct {
+	// Title is how the document is named in the prompt
+	Title string
+	// Brief describes what the document is for and what it should show
+	Brief string
+	// Required are the placeholders the template must contain; a list name
+	// such as items is satisfied by any {{items.field}}
+	Required []string
+}
+
+// defaultDocumentType is used when a request has no document_type
+const defaultDocumentType = "invoice"
+
+var promptPresets = map[string]promptPreset{
+	"invoice": {
+		Title:    "invoice",
+		Brief:    "A bill asking the customer to pay for goods or services delivered, with line items, tax and a total.",
+		Required: []string{"company_name", "invoice_number", "invoice_date", "customer_name", "list", "total_amount"},
+	},
+	"quote": {
+		Title:    "quotation",
+		Brief:    "An offer of prices for goods or services that the customer can accept until an expiry date.",
+		Required: []string{"company_name", "quote_number", "quote_date", "quote_valid_until", "customer_name", "list", "total_amount"},
+	},
+	"purchase_order": {
+		Title:    "purchase order",
+		Brief:    "An order the buyer sends to a supplier, listing the goods requested, delivery address and agreed prices.",
+		Required: []string{"company_name", "po_number", "po_date", "supplier_name", "delivery_address", "list", "total_amount"},
+	},
+	"receipt": {
+		Title:    "payment receipt",
+		Brief:    "A compact confirmation that a payment was received, showing what was paid for and how.",
+		Required: []string{"company_name", "receipt_number", "payment_date", "payment_method", "amount_paid"},
+	},
+	"delivery_challan": {
+		Title:    "delivery challan",
+		Brief:    "A document accompanying goods in transit, listing items and quantities without prices, signed on receipt.",
+		Required: []string{"company_name", "challan_number", "challan_date", "consignee_name", "delivery_address", "list", "receiver_signature"},
+	},
+	"payslip": {
+		Title:    "payslip",
+		Brief:    "A salary statement for one pay period, with separate earnings and deductions tables and the net pay.",
+		Required: []string{"company_name", "employee_name", "employee_id", "pay_period", "earnings", "deductions", "net_pay"},
+	},
+}
+
+// presetFor looks up a document type; "" is the default
+func presetFor(documentType string) (promptPreset, error) {
+	if documentType == "" {
+		documentType = defaultDocumentType
+	}
+	p, ok := promptPresets[documentType]
+	if !ok {
+		names := make([]string, 0, len(promptPresets))
+		for name := range promptPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return promptPreset{}, fmt.Errorf("unknown document_type %q; available: %s", documentType, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// prompt is the system prompt for the preset: the shared design rules
+// followed by the document's brief and required placeholders
+func (p promptPreset) prompt() string {
+	var b strings.Builder
+	b.WriteString(systemPrompt)
+	fmt.Fprintf(&b, "\n**Document type:** %s. %s\n\n**Required placeholders** (use these exact names; lists need at least one field, e.g. {{list.item_name}}):\n", p.Title, p.Brief)
+	for _, name := range p.Required {
+		fmt.Fprintf(&b, "* {{%s}}\n", name)
+	}
+	return b.String()
+}
+
+// check is checkTemplate plus the preset's required placeholders, which are
+// errors when missing so generateTemplate asks the model to add them
+func (p promptPreset) check(tpl string) templateReport {
+	report := checkTemplate(tpl)
+	vars := discoverVariables(tpl)
+	for _, name := range p.Required {
+		if !vars.has(name) {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	if len(report.Missing) > 0 {
+		report.Errors = append(report.Errors, fmt.Sprintf("missing required placeholders for a %s: {{%s}}",
+			p.Title, strings.Join(report.Missing, "}}, {{")))
+		report.Valid = false
+	}
+	return report
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// This file hand-writes the Prometheus text exposition format. Labels are
+// limited to routes, statuses and provider names so cardinality stays bounded.
+
+// Histogram buckets in seconds
+var (
+	renderBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}
+	llmBuckets    = []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60}
+)
+
+// labelPairs renders label names and values as name="value",...
+func labelPairs(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// promCounter is a counter vector keyed by its rendered label set
+type promCounter struct {
+	name, help string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newPromCounter(name, help string) *promCounter {
+	return &promCounter{name: name, help: help, values: make(map[string]float64)}
+}
+
+func (c *promCounter) add(v float64, labels ...string) {
+	key := labelPairs(labels...)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *promCounter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, braces(key), formatFloat(c.values[key]))
+	}
+}
+
+// promHistogram is a histogram vector keyed by its rendered label set
+type promHistogram struct {
+	name, help string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram(name, help string, buckets []float64) *promHistogram {
+	return &promHistogram{name: name, help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *promHistogram) observe(v float64, labels ...string) {
+	key := labelPairs(labels...)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *promHistogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(key), s.count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The exported metrics
+var (
+	promHTTPRequests    = newPromCounter("http_requests_total", "HTTP requests by route and status.")
+	promRenderDuration  = newPromHistogram("pdf_render_duration_seconds", "Render duration by endpoint.", renderBuckets)
+	promPDFBytes        = newPromCounter("pdf_bytes_total", "Bytes of PDF produced.")
+	promBrowserRestarts = newPromCounter("browser_restarts_total", "Browser restarts after a failed health check.")
+	promLLMRequests     = newPromCounter("llmpool_requests_total", "LLM provider calls by provider.")
+	promLLMErrors       = newPromCounter("llmpool_errors_total", "Failed LLM provider calls by provider.")
+	promLLMDuration     = newPromHistogram("llmpool_request_duration_seconds", "LLM provider call latency by provider.", llmBuckets)
+	promLLMTokens       = newPromCounter("llmpool_tokens_total", "LLM tokens used by provider and kind.")
+)
+
+// countHTTPRequests is middleware counting every request by matched route pattern
+func countHTTPRequests(res *fiber.Ctx) error {
+	err := res.Next()
+
+	status := res.Response().StatusCode()
+	if err != nil {
+		if fe, ok := err.(*fiber.Error); ok {
+			status = fe.Code
+		} else {
+			status = 500
+		}
+	}
+	promHTTPRequests.add(1, "route", res.Route().Path, "status", strconv.Itoa(status))
+	return err
+}
+
+// observeLLM is the pool observer feeding the llmpool_* metrics
+func observeLLM(e llmpool.RequestEvent) {
+	promLLMRequests.add(1, "provider", e.Provider)
+	if !e.Success {
+		promLLMErrors.add(1, "provider", e.Provider)
+	}
+	promLLMDuration.observe(e.Duration.Seconds(), "provider", e.Provider)
+	promLLMTokens.add(float64(e.PromptTokens), "provider", e.Provider, "kind", "prompt")
+	promLLMTokens.add(float64(e.CompletionTokens), "provider", e.Provider, "kind", "completion")
+}
+
+// observeRender records a successful render's duration for an endpoint
+func observeRender(endpoint string, d time.Duration) {
+	promRenderDuration.observe(d.Seconds(), "endpoint", endpoint)
+}
+
+// servePrometheus writes every metric in the text exposition format
+func servePrometheus(res *fiber.Ctx) error {
+	res.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := res.Response().BodyWriter()
+
+	promHTTPRequests.write(w)
+	promRenderDuration.write(w)
+	promPDFBytes.write(w)
+
+	fmt.Fprintf(w, "# HELP browser_relaunches_total Browser relaunches.\n# TYPE browser_relaunches_total counter\n")
+	fmt.Fprintf(w, "browser_relaunches_total %d\n", metrics.browserRelaunches.Load())
+
+	promBrowserRestarts.write(w)
+
+	promLLMRequests.write(w)
+	promLLMErrors.write(w)
+	promLLMDuration.write(w)
+	promLLMTokens.write(w)
+	return nil
+}
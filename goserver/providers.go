@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// builtinProviders are the LLM providers configured by environment
+// variables, used without LLM_PROVIDERS_FILE
+func builtinProviders(cfg *Config) []*llmpool.Provider {
+	providers := []*llmpool.Provider{{
+		Name:              "groq-fast",
+		Type:              llmpool.ProviderGroq,
+		APIKey:            cfg.GroqAPIKey,
+		BaseURL:           "https://api.groq.com/openai/v1",
+		Model:             "meta-llama/llama-4-maverick-17b-128e-instruct",
+		Priority:          1,
+		Vision:            true,
+		RequestsPerMinute: 30,
+		TokensPerMinute:   6000,
+		InputCostPer1K:    0.0002,
+		OutputCostPer1K:   0.0006,
+	}}
+	if cfg.Azure.Endpoint != "" {
+		providers = append(providers, &llmpool.Provider{
+			Name:              "azure-openai",
+			Type:              llmpool.ProviderAzureOpenAI,
+			APIKey:            cfg.Azure.APIKey,
+			BaseURL:           cfg.Azure.Endpoint,
+			Deployment:        cfg.Azure.Deployment,
+			APIVersion:        cfg.Azure.APIVersion,
+			Priority:          2,
+			RequestsPerMinute: 60,
+		})
+	}
+	if cfg.GeminiAPIKey != "" {
+		providers = append(providers, &llmpool.Provider{
+			Name:              "gemini-flash",
+			Type:              llmpool.ProviderGemini,
+			APIKey:            cfg.GeminiAPIKey,
+			BaseURL:           "https://generativelanguage.googleapis.com/v1beta",
+			Model:             "gemini-2.0-flash",
+			Priority:          2,
+			Vision:            true,
+			RequestsPerMinute: 15,
+			TokensPerMinute:   1000000,
+			InputCostPer1K:    0.0001,
+			OutputCostPer1K:   0.0004,
+		})
+	}
+	if cfg.OllamaURL != "" {
+		providers = append(providers, &llmpool.Provider{
+			Name:     "ollama",
+			Type:     llmpool.ProviderOllama,
+			BaseURL:  cfg.OllamaURL,
+			Model:    cfg.OllamaModel,
+			Priority: 3,
+		})
+	}
+	return providers
+}
+
+// modelCheckTimeout bounds the startup model check against each provider
+const modelCheckTimeout = 15 * time.Second
+
+// checkProviderModels warns about providers whose configured model they
+// don't list, which would otherwise only show up as 404s on first use
+func checkProviderModels(pool *llmpool.Pool) {
+	providers := pool.GetProviders()
+	for i := range providers {
+		provider := &providers[i]
+		if provider.Model == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), modelCheckTimeout)
+		models, err := pool.ListModels(ctx, provider.Name)
+		cancel()
+
+		switch {
+		case err != nil:
+			slog.Warn("listing provider models failed", "provider", provider.Name, "error", err)
+		case !llmpool.HasModel(models, provider.Model):
+			slog.Warn("provider does not list its configured model",
+				"provider", provider.Name, "model", provider.Model, "available", len(models))
+		}
+	}
+}
+
+// handleProviderModels lists the models a pool provider serves
+func handleProviderModels(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		models, err := pool.ListModels(res.UserContext(), res.Params("name"))
+		if errors.Is(err, llmpool.ErrProviderNotFound) {
+			return sendError(res, 404, "Provider not found")
+		}
+		if err != nil {
+			return sendLLMError(res, err)
+		}
+		return res.JSON(fiber.Map{"provider": res.Params("name"), "models": models})
+	}
+}
+
+// providerView is a provider as the admin API shows it: its configuration,
+// with the API key masked, and its stats
+func providerView(pool *llmpool.Pool, name string) (fiber.Map, bool) {
+	providers := pool.GetProviders()
+	for i := range providers {
+		if providers[i].Name == name {
+			return fiber.Map{"provider": &providers[i], "stats": pool.GetStats()[name]}, true
+		}
+	}
+	return nil, false
+}
+
+// handleListProviders lists the pool's providers with their stats
+func handleListProviders(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		providers := pool.GetProviders()
+		stats := pool.GetStats()
+		views := make([]fiber.Map, 0, len(providers))
+		for i := range providers {
+			views = append(views, fiber.Map{"provider": &providers[i], "stats": stats[providers[i].Name]})
+		}
+		return res.JSON(views)
+	}
+}
+
+// handleAddProvider adds a provider, validated as a configuration file entry
+func handleAddProvider(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		var body llmpool.ProviderConfig
+		if err := res.BodyParser(&body); err != nil {
+			return sendError(res, 400, "Invalid JSON body")
+		}
+		err := pool.AddProviderConfig(body)
+		if errors.Is(err, llmpool.ErrProviderExists) {
+			return sendError(res, 409, "A provider with this name already exists")
+		}
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		slog.Info("LLM provider added", "provider", body.Name)
+		view, _ := providerView(pool, body.Name)
+		return res.Status(201).JSON(view)
+	}
+}
+
+// handleUpdateProvider changes the fields of a provider given in the body;
+// a new API key or model replaces it for requests not yet sent
+func handleUpdateProvider(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		var body struct {
+			APIKey            *string `json:"api_key"`
+			Model             *string `json:"model"`
+			Priority          *int    `json:"priority"`
+			Weight            *int    `json:"weight"`
+			RequestsPerMinute *int    `json:"requests_per_minute"`
+			TokensPerMinute   *int    `json:"tokens_per_minute"`
+			Timeout           *string `json:"timeout"`
+		}
+		if err := res.BodyParser(&body); err != nil {
+			return sendError(res, 400, "Invalid JSON body")
+		}
+
+		name := res.Params("name")
+		err := pool.UpdateProvider(name, func(pc *llmpool.ProviderConfig) {
+			setIfGiven(&pc.APIKey, body.APIKey)
+			setIfGiven(&pc.Model, body.Model)
+			setIfGiven(&pc.Priority, body.Priority)
+			setIfGiven(&pc.Weight, body.Weight)
+			setIfGiven(&pc.RequestsPerMinute, body.RequestsPerMinute)
+			setIfGiven(&pc.TokensPerMinute, body.TokensPerMinute)
+			setIfGiven(&pc.Timeout, body.Timeout)
+		})
+		if errors.Is(err, llmpool.ErrProviderNotFound) {
+			return sendError(res, 404, "Provider not found")
+		}
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		slog.Info("LLM provider updated", "provider", name, "api_key_changed", body.APIKey != nil)
+		view, _ := providerView(pool, name)
+		return res.JSON(view)
+	}
+}
+
+// setIfGiven copies *value to field when the value was given
+func setIfGiven[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+// handleRemoveProvider removes a provider; requests already sent to it finish
+func handleRemoveProvider(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		name := res.Params("name")
+		if !pool.RemoveProvider(name) {
+			return sendError(res, 404, "Provider not found")
+		}
+		slog.Info("LLM provider removed", "provider", name)
+		return res.SendStatus(204)
+	}
+}
+
+// handleResetProvider closes a provider's circuit breaker and clears its
+// error counts
+func handleResetProvider(pool *llmpool.Pool) fiber.Handler {
+	return func(res *fiber.Ctx) error {
+		name := res.Params("name")
+		if !pool.ResetProvider(name) {
+			return sendError(res, 404, "Provider not found")
+		}
+		view, _ := providerView(pool, name)
+		return res.JSON(view)
+	}
+}
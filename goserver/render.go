@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// pdfOptions are the render options accepted by the PDF endpoints. They are
+// embedded in request bodies and take part in the render cache key.
+type pdfOptions struct {
+	InlineImages bool `json:"inline_images,omitempty" query:"inline_images"`
+	InlineCSS    bool `json:"inline_css,omitempty" query:"inline_css"`
+
+	// WaitFor is the page-ready condition: "load" (default), "domcontentloaded",
+	// "networkidle0", "networkidle2" or "selector:<css selector>"
+	WaitFor     string `json:"wait_for,omitempty" query:"wait_for"`
+	WaitDelayMS int    `json:"wait_delay_ms,omitempty" query:"wait_delay_ms"`
+
+	// WaitForSelector is checked after the ready condition, for pages that
+	// render their content asynchronously (React, Vue)
+	WaitForSelector          string `json:"wait_for_selector,omitempty" query:"wait_for_selector"`
+	WaitForSelectorTimeoutMS int    `json:"wait_for_selector_timeout_ms,omitempty" query:"wait_for_selector_timeout_ms"`
+
+	// Viewport size used for layout (defaults 1280x900). PageScale shrinks
+	// or enlarges the printed content (0.1-2, PDF only).
+	ViewportWidth  int     `json:"viewport_width,omitempty" query:"viewport_width"`
+	ViewportHeight int     `json:"viewport_height,omitempty" query:"viewport_height"`
+	PageScale      float64 `json:"page_scale,omitempty" query:"page_scale"`
+
+	// PaperFormat is the printed page size: A3, A4, A5, Letter, Legal or
+	// Tabloid. Empty keeps Chromium's default (Letter).
+	PaperFormat string `json:"paper_format,omitempty" query:"paper_format" form:"paper_format"`
+	// Orientation is "portrait" (default) or "landscape"; MarginMM is the
+	// margin on every side of the printed page (default none)
+	Orientation string  `json:"orientation,omitempty" query:"orientation" form:"orientation"`
+	MarginMM    float64 `json:"margin_mm,omitempty" query:"margin_mm" form:"margin_mm"`
+
+	// BlockThirdParty fails requests to origins other than the page's own,
+	// except fonts and stylesheets. HTML input has no origin of its own, so
+	// every external request other than fonts and CSS is blocked.
+	BlockThirdParty bool `json:"block_third_party,omitempty" query:"block_third_party"`
+
+	// UserAgent overrides the browser's User-Agent. Locale (e.g. "de-DE")
+	// sets Accept-Language and the JavaScript/Intl locale of the page.
+	UserAgent string `json:"user_agent,omitempty" query:"user_agent"`
+	Locale    string `json:"locale,omitempty" query:"locale"`
+
+	// Cookies are set before navigating, for pages behind a login. GET /pdf
+	// takes them as base64-encoded JSON in the cookies query parameter.
+	Cookies []pdfCookie `json:"cookies,omitempty" query:"-"`
+
+	// InjectCSS is appended to <head> in a <style> tag once the page is ready,
+	// like Puppeteer's addStyleTag. It cascades after the page's stylesheets
+	// but, as usual, loses to inline style="" attributes unless !important.
+	InjectCSS string `json:"inject_css,omitempty" query:"inject_css"`
+
+	// Basic Auth credentials, answered only to challenges from the page's own origin
+	BasicAuthUser     string `json:"basic_auth_user,omitempty" query:"basic_auth_user"`
+	BasicAuthPassword string `json:"basic_auth_password,omitempty" query:"basic_auth_password"`
+}
+
+// pdfCookie is a cookie to send with the page load. Without a domain it is
+// scoped to the page URL.
+type pdfCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Domain   string `json:"domain,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+}
+
+// localeRe accepts BCP 47 style tags such as "de", "de-DE" or "zh-Hant-TW"
+var localeRe = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Default viewport; Chromium's own 800px default collapses responsive layouts
+const (
+	defaultViewportWidth  = 1280
+	defaultViewportHeight = 900
+)
+
+// paperSizes are the paper_format sizes in inches (width, height)
+var paperSizes = map[string][2]float64{
+	"a3":      {11.69, 16.54},
+	"a4":      {8.27, 11.69},
+	"a5":      {5.83, 8.27},
+	"letter":  {8.5, 11},
+	"legal":   {8.5, 14},
+	"tabloid": {11, 17},
+}
+
+// injectCSSMaxBytes caps the inject_css option (PDF_INJECT_CSS_MAX_BYTES)
+var injectCSSMaxBytes = 50 << 10
+
+// errSelectorTimeout is returned when wait_for_selector never matched
+var errSelectorTimeout = errors.New("timed out waiting for selector")
+
+// renderErrorStatus maps a render error to the HTTP status returned to the client
+func renderErrorStatus(err error) int {
+	var se *statusError
+	switch {
+	case errors.Is(err, errSelectorTimeout):
+		return 504
+	case errors.As(err, &se):
+		return se.status
+	}
+	return 500
+}
+
+// validate rejects options that can't be applied
+func (o pdfOptions) validate() error {
+	switch {
+	case o.WaitFor == "", o.WaitFor == "load", o.WaitFor == "domcontentloaded",
+		o.WaitFor == "networkidle0", o.WaitFor == "networkidle2":
+	case strings.HasPrefix(o.WaitFor, "selector:") && len(o.WaitFor) > len("selector:"):
+	default:
+		return fmt.Errorf("invalid wait_for %q", o.WaitFor)
+	}
+	if o.WaitDelayMS < 0 || o.WaitDelayMS > maxWaitDelayMS {
+		return fmt.Errorf("wait_delay_ms must be between 0 and %d", maxWaitDelayMS)
+	}
+	if o.ViewportWidth < 0 || o.ViewportHeight < 0 || o.ViewportWidth > 10000 || o.ViewportHeight > 10000 {
+		return fmt.Errorf("viewport dimensions must be between 0 and 10000")
+	}
+	if o.PageScale != 0 && (o.PageScale < 0.1 || o.PageScale > 2) {
+		return fmt.Errorf("page_scale must be between 0.1 and 2")
+	}
+	if _, ok := paperSizes[strings.ToLower(o.PaperFormat)]; o.PaperFormat != "" && !ok {
+		return fmt.Errorf("paper_format must be one of A3, A4, A5, Letter, Legal or Tabloid")
+	}
+	if o.Orientation != "" && o.Orientation != "portrait" && o.Orientation != "landscape" {
+		return fmt.Errorf("orientation must be portrait or landscape")
+	}
+	if o.MarginMM < 0 || o.MarginMM > 100 {
+		return fmt.Errorf("margin_mm must be between 0 and 100")
+	}
+	if o.Locale != "" && !localeRe.MatchString(o.Locale) {
+		return fmt.Errorf("invalid locale %q", o.Locale)
+	}
+	for i, c := range o.Cookies {
+		if c.Name == "" || c.Value == "" {
+			return fmt.Errorf("cookies[%d]: name and value are required", i)
+		}
+	}
+	if len(o.InjectCSS) > injectCSSMaxBytes {
+		return withStatus(413, fmt.Errorf("inject_css must be at most %d bytes", injectCSSMaxBytes))
+	}
+	if o.BasicAuthPassword != "" && o.BasicAuthUser == "" {
+		return fmt.Errorf("basic_auth_password requires basic_auth_user")
+	}
+	if o.WaitForSelectorTimeoutMS < 0 {
+		return fmt.Errorf("wait_for_selector_timeout_ms must not be negative")
+	}
+	return nil
+}
+
+// lifecycleEvents maps wait_for values to the Chromium lifecycle event that signals them
+var lifecycleEvents = map[string]proto.PageLifecycleEventName{
+	"domcontentloaded": proto.PageLifecycleEventNameDOMContentLoaded,
+	"networkidle0":     proto.PageLifecycleEventNameNetworkIdle,
+	"networkidle2":     proto.PageLifecycleEventNameNetworkAlmostIdle,
+}
+
+// navigationTimeout bounds how long a page may take to become ready
+const navigationTimeout = 60 * time.Second
+
+// maxWaitDelayMS caps wait_delay_ms, which is spent holding the render lock
+const maxWaitDelayMS = 30000
+
+// navigate loads url in page and blocks until the configured ready condition holds
+func (o pdfOptions) navigate(page *rod.Page, url string) error {
+	page = page.Timeout(navigationTimeout)
+	defer page.CancelTimeout()
+
+	width, height := o.ViewportWidth, o.ViewportHeight
+	if width == 0 {
+		width = defaultViewportWidth
+	}
+	if height == 0 {
+		height = defaultViewportHeight
+	}
+	if err := page.SetViewport(&proto.EmulationSetDeviceMetricsOverride{
+		Width:             width,
+		Height:            height,
+		DeviceScaleFactor: 1,
+	}); err != nil {
+		return err
+	}
+
+	if err := o.emulate(page); err != nil {
+		return err
+	}
+	if err := o.setCookies(page, url); err != nil {
+		return err
+	}
+
+	// Lifecycle waits have to be armed before navigation starts
+	var waitEvent func()
+	if event, ok := lifecycleEvents[o.WaitFor]; ok {
+		waitEvent = page.WaitNavigation(event)
+	}
+
+	if err := page.Navigate(url); err != nil {
+		return err
+	}
+
+	switch {
+	case waitEvent != nil:
+		waitEvent()
+	case strings.HasPrefix(o.WaitFor, "selector:"):
+		if err := page.WaitLoad(); err != nil {
+			return err
+		}
+		if _, err := page.Element(strings.TrimPrefix(o.WaitFor, "selector:")); err != nil {
+			return err
+		}
+	default:
+		if err := page.WaitLoad(); err != nil {
+			return err
+		}
+	}
+
+	if o.WaitForSelector != "" {
+		timeout := 10 * time.Second
+		if o.WaitForSelectorTimeoutMS > 0 {
+			timeout = time.Duration(o.WaitForSelectorTimeoutMS) * time.Millisecond
+		}
+		if _, err := page.Timeout(timeout).Element(o.WaitForSelector); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return fmt.Errorf("%w %q", errSelectorTimeout, o.WaitForSelector)
+			}
+			return err
+		}
+	}
+
+	if o.InjectCSS != "" {
+		if err := page.AddStyleTag("", o.InjectCSS); err != nil {
+			return fmt.Errorf("inject_css: %w", err)
+		}
+	}
+
+	if o.WaitDelayMS > 0 {
+		// The wait counts towards the page's timeout like the rest of navigate
+		timer := time.NewTimer(time.Duration(o.WaitDelayMS) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-page.GetContext().Done():
+			return page.GetContext().Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// emulate applies the user agent and locale overrides to page
+func (o pdfOptions) emulate(page *rod.Page) error {
+	switch {
+	case o.UserAgent != "":
+		if err := page.SetUserAgent(&proto.NetworkSetUserAgentOverride{
+			UserAgent:      o.UserAgent,
+			AcceptLanguage: o.Locale,
+		}); err != nil {
+			return err
+		}
+	case o.Locale != "":
+		if _, err := page.SetExtraHeaders([]string{"Accept-Language", o.Locale}); err != nil {
+			return err
+		}
+	}
+
+	if o.Locale != "" {
+		// Changes what toLocaleDateString() and Intl.* produce inside the page
+		if err := (proto.EmulationSetLocaleOverride{Locale: o.Locale}).Call(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCookies installs o.Cookies in the browser ahead of loading pageURL
+func (o pdfOptions) setCookies(page *rod.Page, pageURL string) error {
+	if len(o.Cookies) == 0 {
+		return nil
+	}
+
+	params := make([]*proto.NetworkCookieParam, 0, len(o.Cookies))
+	for _, c := range o.Cookies {
+		param := &proto.NetworkCookieParam{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HTTPOnly: c.HTTPOnly,
+		}
+		if c.Domain == "" {
+			if pageOrigin(pageURL) == "" {
+				return fmt.Errorf("cookie %q needs a domain when rendering HTML", c.Name)
+			}
+			param.URL = pageURL
+		}
+		params = append(params, param)
+	}
+	return page.SetCookies(params)
+}
+
+// decodeCookieParam parses the base64-encoded JSON cookie list used by GET /pdf
+func decodeCookieParam(param string) ([]pdfCookie, error) {
+	if param == "" {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(param)
+	if err != nil {
+		// Query strings are often built with the URL-safe alphabet
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, fmt.Errorf("cookies must be base64-encoded JSON")
+		}
+	}
+	var cookies []pdfCookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		return nil, fmt.Errorf("cookies must be a JSON array of {name, value, domain, path, secure, httpOnly}")
+	}
+	return cookies, nil
+}
+
+// pageOrigin returns scheme://host of a URL, or "" for data: and other opaque URLs
+func pageOrigin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// maxAuthAttempts bounds how often credentials are offered to one origin, so
+// a server that keeps rejecting them can't keep the page waiting forever
+const maxAuthAttempts = 3
+
+// interceptRequests installs the request filters and the Basic Auth handler
+// selected in o on page before it navigates to pageURL. The returned func
+// stops interception and must be called once the page is no longer needed.
+func (o pdfOptions) interceptRequests(page *rod.Page, pageURL string) (func(), error) {
+	if !o.BlockThirdParty && o.BasicAuthUser == "" {
+		return func() {}, nil
+	}
+
+	origin := pageOrigin(pageURL)
+	err := proto.FetchEnable{
+		Patterns:           []*proto.FetchRequestPattern{{URLPattern: "*"}},
+		HandleAuthRequests: o.BasicAuthUser != "",
+	}.Call(page)
+	if err != nil {
+		return nil, err
+	}
+
+	authAttempts := make(map[string]int)
+	events, cancel := page.WithCancel()
+	wait := events.EachEvent(func(e *proto.FetchRequestPaused) {
+		reqURL := e.Request.URL
+		if o.BlockThirdParty && !allowFirstParty(e.ResourceType, origin, reqURL) {
+			slog.Debug("blocked third-party request", "url", reqURL, "page", origin)
+			_ = proto.FetchFailRequest{RequestID: e.RequestID, ErrorReason: proto.NetworkErrorReasonBlockedByClient}.Call(page)
+			return
+		}
+		_ = proto.FetchContinueRequest{RequestID: e.RequestID}.Call(page)
+	}, func(e *proto.FetchAuthRequired) {
+		// Credentials only ever go to the page's own origin
+		response := &proto.FetchAuthChallengeResponse{Response: proto.FetchAuthChallengeResponseResponseCancelAuth}
+		reqOrigin := pageOrigin(e.Request.URL)
+		if origin != "" && reqOrigin == origin && authAttempts[reqOrigin] < maxAuthAttempts {
+			authAttempts[reqOrigin]++
+			response = &proto.FetchAuthChallengeResponse{
+				Response: proto.FetchAuthChallengeResponseResponseProvideCredentials,
+				Username: o.BasicAuthUser,
+				Password: o.BasicAuthPassword,
+			}
+		}
+		_ = proto.FetchContinueWithAuth{RequestID: e.RequestID, AuthChallengeResponse: response}.Call(page)
+	})
+	go wait()
+
+	return func() {
+		_ = proto.FetchDisable{}.Call(page)
+		cancel()
+	}, nil
+}
+
+// allowFirstParty is the block_third_party policy: fonts, stylesheets and
+// requests to the page's own origin pass
+func allowFirstParty(resourceType proto.NetworkResourceType, origin, reqURL string) bool {
+	switch resourceType {
+	case proto.NetworkResourceTypeFont, proto.NetworkResourceTypeStylesheet:
+		return true
+	}
+	return origin != "" && pageOrigin(reqURL) == origin
+}
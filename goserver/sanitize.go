@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stripExternalResources makes sanitizeHTML also remove stylesheets, imports
+// and sources loaded from other hosts (AI_STRIP_EXTERNAL_RESOURCES)
+var stripExternalResources = true
+
+var (
+	// unsafeElementRes match each unsafe element with its content, or just
+	// the opening tag when it is never closed; <embed> has no content
+	unsafeElementRes = []*regexp.Regexp{
+		unsafeElementRe("script"),
+		unsafeElementRe("iframe"),
+		unsafeElementRe("object"),
+		regexp.MustCompile(`(?i)<embed\b(?:[^>"']|"[^"]*"|'[^']*')*>`),
+	}
+	// strayCloseRe matches closing tags left behind by unclosed elements
+	strayCloseRe = regexp.MustCompile(`(?i)</(script|iframe|object|embed)\s*>`)
+	// tagRe matches an opening tag, allowing > inside quoted attribute values
+	tagRe = regexp.MustCompile(`<[a-zA-Z][a-zA-Z0-9-]*(?:[^>"']|"[^"]*"|'[^']*')*>`)
+	// tagAttrRe matches one attribute inside a tag, with its leading space
+	tagAttrRe = regexp.MustCompile(`\s+([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+)
+
+func unsafeElementRe(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)<` + name + `\b(?:[^>"']|"[^"]*"|'[^']*')*>(?:.*?</` + name + `\s*>)?`)
+}
+
+// urlAttributes are the attributes whose values are loaded or followed
+var urlAttributes = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true,
+	"xlink:href": true, "background": true, "poster": true, "srcset": true,
+}
+
+// sanitizeHTML removes script-capable content from a template: <script>,
+// <iframe>, <object> and <embed> elements, on* attributes and javascript:
+// URLs, plus external resources when stripExternalResources is set. It
+// works on the text rather than a parsed tree so everything else, including
+// {{placeholders}} in attribute values, is left byte for byte. removed
+// describes each thing taken out.
+func sanitizeHTML(doc string) (string, []string) {
+	removed := []string{}
+
+	for _, re := range unsafeElementRes {
+		doc = re.ReplaceAllStringFunc(doc, func(m string) string {
+			removed = append(removed, fmt.Sprintf("<%s> element", tagName(strings.ToLower(m[1:]))))
+			return ""
+		})
+	}
+	doc = strayCloseRe.ReplaceAllString(doc, "")
+
+	doc = tagRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		return sanitizeTag(tag, &removed)
+	})
+
+	if stripExternalResources {
+		doc = cssImportRe.ReplaceAllStringFunc(doc, func(m string) string {
+			u := cssImportRe.FindStringSubmatch(m)[1]
+			if !isExternalURL(u) {
+				return m
+			}
+			removed = append(removed, "external @import "+u)
+			return ""
+		})
+	}
+	doc = cssURLRe.ReplaceAllStringFunc(doc, func(m string) string {
+		u := cssURLRe.FindStringSubmatch(m)[2]
+		if !isJavaScriptURL(u) && !(stripExternalResources && isExternalURL(u)) {
+			return m
+		}
+		removed = append(removed, "url() reference "+u)
+		return "none"
+	})
+	return doc, removed
+}
+
+// sanitizeTag strips the unsafe attributes of one tag, or the whole tag for
+// an external <link>
+func sanitizeTag(tag string, removed *[]string) string {
+	name := tagName(strings.ToLower(tag[1:]))
+	head := len(name) + 1
+	dropTag := false
+
+	attrs := tagAttrRe.ReplaceAllStringFunc(tag[head:], func(m string) string {
+		sub := tagAttrRe.FindStringSubmatch(m)
+		attr, value := strings.ToLower(sub[1]), strings.Trim(sub[2], `"'`)
+		switch {
+		case strings.HasPrefix(attr, "on"):
+			*removed = append(*removed, fmt.Sprintf("%s attribute on <%s>", attr, name))
+		case urlAttributes[attr] && isJavaScriptURL(value):
+			*removed = append(*removed, fmt.Sprintf("javascript: URL in %s on <%s>", attr, name))
+		case stripExternalResources && name == "link" && attr == "href" && isExternalURL(value):
+			*removed = append(*removed, "external <link> "+value)
+			dropTag = true
+		case stripExternalResources && attr != "href" && urlAttributes[attr] && isExternalURL(value):
+			*removed = append(*removed, fmt.Sprintf("external %s %s on <%s>", attr, value, name))
+		default:
+			return m
+		}
+		return ""
+	})
+	if dropTag {
+		return ""
+	}
+	return tag[:head] + attrs
+}
+
+// isJavaScriptURL reports whether u runs script, ignoring the whitespace
+// and control characters browsers skip
+func isJavaScriptURL(u string) bool {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, u)
+	return strings.HasPrefix(strings.ToLower(u), "javascript:")
+}
+
+// isExternalURL reports whether u is loaded from another host. Placeholders,
+// data: URIs and relative paths are not.
+func isExternalURL(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "//")
+}
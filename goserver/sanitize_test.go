@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		removed []string
+	}{
+		{
+			name:    "script between placeholders",
+			in:      `<p>{{company_name}}<script>alert("{{x}}")</script>{{invoice_number}}</p>`,
+			want:    `<p>{{company_name}}{{invoice_number}}</p>`,
+			removed: []string{"<script> element"},
+		},
+		{
+			name:    "unclosed script before placeholder",
+			in:      `<td>{{total_amount}}<script src="x.js">{{currency}}</td>`,
+			want:    `<td>{{total_amount}}{{currency}}</td>`,
+			removed: []string{"<script> element"},
+		},
+		{
+			name:    "iframe object and embed",
+			in:      `<div>{{a}}<iframe src="https://evil.test"></iframe>{{b}}<object data="x"></object><embed src="y">{{c}}</div>`,
+			want:    `<div>{{a}}{{b}}{{c}}</div>`,
+			removed: []string{"<iframe> element", "<object> element", "<embed> element"},
+		},
+		{
+			name:    "event handler next to placeholder attributes",
+			in:      `<img src="{{logo_url}}" onerror="alert(1)" alt="{{company_name}}">`,
+			want:    `<img src="{{logo_url}}" alt="{{company_name}}">`,
+			removed: []string{"onerror attribute on <img>"},
+		},
+		{
+			name:    "placeholders in style kept byte for byte",
+			in:      `<td style="color: {{brand_color}}; width: {{col_width}}px" onclick="x()">{{list.item_name}}</td>`,
+			want:    `<td style="color: {{brand_color}}; width: {{col_width}}px">{{list.item_name}}</td>`,
+			removed: []string{"onclick attribute on <td>"},
+		},
+		{
+			name:    "javascript URL",
+			in:      `<a href=" java	script:steal()" title="{{customer_name}}">{{invoice_number}}</a>`,
+			want:    `<a title="{{customer_name}}">{{invoice_number}}</a>`,
+			removed: []string{"javascript: URL in href on <a>"},
+		},
+		{
+			name:    "placeholder URL is not external",
+			in:      `<a href="{{payment_link}}">Pay</a><img src="data:image/png;base64,AAAA">`,
+			want:    `<a href="{{payment_link}}">Pay</a><img src="data:image/png;base64,AAAA">`,
+			removed: []string{},
+		},
+		{
+			name:    "external stylesheet and image",
+			in:      `<link rel="stylesheet" href="https://cdn.test/x.css"><p>{{a}}</p><img src="https://cdn.test/logo.png" alt="{{b}}">`,
+			want:    `<p>{{a}}</p><img alt="{{b}}">`,
+			removed: []string{"external <link> https://cdn.test/x.css", "external src https://cdn.test/logo.png on <img>"},
+		},
+		{
+			name:    "external CSS import and url()",
+			in:      `<style>@import url("https://fonts.test/f.css"); body { background: url(https://cdn.test/bg.png) } h1 { color: {{brand_color}} }</style>`,
+			want:    `<style> body { background: none } h1 { color: {{brand_color}} }</style>`,
+			removed: []string{"external @import https://fonts.test/f.css", "url() reference https://cdn.test/bg.png"},
+		},
+		{
+			name:    "quoted > in attribute",
+			in:      `<div title="a > b" onmouseover="x()">{{a}}</div>`,
+			want:    `<div title="a > b">{{a}}</div>`,
+			removed: []string{"onmouseover attribute on <div>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed := sanitizeHTML(tt.in)
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed %q, want %q", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestSanitizeHTMLKeepsExternal(t *testing.T) {
+	previous := stripExternalResources
+	stripExternalResources = false
+	t.Cleanup(func() { stripExternalResources = previous })
+
+	in := `<link rel="stylesheet" href="https://cdn.test/x.css"><img src="https://cdn.test/{{logo}}.png" onload="x()">`
+	got, removed := sanitizeHTML(in)
+	if want := `<link rel="stylesheet" href="https://cdn.test/x.css"><img src="https://cdn.test/{{logo}}.png">`; got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if want := []string{"onload attribute on <img>"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %q, want %q", removed, want)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleRunTimeout bounds one scheduled render, upload and email
+const scheduleRunTimeout = 5 * time.Minute
+
+var (
+	// scheduler runs the stored schedules
+	scheduler *invoiceScheduler
+
+	errScheduleNotFound = errors.New("schedule not found")
+)
+
+// invoiceSchedule renders an invoice on a cron schedule. The invoice
+// request is stored whole, and its invoice_number is bumped after each run.
+type invoiceSchedule struct {
+	ID   string `json:"id"`
+	Cron string `json:"cron"`
+	// RecipientEmail gets each invoice as an attachment when set
+	RecipientEmail string `json:"recipient_email,omitempty"`
+	// Storage archives each invoice; same shape as storage_destination
+	Storage *storageDestination `json:"storage_backend,omitempty"`
+	invoiceRequest
+
+	LastRunAt  *time.Time `json:"last_run_at"`
+	LastStatus string     `json:"last_status,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	// LastURL is the presigned link of the last stored invoice
+	LastURL   string     `json:"last_url,omitempty"`
+	NextRunAt *time.Time `json:"next_run_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// validate checks the cron expression, recipient and invoice request
+func (s *invoiceSchedule) validate() error {
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return fmt.Errorf("cron: %v", err)
+	}
+	if s.RecipientEmail != "" {
+		if _, err := mail.ParseAddress(s.RecipientEmail); err != nil {
+			return fmt.Errorf("invalid recipient_email %q", s.RecipientEmail)
+		}
+		if mailer == nil {
+			return errMailNotConfigured
+		}
+	}
+	if err := s.Storage.validate("storage_backend"); err != nil {
+		return err
+	}
+	if s.invoiceRequest.Storage != nil {
+		return errors.New("use storage_backend to store scheduled invoices")
+	}
+	if s.Mode == "html" {
+		return errors.New("scheduled invoices are always rendered as pdf")
+	}
+	return s.invoiceRequest.validate()
+}
+
+// scheduleColumns is the column list scanned by scanSchedule
+const scheduleColumns = `id, cron, recipient_email, storage, request, last_run_at, last_status, last_error, last_url, created_at`
+
+func scanSchedule(row rowScanner) (*invoiceSchedule, error) {
+	var s invoiceSchedule
+	var storageJSON, request string
+	var lastRun sql.NullTime
+	err := row.Scan(&s.ID, &s.Cron, &s.RecipientEmail, &storageJSON, &request, &lastRun, &s.LastStatus, &s.LastError, &s.LastURL, &s.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storageJSON != "" {
+		if err := json.Unmarshal([]byte(storageJSON), &s.Storage); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal([]byte(request), &s.invoiceRequest); err != nil {
+		return nil, err
+	}
+	if lastRun.Valid {
+		s.LastRunAt = &lastRun.Time
+	}
+	return &s, nil
+}
+
+func getSchedule(conn *sql.DB, id string) (*invoiceSchedule, error) {
+	return scanSchedule(conn.QueryRow(`SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`, id))
+}
+
+// listSchedules returns every schedule, oldest first
+func listSchedules(conn *sql.DB) ([]*invoiceSchedule, error) {
+	rows, err := conn.Query(`SELECT ` + scheduleColumns + ` FROM schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []*invoiceSchedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func insertSchedule(conn *sql.DB, s *invoiceSchedule) error {
+	s.ID = uuid.NewString()
+	s.CreatedAt = time.Now().UTC()
+	storageJSON, request, err := s.encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(`INSERT INTO schedules (id, cron, recipient_email, storage, request, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Cron, s.RecipientEmail, storageJSON, request, s.CreatedAt)
+	return err
+}
+
+// saveScheduleRun records the outcome of a run and the request for the next
+func saveScheduleRun(conn *sql.DB, s *invoiceSchedule) error {
+	_, request, err := s.encode()
+	if err != nil {
+		return err
+	}
+	result, err := conn.Exec(`UPDATE schedules SET request = ?, last_run_at = ?, last_status = ?, last_error = ?, last_url = ? WHERE id = ?`,
+		request, s.LastRunAt, s.LastStatus, s.LastError, s.LastURL, s.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errScheduleNotFound
+	}
+	return nil
+}
+
+func deleteSchedule(conn *sql.DB, id string) error {
+	result, err := conn.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errScheduleNotFound
+	}
+	return nil
+}
+
+// encode returns the JSON stored in the storage and request columns
+func (s *invoiceSchedule) encode() (string, string, error) {
+	request, err := json.Marshal(s.invoiceRequest)
+	if err != nil {
+		return "", "", err
+	}
+	if s.Storage == nil {
+		return "", string(request), nil
+	}
+	storageJSON, err := json.Marshal(s.Storage)
+	return string(storageJSON), string(request), err
+}
+
+// invoiceScheduler registers schedules with cron and runs them
+type invoiceScheduler struct {
+	cron *cron.Cron
+	conn *sql.DB
+
+	mu      sync.Mutex
+	entries map[string]cron.EntryID
+}
+
+// cronLogger sends the cron library's messages to slog
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...any) {
+	slog.Debug("cron: "+msg, keysAndValues...)
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...any) {
+	slog.Error("cron: "+msg, append(keysAndValues, "error", err)...)
+}
+
+// startScheduler loads every stored schedule and starts running them.
+// A run still going when its next one is due makes that one skip.
+func startScheduler(conn *sql.DB) (*invoiceScheduler, error) {
+	logger := cronLogger{}
+	s := &invoiceScheduler{
+		cron:    cron.New(cron.WithChain(cron.Recover(logger), cron.SkipIfStillRunning(logger))),
+		conn:    conn,
+		entries: make(map[string]cron.EntryID),
+	}
+	schedules, err := listSchedules(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, sched := range schedules {
+		if err := s.add(sched); err != nil {
+			slog.Error("skipping schedule", "schedule_id", sched.ID, "error", err)
+		}
+	}
+	s.cron.Start()
+	return s, nil
+}
+
+func (s *invoiceScheduler) add(sched *invoiceSchedule) error {
+	id := sched.ID
+	entry, err := s.cron.AddFunc(sched.Cron, func() { s.run(id) })
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.entries[id] = entry
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *invoiceScheduler) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[id]; ok {
+		s.cron.Remove(entry)
+		delete(s.entries, id)
+	}
+}
+
+// nextRun fills in when sched fires next
+func (s *invoiceScheduler) nextRun(sched *invoiceSchedule) {
+	s.mu.Lock()
+	entry, ok := s.entries[sched.ID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if next := s.cron.Entry(entry).Next; !next.IsZero() {
+		sched.NextRunAt = &next
+	}
+}
+
+// run renders, stores and emails one invoice. The stored request is read
+// fresh each time so the bumped invoice number is picked up.
+func (s *invoiceScheduler) run(id string) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), requestIDKey, "schedule-"+id), scheduleRunTimeout)
+	defer cancel()
+
+	sched, err := getSchedule(s.conn, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "loading schedule", "schedule_id", id, "error", err)
+		return
+	}
+	now := time.Now().UTC()
+	sched.LastRunAt = &now
+	sched.LastStatus, sched.LastError = "ok", ""
+
+	rendered, err := sched.runOnce(ctx)
+	if err != nil {
+		sched.LastStatus, sched.LastError = "failed", err.Error()
+		slog.ErrorContext(ctx, "scheduled invoice failed", "schedule_id", id, "error", err)
+	}
+	// A rendered invoice used up its number even if delivery failed
+	if number, ok := sched.Data["invoice_number"]; ok && rendered {
+		sched.Data["invoice_number"] = nextInvoiceNumber(number)
+	}
+	if err := saveScheduleRun(s.conn, sched); err != nil && !errors.Is(err, errScheduleNotFound) {
+		slog.ErrorContext(ctx, "saving schedule run", "schedule_id", id, "error", err)
+	}
+}
+
+// runOnce does the work of one run and reports whether a PDF was rendered
+func (sched *invoiceSchedule) runOnce(ctx context.Context) (bool, error) {
+	body := sched.invoiceRequest
+	data := make(map[string]any, len(body.Data))
+	for k, v := range body.Data {
+		data[k] = v
+	}
+	body.Data = data
+
+	rendered, tpl, err := buildInvoice(ctx, &body)
+	if err != nil {
+		return false, err
+	}
+	pdf, filename, err := renderInvoicePDF(ctx, &body, rendered, tpl)
+	if err != nil {
+		return false, err
+	}
+
+	if sched.Storage != nil {
+		stored, err := storePDF(ctx, sched.Storage, pdf, filename)
+		if err != nil {
+			return true, err
+		}
+		sched.LastURL = stored.URL
+	}
+	if sched.RecipientEmail != "" {
+		number := formatValue(data["invoice_number"])
+		_, err := sendMail(ctx, mailer, &emailMessage{
+			From:     mailFrom,
+			To:       []string{sched.RecipientEmail},
+			Subject:  "Invoice " + number,
+			BodyHTML: "<p>Please find invoice " + html.EscapeString(number) + " attached.</p>",
+			Attachments: []emailAttachment{{
+				Filename:    sanitizeFilename(filename),
+				ContentType: "application/pdf",
+				Content:     pdf,
+			}},
+		})
+		if err != nil {
+			return true, fmt.Errorf("emailing invoice: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// trailingDigitsRe finds the counter at the end of an invoice number
+var trailingDigitsRe = regexp.MustCompile(`(\d+)(\D*)$`)
+
+// nextInvoiceNumber increments an invoice number, keeping its prefix,
+// suffix and zero padding: INV-0099 becomes INV-0100. Numbers without
+// digits are returned unchanged.
+func nextInvoiceNumber(v any) any {
+	switch n := v.(type) {
+	case float64:
+		return n + 1
+	case string:
+		m := trailingDigitsRe.FindStringSubmatchIndex(n)
+		if m == nil {
+			return n
+		}
+		digits := n[m[2]:m[3]]
+		next, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil {
+			return n
+		}
+		return n[:m[2]] + fmt.Sprintf("%0*d", len(digits), next+1) + n[m[3]:]
+	default:
+		return v
+	}
+}
+
+// sendScheduleError maps store errors to a response
+func sendScheduleError(res *fiber.Ctx, err error) error {
+	if errors.Is(err, errScheduleNotFound) {
+		return sendError(res, 404, "Schedule not found")
+	}
+	return sendError(res, 500, err.Error())
+}
+
+func handleCreateSchedule(res *fiber.Ctx) error {
+	var sched invoiceSchedule
+	if err := res.BodyParser(&sched); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if err := sched.validate(); err != nil {
+		return sendValidationError(res, err)
+	}
+	if _, err := getTemplate(db, sched.TemplateID); err != nil {
+		return sendTemplateError(res, err)
+	}
+	sched.LastRunAt, sched.LastStatus, sched.LastError, sched.LastURL = nil, "", "", ""
+	if sched.Data == nil {
+		sched.Data = make(map[string]any)
+	}
+
+	if err := insertSchedule(db, &sched); err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	if err := scheduler.add(&sched); err != nil {
+		deleteSchedule(db, sched.ID)
+		return sendError(res, 500, err.Error())
+	}
+	scheduler.nextRun(&sched)
+	return res.Status(fiber.StatusCreated).JSON(sched)
+}
+
+func handleListSchedules(res *fiber.Ctx) error {
+	schedules, err := listSchedules(db)
+	if err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	for _, s := range schedules {
+		scheduler.nextRun(s)
+	}
+	return res.JSON(schedules)
+}
+
+func handleGetSchedule(res *fiber.Ctx) error {
+	sched, err := getSchedule(db, res.Params("id"))
+	if err != nil {
+		return sendScheduleError(res, err)
+	}
+	scheduler.nextRun(sched)
+	return res.JSON(sched)
+}
+
+func handleDeleteSchedule(res *fiber.Ctx) error {
+	id := res.Params("id")
+	if err := deleteSchedule(db, id); err != nil {
+		return sendScheduleError(res, err)
+	}
+	scheduler.remove(id)
+	return res.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// jsonSchemaDialect is the JSON Schema draft templateSchema targets
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// templateSchema describes the data object a template expects, for building
+// forms and checking payloads before POST /invoice. Every scalar placeholder
+// is a required string and every list an array of objects whose fields are
+// required strings; other properties are allowed. The template language has
+// no conditionals, so nothing is optional. Data valid against the schema
+// fills every placeholder.
+func templateSchema(tpl string) fiber.Map {
+	vars := discoverVariables(tpl)
+	properties := fiber.Map{}
+	required := []string{}
+
+	for _, name := range vars.Variables {
+		properties[name] = fiber.Map{"type": "string"}
+		required = append(required, name)
+	}
+	for _, name := range listNames(tpl) {
+		fields := vars.Lists[name]
+		items := fiber.Map{}
+		for _, f := range fields {
+			items[f] = fiber.Map{"type": "string"}
+		}
+		if _, scalar := properties[name]; !scalar {
+			required = append(required, name)
+		}
+		properties[name] = fiber.Map{
+			"type": "array",
+			"items": fiber.Map{
+				"type":       "object",
+				"properties": items,
+				"required":   fields,
+			},
+		}
+	}
+
+	return fiber.Map{
+		"$schema":    jsonSchemaDialect,
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// handleTemplateSchema answers POST /template/schema for either inline html
+// or a stored template_id
+func handleTemplateSchema(res *fiber.Ctx) error {
+	var body struct {
+		HTML       string `json:"html"`
+		TemplateID string `json:"template_id"`
+	}
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	switch {
+	case body.HTML != "" && body.TemplateID != "":
+		return sendError(res, 400, "Provide either html or template_id, not both")
+	case body.TemplateID != "":
+		t, err := getTemplate(db, body.TemplateID)
+		if err != nil {
+			return sendTemplateError(res, err)
+		}
+		body.HTML = t.HTMLContent
+	case body.HTML == "":
+		return sendError(res, 400, "Either html or template_id is required")
+	}
+	return res.JSON(templateSchema(body.HTML))
+}
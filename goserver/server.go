@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listenConfig controls where and how the HTTP server listens
+type listenConfig struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+	// TrustedProxies are the IPs/CIDRs allowed to set X-Forwarded-For
+	TrustedProxies []string
+}
+
+// TLS reports whether the server should serve HTTPS
+func (c listenConfig) TLS() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// apply sets the proxy options on a Fiber config. Without trusted proxies
+// X-Forwarded-For is ignored and res.IP() is the peer address.
+func (c listenConfig) apply(cfg *fiber.Config) {
+	if len(c.TrustedProxies) == 0 {
+		return
+	}
+	cfg.EnableTrustedProxyCheck = true
+	cfg.TrustedProxies = c.TrustedProxies
+	cfg.ProxyHeader = fiber.HeaderXForwardedFor
+	// Pick the first valid address out of a "client, proxy1, proxy2" header
+	cfg.EnableIPValidation = true
+}
+
+// URL returns the base URL for the startup banner
+func (c listenConfig) URL() string {
+	scheme := "http"
+	if c.TLS() {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return scheme + "://" + c.Addr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// listen serves app according to c
+func (c listenConfig) listen(app *fiber.App) error {
+	if c.TLS() {
+		return app.ListenTLS(c.Addr, c.CertFile, c.KeyFile)
+	}
+	return app.Listen(c.Addr)
+}
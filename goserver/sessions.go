@@ -0,0 +1,243 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// sessionStore keeps the conversations of /sessions in memory. A session
+// expires SessionTTL after its last use and keeps at most maxTurns turns,
+// dropping the oldest, so the history sent to the model stays bounded.
+type sessionStore struct {
+	pool     *llmpool.Pool
+	ttl      time.Duration
+	maxTurns int
+	retries  int
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is one conversation about a template. mu guards Messages and
+// serializes the session's messages so each sees the previous reply.
+type session struct {
+	ID           string
+	DocumentType string
+	Provider     string
+	Model        string
+	Messages     []sessionMessage
+	CreatedAt    time.Time
+	// ExpiresAt is guarded by sessionStore.mu
+	ExpiresAt time.Time
+
+	owner string
+	mu    sync.Mutex
+}
+
+// sessionMessage is one entry of a session's history
+type sessionMessage struct {
+	Role    string    `json:"role"` // "user" or "assistant"
+	Content string    `json:"content"`
+	At      time.Time `json:"at"`
+}
+
+func newSessionStore(pool *llmpool.Pool, ttl time.Duration, maxTurns, retries int) *sessionStore {
+	s := &sessionStore{
+		pool:     pool,
+		ttl:      ttl,
+		maxTurns: maxTurns,
+		retries:  retries,
+		sessions: make(map[string]*session),
+	}
+	go s.sweepLoop()
+	return s
+}
+
+// get returns the live session id of the caller's API key, extending its
+// expiry
+func (s *sessionStore) get(res *fiber.Ctx, id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok || sess.owner != keyName(res) {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(sess.ExpiresAt) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	sess.ExpiresAt = now.Add(s.ttl)
+	return sess, true
+}
+
+// sweepLoop drops expired sessions that are never used again
+func (s *sessionStore) sweepLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		s.mu.Lock()
+		for id, sess := range s.sessions {
+			if now.After(sess.ExpiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleCreate starts a session. The document type, provider and model
+// are fixed for all of its messages.
+func (s *sessionStore) handleCreate(res *fiber.Ctx) error {
+	var body struct {
+		DocumentType string `json:"document_type,omitempty"`
+		Provider     string `json:"provider,omitempty"`
+		Model        string `json:"model,omitempty"`
+	}
+	if len(res.Body()) > 0 {
+		if err := res.BodyParser(&body); err != nil {
+			return sendError(res, 400, "Invalid JSON body")
+		}
+	}
+	if _, err := presetFor(body.DocumentType); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	if _, err := providerTarget(s.pool, body.Provider); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+
+	now := time.Now()
+	sess := &session{
+		ID:           uuid.NewString(),
+		DocumentType: body.DocumentType,
+		Provider:     body.Provider,
+		Model:        body.Model,
+		Messages:     []sessionMessage{},
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(s.ttl),
+		owner:        keyName(res),
+	}
+	s.mu.Lock()
+	s.sessions[sess.ID] = sess
+	s.mu.Unlock()
+
+	return res.Status(201).JSON(fiber.Map{
+		"session_id": sess.ID,
+		"expires_at": sess.ExpiresAt,
+	})
+}
+
+// handleMessage sends a message to the model along with the system prompt
+// and the session's history, and adds both it and the reply to the history
+func (s *sessionStore) handleMessage(res *fiber.Ctx) error {
+	var body struct {
+		Message     string `json:"message"`
+		ImageBase64 string `json:"image_base64,omitempty"`
+		Base64Image string `json:"image,omitempty"`
+	}
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if strings.TrimSpace(body.Message) == "" {
+		return sendError(res, 400, "message is required")
+	}
+
+	sess, ok := s.get(res, res.Params("id"))
+	if !ok {
+		return sendError(res, 404, "Session not found")
+	}
+	preset, err := presetFor(sess.DocumentType)
+	if err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	target, err := providerTarget(s.pool, sess.Provider)
+	if err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	// The image goes with this message only; the history keeps text
+	image, err := requestImage(res, body.ImageBase64, body.Base64Image)
+	if err != nil {
+		return sendError(res, imageErrorStatus(err), err.Error())
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	messages := []llmpool.ChatMessage{{Role: "system", Content: preset.prompt()}}
+	for _, msg := range sess.Messages {
+		messages = append(messages, llmpool.ChatMessage{Role: msg.Role, Content: msg.Content})
+	}
+	messages = append(messages, userMessage(body.Message, image))
+	req := &llmpool.ChatRequest{
+		Messages:    messages,
+		Model:       sess.Model,
+		Temperature: llmpool.Ptr(0.5),
+		MaxTokens:   8000,
+	}
+
+	result, err := generateTemplate(res.UserContext(), target.chat, req, s.retries, preset.check)
+	if err != nil {
+		return sendLLMError(res, err)
+	}
+
+	now := time.Now()
+	sess.Messages = append(sess.Messages,
+		sessionMessage{Role: "user", Content: body.Message, At: now},
+		sessionMessage{Role: "assistant", Content: result.HTML, At: now},
+	)
+	if extra := len(sess.Messages) - 2*s.maxTurns; extra > 0 {
+		sess.Messages = append([]sessionMessage(nil), sess.Messages[extra:]...)
+	}
+
+	return sendTemplateResult(res, result, fiber.Map{
+		"session_id": sess.ID,
+		"turns":      len(sess.Messages) / 2,
+	})
+}
+
+// handleHistory returns a session's messages, oldest first
+func (s *sessionStore) handleHistory(res *fiber.Ctx) error {
+	sess, ok := s.get(res, res.Params("id"))
+	if !ok {
+		return sendError(res, 404, "Session not found")
+	}
+
+	// ExpiresAt is guarded by the store, the rest of the session by sess.mu
+	s.mu.Lock()
+	expires := sess.ExpiresAt
+	s.mu.Unlock()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return res.JSON(fiber.Map{
+		"session_id":    sess.ID,
+		"document_type": sess.DocumentType,
+		"provider":      sess.Provider,
+		"model":         sess.Model,
+		"messages":      sess.Messages,
+		"turns":         len(sess.Messages) / 2,
+		"created_at":    sess.CreatedAt,
+		"expires_at":    expires,
+	})
+}
+
+// handleDelete ends a session
+func (s *sessionStore) handleDelete(res *fiber.Ctx) error {
+	if _, ok := s.get(res, res.Params("id")); !ok {
+		return sendError(res, 404, "Session not found")
+	}
+
+	s.mu.Lock()
+	delete(s.sessions, res.Params("id"))
+	s.mu.Unlock()
+	return res.SendStatus(204)
+}
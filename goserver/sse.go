@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"server/llmpool"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// aiStreamTimeout bounds a streamed generation, which outlives the handler
+const aiStreamTimeout = 5 * time.Minute
+
+// streamTemplate answers /create/ai as server-sent events: "delta" events
+// carry the HTML as it is generated, with the markdown fence removed, then
+// a "done" event has the same fields as the JSON response, or an "error"
+// event has the error and the status the JSON response would have had.
+// Validation runs on the result but there is no retry, since the client has
+// already seen the template.
+func streamTemplate(res *fiber.Ctx, target llmTarget, req *llmpool.ChatRequest, check func(string) templateReport) error {
+	// The writer runs after the handler returns, so take what it needs now
+	u := usage.get(keyName(res))
+	requestID, _ := res.Locals("request_id").(string)
+
+	res.Set(fiber.HeaderContentType, "text/event-stream")
+	res.Set(fiber.HeaderCacheControl, "no-cache")
+	res.Set("X-Accel-Buffering", "no")
+
+	res.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// A failed write means the client left; returning its error from
+		// the callback ends the stream and cancel aborts the provider call
+		base := context.WithValue(context.Background(), requestIDKey, requestID)
+		ctx, cancel := context.WithTimeout(base, aiStreamTimeout)
+		defer cancel()
+
+		filter := &fenceFilter{}
+		resp, err := target.stream(ctx, req, func(chunk llmpool.StreamChunk) error {
+			if text := filter.write(chunk.Content); text != "" {
+				return writeEvent(w, "delta", fiber.Map{"content": text})
+			}
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "llm stream failed", "error", err)
+			status, message, _ := describeLLMError(err)
+			writeEvent(w, "error", fiber.Map{"error": message, "status": status, "request_id": requestID})
+			return
+		}
+		u.AICalls.Add(1)
+
+		template, warnings, removed := cleanAIHTML(resp.Content)
+		writeEvent(w, "done", fiber.Map{
+			"response":   template,
+			"provider":   resp.Provider,
+			"model":      resp.Model,
+			"usage":      resp.Usage,
+			"variables":  discoverVariables(template),
+			"schema":     templateSchema(template),
+			"warnings":   warnings,
+			"removed":    removed,
+			"validation": check(template),
+		})
+	})
+	return nil
+}
+
+// writeEvent sends one SSE event and flushes it to the client
+func writeEvent(w *bufio.Writer, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// fenceFilter removes the ```html fence around a streamed reply, whose
+// markers can be split across chunks. Text before the fence (or before the
+// first tag when there is none) and after the closing fence is dropped.
+type fenceFilter struct {
+	pending string
+	state   int
+}
+
+const (
+	fenceStart = iota
+	fenceBody
+	fenceDone
+)
+
+// write adds a chunk and returns the HTML that is safe to pass on
+func (f *fenceFilter) write(chunk string) string {
+	f.pending += chunk
+
+	switch f.state {
+	case fenceStart:
+		fence, tag := strings.Index(f.pending, "```"), strings.IndexByte(f.pending, '<')
+		switch {
+		case fence >= 0 && (tag < 0 || fence < tag):
+			nl := strings.IndexByte(f.pending[fence:], '\n')
+			if nl < 0 {
+				// The language tag is still arriving
+				return ""
+			}
+			f.pending = f.pending[fence+nl+1:]
+		case tag >= 0:
+			f.pending = f.pending[tag:]
+		default:
+			return ""
+		}
+		f.state = fenceBody
+		return f.body()
+	case fenceBody:
+		return f.body()
+	default:
+		f.pending = ""
+		return ""
+	}
+}
+
+// body passes on pending text up to the closing fence, holding back
+// trailing backticks that may be its start
+func (f *fenceFilter) body() string {
+	if i := strings.Index(f.pending, "```"); i >= 0 {
+		out := f.pending[:i]
+		f.pending = ""
+		f.state = fenceDone
+		return out
+	}
+	keep := len(f.pending) - len(strings.TrimRight(f.pending, "`"))
+	out := f.pending[:len(f.pending)-keep]
+	f.pending = f.pending[len(f.pending)-keep:]
+	return out
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxPresignTTL is the longest a SigV4 presigned URL may be valid for
+const maxPresignTTL = 7 * 24 * time.Hour
+
+var (
+	// storage archives PDFs for requests with a storage_destination
+	storage *s3Client
+
+	errStorageNotConfigured = errors.New("s3 storage is not configured: no AWS credentials in the environment or instance role")
+)
+
+// storageDestination asks for a PDF to be stored instead of returned
+type storageDestination struct {
+	Backend   string `json:"backend"`
+	Bucket    string `json:"bucket"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+}
+
+// validate checks the destination names a supported backend and a bucket;
+// field is its name in the request
+func (d *storageDestination) validate(field string) error {
+	if d == nil {
+		return nil
+	}
+	if d.Backend != "s3" {
+		return fmt.Errorf("%s.backend %q is not supported; use s3", field, d.Backend)
+	}
+	if d.Bucket == "" || strings.ContainsAny(d.Bucket, "/?#") {
+		return fmt.Errorf("%s.bucket must be a bucket name", field)
+	}
+	for _, part := range strings.Split(d.KeyPrefix, "/") {
+		if part == ".." {
+			return fmt.Errorf("%s.key_prefix must not contain ..", field)
+		}
+	}
+	return nil
+}
+
+// key places a file under the prefix in a directory of its own, so stored
+// PDFs keep their download name without overwriting each other
+func (d *storageDestination) key(filename string) string {
+	return strings.TrimPrefix(path.Join(d.KeyPrefix, uuid.NewString(), filename), "/")
+}
+
+// storedPDF is where storePDF put a PDF
+type storedPDF struct {
+	URL       string    `json:"url"`
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// storePDF uploads pdf to dest and presigns a download URL for it
+func storePDF(ctx context.Context, dest *storageDestination, pdf []byte, filename string) (*storedPDF, error) {
+	key := dest.key(sanitizeFilename(filename))
+	if err := storage.put(ctx, dest.Bucket, key, pdf, "application/pdf"); err != nil {
+		return nil, fmt.Errorf("storing pdf: %w", err)
+	}
+	url, expires, err := storage.presign(ctx, dest.Bucket, key, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("signing pdf url: %w", err)
+	}
+	return &storedPDF{URL: url, Key: key, ExpiresAt: expires.UTC().Truncate(time.Second)}, nil
+}
+
+// sendStoredPDF uploads pdf to dest and replies with a presigned URL to it
+func sendStoredPDF(res *fiber.Ctx, dest *storageDestination, pdf []byte, filename string) error {
+	stored, err := storePDF(res.UserContext(), dest, pdf, filename)
+	if err != nil {
+		status := 502
+		if errors.Is(err, errStorageNotConfigured) {
+			status = 503
+		}
+		return sendError(res, status, err.Error())
+	}
+	recordRender(res, len(pdf))
+	res.Set("X-PDF-Size-Bytes", strconv.Itoa(len(pdf)))
+	return res.JSON(stored)
+}
+
+// awsCredentials sign S3 requests; Expires is zero for static keys
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// s3Client is a minimal S3 client: a signed PutObject and presigned GETs.
+// It works against AWS and S3-compatible stores such as MinIO and R2.
+type s3Client struct {
+	cfg    storageConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+func newS3Client(cfg storageConfig) *s3Client {
+	c := &s3Client{cfg: cfg, client: &http.Client{Timeout: 60 * time.Second}}
+	if cfg.AccessKeyID != "" {
+		c.creds = awsCredentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken}
+	}
+	return c
+}
+
+// credentials returns the static keys or, without them, the instance
+// role's, refreshed a few minutes before they expire
+func (c *s3Client) credentials(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && (c.creds.Expires.IsZero() || time.Until(c.creds.Expires) > 5*time.Minute) {
+		return c.creds, nil
+	}
+	creds, err := instanceRoleCredentials(ctx, c.client)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("%w (%v)", errStorageNotConfigured, err)
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// imdsURL is the EC2 instance metadata service
+const imdsURL = "http://169.254.169.254"
+
+// instanceRoleCredentials fetches the instance role's credentials via IMDSv2
+func instanceRoleCredentials(ctx context.Context, client *http.Client) (awsCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	get := func(method, path string, header http.Header) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, method, imdsURL+path, nil)
+		if err != nil {
+			return "", err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("instance metadata %s returned status %d", path, resp.StatusCode)
+		}
+		return string(body), err
+	}
+
+	token, err := get(http.MethodPut, "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"300"}})
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	role, err := get(http.MethodGet, "/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	body, err := get(http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, header)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	var doc struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{AccessKeyID: doc.AccessKeyID, SecretAccessKey: doc.SecretAccessKey, SessionToken: doc.Token, Expires: doc.Expiration}, nil
+}
+
+// objectURL addresses key in bucket: virtual-hosted style on AWS, path
+// style for custom endpoints that ask for it and for dotted bucket names
+func (c *s3Client) objectURL(bucket, key string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: "s3." + c.cfg.Region + ".amazonaws.com"}
+	if c.cfg.Endpoint != "" {
+		u, _ = url.Parse(c.cfg.Endpoint)
+	}
+	escaped := awsURIEncode(key, false)
+	if c.cfg.PathStyle || strings.Contains(bucket, ".") {
+		u.Path = "/" + bucket + "/" + key
+		u.RawPath = "/" + awsURIEncode(bucket, true) + "/" + escaped
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escaped
+	}
+	return u
+}
+
+// put uploads body as key
+func (c *s3Client) put(ctx context.Context, bucket, key string, body []byte, contentType string) error {
+	creds, err := c.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	u := c.objectURL(bucket, key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	sum := sha256.Sum256(body)
+	c.sign(req, u, creds, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("s3 returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// presign returns a GET URL for key valid for the configured TTL
+func (c *s3Client) presign(ctx context.Context, bucket, key string, now time.Time) (string, time.Time, error) {
+	creds, err := c.credentials(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ttl := c.cfg.PresignTTL
+	if !creds.Expires.IsZero() && creds.Expires.Sub(now) < ttl {
+		// a URL signed with session credentials dies with them
+		ttl = creds.Expires.Sub(now)
+	}
+
+	u := c.objectURL(bucket, key)
+	now = now.UTC()
+	scope := c.scope(now)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {creds.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {fmt.Sprint(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if creds.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	query := canonicalQuery(q)
+	canonical := strings.Join([]string{http.MethodGet, u.EscapedPath(), query, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	u.RawQuery = query + "&X-Amz-Signature=" + c.signature(creds, now, canonical)
+	return u.String(), now.Add(ttl), nil
+}
+
+// sign adds SigV4 authorization headers to req
+func (c *s3Client) sign(req *http.Request, u *url.URL, creds awsCredentials, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": u.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, u.EscapedPath(), canonicalQuery(u.Query()), canonicalHeaders.String(), signed, payloadHash}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, c.scope(now), signed, c.signature(creds, now, canonical)))
+}
+
+func (c *s3Client) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + c.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with the day's derived key
+func (c *s3Client) signature(creds awsCredentials, now time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + c.scope(now) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), c.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts and encodes a query string the way SigV4 expects
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and
+// slashes too when encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// templateReport is the result of checking a template
+type templateReport struct {
+	Valid bool `json:"valid"`
+	// Errors break rendering; Warnings are worth a look but render fine
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+	// Missing lists required placeholders absent from the template, when
+	// the check has any (see promptPreset.check)
+	Missing []string `json:"missing_fields,omitempty"`
+}
+
+// bracesRe matches anything between {{ and }}, well-formed or not
+var bracesRe = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+// checkTemplate looks for the mistakes that break the render engine:
+// unbalanced or malformed placeholders, list placeholders spread over more
+// than one row, and text outside the markup
+func checkTemplate(tpl string) templateReport {
+	r := templateReport{Errors: []string{}, Warnings: []string{}}
+
+	trimmed := strings.TrimSpace(tpl)
+	switch {
+	case trimmed == "":
+		r.Errors = append(r.Errors, "template is empty")
+	case !strings.HasPrefix(trimmed, "<") || !strings.HasSuffix(trimmed, ">"):
+		r.Errors = append(r.Errors, "template has text before the first or after the last tag")
+	}
+	if strings.Contains(tpl, "```") {
+		r.Errors = append(r.Errors, "template contains markdown code fences")
+	}
+
+	if open, closing := strings.Count(tpl, "{{"), strings.Count(tpl, "}}"); open != closing {
+		r.Errors = append(r.Errors, fmt.Sprintf("unbalanced placeholder braces: %d {{ and %d }}", open, closing))
+	}
+	for _, m := range bracesRe.FindAllString(tpl, -1) {
+		if placeholderRe.FindString(m) != m {
+			r.Errors = append(r.Errors, fmt.Sprintf("malformed placeholder %s; use {{name}} or {{list.field}}", m))
+		}
+	}
+
+	vars := discoverVariables(tpl)
+	if len(vars.Variables) == 0 && len(vars.Lists) == 0 {
+		r.Warnings = append(r.Warnings, "template has no placeholders")
+	}
+	for _, name := range listNames(tpl) {
+		if rows := listRows(tpl, name); rows > 1 {
+			r.Errors = append(r.Errors, fmt.Sprintf("{{%s.*}} placeholders are spread over %d rows; use exactly one example row", name, rows))
+		}
+	}
+
+	for _, s := range suspiciousHTML {
+		if s.re.MatchString(tpl) {
+			r.Warnings = append(r.Warnings, "template contains "+s.what)
+		}
+	}
+
+	r.Valid = len(r.Errors) == 0
+	return r
+}
+
+// listRows counts the <tr> elements holding {{name.x}} placeholders
+func listRows(tpl, name string) int {
+	re := regexp.MustCompile(`\{\{\s*` + regexp.QuoteMeta(name) + `\.\w+\s*\}\}`)
+	rows := make(map[int]bool)
+	for _, m := range re.FindAllStringIndex(tpl, -1) {
+		if start, ok := enclosingRow(tpl, m[0]); ok {
+			rows[start] = true
+		}
+	}
+	return len(rows)
+}
+
+// enclosingRow returns the offset of the <tr> containing pos
+func enclosingRow(tpl string, pos int) (int, bool) {
+	lower := strings.ToLower(tpl)
+	for i := strings.LastIndex(lower[:pos], "<tr"); i >= 0; i = strings.LastIndex(lower[:i], "<tr") {
+		if tagName(lower[i+1:]) != "tr" {
+			continue
+		}
+		if end := closingTag(lower, "tr", i+1); end > pos || end < 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// lintDiagnostic is one finding of lintTemplate, at a 1-based line and
+// column (in characters)
+type lintDiagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+}
+
+// voidElements never have a closing tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// optionalClose are elements whose closing tag HTML lets you leave out.
+// Leaving it out renders fine, so it is only a warning.
+var optionalClose = map[string]bool{
+	"p": true, "li": true, "dt": true, "dd": true, "option": true,
+	"thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true,
+	"html": true, "head": true, "body": true,
+}
+
+var (
+	lintTagRe    = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)((?:"[^"]*"|'[^']*'|[^'">])*)>`)
+	styleAttrRe  = regexp.MustCompile(`(?i)\sstyle\s*=\s*("[^"]*"|'[^']*')`)
+	listFieldRe  = regexp.MustCompile(`\{\{\s*\w+\.\w+\s*\}\}`)
+	placeholders = regexp.MustCompile(`\{\{.*?\}\}`)
+)
+
+// lintTemplate reports the template mistakes that break rendering or the
+// loop engine, with their positions: unclosed and stray tags, unmatched
+// {{ and }}, list placeholders outside a table row and unbalanced CSS braces
+func lintTemplate(tpl string) []lintDiagnostic {
+	l := &linter{src: tpl, diags: []lintDiagnostic{}}
+	l.tags()
+	l.braces()
+	l.listRows()
+	l.css()
+
+	sort.SliceStable(l.diags, func(i, j int) bool {
+		a, b := l.diags[i], l.diags[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.diags
+}
+
+type linter struct {
+	src   string
+	diags []lintDiagnostic
+}
+
+// report adds a diagnostic at byte offset pos
+func (l *linter) report(pos int, severity, format string, args ...any) {
+	line := 1 + strings.Count(l.src[:pos], "\n")
+	lineStart := strings.LastIndexByte(l.src[:pos], '\n') + 1
+	l.diags = append(l.diags, lintDiagnostic{
+		Line:     line,
+		Column:   utf8.RuneCountInString(l.src[lineStart:pos]) + 1,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// tags matches opening and closing tags on a stack, skipping comments and
+// the contents of script and style elements
+func (l *linter) tags() {
+	type open struct {
+		name string
+		pos  int
+	}
+	var stack []open
+
+	unclosed := func(o open) {
+		if optionalClose[o.name] {
+			l.report(o.pos, "warning", "<%s> is not closed", o.name)
+		} else {
+			l.report(o.pos, "error", "<%s> is not closed", o.name)
+		}
+	}
+
+	lower := strings.ToLower(l.src)
+	pos := 0
+	for {
+		m := lintTagRe.FindStringSubmatchIndex(l.src[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[0], pos+m[1]
+
+		// Skip comments, which may contain anything
+		if c := strings.Index(l.src[pos:start], "<!--"); c >= 0 {
+			c += pos
+			e := strings.Index(l.src[c+4:], "-->")
+			if e < 0 {
+				l.report(c, "error", "comment is not closed")
+				break
+			}
+			pos = c + 4 + e + 3
+			continue
+		}
+
+		closing := m[2] != m[3]
+		name := strings.ToLower(l.src[pos+m[4] : pos+m[5]])
+		selfClosing := strings.HasSuffix(strings.TrimSpace(l.src[pos+m[6]:pos+m[7]]), "/")
+		pos = end
+
+		switch {
+		case closing && voidElements[name]:
+			l.report(start, "warning", "</%s> closes a void element", name)
+		case closing:
+			i := len(stack) - 1
+			for i >= 0 && stack[i].name != name {
+				i--
+			}
+			if i < 0 {
+				l.report(start, "error", "</%s> has no matching <%s>", name, name)
+				continue
+			}
+			for _, o := range stack[i+1:] {
+				unclosed(o)
+			}
+			stack = stack[:i]
+		case voidElements[name] || selfClosing:
+		case name == "script" || name == "style":
+			// Raw text: jump to the closing tag
+			e := strings.Index(lower[pos:], "</"+name)
+			if e < 0 {
+				l.report(start, "error", "<%s> is not closed", name)
+				return
+			}
+			stack = append(stack, open{name, start})
+			pos += e
+		default:
+			stack = append(stack, open{name, start})
+		}
+	}
+	for _, o := range stack {
+		unclosed(o)
+	}
+}
+
+// braces pairs each {{ with the next }}, reporting either one left over
+func (l *linter) braces() {
+	pos := 0
+	for {
+		openAt := strings.Index(l.src[pos:], "{{")
+		closeAt := strings.Index(l.src[pos:], "}}")
+		switch {
+		case openAt < 0 && closeAt < 0:
+			return
+		case openAt < 0 || closeAt >= 0 && closeAt < openAt:
+			l.report(pos+closeAt, "error", "}} has no matching {{")
+			pos += closeAt + 2
+			continue
+		}
+
+		start := pos + openAt
+		next := strings.Index(l.src[start+2:], "{{")
+		if closeAt < 0 || next >= 0 && start+2+next < pos+closeAt {
+			l.report(start, "error", "{{ is not closed")
+			pos = start + 2
+			continue
+		}
+
+		end := pos + closeAt + 2
+		if m := l.src[start:end]; placeholderRe.FindString(m) != m {
+			l.report(start, "error", "malformed placeholder %s; use {{name}} or {{list.field}}", m)
+		}
+		pos = end
+	}
+}
+
+// listRows reports list placeholders outside a <tr>: the loop engine
+// repeats the row holding them, so without one the list can't render
+func (l *linter) listRows() {
+	for _, m := range listFieldRe.FindAllStringIndex(l.src, -1) {
+		if _, ok := enclosingRow(l.src, m[0]); !ok {
+			l.report(m[0], "error", "list placeholder %s is outside a table row", l.src[m[0]:m[1]])
+		}
+	}
+}
+
+// css checks that braces balance in <style> blocks and that style
+// attributes, which take declarations only, have none. Placeholders are
+// left out of the count.
+func (l *linter) css() {
+	lower := strings.ToLower(l.src)
+	for pos := 0; ; {
+		i := strings.Index(lower[pos:], "<style")
+		if i < 0 {
+			break
+		}
+		start := pos + i
+		gt := strings.IndexByte(lower[start:], '>')
+		end := strings.Index(lower[start:], "</style")
+		if gt < 0 || end < 0 {
+			break
+		}
+		body := placeholders.ReplaceAllString(l.src[start+gt+1:start+end], "")
+		if open, closing := strings.Count(body, "{"), strings.Count(body, "}"); open != closing {
+			l.report(start, "error", "<style> has unbalanced braces: %d { and %d }", open, closing)
+		}
+		pos = start + end
+	}
+
+	for _, m := range styleAttrRe.FindAllStringSubmatchIndex(l.src, -1) {
+		value := placeholders.ReplaceAllString(l.src[m[2]:m[3]], "")
+		if strings.ContainsAny(value, "{}") {
+			l.report(m[2], "warning", "style attribute contains braces; it takes declarations only")
+		}
+	}
+}
+
+// handleLintTemplate checks a template without saving it
+func handleLintTemplate(res *fiber.Ctx) error {
+	var body struct {
+		HTMLContent string `json:"html_content"`
+	}
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+	if strings.TrimSpace(body.HTMLContent) == "" {
+		return sendError(res, 400, "html_content is required")
+	}
+	if len(body.HTMLContent) > maxTemplateBytes {
+		return sendError(res, 400, "html_content is too large")
+	}
+	return res.JSON(lintTemplate(body.HTMLContent))
+}
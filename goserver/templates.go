@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxTemplateBytes caps the html_content of a stored template
+const maxTemplateBytes = 1 << 20
+
+// invoiceTemplate is a stored HTML template with {{placeholders}}
+type invoiceTemplate struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	HTMLContent string    `json:"html_content,omitempty"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var errTemplateNotFound = errors.New("template not found")
+
+// templateColumns is the column list scanned by scanTemplate
+const templateColumns = `id, name, html_content, description, tags, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTemplate(row rowScanner) (*invoiceTemplate, error) {
+	var t invoiceTemplate
+	var tags string
+	err := row.Scan(&t.ID, &t.Name, &t.HTMLContent, &t.Description, &tags, &t.CreatedAt, &t.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Tags = splitTags(tags)
+	return &t, nil
+}
+
+// Tags are stored comma-separated, lowercased and without duplicates
+func splitTags(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// normalizeTags trims, lowercases and dedupes tags, rejecting commas
+func normalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("tag %q must not contain a comma", tag)
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out, nil
+}
+
+// getTemplate loads a template by id
+func getTemplate(conn *sql.DB, id string) (*invoiceTemplate, error) {
+	return scanTemplate(conn.QueryRow(`SELECT `+templateColumns+` FROM templates WHERE id = ?`, id))
+}
+
+// templateFilter selects templates: those with all of Tags, a name
+// containing NameContains (ignoring case) and created after CreatedAfter
+type templateFilter struct {
+	Tags         []string
+	NameContains string
+	CreatedAfter time.Time
+}
+
+// where returns the SQL condition for f and its arguments
+func (f templateFilter) where() (string, []any) {
+	conds := []string{"1 = 1"}
+	var args []any
+	for _, tag := range f.Tags {
+		conds = append(conds, `instr(',' || tags || ',', ',' || ? || ',') > 0`)
+		args = append(args, tag)
+	}
+	if f.NameContains != "" {
+		conds = append(conds, `instr(lower(name), lower(?)) > 0`)
+		args = append(args, f.NameContains)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conds = append(conds, `created_at > ?`)
+		args = append(args, f.CreatedAfter.UTC())
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// countTemplates counts the templates f selects
+func countTemplates(conn *sql.DB, f templateFilter) (int, error) {
+	where, args := f.where()
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM templates WHERE `+where, args...).Scan(&n)
+	return n, err
+}
+
+// listTemplates returns the templates f selects, newest first, without
+// their HTML. A limit of 0 returns all of them.
+func listTemplates(conn *sql.DB, f templateFilter, limit, offset int) ([]*invoiceTemplate, error) {
+	where, args := f.where()
+	query := `SELECT ` + templateColumns + ` FROM templates WHERE ` + where + ` ORDER BY created_at DESC, name`
+	if limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, offset)
+	}
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []*invoiceTemplate{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		t.HTMLContent = ""
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// insertTemplate stores t under a new id and fills in the timestamps
+func insertTemplate(conn *sql.DB, t *invoiceTemplate) error {
+	t.ID = uuid.NewString()
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+	_, err := conn.Exec(`INSERT INTO templates (`+templateColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, t.HTMLContent, t.Description, strings.Join(t.Tags, ","), t.CreatedAt, t.UpdatedAt)
+	return err
+}
+
+// updateTemplate saves the editable fields of t
+func updateTemplate(conn *sql.DB, t *invoiceTemplate) error {
+	t.UpdatedAt = time.Now().UTC()
+	result, err := conn.Exec(`UPDATE templates SET name = ?, html_content = ?, description = ?, tags = ?, updated_at = ? WHERE id = ?`,
+		t.Name, t.HTMLContent, t.Description, strings.Join(t.Tags, ","), t.UpdatedAt, t.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+func deleteTemplate(conn *sql.DB, id string) error {
+	result, err := conn.Exec(`DELETE FROM templates WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+// templateInput is the body of POST and PUT /templates; PUT only changes
+// the fields that are present
+type templateInput struct {
+	Name        *string `json:"name"`
+	HTMLContent *string `json:"html_content"`
+	Description *string `json:"description"`
+	// Tags replace the template's tags when present
+	Tags *[]string `json:"tags"`
+}
+
+// apply copies the present fields onto t and checks the result
+func (in templateInput) apply(t *invoiceTemplate) error {
+	if in.Name != nil {
+		t.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.HTMLContent != nil {
+		t.HTMLContent = *in.HTMLContent
+	}
+	if in.Description != nil {
+		t.Description = *in.Description
+	}
+	if in.Tags != nil {
+		tags, err := normalizeTags(*in.Tags)
+		if err != nil {
+			return err
+		}
+		t.Tags = tags
+	}
+	if t.Tags == nil {
+		t.Tags = []string{}
+	}
+
+	switch {
+	case t.Name == "":
+		return errors.New("name is required")
+	case strings.TrimSpace(t.HTMLContent) == "":
+		return errors.New("html_content is required")
+	case len(t.HTMLContent) > maxTemplateBytes:
+		return errors.New("html_content is too large")
+	}
+	return nil
+}
+
+// sendTemplateError maps store errors to a response
+func sendTemplateError(res *fiber.Ctx, err error) error {
+	if errors.Is(err, errTemplateNotFound) {
+		return sendError(res, 404, "Template not found")
+	}
+	return sendError(res, 500, err.Error())
+}
+
+// handleListTemplates lists the stored templates; ?tags=a,b keeps those
+// with all of the tags
+func handleListTemplates(res *fiber.Ctx) error {
+	var filter templateFilter
+	if q := res.Query("tags"); q != "" {
+		tags, err := normalizeTags(strings.Split(q, ","))
+		if err != nil {
+			return sendError(res, 400, err.Error())
+		}
+		filter.Tags = tags
+	}
+
+	templates, err := listTemplates(db, filter, 0, 0)
+	if err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	return res.JSON(templates)
+}
+
+// Page sizes of POST /templates/search
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// handleSearchTemplates returns a page of the templates matching the
+// body's tags (all of them), name_contains and created_after, which is
+// RFC 3339 or a date
+func handleSearchTemplates(res *fiber.Ctx) error {
+	var body struct {
+		Tags         []string `json:"tags"`
+		NameContains string   `json:"name_contains"`
+		CreatedAfter string   `json:"created_after"`
+		Limit        int      `json:"limit"`
+		Offset       int      `json:"offset"`
+	}
+	if err := res.BodyParser(&body); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	var filter templateFilter
+	var err error
+	if filter.Tags, err = normalizeTags(body.Tags); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	filter.NameContains = strings.TrimSpace(body.NameContains)
+	if body.CreatedAfter != "" {
+		if filter.CreatedAfter, err = time.Parse(time.RFC3339, body.CreatedAfter); err != nil {
+			if filter.CreatedAfter, err = time.Parse(time.DateOnly, body.CreatedAfter); err != nil {
+				return sendError(res, 400, "created_after must be an RFC 3339 time or a YYYY-MM-DD date")
+			}
+		}
+	}
+
+	if body.Limit == 0 {
+		body.Limit = defaultSearchLimit
+	}
+	if body.Limit < 1 || body.Limit > maxSearchLimit || body.Offset < 0 {
+		return sendError(res, 400, fmt.Sprintf("limit must be between 1 and %d and offset not negative", maxSearchLimit))
+	}
+
+	total, err := countTemplates(db, filter)
+	if err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	templates, err := listTemplates(db, filter, body.Limit, body.Offset)
+	if err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	return res.JSON(fiber.Map{
+		"templates": templates,
+		"total":     total,
+		"limit":     body.Limit,
+		"offset":    body.Offset,
+	})
+}
+
+func handleGetTemplate(res *fiber.Ctx) error {
+	t, err := getTemplate(db, res.Params("id"))
+	if err != nil {
+		return sendTemplateError(res, err)
+	}
+	return res.JSON(t)
+}
+
+func handleCreateTemplate(res *fiber.Ctx) error {
+	var in templateInput
+	if err := res.BodyParser(&in); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	t := &invoiceTemplate{}
+	if err := in.apply(t); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	if err := insertTemplate(db, t); err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	return res.Status(fiber.StatusCreated).JSON(t)
+}
+
+func handleUpdateTemplate(res *fiber.Ctx) error {
+	var in templateInput
+	if err := res.BodyParser(&in); err != nil {
+		return sendError(res, 400, "Invalid JSON body")
+	}
+
+	t, err := getTemplate(db, res.Params("id"))
+	if err != nil {
+		return sendTemplateError(res, err)
+	}
+	if err := in.apply(t); err != nil {
+		return sendError(res, 400, err.Error())
+	}
+	if err := updateTemplate(db, t); err != nil {
+		return sendTemplateError(res, err)
+	}
+	return res.JSON(t)
+}
+
+// handleDuplicateTemplate stores a copy of a template under a new id, named
+// after the original with " (Copy)" appended
+func handleDuplicateTemplate(res *fiber.Ctx) error {
+	t, err := getTemplate(db, res.Params("id"))
+	if err != nil {
+		return sendTemplateError(res, err)
+	}
+
+	t.Name += " (Copy)"
+	if err := insertTemplate(db, t); err != nil {
+		return sendError(res, 500, err.Error())
+	}
+	return res.Status(fiber.StatusCreated).JSON(t)
+}
+
+func handleDeleteTemplate(res *fiber.Ctx) error {
+	if err := deleteTemplate(db, res.Params("id")); err != nil {
+		return sendTemplateError(res, err)
+	}
+	return res.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// keyUsage counts what an API key has consumed since the last reset
+type keyUsage struct {
+	Renders  atomic.Int64
+	AICalls  atomic.Int64
+	PDFBytes atomic.Int64
+}
+
+// tokenBucket allows rate requests per minute with bursts up to the same size
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// take consumes a token, or reports how long until one is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	perSecond := b.capacity / 60
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / perSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// usageTracker rate limits and accounts usage per API key. It is independent
+// of the LLM pool's own per-provider limits.
+type usageTracker struct {
+	defaultLimit int
+	limits       map[string]int
+
+	mu      sync.Mutex
+	usage   map[string]*keyUsage
+	buckets map[string]*tokenBucket
+}
+
+var usage *usageTracker
+
+// newUsageTracker limits each key to defaultLimit requests/minute (0 for
+// unlimited) unless limits has an override for it
+func newUsageTracker(defaultLimit int, limits map[string]int) *usageTracker {
+	return &usageTracker{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		usage:        make(map[string]*keyUsage),
+		buckets:      make(map[string]*tokenBucket),
+	}
+}
+
+// limitFor returns the per-minute limit for a key
+func (t *usageTracker) limitFor(name string) int {
+	if limit, ok := t.limits[name]; ok {
+		return limit
+	}
+	return t.defaultLimit
+}
+
+// allow consumes one request from the key's bucket
+func (t *usageTracker) allow(name string) (bool, time.Duration) {
+	limit := t.limitFor(name)
+	if limit <= 0 {
+		return true, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.buckets[name]
+	if !ok {
+		b = &tokenBucket{capacity: float64(limit), tokens: float64(limit), last: time.Now()}
+		t.buckets[name] = b
+	}
+	return b.take(time.Now())
+}
+
+// get returns the counters for a key, creating them on first use
+func (t *usageTracker) get(name string) *keyUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.usage[name]
+	if !ok {
+		u = &keyUsage{}
+		t.usage[name] = u
+	}
+	return u
+}
+
+// snapshot returns the counters and limits of every key seen so far
+func (t *usageTracker) snapshot() fiber.Map {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := fiber.Map{}
+	for name, u := range t.usage {
+		out[name] = fiber.Map{
+			"renders":          u.Renders.Load(),
+			"ai_calls":         u.AICalls.Load(),
+			"pdf_bytes":        u.PDFBytes.Load(),
+			"limit_per_minute": t.limitFor(name),
+		}
+	}
+	return out
+}
+
+// reset zeroes the counters of one key, or of every key when name is empty
+func (t *usageTracker) reset(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, u := range t.usage {
+		if name == "" || key == name {
+			u.Renders.Store(0)
+			u.AICalls.Store(0)
+			u.PDFBytes.Store(0)
+		}
+	}
+}
+
+// load restores counters persisted by save
+func (t *usageTracker) load(conn *sql.DB) error {
+	rows, err := conn.Query(`SELECT key_name, renders, ai_calls, pdf_bytes FROM api_usage`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var renders, aiCalls, pdfBytes int64
+		if err := rows.Scan(&name, &renders, &aiCalls, &pdfBytes); err != nil {
+			return err
+		}
+		u := t.get(name)
+		u.Renders.Store(renders)
+		u.AICalls.Store(aiCalls)
+		u.PDFBytes.Store(pdfBytes)
+	}
+	return rows.Err()
+}
+
+// save writes every key's counters to the database
+func (t *usageTracker) save(conn *sql.DB) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	for name, u := range t.usage {
+		_, err := tx.Exec(`INSERT INTO api_usage (key_name, renders, ai_calls, pdf_bytes, updated_at)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(key_name) DO UPDATE SET
+				renders = excluded.renders, ai_calls = excluded.ai_calls,
+				pdf_bytes = excluded.pdf_bytes, updated_at = excluded.updated_at`,
+			name, u.Renders.Load(), u.AICalls.Load(), u.PDFBytes.Load())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// persistLoop saves the counters periodically so they survive restarts
+func (t *usageTracker) persistLoop(conn *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := t.save(conn); err != nil {
+			slog.Error("persisting usage failed", "error", err)
+		}
+	}
+}
+
+// keyName returns the name of the API key that authenticated the request
+func keyName(res *fiber.Ctx) string {
+	if name, ok := res.Locals("api_key_name").(string); ok {
+		return name
+	}
+	return "anonymous"
+}
+
+// rateLimitKey enforces the per-key request rate on authenticated routes
+func rateLimitKey(res *fiber.Ctx) error {
+	if !authEnabled || authExempt[res.Path()] {
+		return res.Next()
+	}
+
+	ok, retryAfter := usage.allow(keyName(res))
+	if !ok {
+		res.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return sendError(res, 429, "Rate limit exceeded for API key")
+	}
+	return res.Next()
+}
+
+// recordRender counts a finished render and its size for the request's key
+func recordRender(res *fiber.Ctx, pdfBytes int) {
+	recordRenderBytes(keyName(res), pdfBytes)
+}
+
+// recordRenderBytes is recordRender for a key looked up beforehand, for
+// streams that finish after the handler returns
+func recordRenderBytes(key string, pdfBytes int) {
+	u := usage.get(key)
+	u.Renders.Add(1)
+	u.PDFBytes.Add(int64(pdfBytes))
+	promPDFBytes.add(float64(pdfBytes))
+}